@@ -0,0 +1,479 @@
+package servicebus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+type (
+	// NamespaceSpec declares the Queues and Topics, along with their Subscriptions and Rules, which should exist in a
+	// Service Bus Namespace. It is reconciled with the Namespace by Namespace.Apply.
+	NamespaceSpec struct {
+		Queues []QueueSpec
+		Topics []TopicSpec
+	}
+
+	// QueueSpec declares a Queue and the options it should be configured with
+	QueueSpec struct {
+		Name    string
+		Options []QueueManagementOption
+	}
+
+	// TopicSpec declares a Topic, the options it should be configured with and its Subscriptions
+	TopicSpec struct {
+		Name          string
+		Options       []TopicManagementOption
+		Subscriptions []SubscriptionSpec
+	}
+
+	// SubscriptionSpec declares a Subscription, the options it should be configured with and its Rules. If Rules is
+	// empty, the Rules of the Subscription are left untouched. Otherwise, they are reconciled to be exactly the Rules
+	// declared, which removes the $Default rule unless it is declared.
+	SubscriptionSpec struct {
+		Name    string
+		Options []SubscriptionManagementOption
+		Rules   []RuleSpec
+	}
+
+	// RuleSpec declares a Subscription Rule
+	RuleSpec struct {
+		Name   string
+		Filter FilterDescription
+		Action *ActionDescription
+	}
+
+	// ApplyResult reports the changes made to a Namespace by Namespace.Apply
+	ApplyResult struct {
+		Changes []EntityChange
+	}
+
+	// EntityChange describes what Namespace.Apply did to reconcile a single entity
+	EntityChange struct {
+		Kind   EntityKind
+		Path   string
+		Action ApplyAction
+		// Diffs lists the differences found between the entity and its spec, formatted as "Field: current -> desired"
+		Diffs []string
+	}
+
+	// EntityKind is the kind of a Service Bus entity reconciled by Namespace.Apply
+	EntityKind string
+
+	// ApplyAction is what Namespace.Apply did to an entity
+	ApplyAction string
+)
+
+const (
+	// QueueKind is a Service Bus Queue
+	QueueKind EntityKind = "Queue"
+	// TopicKind is a Service Bus Topic
+	TopicKind EntityKind = "Topic"
+	// SubscriptionKind is a Service Bus Topic Subscription
+	SubscriptionKind EntityKind = "Subscription"
+	// RuleKind is a Service Bus Subscription Rule
+	RuleKind EntityKind = "Rule"
+
+	// EntityCreated means the entity did not exist and was created
+	EntityCreated ApplyAction = "Created"
+	// EntityUpdated means the entity existed but differed from its spec and was updated
+	EntityUpdated ApplyAction = "Updated"
+	// EntityUnchanged means the entity already matched its spec
+	EntityUnchanged ApplyAction = "Unchanged"
+	// EntityDeleted means the entity was not part of the spec and was deleted
+	EntityDeleted ApplyAction = "Deleted"
+)
+
+var (
+	// readOnlyDescriptionFields are reported by Service Bus, but can't be set
+	readOnlyDescriptionFields = map[string]bool{
+		"SizeInBytes":              true,
+		"MessageCount":             true,
+		"CreatedAt":                true,
+		"UpdatedAt":                true,
+		"AccessedAt":               true,
+		"CountDetails":             true,
+		"EntityAvailabilityStatus": true,
+	}
+
+	// immutableDescriptionFields can only be set when an entity is created
+	immutableDescriptionFields = map[string]bool{
+		"RequiresSession":            true,
+		"RequiresDuplicateDetection": true,
+		"EnablePartitioning":         true,
+	}
+)
+
+// Changed returns true if Apply created, updated or deleted any entity
+func (ar *ApplyResult) Changed() bool {
+	for _, change := range ar.Changes {
+		if change.Action != EntityUnchanged {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply reconciles the Namespace with spec: entities which are missing are created and entities which differ from their
+// spec are updated. Only the properties set by the options of a spec are compared, so properties left to their defaults
+// are not reverted. Queues, Topics and Subscriptions which are not part of spec are never deleted. Apply is idempotent;
+// applying the same spec again reports every entity as EntityUnchanged.
+//
+// Properties which can only be set when an entity is created, such as RequiresSession, can't be reconciled and cause an
+// error. The result lists the changes made before an error was encountered.
+func (ns *Namespace) Apply(ctx context.Context, spec NamespaceSpec) (*ApplyResult, error) {
+	span, ctx := ns.startSpanFromContext(ctx, "sb.Namespace.Apply")
+	defer span.Finish()
+
+	result := new(ApplyResult)
+	qm := ns.NewQueueManager()
+	for _, qs := range spec.Queues {
+		if err := qm.apply(ctx, qs, result); err != nil {
+			return result, err
+		}
+	}
+
+	tm := ns.NewTopicManager()
+	for _, ts := range spec.Topics {
+		if err := tm.apply(ctx, ts, result); err != nil {
+			return result, err
+		}
+
+		sm, err := ns.NewSubscriptionManager(ts.Name)
+		if err != nil {
+			return result, err
+		}
+
+		for _, ss := range ts.Subscriptions {
+			if err := sm.apply(ctx, ss, result); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func (qm *QueueManager) apply(ctx context.Context, spec QueueSpec, result *ApplyResult) error {
+	if spec.Name == "" {
+		return errors.New("queue spec must have a name")
+	}
+
+	desired := new(QueueDescription)
+	for _, opt := range spec.Options {
+		if err := opt(desired); err != nil {
+			return err
+		}
+	}
+
+	existing, err := qm.Get(ctx, spec.Name)
+	if err != nil {
+		return err
+	}
+
+	if existing == nil {
+		if _, err := qm.put(ctx, spec.Name, desired); err != nil {
+			return err
+		}
+		result.Changes = append(result.Changes, EntityChange{Kind: QueueKind, Path: spec.Name, Action: EntityCreated})
+		return nil
+	}
+
+	diffs, err := diffEntityDescriptions(QueueKind, spec.Name, desired, existing.QueueDescription)
+	if err != nil || len(diffs) == 0 {
+		result.Changes = appendUnchanged(result.Changes, QueueKind, spec.Name, err)
+		return err
+	}
+
+	updated := *existing.QueueDescription
+	mergeEntityDescriptions(&updated, desired)
+	if _, err := qm.put(ctx, spec.Name, &updated, withIfMatch("*")); err != nil {
+		return err
+	}
+	result.Changes = append(result.Changes, EntityChange{Kind: QueueKind, Path: spec.Name, Action: EntityUpdated, Diffs: diffs})
+	return nil
+}
+
+func (tm *TopicManager) apply(ctx context.Context, spec TopicSpec, result *ApplyResult) error {
+	if spec.Name == "" {
+		return errors.New("topic spec must have a name")
+	}
+
+	desired := new(TopicDescription)
+	for _, opt := range spec.Options {
+		if err := opt(desired); err != nil {
+			return err
+		}
+	}
+
+	existing, err := tm.Get(ctx, spec.Name)
+	if err != nil {
+		return err
+	}
+
+	if existing == nil {
+		if _, err := tm.put(ctx, spec.Name, desired); err != nil {
+			return err
+		}
+		result.Changes = append(result.Changes, EntityChange{Kind: TopicKind, Path: spec.Name, Action: EntityCreated})
+		return nil
+	}
+
+	diffs, err := diffEntityDescriptions(TopicKind, spec.Name, desired, existing.TopicDescription)
+	if err != nil || len(diffs) == 0 {
+		result.Changes = appendUnchanged(result.Changes, TopicKind, spec.Name, err)
+		return err
+	}
+
+	updated := *existing.TopicDescription
+	mergeEntityDescriptions(&updated, desired)
+	if _, err := tm.put(ctx, spec.Name, &updated, withIfMatch("*")); err != nil {
+		return err
+	}
+	result.Changes = append(result.Changes, EntityChange{Kind: TopicKind, Path: spec.Name, Action: EntityUpdated, Diffs: diffs})
+	return nil
+}
+
+func (sm *SubscriptionManager) apply(ctx context.Context, spec SubscriptionSpec, result *ApplyResult) error {
+	if spec.Name == "" {
+		return fmt.Errorf("subscription spec of topic %q must have a name", sm.Topic.Name)
+	}
+
+	path := sm.Topic.Name + "/Subscriptions/" + spec.Name
+	desired := new(SubscriptionDescription)
+	for _, opt := range spec.Options {
+		if err := opt(desired); err != nil {
+			return err
+		}
+	}
+
+	existing, err := sm.Get(ctx, spec.Name)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case existing == nil:
+		if _, err := sm.put(ctx, spec.Name, desired); err != nil {
+			return err
+		}
+		result.Changes = append(result.Changes, EntityChange{Kind: SubscriptionKind, Path: path, Action: EntityCreated})
+	default:
+		diffs, err := diffEntityDescriptions(SubscriptionKind, path, desired, existing.SubscriptionDescription)
+		if err != nil || len(diffs) == 0 {
+			result.Changes = appendUnchanged(result.Changes, SubscriptionKind, path, err)
+			if err != nil {
+				return err
+			}
+			break
+		}
+
+		updated := *existing.SubscriptionDescription
+		mergeEntityDescriptions(&updated, desired)
+		if _, err := sm.put(ctx, spec.Name, &updated, withIfMatch("*")); err != nil {
+			return err
+		}
+		result.Changes = append(result.Changes, EntityChange{Kind: SubscriptionKind, Path: path, Action: EntityUpdated, Diffs: diffs})
+	}
+
+	if len(spec.Rules) == 0 {
+		return nil
+	}
+	return sm.applyRules(ctx, spec.Name, path, spec.Rules, result)
+}
+
+// applyRules reconciles the Rules of a Subscription. Rules can't be updated, so a Rule which differs from its spec is
+// deleted and created again.
+func (sm *SubscriptionManager) applyRules(ctx context.Context, subscriptionName, subscriptionPath string, specs []RuleSpec, result *ApplyResult) error {
+	rules, err := sm.ListRules(ctx, subscriptionName)
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]*RuleEntity, len(rules))
+	for _, rule := range rules {
+		existing[rule.Name] = rule
+	}
+
+	declared := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		if spec.Name == "" {
+			return fmt.Errorf("rule spec of subscription %q must have a name", subscriptionPath)
+		}
+		declared[spec.Name] = true
+
+		path := subscriptionPath + "/Rules/" + spec.Name
+		desired := &RuleDescription{
+			Filter: spec.Filter,
+			Action: spec.Action,
+		}
+
+		current, ok := existing[spec.Name]
+		if !ok {
+			if _, err := sm.putRule(ctx, subscriptionName, spec.Name, desired); err != nil {
+				return err
+			}
+			result.Changes = append(result.Changes, EntityChange{Kind: RuleKind, Path: path, Action: EntityCreated})
+			continue
+		}
+
+		diffs := diffDescriptionFields("", reflect.ValueOf(desired).Elem(), reflect.ValueOf(current.RuleDescription).Elem())
+		if len(diffs) == 0 {
+			result.Changes = append(result.Changes, EntityChange{Kind: RuleKind, Path: path, Action: EntityUnchanged})
+			continue
+		}
+
+		if err := sm.DeleteRule(ctx, subscriptionName, spec.Name); err != nil {
+			return err
+		}
+		if _, err := sm.putRule(ctx, subscriptionName, spec.Name, desired); err != nil {
+			return err
+		}
+		result.Changes = append(result.Changes, EntityChange{Kind: RuleKind, Path: path, Action: EntityUpdated, Diffs: diffs})
+	}
+
+	for _, rule := range rules {
+		if declared[rule.Name] {
+			continue
+		}
+
+		if err := sm.DeleteRule(ctx, subscriptionName, rule.Name); err != nil {
+			return err
+		}
+		result.Changes = append(result.Changes, EntityChange{Kind: RuleKind, Path: subscriptionPath + "/Rules/" + rule.Name, Action: EntityDeleted})
+	}
+	return nil
+}
+
+func appendUnchanged(changes []EntityChange, kind EntityKind, path string, err error) []EntityChange {
+	if err != nil {
+		return changes
+	}
+	return append(changes, EntityChange{Kind: kind, Path: path, Action: EntityUnchanged})
+}
+
+// diffEntityDescriptions compares the properties set in desired with those of existing, which must be pointers to the
+// same description type. An error is returned if a property which can't be updated differs.
+func diffEntityDescriptions(kind EntityKind, path string, desired, existing interface{}) ([]string, error) {
+	diffs := diffDescriptionFields("", reflect.ValueOf(desired).Elem(), reflect.ValueOf(existing).Elem())
+
+	var immutable []string
+	for _, diff := range diffs {
+		name := strings.SplitN(diff, ":", 2)[0]
+		if immutableDescriptionFields[name] {
+			immutable = append(immutable, name)
+		}
+	}
+
+	if len(immutable) > 0 {
+		entityKind := strings.ToLower(string(kind))
+		return diffs, fmt.Errorf("%s %q: %s can only be set when the %s is created", entityKind, path, strings.Join(immutable, ", "), entityKind)
+	}
+	return diffs, nil
+}
+
+// diffDescriptionFields compares each field set in desired with the same field of existing, recursing into nested
+// structs, and returns the differences formatted as "Field: current -> desired". Unset fields of desired, read-only
+// fields and XML bookkeeping fields are ignored.
+func diffDescriptionFields(prefix string, desired, existing reflect.Value) []string {
+	var diffs []string
+	for i := 0; i < desired.NumField(); i++ {
+		field := desired.Type().Field(i)
+		if field.Name == "XMLName" || field.Anonymous || readOnlyDescriptionFields[field.Name] {
+			continue
+		}
+
+		name := prefix + field.Name
+		dv, ev := desired.Field(i), existing.Field(i)
+		if isUnsetDescriptionField(dv) {
+			continue
+		}
+
+		if dv.Kind() == reflect.Ptr {
+			if ev.IsNil() {
+				diffs = append(diffs, fmt.Sprintf("%s: <unset> -> %v", name, dv.Elem().Interface()))
+				continue
+			}
+			dv, ev = dv.Elem(), ev.Elem()
+		}
+
+		if dv.Kind() == reflect.Struct {
+			diffs = append(diffs, diffDescriptionFields(name+".", dv, ev)...)
+			continue
+		}
+
+		if !equalDescriptionValues(dv, ev) {
+			diffs = append(diffs, fmt.Sprintf("%s: %v -> %v", name, ev.Interface(), dv.Interface()))
+		}
+	}
+	return diffs
+}
+
+// mergeEntityDescriptions copies each field set in desired to existing, which must be pointers to the same description
+// type, and clears the read-only fields of existing so it can be sent as an update
+func mergeEntityDescriptions(existing, desired interface{}) {
+	ev, dv := reflect.ValueOf(existing).Elem(), reflect.ValueOf(desired).Elem()
+	for i := 0; i < dv.NumField(); i++ {
+		field := dv.Type().Field(i)
+		if field.Name == "XMLName" || field.Anonymous {
+			continue
+		}
+
+		if readOnlyDescriptionFields[field.Name] {
+			ev.Field(i).Set(reflect.Zero(field.Type))
+			continue
+		}
+
+		if !isUnsetDescriptionField(dv.Field(i)) {
+			ev.Field(i).Set(dv.Field(i))
+		}
+	}
+}
+
+func isUnsetDescriptionField(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	default:
+		return false
+	}
+}
+
+// equalDescriptionValues compares two values of a description field. Strings which are both ISO 8601 durations are
+// compared by length, as Service Bus normalizes durations, reporting PT600S as PT10M for example.
+func equalDescriptionValues(desired, existing reflect.Value) bool {
+	if desired.Kind() == reflect.String {
+		if d, ok := iso8601DurationSeconds(desired.String()); ok {
+			if e, ok := iso8601DurationSeconds(existing.String()); ok {
+				return d == e
+			}
+		}
+	}
+	return reflect.DeepEqual(desired.Interface(), existing.Interface())
+}
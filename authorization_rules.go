@@ -0,0 +1,301 @@
+package servicebus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/Azure/azure-amqp-common-go/log"
+	"github.com/Azure/go-autorest/autorest/date"
+)
+
+type (
+	// AuthorizationRule is a shared access authorization rule of a queue or topic. Its keys sign the shared access
+	// signatures which grant their holders the Rights of the rule on the entity, so a key with only the Send or the
+	// Listen right can be handed to an application instead of a key of the namespace.
+	AuthorizationRule struct {
+		// Type, ClaimType and ClaimValue identify the rule as a shared access rule, and are set by PutAuthorizationRule
+		Type         string        `xml:"http://www.w3.org/2001/XMLSchema-instance type,attr,omitempty"`
+		ClaimType    string        `xml:"ClaimType,omitempty"`
+		ClaimValue   string        `xml:"ClaimValue,omitempty"`
+		Rights       []AccessRight `xml:"Rights>AccessRights"`
+		CreatedTime  *date.Time    `xml:"CreatedTime,omitempty"`
+		KeyName      string        `xml:"KeyName"`
+		ModifiedTime *date.Time    `xml:"ModifiedTime,omitempty"`
+		PrimaryKey   string        `xml:"PrimaryKey,omitempty"`
+		SecondaryKey string        `xml:"SecondaryKey,omitempty"`
+	}
+
+	// AccessRight is a right an AuthorizationRule grants on an entity
+	AccessRight string
+)
+
+const (
+	// SendRight grants sending messages to the entity
+	SendRight AccessRight = "Send"
+	// ListenRight grants receiving messages from the entity
+	ListenRight AccessRight = "Listen"
+	// ManageRight grants managing the entity, and must be granted with SendRight and ListenRight
+	ManageRight AccessRight = "Manage"
+
+	sharedAccessAuthorizationRuleType = "SharedAccessAuthorizationRule"
+	sharedAccessKeyClaimType          = "SharedAccessKey"
+
+	// authorizationRuleKeyBytes is the number of random bytes of a generated key, which Service Bus expects to be 256
+	// bits
+	authorizationRuleKeyBytes = 32
+)
+
+// PutAuthorizationRule creates or replaces the authorization rule of the queue with the KeyName of rule, and returns the
+// rule as Service Bus stored it. Keys which rule leaves empty are generated, so the returned rule holds the keys to hand
+// to the applications it authorizes. An error is returned if the queue does not exist.
+func (qm *QueueManager) PutAuthorizationRule(ctx context.Context, queueName string, rule AuthorizationRule) (*AuthorizationRule, error) {
+	span, ctx := qm.startSpanFromContext(ctx, "sb.QueueManager.PutAuthorizationRule")
+	defer span.Finish()
+
+	rule, err := newAuthorizationRule(rule)
+	if err != nil {
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+
+	qe, err := qm.Get(ctx, queueName)
+	if err != nil {
+		return nil, err
+	}
+	if qe == nil {
+		return nil, fmt.Errorf("queue %q does not exist", queueName)
+	}
+
+	updated := *qe.QueueDescription
+	mergeEntityDescriptions(&updated, new(QueueDescription))
+	updated.AuthorizationRules = setAuthorizationRule(updated.AuthorizationRules, rule)
+	qe, err = qm.put(ctx, queueName, &updated, withIfMatch("*"))
+	if err != nil {
+		return nil, err
+	}
+	return findAuthorizationRule(qe.AuthorizationRules, rule.KeyName)
+}
+
+// ListAuthorizationRules fetches the authorization rules of the queue, including their keys. An error is returned if the
+// queue does not exist.
+func (qm *QueueManager) ListAuthorizationRules(ctx context.Context, queueName string) ([]AuthorizationRule, error) {
+	span, ctx := qm.startSpanFromContext(ctx, "sb.QueueManager.ListAuthorizationRules")
+	defer span.Finish()
+
+	qe, err := qm.Get(ctx, queueName)
+	if err != nil {
+		return nil, err
+	}
+	if qe == nil {
+		return nil, fmt.Errorf("queue %q does not exist", queueName)
+	}
+	return qe.AuthorizationRules, nil
+}
+
+// DeleteAuthorizationRule deletes the authorization rule of the queue named keyName, which invalidates the shared access
+// signatures signed with its keys. Deleting a rule which does not exist does nothing. An error is returned if the queue
+// does not exist.
+func (qm *QueueManager) DeleteAuthorizationRule(ctx context.Context, queueName, keyName string) error {
+	span, ctx := qm.startSpanFromContext(ctx, "sb.QueueManager.DeleteAuthorizationRule")
+	defer span.Finish()
+
+	qe, err := qm.Get(ctx, queueName)
+	if err != nil {
+		return err
+	}
+	if qe == nil {
+		return fmt.Errorf("queue %q does not exist", queueName)
+	}
+
+	rules, ok := removeAuthorizationRule(qe.AuthorizationRules, keyName)
+	if !ok {
+		return nil
+	}
+
+	updated := *qe.QueueDescription
+	mergeEntityDescriptions(&updated, new(QueueDescription))
+	updated.AuthorizationRules = rules
+	_, err = qm.put(ctx, queueName, &updated, withIfMatch("*"))
+	return err
+}
+
+// PutAuthorizationRule creates or replaces the authorization rule of the topic with the KeyName of rule, and returns the
+// rule as Service Bus stored it. Keys which rule leaves empty are generated, so the returned rule holds the keys to hand
+// to the applications it authorizes. An error is returned if the topic does not exist.
+func (tm *TopicManager) PutAuthorizationRule(ctx context.Context, topicName string, rule AuthorizationRule) (*AuthorizationRule, error) {
+	span, ctx := tm.startSpanFromContext(ctx, "sb.TopicManager.PutAuthorizationRule")
+	defer span.Finish()
+
+	rule, err := newAuthorizationRule(rule)
+	if err != nil {
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+
+	te, err := tm.Get(ctx, topicName)
+	if err != nil {
+		return nil, err
+	}
+	if te == nil {
+		return nil, fmt.Errorf("topic %q does not exist", topicName)
+	}
+
+	updated := *te.TopicDescription
+	mergeEntityDescriptions(&updated, new(TopicDescription))
+	updated.AuthorizationRules = setAuthorizationRule(updated.AuthorizationRules, rule)
+	te, err = tm.put(ctx, topicName, &updated, withIfMatch("*"))
+	if err != nil {
+		return nil, err
+	}
+	return findAuthorizationRule(te.AuthorizationRules, rule.KeyName)
+}
+
+// ListAuthorizationRules fetches the authorization rules of the topic, including their keys. An error is returned if the
+// topic does not exist.
+func (tm *TopicManager) ListAuthorizationRules(ctx context.Context, topicName string) ([]AuthorizationRule, error) {
+	span, ctx := tm.startSpanFromContext(ctx, "sb.TopicManager.ListAuthorizationRules")
+	defer span.Finish()
+
+	te, err := tm.Get(ctx, topicName)
+	if err != nil {
+		return nil, err
+	}
+	if te == nil {
+		return nil, fmt.Errorf("topic %q does not exist", topicName)
+	}
+	return te.AuthorizationRules, nil
+}
+
+// DeleteAuthorizationRule deletes the authorization rule of the topic named keyName, which invalidates the shared access
+// signatures signed with its keys. Deleting a rule which does not exist does nothing. An error is returned if the topic
+// does not exist.
+func (tm *TopicManager) DeleteAuthorizationRule(ctx context.Context, topicName, keyName string) error {
+	span, ctx := tm.startSpanFromContext(ctx, "sb.TopicManager.DeleteAuthorizationRule")
+	defer span.Finish()
+
+	te, err := tm.Get(ctx, topicName)
+	if err != nil {
+		return err
+	}
+	if te == nil {
+		return fmt.Errorf("topic %q does not exist", topicName)
+	}
+
+	rules, ok := removeAuthorizationRule(te.AuthorizationRules, keyName)
+	if !ok {
+		return nil
+	}
+
+	updated := *te.TopicDescription
+	mergeEntityDescriptions(&updated, new(TopicDescription))
+	updated.AuthorizationRules = rules
+	_, err = tm.put(ctx, topicName, &updated, withIfMatch("*"))
+	return err
+}
+
+// newAuthorizationRule validates rule and returns it as a shared access rule, generating the keys it leaves empty
+func newAuthorizationRule(rule AuthorizationRule) (AuthorizationRule, error) {
+	if rule.KeyName == "" {
+		return rule, errors.New("authorization rule: KeyName must not be empty")
+	}
+	if len(rule.Rights) == 0 {
+		return rule, fmt.Errorf("authorization rule %q: at least one right must be granted", rule.KeyName)
+	}
+
+	granted := make(map[AccessRight]bool, len(rule.Rights))
+	for _, right := range rule.Rights {
+		switch right {
+		case SendRight, ListenRight, ManageRight:
+			granted[right] = true
+		default:
+			return rule, fmt.Errorf("authorization rule %q: unknown right %q", rule.KeyName, right)
+		}
+	}
+	if granted[ManageRight] && !(granted[SendRight] && granted[ListenRight]) {
+		return rule, fmt.Errorf("authorization rule %q: the Manage right must be granted with the Send and Listen rights", rule.KeyName)
+	}
+
+	for _, key := range []*string{&rule.PrimaryKey, &rule.SecondaryKey} {
+		if *key != "" {
+			continue
+		}
+		generated, err := newAuthorizationRuleKey()
+		if err != nil {
+			return rule, err
+		}
+		*key = generated
+	}
+
+	rule.Type = sharedAccessAuthorizationRuleType
+	rule.ClaimType = sharedAccessKeyClaimType
+	rule.ClaimValue = "None"
+	rule.CreatedTime = nil
+	rule.ModifiedTime = nil
+	return rule, nil
+}
+
+// newAuthorizationRuleKey returns a random key for an authorization rule
+func newAuthorizationRuleKey() (string, error) {
+	b := make([]byte, authorizationRuleKeyBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// setAuthorizationRule returns rules with the rule of the same KeyName replaced by rule, or with rule appended
+func setAuthorizationRule(rules []AuthorizationRule, rule AuthorizationRule) []AuthorizationRule {
+	updated := make([]AuthorizationRule, 0, len(rules)+1)
+	for _, existing := range rules {
+		if existing.KeyName != rule.KeyName {
+			updated = append(updated, existing)
+		}
+	}
+	return append(updated, rule)
+}
+
+// removeAuthorizationRule returns rules without the rule named keyName, and whether rules held it
+func removeAuthorizationRule(rules []AuthorizationRule, keyName string) ([]AuthorizationRule, bool) {
+	updated := make([]AuthorizationRule, 0, len(rules))
+	for _, existing := range rules {
+		if existing.KeyName != keyName {
+			updated = append(updated, existing)
+		}
+	}
+	return updated, len(updated) != len(rules)
+}
+
+// findAuthorizationRule returns the rule named keyName
+func findAuthorizationRule(rules []AuthorizationRule, keyName string) (*AuthorizationRule, error) {
+	for i := range rules {
+		if rules[i].KeyName == keyName {
+			return &rules[i], nil
+		}
+	}
+	return nil, fmt.Errorf("authorization rule %q was not returned by Service Bus", keyName)
+}
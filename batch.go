@@ -0,0 +1,230 @@
+package servicebus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/azure-amqp-common-go/log"
+	"pack.ag/amqp"
+)
+
+const (
+	// batchMessageFormat is the AMQP message format Service Bus uses for a batch of messages encoded as data sections
+	batchMessageFormat uint32 = 0x80013700
+	// maxBatchSize is the size limit of a transfer to Service Bus
+	maxBatchSize = 256 * 1024
+	// batchEnvelopeReserve is the part of a batch transfer reserved for the properties and framing of the batch
+	batchEnvelopeReserve = 2 * 1024
+	// batchSectionOverhead bounds the bytes added by encoding a message as a data section of a batch
+	batchSectionOverhead = 8
+)
+
+type (
+	// BatchSendError is returned by SendBatch when some of the messages were not sent. Failed holds the indexes of those
+	// messages in the slice passed to SendBatch, and Err is the first reason a message was not sent.
+	BatchSendError struct {
+		Failed []int
+		Err    error
+	}
+
+	// messageBatch is a set of messages sent to Service Bus in a single transfer
+	messageBatch struct {
+		first      *amqp.Message
+		data       [][]byte
+		indexes    []int
+		size       int
+		properties map[string]interface{}
+	}
+)
+
+// Error implements error
+func (e *BatchSendError) Error() string {
+	return fmt.Sprintf("failed to send %d messages of the batch: %v", len(e.Failed), e.Err)
+}
+
+// SendBatch sends the messages to the Queue in as few transfers as possible. Messages are packed into a transfer until
+// it would exceed the 256KB limit of Service Bus, and messages of different sessions are never sent in the same
+// transfer. If some messages are not sent, a *BatchSendError identifies them. Send middleware is not applied to batched
+// messages.
+func (q *Queue) SendBatch(ctx context.Context, messages []*Message) error {
+	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.SendBatch")
+	defer span.Finish()
+
+	if err := q.ensureSender(ctx); err != nil {
+		log.For(ctx).Error(err)
+		return err
+	}
+	return q.sender.SendBatch(ctx, messages)
+}
+
+// SendBatch sends the messages to the Topic in as few transfers as possible. See Queue.SendBatch.
+func (t *Topic) SendBatch(ctx context.Context, messages []*Message) error {
+	span, ctx := t.startSpanFromContext(ctx, "sb.Topic.SendBatch")
+	defer span.Finish()
+
+	if err := t.ensureSender(ctx); err != nil {
+		log.For(ctx).Error(err)
+		return err
+	}
+	return t.sender.SendBatch(ctx, messages)
+}
+
+// SendBatch sends messages to the entity path, packing them into as few transfers as the size limit and their sessions
+// allow. A transfer failing stops the send, and the messages not sent are reported by a *BatchSendError.
+func (s *sender) SendBatch(ctx context.Context, messages []*Message) error {
+	span, ctx := s.startProducerSpanFromContext(ctx, "sb.sender.SendBatch")
+	defer span.Finish()
+
+	var batchErr *BatchSendError
+	fail := func(err error, indexes ...int) {
+		if batchErr == nil {
+			batchErr = &BatchSendError{Err: err}
+		}
+		batchErr.Failed = append(batchErr.Failed, indexes...)
+	}
+
+	var batch *messageBatch
+	stopped := false
+	for i, msg := range messages {
+		if stopped {
+			// a transfer failed, so the remaining messages are not sent
+			fail(nil, i)
+			continue
+		}
+
+		encoded, amqpMsg, err := s.encodeForBatch(ctx, msg)
+		if err != nil {
+			fail(err, i)
+			continue
+		}
+
+		if batch != nil && !batch.accepts(amqpMsg, encoded) {
+			if err := s.trySend(ctx, batch); err != nil {
+				fail(err, batch.indexes...)
+				fail(nil, i)
+				stopped = true
+				continue
+			}
+			batch = nil
+		}
+
+		if batch == nil {
+			batch = newMessageBatch(amqpMsg)
+		}
+		if !batch.accepts(amqpMsg, encoded) {
+			fail(fmt.Errorf("message %d of %d bytes is too large to be sent", i, len(encoded)), i)
+			batch = nil
+			continue
+		}
+		batch.add(i, encoded)
+	}
+
+	if !stopped && batch != nil && len(batch.data) > 0 {
+		if err := s.trySend(ctx, batch); err != nil {
+			fail(err, batch.indexes...)
+		}
+	}
+
+	if batchErr != nil {
+		log.For(ctx).Error(batchErr)
+		return batchErr
+	}
+	return nil
+}
+
+// encodeForBatch prepares a message for sending and encodes it as a data section of a batch
+func (s *sender) encodeForBatch(ctx context.Context, msg *Message) ([]byte, *amqp.Message, error) {
+	if err := s.prepare(ctx, msg); err != nil {
+		return nil, nil, err
+	}
+
+	amqpMsg, err := msg.toMsg()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encoded, err := amqpMsg.MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	return encoded, amqpMsg, nil
+}
+
+func newMessageBatch(first *amqp.Message) *messageBatch {
+	return &messageBatch{
+		first: first,
+		size:  batchEnvelopeReserve,
+	}
+}
+
+// accepts returns true if the encoded message fits in the batch and belongs to the same session as the batch
+func (b *messageBatch) accepts(msg *amqp.Message, encoded []byte) bool {
+	if b.size+len(encoded)+batchSectionOverhead > maxBatchSize {
+		return false
+	}
+	return sessionOf(b.first) == sessionOf(msg)
+}
+
+func (b *messageBatch) add(index int, encoded []byte) {
+	b.data = append(b.data, encoded)
+	b.indexes = append(b.indexes, index)
+	b.size += len(encoded) + batchSectionOverhead
+}
+
+// Set implements opentracing.TextMapWriter, so the span of the transfer is propagated with the batch
+func (b *messageBatch) Set(key, value string) {
+	if b.properties == nil {
+		b.properties = make(map[string]interface{})
+	}
+	b.properties[key] = value
+}
+
+// toMsg builds the batch message, which carries the ID, session and partition key of its first message so Service Bus
+// can route the batch
+func (b *messageBatch) toMsg() (*amqp.Message, error) {
+	msg := &amqp.Message{
+		Format:                batchMessageFormat,
+		Data:                  b.data,
+		ApplicationProperties: b.properties,
+		Properties:            new(amqp.MessageProperties),
+	}
+
+	if b.first.Properties != nil {
+		msg.Properties.MessageID = b.first.Properties.MessageID
+		msg.Properties.GroupID = b.first.Properties.GroupID
+	}
+
+	if pk, ok := b.first.Annotations[partitionKeyName]; ok {
+		msg.Annotations = amqp.Annotations{partitionKeyName: pk}
+	}
+	return msg, nil
+}
+
+func sessionOf(msg *amqp.Message) string {
+	if msg.Properties == nil {
+		return ""
+	}
+	return msg.Properties.GroupID
+}
@@ -0,0 +1,145 @@
+package servicebus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-amqp-common-go/log"
+)
+
+const (
+	// clockSkewSamples is the number of recent observations of server time used to estimate the clock skew
+	clockSkewSamples = 16
+	// clockSkewMeasureTimeout bounds the time spent measuring the clock skew after the first receiver connects
+	clockSkewMeasureTimeout = 5 * time.Second
+)
+
+type (
+	// clockSkew estimates the offset of the Service Bus clock from the local clock. Each observation of a server
+	// timestamp yields the offset less the time it took the timestamp to arrive, so the largest of the recent
+	// observations is the closest estimate.
+	clockSkew struct {
+		mu       sync.RWMutex
+		samples  [clockSkewSamples]time.Duration
+		count    int
+		next     int
+		estimate time.Duration
+		measure  sync.Once
+	}
+)
+
+// observe records a timestamp reported by Service Bus at the local time it was received
+func (c *clockSkew) observe(serverTime, localTime time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.samples[c.next] = serverTime.Sub(localTime)
+	c.next = (c.next + 1) % clockSkewSamples
+	if c.count < clockSkewSamples {
+		c.count++
+	}
+
+	c.estimate = c.samples[0]
+	for _, sample := range c.samples[1:c.count] {
+		if sample > c.estimate {
+			c.estimate = sample
+		}
+	}
+}
+
+// offset returns how far the Service Bus clock is ahead of the local clock
+func (c *clockSkew) offset() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.estimate
+}
+
+// ClockSkew returns the estimated offset of the Service Bus clock from the local clock. A positive value means the
+// Service Bus clock is ahead of the local clock. The skew is estimated from the Date header of HTTP responses returned
+// by Service Bus, which is first measured when a receiver connects and then refined by each management request. Lock
+// expiration times reported by Service Bus are compensated by the skew, so lock renewal is not scheduled too late.
+func (ns *Namespace) ClockSkew() time.Duration {
+	return ns.clock.offset()
+}
+
+// toLocalTime converts a timestamp reported by Service Bus to the local clock
+func (ns *Namespace) toLocalTime(serverTime time.Time) time.Time {
+	return serverTime.Add(-ns.clock.offset())
+}
+
+// observeServerDate records the Date header of an HTTP response returned by Service Bus
+func (ns *Namespace) observeServerDate(res *http.Response) {
+	if res == nil {
+		return
+	}
+
+	date, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	// the Date header is truncated to the second, so the middle of the second is the closest estimate
+	ns.clock.observe(date.Add(500*time.Millisecond), time.Now())
+}
+
+// ensureClockSkewMeasured starts measuring the clock skew once for the namespace. The measurement runs in the
+// background, so connecting a receiver doesn't wait on it; until it completes, lock expirations are not compensated.
+func (ns *Namespace) ensureClockSkewMeasured() {
+	ns.clock.measure.Do(func() {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), clockSkewMeasureTimeout)
+			defer cancel()
+
+			if err := ns.measureClockSkew(ctx); err != nil {
+				log.For(ctx).Debug("unable to measure clock skew: " + err.Error())
+			}
+		}()
+	})
+}
+
+// measureClockSkew records the Date header of a response of Service Bus. The Date header is returned on every response,
+// including those to unauthenticated requests, so a HEAD of the namespace endpoint is sufficient. The request goes
+// through the HTTP transport of the namespace, so it takes the same proxy as management requests.
+func (ns *Namespace) measureClockSkew(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodHead, ns.getHTTPSHostURI(), http.NoBody)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: clockSkewMeasureTimeout}
+	if ns.httpTransport != nil {
+		client.Transport = ns.httpTransport
+	}
+
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+	ns.observeServerDate(res)
+	return nil
+}
@@ -0,0 +1,177 @@
+package servicebus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"sync"
+)
+
+type (
+	// Codec serializes the bodies of messages of a type to and from a format identified by a content type. Using the same
+	// Codec for producers and consumers of a message type standardizes its format without marshaling at every call site.
+	Codec interface {
+		// ContentType is the MIME type of the format, which is set as the ContentType of the messages it encodes
+		ContentType() string
+		// Marshal encodes v as a message body
+		Marshal(v interface{}) ([]byte, error)
+		// Unmarshal decodes a message body into v
+		Unmarshal(data []byte, v interface{}) error
+	}
+
+	// JSONCodec encodes message bodies as JSON
+	JSONCodec struct{}
+
+	// RawCodec passes message bodies through unchanged. It marshals []byte and string values, and unmarshals into
+	// *[]byte and *string values.
+	RawCodec struct{}
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		JSONCodec{}.ContentType(): JSONCodec{},
+		RawCodec{}.ContentType():  RawCodec{},
+	}
+)
+
+// RegisterCodec makes a Codec available to Message.Unmarshal for messages with its content type, replacing any Codec
+// previously registered for the content type. The JSON and raw codecs are registered by default.
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	codecs[codec.ContentType()] = codec
+}
+
+// codecFor returns the Codec registered for a content type
+func codecFor(contentType string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	codec, ok := codecs[contentType]
+	return codec, ok
+}
+
+// NewMessageWithCodec builds a Message with a body of v encoded by codec, and sets the ContentType of the Message to
+// the content type of the codec
+func NewMessageWithCodec(v interface{}, codec Codec) (*Message, error) {
+	if codec == nil {
+		return nil, errors.New("codec must not be nil")
+	}
+
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := NewMessage(data)
+	msg.ContentType = codec.ContentType()
+	return msg, nil
+}
+
+// NewMessageFromJSON builds a Message with a body of v encoded as JSON, and sets the ContentType of the Message to
+// "application/json"
+func NewMessageFromJSON(v interface{}) (*Message, error) {
+	return NewMessageWithCodec(v, JSONCodec{})
+}
+
+// DecodeJSON decodes the JSON body of the message into v. Messages with a ContentType other than JSON are refused, and
+// messages without a ContentType are assumed to be JSON.
+func (m *Message) DecodeJSON(v interface{}) error {
+	if m.ContentType != "" {
+		mediaType, _, err := mime.ParseMediaType(m.ContentType)
+		if err != nil {
+			return err
+		}
+		if mediaType != (JSONCodec{}).ContentType() {
+			return fmt.Errorf("the message has content type %q rather than JSON", m.ContentType)
+		}
+	}
+
+	return json.Unmarshal(m.Data, v)
+}
+
+// Unmarshal decodes the body of the message into v. The Codec registered for the ContentType of the message is used,
+// and codec is used if the message has no ContentType or no Codec is registered for it. If codec is nil, the message
+// must have the content type of a registered Codec.
+func (m *Message) Unmarshal(v interface{}, codec Codec) error {
+	if registered, ok := codecFor(m.ContentType); ok && m.ContentType != "" {
+		codec = registered
+	}
+
+	if codec == nil {
+		return fmt.Errorf("no codec is registered for the content type %q of the message", m.ContentType)
+	}
+
+	return codec.Unmarshal(m.Data, v)
+}
+
+// ContentType returns "application/json"
+func (JSONCodec) ContentType() string {
+	return "application/json"
+}
+
+// Marshal encodes v as JSON
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes JSON data into v
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// ContentType returns "application/octet-stream"
+func (RawCodec) ContentType() string {
+	return "application/octet-stream"
+}
+
+// Marshal returns v if it is a []byte, or its bytes if it is a string
+func (RawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch t := v.(type) {
+	case []byte:
+		return t, nil
+	case string:
+		return []byte(t), nil
+	default:
+		return nil, fmt.Errorf("the raw codec can not marshal a value of type %T", v)
+	}
+}
+
+// Unmarshal copies data into v if it is a *[]byte, or converts it to a string if it is a *string
+func (RawCodec) Unmarshal(data []byte, v interface{}) error {
+	switch t := v.(type) {
+	case *[]byte:
+		*t = append([]byte(nil), data...)
+		return nil
+	case *string:
+		*t = string(data)
+		return nil
+	default:
+		return fmt.Errorf("the raw codec can not unmarshal into a value of type %T", v)
+	}
+}
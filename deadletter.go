@@ -0,0 +1,238 @@
+package servicebus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Azure/azure-amqp-common-go/log"
+)
+
+type (
+	// DeadLetterSender sends messages directly to the dead letter queue of a Queue or Subscription. It is intended for
+	// tooling, such as replaying or migrating dead lettered messages. Service Bus may refuse messages sent directly to a
+	// dead letter queue, in which case ErrUnsupported is returned.
+	DeadLetterSender struct {
+		namespace  *Namespace
+		entityPath string
+		sender     *sender
+		senderMu   sync.Mutex
+	}
+
+	// DeadLetterReceiver receives messages from the dead letter queue of a Queue or Subscription. The reason a message
+	// was dead lettered is available from its DeadLetterReason and DeadLetterErrorDescription.
+	DeadLetterReceiver struct {
+		namespace  *Namespace
+		entityPath string
+		receiver   *receiver
+		receiverMu sync.Mutex
+	}
+)
+
+const (
+	deadLetterQueueName = "$DeadLetterQueue"
+
+	deadLetterReasonName           = "DeadLetterReason"
+	deadLetterErrorDescriptionName = "DeadLetterErrorDescription"
+)
+
+// NewDeadLetterSender creates a DeadLetterSender which sends to the dead letter queue of the Queue
+func (q *Queue) NewDeadLetterSender() *DeadLetterSender {
+	return newDeadLetterSender(q.namespace, q.Name)
+}
+
+// NewDeadLetterSender creates a DeadLetterSender which sends to the dead letter queue of the Subscription
+func (s *Subscription) NewDeadLetterSender() *DeadLetterSender {
+	return newDeadLetterSender(s.namespace, s.entityPath())
+}
+
+func newDeadLetterSender(ns *Namespace, entityPath string) *DeadLetterSender {
+	return &DeadLetterSender{
+		namespace:  ns,
+		entityPath: deadLetterPath(entityPath),
+	}
+}
+
+// Send sends a message to the dead letter queue. If Service Bus does not permit sending directly to the dead letter
+// queue, ErrUnsupported is returned.
+func (d *DeadLetterSender) Send(ctx context.Context, msg *Message) error {
+	span, ctx := d.namespace.startSpanFromContext(ctx, "sb.DeadLetterSender.Send")
+	defer span.Finish()
+
+	if err := d.ensureSender(ctx); err != nil {
+		return err
+	}
+
+	err := d.sender.Send(ctx, msg)
+	if isUnsupportedError(err) {
+		log.For(ctx).Error(err)
+		return ErrUnsupported
+	}
+	return err
+}
+
+// Close closes the connection to the dead letter queue
+func (d *DeadLetterSender) Close(ctx context.Context) error {
+	span, ctx := d.namespace.startSpanFromContext(ctx, "sb.DeadLetterSender.Close")
+	defer span.Finish()
+
+	d.senderMu.Lock()
+	defer d.senderMu.Unlock()
+
+	if d.sender == nil {
+		return nil
+	}
+
+	err := d.sender.Close(ctx)
+	d.sender = nil
+	return err
+}
+
+func (d *DeadLetterSender) ensureSender(ctx context.Context) error {
+	d.senderMu.Lock()
+	defer d.senderMu.Unlock()
+
+	if d.sender != nil {
+		return nil
+	}
+
+	s, err := d.namespace.newSender(ctx, d.entityPath)
+	if err != nil {
+		log.For(ctx).Error(err)
+		if isUnsupportedError(err) {
+			return ErrUnsupported
+		}
+		return err
+	}
+	d.sender = s
+	return nil
+}
+
+// NewDeadLetterReceiver creates a DeadLetterReceiver which receives from the dead letter queue of the Queue
+func (q *Queue) NewDeadLetterReceiver() *DeadLetterReceiver {
+	return newDeadLetterReceiver(q.namespace, q.Name)
+}
+
+// NewDeadLetterReceiver creates a DeadLetterReceiver which receives from the dead letter queue of the Subscription
+func (s *Subscription) NewDeadLetterReceiver() *DeadLetterReceiver {
+	return newDeadLetterReceiver(s.namespace, s.entityPath())
+}
+
+func newDeadLetterReceiver(ns *Namespace, entityPath string) *DeadLetterReceiver {
+	return &DeadLetterReceiver{
+		namespace:  ns,
+		entityPath: deadLetterPath(entityPath),
+	}
+}
+
+// ReceiveOne receives a single message from the dead letter queue. ReceiveOne will only wait as long as the context
+// allows.
+func (d *DeadLetterReceiver) ReceiveOne(ctx context.Context, handler Handler) error {
+	span, ctx := d.namespace.startSpanFromContext(ctx, "sb.DeadLetterReceiver.ReceiveOne")
+	defer span.Finish()
+
+	if err := d.ensureReceiver(ctx); err != nil {
+		return err
+	}
+	return d.receiver.ReceiveOne(ctx, handler)
+}
+
+// Receive receives messages from the dead letter queue until the context is canceled
+func (d *DeadLetterReceiver) Receive(ctx context.Context, handler Handler) error {
+	span, ctx := d.namespace.startSpanFromContext(ctx, "sb.DeadLetterReceiver.Receive")
+	defer span.Finish()
+
+	if err := d.ensureReceiver(ctx); err != nil {
+		return err
+	}
+
+	handle := d.receiver.Listen(ctx, handler)
+	<-handle.Done()
+	return handle.Err()
+}
+
+// NewReceiver opens a Receiver for the messages of the dead letter queue, such as to move them back to their entity
+// with ForwardMessages. The Receiver has its own connection, independent of Receive and ReceiveOne.
+func (d *DeadLetterReceiver) NewReceiver(ctx context.Context, opts ...ReceiveOption) (*Receiver, error) {
+	span, ctx := d.namespace.startSpanFromContext(ctx, "sb.DeadLetterReceiver.NewReceiver")
+	defer span.Finish()
+
+	r, err := d.namespace.newReceiver(ctx, d.entityPath, receiverOptions(opts)...)
+	if err != nil {
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+	return &Receiver{r: r}, nil
+}
+
+// Close closes the connection to the dead letter queue
+func (d *DeadLetterReceiver) Close(ctx context.Context) error {
+	span, ctx := d.namespace.startSpanFromContext(ctx, "sb.DeadLetterReceiver.Close")
+	defer span.Finish()
+
+	d.receiverMu.Lock()
+	defer d.receiverMu.Unlock()
+
+	if d.receiver == nil {
+		return nil
+	}
+
+	err := d.receiver.Close(ctx)
+	d.receiver = nil
+	return err
+}
+
+func (d *DeadLetterReceiver) ensureReceiver(ctx context.Context) error {
+	d.receiverMu.Lock()
+	defer d.receiverMu.Unlock()
+
+	if d.receiver != nil {
+		return nil
+	}
+
+	r, err := d.namespace.newReceiver(ctx, d.entityPath)
+	if err != nil {
+		log.For(ctx).Error(err)
+		return err
+	}
+	d.receiver = r
+	return nil
+}
+
+// DeadLetterReason returns the reason the message was dead lettered, or an empty string if it was not
+func (m *Message) DeadLetterReason() string {
+	reason, _ := m.UserProperties[deadLetterReasonName].(string)
+	return reason
+}
+
+// DeadLetterErrorDescription returns the description of the error for which the message was dead lettered, or an empty
+// string if it was not
+func (m *Message) DeadLetterErrorDescription() string {
+	description, _ := m.UserProperties[deadLetterErrorDescriptionName].(string)
+	return description
+}
+
+func deadLetterPath(entityPath string) string {
+	return entityPath + "/" + deadLetterQueueName
+}
@@ -0,0 +1,157 @@
+package servicebus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultDuplicateDetectionWindow is the duplicate detection history time window Service Bus uses by default
+	defaultDuplicateDetectionWindow = 10 * time.Minute
+	// maxTrackedMessageIDs bounds the memory used to track the IDs of sent messages
+	maxTrackedMessageIDs = 10000
+)
+
+type (
+	// sentMessageTracker remembers the IDs of messages sent within the duplicate detection window of an entity
+	sentMessageTracker struct {
+		mu     sync.Mutex
+		window time.Duration
+		order  *list.List
+		sent   map[string]*list.Element
+		// peekedThrough is the highest sequence number seen by a peek check, which later checks start after
+		peekedThrough int64
+	}
+
+	sentMessage struct {
+		id     string
+		sentAt time.Time
+	}
+)
+
+// assignsMessageIDs reports whether messages sent to the entity without an ID are assigned one. They are unless the
+// queue or topic was configured otherwise, so a message sent again after an ambiguous failure is deduplicated.
+func (e *entity) assignsMessageIDs() bool {
+	return e.assignMessageIDs == nil || *e.assignMessageIDs
+}
+
+func newSentMessageTracker(window time.Duration) *sentMessageTracker {
+	return &sentMessageTracker{
+		window: window,
+		order:  list.New(),
+		sent:   make(map[string]*list.Element),
+	}
+}
+
+// track records the message ID as sent and reports if a message with the same ID was already sent within the window
+func (t *sentMessageTracker) track(id string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expire(now)
+	if elem, ok := t.sent[id]; ok {
+		// the broker keeps the original message, so the window is not extended by the duplicate
+		return now.Sub(elem.Value.(*sentMessage).sentAt) < t.window
+	}
+
+	t.sent[id] = t.order.PushBack(&sentMessage{id: id, sentAt: now})
+	if t.order.Len() > maxTrackedMessageIDs {
+		t.remove(t.order.Front())
+	}
+	return false
+}
+
+// forget removes the message ID, so a failed send is not considered when deduplicating a retry
+func (t *sentMessageTracker) forget(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if elem, ok := t.sent[id]; ok {
+		t.remove(elem)
+	}
+}
+
+func (t *sentMessageTracker) expire(now time.Time) {
+	for elem := t.order.Front(); elem != nil; elem = t.order.Front() {
+		if now.Sub(elem.Value.(*sentMessage).sentAt) < t.window {
+			return
+		}
+		t.remove(elem)
+	}
+}
+
+func (t *sentMessageTracker) remove(elem *list.Element) {
+	delete(t.sent, elem.Value.(*sentMessage).id)
+	t.order.Remove(elem)
+}
+
+// peekFrom returns the sequence number a peek check for a message which is about to be sent starts at. Messages sent
+// after a check advanced past a sequence number are enqueued with a higher one.
+func (t *sentMessageTracker) peekFrom() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.peekedThrough + 1
+}
+
+// peeked records the sequence number as seen by a peek check
+func (t *sentMessageTracker) peeked(seq int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if seq > t.peekedThrough {
+		t.peekedThrough = seq
+	}
+}
+
+// peekForSentMessage looks for the message with the ID among the messages of the queue starting at the sequence number
+// from, and reports whether it was found
+func (q *Queue) peekForSentMessage(ctx context.Context, id string, from int64) (bool, error) {
+	iter, err := q.PeekFromSequenceNumber(ctx, from, PeekWithScheduledMessages(), PeekWithoutBody())
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = iter.Close(ctx)
+	}()
+
+	for {
+		msg, err := iter.Next(ctx)
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		q.sentMessages.peeked(*msg.SystemProperties.SequenceNumber)
+		if msg.ID == id {
+			return true, nil
+		}
+	}
+}
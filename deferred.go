@@ -0,0 +1,254 @@
+package servicebus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Azure/azure-amqp-common-go/log"
+	"pack.ag/amqp"
+)
+
+type (
+	// dispositionStatus is the outcome of a message settled through the management node of its entity
+	dispositionStatus string
+
+	// managementSettlement settles a message which was received through the management node of its entity, rather than
+	// over a receive link, so its disposition must also be sent through the management node. The deferred messages of
+	// a session are settled with the lock of the session, through the connection of receiver, which holds it.
+	managementSettlement struct {
+		namespace  *Namespace
+		entityPath string
+		receiver   *receiver
+		sessionID  *string
+		// lockLost is told about messages whose disposition Service Bus refused because their lock was lost
+		lockLost lockLostHandling
+	}
+)
+
+const (
+	completedDisposition dispositionStatus = "completed"
+	abandonedDisposition dispositionStatus = "abandoned"
+	suspendedDisposition dispositionStatus = "suspended"
+	// deferredDisposition is spelled as Service Bus expects it
+	deferredDisposition dispositionStatus = "defered"
+)
+
+// Defer will notify Azure Service Bus the message should be set aside. A deferred message is not delivered by Receive
+// again; it can only be received by its sequence number, with ReceiveDeferred, or MessageSession.ReceiveDeferred for a
+// message of a session. The caller is responsible for persisting the sequence number of the message, found in its
+// SystemProperties, or the message can't be retrieved.
+func (m *Message) Defer() DispositionAction {
+	return func(ctx context.Context) {
+		if !m.settle() {
+			return
+		}
+
+		span, ctx := m.startSpanFromContext(ctx, "sb.Message.Defer")
+		defer span.Finish()
+		m.logDisposition("defer")
+
+		if m.mgmt != nil {
+			m.mgmt.settle(ctx, m, deferredDisposition, nil)
+			return
+		}
+
+		m.message.Modify(false, true, nil)
+	}
+}
+
+// ReceiveDeferred receives the deferred messages with the given sequence numbers. The messages are locked, and must be
+// settled with Complete, Abandon, DeadLetter or Defer like messages delivered by Receive.
+func (q *Queue) ReceiveDeferred(ctx context.Context, sequenceNumbers ...int64) ([]*Message, error) {
+	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.ReceiveDeferred")
+	defer span.Finish()
+
+	return q.namespace.receiveDeferred(ctx, q.Name, q.lockLost, sequenceNumbers...)
+}
+
+func (ns *Namespace) receiveDeferred(ctx context.Context, entityPath string, lockLost lockLostHandling, sequenceNumbers ...int64) ([]*Message, error) {
+	if len(sequenceNumbers) == 0 {
+		return nil, nil
+	}
+
+	link, err := ns.newManagementLink(ctx, entityPath)
+	if err != nil {
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+	defer func() {
+		_ = link.Close(ctx)
+	}()
+
+	messages, err := link.receiveBySequenceNumber(ctx, nil, sequenceNumbers...)
+	if err != nil {
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+
+	settlement := &managementSettlement{
+		namespace:  ns,
+		entityPath: entityPath,
+		lockLost:   lockLost,
+	}
+	for _, msg := range messages {
+		msg.mgmt = settlement
+	}
+	return messages, nil
+}
+
+// ReceiveDeferred receives the deferred messages of the session with the given sequence numbers. The deferred messages
+// of a session can only be received while its lock is held, so they are received through the connection of the
+// session, and their dispositions are sent through it. They must be settled before the session is closed.
+func (ms *MessageSession) ReceiveDeferred(ctx context.Context, sequenceNumbers ...int64) ([]*Message, error) {
+	span, ctx := ms.receiver.startConsumerSpanFromContext(ctx, "sb.MessageSession.ReceiveDeferred")
+	defer span.Finish()
+
+	if len(sequenceNumbers) == 0 {
+		return nil, nil
+	}
+
+	link, err := ms.receiver.newManagementLink(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = link.Close(ctx)
+	}()
+
+	messages, err := link.receiveBySequenceNumber(ctx, ms.SessionID(), sequenceNumbers...)
+	if err != nil {
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+
+	settlement := &managementSettlement{
+		namespace:  ms.receiver.namespace,
+		entityPath: ms.receiver.entityPath,
+		receiver:   ms.receiver,
+		sessionID:  ms.SessionID(),
+		lockLost:   ms.receiver.lockLost,
+	}
+	for _, msg := range messages {
+		msg.mgmt = settlement
+	}
+	return messages, nil
+}
+
+// settle sends the disposition of a message through the management node of its entity. Dispositions don't report
+// errors, so a failure is logged and the lock on the message expires. When Service Bus refuses the disposition because
+// the lock on the message was lost, the lock lost callback is called with ErrMessageLockLost, or ErrSessionLockLost for
+// a message of a session.
+func (s *managementSettlement) settle(ctx context.Context, m *Message, status dispositionStatus, properties map[string]interface{}) {
+	if m.LockToken == nil {
+		log.For(ctx).Error(errNoLockToken)
+		return
+	}
+
+	err := s.updateDisposition(ctx, status, []amqp.UUID{amqp.UUID(*m.LockToken)}, properties)
+	if err == nil {
+		return
+	}
+	log.For(ctx).Error(err)
+
+	if s.lockLost.onLockLost == nil || !isLockLostError(err) {
+		return
+	}
+	if errors.Is(err, ErrSessionLockLost) {
+		s.lockLost.onLockLost(ctx, m, ErrSessionLockLost)
+		return
+	}
+	s.lockLost.onLockLost(ctx, m, ErrMessageLockLost)
+}
+
+// updateDisposition settles the messages with the given lock tokens with a single request to the management node
+func (s *managementSettlement) updateDisposition(ctx context.Context, status dispositionStatus, lockTokens []amqp.UUID, properties map[string]interface{}) error {
+	link, err := s.newLink(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = link.Close(ctx)
+	}()
+
+	return link.updateDisposition(ctx, status, lockTokens, s.withSession(properties))
+}
+
+// updateDispositions settles the messages with the given lock tokens with a single request to the management node. If
+// Service Bus refuses the request, the messages are settled one at a time to find which were refused, and their lock
+// tokens are returned along with the reason the first of them was refused. If the management node can't be reached, no
+// lock tokens are returned.
+func (s *managementSettlement) updateDispositions(ctx context.Context, status dispositionStatus, lockTokens []amqp.UUID) ([]amqp.UUID, error) {
+	link, err := s.newLink(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = link.Close(ctx)
+	}()
+
+	properties := s.withSession(nil)
+	err = link.updateDisposition(ctx, status, lockTokens, properties)
+	if err == nil {
+		return nil, nil
+	}
+	if len(lockTokens) == 1 {
+		return lockTokens, err
+	}
+
+	// a refused request does not identify the messages at fault, so settle them one at a time to find which were refused
+	var rejected []amqp.UUID
+	var firstErr error
+	for _, lockToken := range lockTokens {
+		if err := link.updateDisposition(ctx, status, []amqp.UUID{lockToken}, properties); err != nil {
+			rejected = append(rejected, lockToken)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return rejected, firstErr
+}
+
+// newLink opens a link to the management node the messages are settled through
+func (s *managementSettlement) newLink(ctx context.Context) (*managementLink, error) {
+	if s.receiver != nil {
+		return s.receiver.newManagementLink(ctx)
+	}
+	return s.namespace.newManagementLink(ctx, s.entityPath)
+}
+
+// withSession adds the session of the messages to the properties of a disposition request
+func (s *managementSettlement) withSession(properties map[string]interface{}) map[string]interface{} {
+	if s.sessionID == nil {
+		return properties
+	}
+
+	withSession := make(map[string]interface{}, len(properties)+1)
+	for key, val := range properties {
+		withSession[key] = val
+	}
+	withSession[sessionIDFieldName] = *s.sessionID
+	return withSession
+}
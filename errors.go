@@ -0,0 +1,315 @@
+package servicebus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-amqp-common-go/uuid"
+	"pack.ag/amqp"
+)
+
+var (
+	// ErrUnsupported is returned when an operation is refused by Service Bus because the entity does not support it
+	ErrUnsupported = errors.New("servicebus: operation is not supported by the entity")
+
+	// ErrConfirmTimeout is returned when the timeouts of a send with SendOptions elapsed before the outcome of the
+	// message was received. The message may or may not have been accepted by the entity, so it should be sent again with
+	// the same ID, which duplicate detection discards if it was.
+	ErrConfirmTimeout = errors.New("servicebus: timed out waiting for the outcome of a transferred message; the message may have been accepted")
+
+	// ErrMessageLockLost is reported when the lock on a received message expired before it was settled. Service Bus may
+	// already have delivered the message to another receiver.
+	ErrMessageLockLost = errors.New("servicebus: the lock on the message was lost; it may have been delivered again")
+
+	errNoLockToken = errors.New("servicebus: the message has no lock token")
+
+	// ErrSessionLockLost is returned when the lock on a session expired or was taken by another receiver
+	ErrSessionLockLost = errors.New("servicebus: the lock on the session was lost")
+
+	// ErrSessionStateConflict is returned when a conditional update of session state finds the state was changed since
+	// it was last read
+	ErrSessionStateConflict = errors.New("servicebus: session state was changed since it was last read")
+
+	// ErrNoSessionAvailable is returned by ReceiveOneSession when no session could be locked within the session accept
+	// timeout, either because the entity holds no sessions with messages or because they are all locked by other receivers
+	ErrNoSessionAvailable = errors.New("servicebus: no session became available")
+
+	// ErrPartitionKeyMismatch is returned when a message sent to a session has a partition key other than its session
+	// ID, which Service Bus would reject for a partitioned entity
+	ErrPartitionKeyMismatch = errors.New("servicebus: the partition key of the message must be equal to its session ID")
+
+	// ErrMessageNotFound is returned when a message, such as a deferred message, does not exist in the entity
+	ErrMessageNotFound = errors.New("servicebus: the message was not found")
+
+	// ErrTimeout is returned when Service Bus did not complete an operation in time
+	ErrTimeout = errors.New("servicebus: the operation timed out")
+
+	// ErrServerBusy is returned when Service Bus is throttling requests; the operation can be retried after a while
+	ErrServerBusy = errors.New("servicebus: the server is busy")
+
+	// ErrMessageSizeExceeded is returned when a message is larger than the entity allows
+	ErrMessageSizeExceeded = errors.New("servicebus: the message exceeds the maximum size")
+
+	// ErrEntityDisabled is returned when Service Bus refused to send messages to, or receive messages from, an entity
+	// because of its status, such as sending to a queue which is Disabled or SendDisabled
+	ErrEntityDisabled = errors.New("servicebus: the entity is disabled")
+
+	// ErrNamespaceClosed is returned by operations of a Namespace, or of its queues, topics and subscriptions, once the
+	// Namespace was closed
+	ErrNamespaceClosed = errors.New("servicebus: the namespace is closed")
+)
+
+type (
+	// ConditionError is an error reported by Service Bus with an AMQP error condition. It wraps the AMQP error, and
+	// matches the error value for its condition with errors.Is, such as ErrMessageLockLost for
+	// ErrorMessageLockLost.
+	ConditionError struct {
+		Condition   MessageErrorCondition
+		Description string
+		Err         error
+	}
+
+	// serverBusyError reports that Service Bus is throttling requests, and how long it asked clients to wait
+	serverBusyError struct {
+		retryAfter time.Duration
+	}
+
+	// partitionKeyMismatchError reports the partition key and session ID of a message which don't match
+	partitionKeyMismatchError struct {
+		partitionKey string
+		sessionID    string
+	}
+
+	// entityConflictError reports that Service Bus refused to create an entity because it already exists, or was being
+	// created concurrently
+	entityConflictError struct {
+		err error
+	}
+
+	// CancelScheduledError is returned when Service Bus refused to cancel some scheduled messages, such as ones which were
+	// already enqueued. Rejected holds their sequence numbers, and Err the reason the first of them was refused.
+	CancelScheduledError struct {
+		Rejected []int64
+		Err      error
+	}
+
+	// DispositionBatchError is returned by CompleteBatch and AbandonBatch when Service Bus refused to settle some of the
+	// messages, such as ones whose locks were lost, or the request settling the messages of an entity failed. Rejected
+	// holds the lock tokens of the messages which were not settled, and Err the reason the first of them was not.
+	DispositionBatchError struct {
+		Rejected []uuid.UUID
+		Err      error
+	}
+)
+
+// Error implements error
+func (e *CancelScheduledError) Error() string {
+	return fmt.Sprintf("failed to cancel scheduled messages %v: %v", e.Rejected, e.Err)
+}
+
+// Error implements error
+func (e *DispositionBatchError) Error() string {
+	return fmt.Sprintf("failed to settle messages with lock tokens %v: %v", e.Rejected, e.Err)
+}
+
+// Error implements error
+func (e *ConditionError) Error() string {
+	return fmt.Sprintf("servicebus: %s: %s", e.Condition, e.Description)
+}
+
+// Unwrap returns the AMQP error reported by Service Bus
+func (e *ConditionError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true if target is the error value for the condition of the error
+func (e *ConditionError) Is(target error) bool {
+	return target != nil && conditionErrors[e.Condition] == target
+}
+
+// Error implements error
+func (e *partitionKeyMismatchError) Error() string {
+	return fmt.Sprintf("the partition key %q of the message must be equal to its session ID %q", e.partitionKey, e.sessionID)
+}
+
+// Is returns true for ErrPartitionKeyMismatch
+func (e *partitionKeyMismatchError) Is(target error) bool {
+	return target == ErrPartitionKeyMismatch
+}
+
+// Error implements error
+func (e *entityConflictError) Error() string {
+	return e.err.Error()
+}
+
+// Error implements error
+func (e *serverBusyError) Error() string {
+	return fmt.Sprintf("%v; retry after %v", ErrServerBusy, e.retryAfter)
+}
+
+// Is returns true for ErrServerBusy
+func (e *serverBusyError) Is(target error) bool {
+	return target == ErrServerBusy
+}
+
+// conditionErrors maps error conditions to the error values matched by ConditionError
+var conditionErrors = map[MessageErrorCondition]error{
+	ErrorMessageLockLost:     ErrMessageLockLost,
+	ErrorSessionLockLost:     ErrSessionLockLost,
+	ErrorMessageNotFound:     ErrMessageNotFound,
+	ErrorTimeout:             ErrTimeout,
+	ErrorServerBusy:          ErrServerBusy,
+	ErrorMessageSizeExceeded: ErrMessageSizeExceeded,
+	ErrorEntityDisabled:      ErrEntityDisabled,
+}
+
+// IsRetryable returns true if err is transient, so the operation which failed may succeed if it is tried again. Errors
+// which are not known to be transient, such as ErrMessageSizeExceeded or ErrMessageLockLost, are not retryable.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, ErrServerBusy) || errors.Is(err, ErrTimeout) {
+		return true
+	}
+
+	if condition, ok := conditionOf(err); ok {
+		switch condition {
+		case ErrorInternalError, ErrorResourceLimitExceeded, ErrorResourceDeleted:
+			return true
+		default:
+			return false
+		}
+	}
+
+	var detachErr *amqp.DetachError
+	if errors.As(err, &detachErr) {
+		// the link was detached without an error condition, so it can be attached again
+		return true
+	}
+
+	switch err {
+	case amqp.ErrConnClosed, amqp.ErrSessionClosed, amqp.ErrLinkClosed, amqp.ErrTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// wrapError wraps an AMQP error reported by Service Bus in a ConditionError. Other errors are returned as is.
+func wrapError(err error) error {
+	condition, ok := conditionOf(err)
+	if !ok {
+		return err
+	}
+
+	var conditionErr *ConditionError
+	if errors.As(err, &conditionErr) {
+		return err
+	}
+
+	var description string
+	var amqpErr *amqp.Error
+	var detachErr *amqp.DetachError
+	if errors.As(err, &amqpErr) {
+		description = amqpErr.Description
+	} else if errors.As(err, &detachErr) {
+		description = detachErr.RemoteError.Description
+	}
+
+	return &ConditionError{
+		Condition:   condition,
+		Description: description,
+		Err:         err,
+	}
+}
+
+// conditionOf returns the AMQP error condition reported by Service Bus with err, if there is one
+func conditionOf(err error) (MessageErrorCondition, bool) {
+	var conditionErr *ConditionError
+	if errors.As(err, &conditionErr) {
+		return conditionErr.Condition, true
+	}
+
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) {
+		return MessageErrorCondition(amqpErr.Condition), true
+	}
+
+	var detachErr *amqp.DetachError
+	if errors.As(err, &detachErr) && detachErr.RemoteError != nil {
+		return MessageErrorCondition(detachErr.RemoteError.Condition), true
+	}
+	return "", false
+}
+
+// isNonRetryableCondition returns true if the AMQP error condition will not change by retrying the same operation
+func isNonRetryableCondition(condition amqp.ErrorCondition) bool {
+	switch MessageErrorCondition(condition) {
+	case ErrorNotAllowed, ErrorNotImplemented, ErrorUnauthorizedAccess, ErrorNotFound, ErrorMessageSizeExceeded, ErrorEntityDisabled:
+		return true
+	default:
+		return false
+	}
+}
+
+// isLockLostError returns true if the error reports that the lock on a message or session was lost, which can not be
+// recovered by retrying
+func isLockLostError(err error) bool {
+	if errors.Is(err, ErrMessageLockLost) || errors.Is(err, ErrSessionLockLost) {
+		return true
+	}
+
+	condition, ok := conditionOf(err)
+	return ok && (condition == ErrorMessageLockLost || condition == ErrorSessionLockLost)
+}
+
+// isTimeoutError returns true if the error represents Service Bus not completing an operation in time
+func isTimeoutError(err error) bool {
+	if errors.Is(err, ErrTimeout) {
+		return true
+	}
+
+	condition, ok := conditionOf(err)
+	return ok && condition == ErrorTimeout
+}
+
+// isNonRecoverableError returns true if the error can't be recovered from by rebuilding the link, such as an
+// authorization failure, the entity having been deleted or the namespace having been closed
+func isNonRecoverableError(err error) bool {
+	if errors.Is(err, ErrNamespaceClosed) {
+		return true
+	}
+	condition, ok := conditionOf(err)
+	return ok && (condition == ErrorUnauthorizedAccess || condition == ErrorNotFound)
+}
+
+// isUnsupportedError returns true if the error represents Service Bus refusing an operation on an entity
+func isUnsupportedError(err error) bool {
+	condition, ok := conditionOf(err)
+	return ok && (condition == ErrorNotAllowed || condition == ErrorNotImplemented)
+}
@@ -0,0 +1,150 @@
+package servicebus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/Azure/azure-amqp-common-go/log"
+)
+
+type (
+	// ForwardOption configures how ForwardMessages copies messages
+	ForwardOption func(*forwarder) error
+
+	forwarder struct {
+		keepMessageID bool
+	}
+)
+
+// ForwardWithMessageID keeps the ID of forwarded messages, rather than sending each copy with a new ID. Duplicate
+// detection on the destination then discards a copy sent again after forwarding was interrupted, but it also discards
+// the copy of a message whose ID the destination saw within its duplicate detection window, such as a message moved
+// out of the dead letter queue of the entity it is forwarded to.
+func ForwardWithMessageID() ForwardOption {
+	return func(f *forwarder) error {
+		f.keepMessageID = true
+		return nil
+	}
+}
+
+// ForwardMessages moves up to n messages received by from to the entity to sends to, such as the Send of another Queue,
+// and returns how many were moved. Each message is sent as a copy of the received message, then completed, so a message
+// is never lost: if forwarding is interrupted between the two, the message is delivered again by from and forwarded
+// again.
+//
+// The copy keeps the body, ContentType, CorrelationID, Label, ReplyTo, ReplyToGroupID, To, GroupID, GroupSequence,
+// PartitionKey, TTL and UserProperties of the message, including the DeadLetterReason of messages moved out of a dead
+// letter queue. It is sent with a new ID, unless ForwardWithMessageID is given. The properties Service Bus sets, such as
+// the sequence number and enqueued time, are assigned anew by the destination.
+//
+// Forwarding stops once n messages were moved or ctx is done, which is not reported as an error, so a ctx with a
+// deadline bounds how long ForwardMessages waits for messages from an empty entity. If a message can't be sent, it is
+// abandoned, so it can be received again, and the error is returned. If a message was sent but can't be completed, such
+// as when its lock expired while it was sent, it is not counted and the error is returned; the message is delivered
+// again by from once its lock expires, and forwarded again. from must receive in PeekLock mode; messages received in
+// ReceiveAndDelete mode are deleted before they are sent, and are lost if sending them fails.
+func ForwardMessages(ctx context.Context, from *Receiver, to SendFunc, n int, opts ...ForwardOption) (int, error) {
+	if from == nil || to == nil {
+		return 0, errors.New("ForwardMessages: from and to must not be nil")
+	}
+
+	f := new(forwarder)
+	for _, opt := range opts {
+		if err := opt(f); err != nil {
+			return 0, err
+		}
+	}
+
+	forwarded := 0
+	for forwarded < n {
+		msg, err := from.Next(ctx)
+		if err == io.EOF {
+			return forwarded, nil
+		}
+		if err != nil {
+			return forwarded, err
+		}
+
+		copied := forwardedMessage(msg)
+		if !f.keepMessageID {
+			if copied.ID, err = from.r.namespace.newID(); err != nil {
+				msg.Abandon()(ctx)
+				return forwarded, err
+			}
+		}
+
+		if err := to(ctx, copied); err != nil {
+			log.For(ctx).Error(err)
+			msg.Abandon()(ctx)
+			return forwarded, err
+		}
+
+		if err := completeForwarded(ctx, msg); err != nil {
+			log.For(ctx).Error(err)
+			return forwarded, err
+		}
+		forwarded++
+	}
+	return forwarded, nil
+}
+
+// completeForwarded completes a message which was forwarded, and returns an error if Service Bus can't have completed
+// it. The disposition of a message received over a receive link is not acknowledged, so a lock known to have expired
+// is reported; messages received through the management node are completed with a request whose response is checked.
+func completeForwarded(ctx context.Context, msg *Message) error {
+	if msg.LockExpired() {
+		return ErrMessageLockLost
+	}
+	return settleBatch(ctx, []*Message{msg}, "complete", completedDisposition, (*Message).Complete)
+}
+
+// forwardedMessage returns a copy of a received message to be sent to another entity. Annotations and system
+// properties are left out, as they describe the message in the entity it was received from.
+func forwardedMessage(msg *Message) *Message {
+	forwarded := &Message{
+		ContentType:    msg.ContentType,
+		CorrelationID:  msg.CorrelationID,
+		Data:           msg.Data,
+		Value:          msg.Value,
+		GroupID:        msg.GroupID,
+		GroupSequence:  msg.GroupSequence,
+		ID:             msg.ID,
+		Label:          msg.Label,
+		ReplyTo:        msg.ReplyTo,
+		ReplyToGroupID: msg.ReplyToGroupID,
+		To:             msg.To,
+		TTL:            msg.TTL,
+		PartitionKey:   msg.PartitionKey,
+	}
+
+	if msg.UserProperties != nil {
+		forwarded.UserProperties = make(map[string]interface{}, len(msg.UserProperties))
+		for key, value := range msg.UserProperties {
+			forwarded.UserProperties[key] = value
+		}
+	}
+	return forwarded
+}
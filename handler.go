@@ -1,6 +1,9 @@
 package servicebus
 
-import "context"
+import (
+	"context"
+	"fmt"
+)
 
 type (
 	// Handler exposes the functionality required to process a Service Bus message.
@@ -54,3 +57,37 @@ func (dsh defaultSessionHandler) Start(ms *MessageSession) error {
 func (dsh defaultSessionHandler) End() {
 	dsh.end()
 }
+
+// routingHandler dispatches each message to the Handler returned by router for the value of the message's routing
+// property. Messages which do not carry the property, or for which router returns nil, are sent to the fallback Handler.
+type routingHandler struct {
+	property string
+	router   func(key string) Handler
+	fallback Handler
+}
+
+// Handle looks up the routing key of the message and calls the Handler selected for it
+func (rh *routingHandler) Handle(ctx context.Context, msg *Message) DispositionAction {
+	if key, ok := routingKeyFromMessage(msg, rh.property); ok {
+		if handler := rh.router(key); handler != nil {
+			return handler.Handle(ctx, msg)
+		}
+	}
+	return rh.fallback.Handle(ctx, msg)
+}
+
+func routingKeyFromMessage(msg *Message, property string) (string, bool) {
+	if msg == nil || msg.UserProperties == nil {
+		return "", false
+	}
+
+	val, ok := msg.UserProperties[property]
+	if !ok || val == nil {
+		return "", false
+	}
+
+	if key, ok := val.(string); ok {
+		return key, true
+	}
+	return fmt.Sprintf("%v", val), true
+}
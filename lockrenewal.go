@@ -2,22 +2,111 @@ package servicebus
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/Azure/azure-amqp-common-go/log"
-	"github.com/Azure/azure-amqp-common-go/rpc"
 	"go.opencensus.io/trace"
 	"pack.ag/amqp"
 )
 
-//RenewLocks renews the locks on messages provided
-func (e *entity) RenewLocks(ctx context.Context, messages []*Message) error {
+// RenewLocks renews the locks on messages provided. It returns the new expirations of the locks, in the same order as
+// messages, as reported by Service Bus, and records each of them in the LockedUntil system property of its message.
+// The expiration of a message without a lock token, whose lock can't be renewed, is the zero time.
+func (e *entity) RenewLocks(ctx context.Context, messages []*Message) ([]time.Time, error) {
 	span, ctx := e.startSpanFromContext(ctx, "sb.entity.renewLocks")
 	defer span.Finish()
 
+	e.renewMessageLockMutex.Lock()
+	defer e.renewMessageLockMutex.Unlock()
+
+	return e.namespace.renewLocks(ctx, e.Name, messages)
+}
+
+// RenewLocksWithRetry renews the locks on messages provided, retrying transient failures as allowed by policy. It stops
+// retrying if a lock was lost, returning ErrMessageLockLost. The new expirations of the locks are returned like
+// RenewLocks returns them.
+func (e *entity) RenewLocksWithRetry(ctx context.Context, messages []*Message, policy RetryPolicy) ([]time.Time, error) {
+	var expirations []time.Time
+	err := policy.do(ctx, func(ctx context.Context) error {
+		var err error
+		expirations, err = e.RenewLocks(ctx, messages)
+		return err
+	}, isLockLostError)
+	return expirations, err
+}
+
+// RenewLock renews the lock on a message received from a Queue or Subscription
+func (m *Message) RenewLock(ctx context.Context) error {
+	span, ctx := m.startSpanFromContext(ctx, "sb.Message.RenewLock")
+	defer span.Finish()
+
+	if m.mgmt != nil {
+		_, err := m.mgmt.namespace.renewLocks(ctx, m.mgmt.entityPath, []*Message{m})
+		return err
+	}
+	if m.receiver == nil {
+		return errors.New("the message was not received from an entity and holds no lock")
+	}
+	if m.receiver.mode == ReceiveAndDeleteMode {
+		return errors.New("the message was received in receive and delete mode and holds no lock")
+	}
+	_, err := m.receiver.namespace.renewLocks(ctx, m.receiver.entityPath, []*Message{m})
+	return err
+}
+
+// RenewLockWithRetry renews the lock on a message, retrying transient failures as allowed by policy within the deadline
+// of ctx. It stops retrying if the lock was lost, returning ErrMessageLockLost.
+func (m *Message) RenewLockWithRetry(ctx context.Context, policy RetryPolicy) error {
+	return policy.do(ctx, m.RenewLock, isLockLostError)
+}
+
+// LockExpired returns true if the message is locked and its lock has expired, as measured by the local clock
+// compensated for its skew from the clock of Service Bus. The lock on a message, which expires at the LockedUntil of its
+// SystemProperties unless it is renewed, can expire before the message is handled when it waits in the prefetch buffer
+// of the receiver. A message whose lock expired can't be settled, and Service Bus may already have delivered it again.
+func (m *Message) LockExpired() bool {
+	lockedUntil, ok := m.lockedUntil()
+	if !ok {
+		return false
+	}
+
+	switch {
+	case m.receiver != nil:
+		if m.receiver.mode == ReceiveAndDeleteMode {
+			return false
+		}
+		lockedUntil = m.receiver.namespace.toLocalTime(lockedUntil)
+	case m.mgmt != nil:
+		lockedUntil = m.mgmt.namespace.toLocalTime(lockedUntil)
+	}
+	return !lockedUntil.After(time.Now())
+}
+
+// lockedUntil returns when the lock on the message expires as reported by Service Bus, and false if the message is not
+// locked. The messages of a session are locked by the lock on the session, so renewing it extends their locks, including
+// those of messages which were prefetched before the renewal.
+func (m *Message) lockedUntil() (time.Time, bool) {
+	if m.SystemProperties == nil || m.SystemProperties.LockedUntil == nil {
+		return time.Time{}, false
+	}
+
+	lockedUntil := *m.SystemProperties.LockedUntil
+	if m.receiver != nil {
+		if sessionLockedUntil := m.receiver.sessionLockExpiration(); sessionLockedUntil.After(lockedUntil) {
+			lockedUntil = sessionLockedUntil
+		}
+	}
+	return lockedUntil, true
+}
+
+// renewLocks renews the locks on messages and returns their new expirations, in the same order as messages
+func (ns *Namespace) renewLocks(ctx context.Context, entityPath string, messages []*Message) ([]time.Time, error) {
 	lockTokens := make([]amqp.UUID, 0, len(messages))
-	for _, m := range messages {
+	renewed := make([]int, 0, len(messages))
+	for i, m := range messages {
 		if m.LockToken == nil {
 			log.For(ctx).Error(fmt.Errorf("failed: message has nil lock token, cannot renew lock"), trace.StringAttribute("messageId", m.ID))
 			continue
@@ -25,16 +114,15 @@ func (e *entity) RenewLocks(ctx context.Context, messages []*Message) error {
 
 		amqpLockToken := amqp.UUID(*m.LockToken)
 		lockTokens = append(lockTokens, amqpLockToken)
+		renewed = append(renewed, i)
 	}
 
+	expirations := make([]time.Time, len(messages))
 	if len(lockTokens) < 1 {
 		log.For(ctx).Info("no lock tokens present to renew")
-		return nil
+		return expirations, nil
 	}
 
-	e.renewMessageLockMutex.Lock()
-	defer e.renewMessageLockMutex.Unlock()
-
 	renewRequestMsg := &amqp.Message{
 		ApplicationProperties: map[string]interface{}{
 			operationFieldName: serviceBuslockRenewalOperationName,
@@ -44,30 +132,123 @@ func (e *entity) RenewLocks(ctx context.Context, messages []*Message) error {
 		},
 	}
 
-	entityManagementAddress := e.ManagementPath()
-	conn, err := e.namespace.newConnection()
-	if err != nil {
-		return err
-	}
-	err = e.namespace.negotiateClaim(ctx, conn, entityManagementAddress)
+	link, err := ns.newManagementLink(ctx, entityPath)
 	if err != nil {
-		log.For(ctx).Error(err)
-		return err
+		return nil, err
 	}
+	defer func() {
+		_ = link.Close(ctx)
+	}()
 
-	rpcLink, err := rpc.NewLink(conn, entityManagementAddress)
+	response, err := link.rpc(ctx, renewRequestMsg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	response, err := rpcLink.RetryableRPC(ctx, 3, 1*time.Second, renewRequestMsg)
-	if err != nil {
-		return err
+	if response.Code == http.StatusGone {
+		return nil, ErrMessageLockLost
 	}
 
 	if response.Code != 200 {
-		return fmt.Errorf("error renewing locks: %v", response.Description)
+		return nil, fmt.Errorf("error renewing locks: %v", response.Description)
+	}
+
+	updateLockExpirations(response.Message, messages, renewed, expirations)
+	return expirations, nil
+}
+
+// updateLockExpirations records the lock expirations returned by a lock renewal on the renewed messages, which are the
+// messages at the indexes in renewed, and in expirations at the same indexes. The expirations of the response are in
+// the same order as the lock tokens of the request.
+func updateLockExpirations(rsp *amqp.Message, messages []*Message, renewed []int, expirations []time.Time) {
+	if rsp == nil {
+		return
+	}
+
+	val, ok := rsp.Value.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	renewedExpirations, ok := val[expirationsFieldName].([]time.Time)
+	if !ok {
+		return
+	}
+
+	for i, expiration := range renewedExpirations {
+		if i >= len(renewed) {
+			break
+		}
+
+		m := messages[renewed[i]]
+		if m.SystemProperties == nil {
+			m.SystemProperties = new(SystemProperties)
+		}
+		lockedUntil := expiration
+		m.SystemProperties.LockedUntil = &lockedUntil
+		expirations[renewed[i]] = expiration
 	}
+}
+
+const (
+	// defaultAutoRenewalInterval is how often locks are renewed when Service Bus did not report when a lock expires
+	defaultAutoRenewalInterval = 10 * time.Second
+	// minAutoRenewalInterval keeps a lock which keeps failing to renew from being renewed in a tight loop
+	minAutoRenewalInterval = 1 * time.Second
+)
+
+// renewLockWhileHandled renews the lock on msg in the background until the returned stop func is called, the message is
+// settled, ctx is done or the receiver's auto renewal duration elapsed since the message was received at receivedAt.
+// Stop waits for the renewal to finish.
+func (r *receiver) renewLockWhileHandled(ctx context.Context, msg *Message, receivedAt time.Time) (stop func()) {
+	if r.autoRenewal <= 0 || r.mode == ReceiveAndDeleteMode {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, receivedAt.Add(r.autoRenewal))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			timer := time.NewTimer(r.nextLockRenewal(msg))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			if msg.isSettled() {
+				return
+			}
 
-	return nil
+			if err := msg.RenewLock(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.For(ctx).Error(err)
+				if isLockLostError(err) {
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// nextLockRenewal returns how long to wait before renewing the lock on msg, which is half the time left on the lock
+func (r *receiver) nextLockRenewal(msg *Message) time.Duration {
+	if msg.SystemProperties == nil || msg.SystemProperties.LockedUntil == nil {
+		return defaultAutoRenewalInterval
+	}
+
+	next := time.Until(r.namespace.toLocalTime(*msg.SystemProperties.LockedUntil)) / 2
+	if next < minAutoRenewalInterval {
+		return minAutoRenewalInterval
+	}
+	return next
 }
@@ -2,13 +2,18 @@ package servicebus
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"net/http"
 	"testing"
 	"time"
 
+	"github.com/Azure/azure-amqp-common-go/rpc"
+	"github.com/Azure/azure-amqp-common-go/uuid"
 	"github.com/Azure/azure-service-bus-go/internal/test"
 	"github.com/stretchr/testify/assert"
+	"pack.ag/amqp"
 )
 
 func (suite *serviceBusSuite) TestQueueSendReceiveWithLock() {
@@ -75,7 +80,7 @@ func testQueueSendAndReceiveWithRenewLock(ctx context.Context, t *testing.T, que
 	go func() {
 		for runRenewal {
 			time.Sleep(renewEvery)
-			err := queue.RenewLocks(ctx, activeMessages)
+			_, err := queue.RenewLocks(ctx, activeMessages)
 			if err != nil {
 				fmt.Println(err.Error())
 			}
@@ -114,3 +119,169 @@ func testQueueSendAndReceiveWithRenewLock(ctx context.Context, t *testing.T, que
 		assert.Equal(t, expected[k], v)
 	}
 }
+
+func (suite *serviceBusSuite) TestRetryPolicy() {
+	policy := RetryPolicy{MaxAttempts: 4, MinBackoff: time.Millisecond, MaxBackoff: 3 * time.Millisecond}
+	suite.Equal(time.Millisecond, policy.backoff(1))
+	suite.Equal(2*time.Millisecond, policy.backoff(2))
+	suite.Equal(3*time.Millisecond, policy.backoff(3))
+
+	attempts := 0
+	transient := errors.New("connection reset")
+	err := policy.do(context.Background(), func(context.Context) error {
+		attempts++
+		return transient
+	}, isLockLostError)
+	suite.Equal(transient, err)
+	suite.Equal(4, attempts)
+
+	attempts = 0
+	err = policy.do(context.Background(), func(context.Context) error {
+		attempts++
+		if attempts == 1 {
+			return transient
+		}
+		return ErrMessageLockLost
+	}, isLockLostError)
+	suite.Equal(ErrMessageLockLost, err)
+	suite.Equal(2, attempts, "a lost lock should not be retried")
+
+	suite.True(isLockLostError(&amqp.Error{Condition: amqp.ErrorCondition(ErrorSessionLockLost)}))
+	suite.False(isLockLostError(&amqp.Error{Condition: amqp.ErrorCondition(ErrorInternalError)}))
+
+	attempts = 0
+	err = RetryPolicyNone().do(context.Background(), func(context.Context) error {
+		attempts++
+		return transient
+	}, isLockLostError)
+	suite.Equal(transient, err)
+	suite.Equal(1, attempts)
+
+	slow := RetryPolicy{MaxAttempts: 4, MinBackoff: time.Second, MaxBackoff: time.Minute, BackoffFactor: 3}
+	suite.Equal(9*time.Second, slow.backoff(3))
+	suite.Equal(serverBusyBackoff, slow.delay(1, ErrServerBusy))
+	suite.Equal(30*time.Second, slow.delay(1, &serverBusyError{retryAfter: 30 * time.Second}))
+	suite.Equal(9*time.Second, slow.delay(3, &serverBusyError{retryAfter: time.Second}))
+
+	slow.Jitter = 0.5
+	for i := 0; i < 10; i++ {
+		backoff := slow.backoff(3)
+		suite.True(backoff >= 4500*time.Millisecond && backoff <= 13500*time.Millisecond, "backoff %v is out of bounds", backoff)
+	}
+}
+
+func (suite *serviceBusSuite) TestServerBusyThrottling() {
+	wait, busy := serverBusyDelay(wrapError(&amqp.Error{Condition: amqp.ErrorCondition(ErrorServerBusy)}))
+	suite.True(busy)
+	suite.Equal(serverBusyBackoff, wait)
+
+	wait, busy = serverBusyDelay(&serverBusyError{retryAfter: 3 * time.Second})
+	suite.True(busy)
+	suite.Equal(3*time.Second, wait)
+
+	_, busy = serverBusyDelay(errors.New("transient"))
+	suite.False(busy)
+
+	logger := new(recordingLogger)
+	policy := RetryPolicy{MaxAttempts: 2, MinBackoff: time.Millisecond}
+	err := policy.doLogged(context.Background(), logger, "test", func(context.Context) error {
+		return &serverBusyError{retryAfter: time.Millisecond}
+	}, func(error) bool { return false })
+	suite.True(errors.Is(err, ErrServerBusy))
+	suite.Equal([]string{"service bus is throttling requests", "retrying operation"}, logger.messages)
+}
+
+func (suite *serviceBusSuite) TestAutoLockRenewal() {
+	r := &receiver{namespace: suite.getNewSasInstance()}
+	suite.Error(WithAutoLockRenewal(0)(r))
+	suite.Require().NoError(WithAutoLockRenewal(time.Minute)(r))
+	suite.Equal(time.Minute, r.autoRenewal)
+
+	lockedUntil := time.Now().Add(30 * time.Second)
+	msg := &Message{SystemProperties: &SystemProperties{LockedUntil: &lockedUntil}}
+	suite.InDelta(float64(15*time.Second), float64(r.nextLockRenewal(msg)), float64(time.Second))
+	suite.Equal(defaultAutoRenewalInterval, r.nextLockRenewal(&Message{}))
+
+	expired := time.Now().Add(-time.Second)
+	suite.Equal(minAutoRenewalInterval, r.nextLockRenewal(&Message{SystemProperties: &SystemProperties{LockedUntil: &expired}}))
+
+	stopped := make(chan struct{})
+	go func() {
+		r.renewLockWhileHandled(context.Background(), msg, time.Now())()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		suite.Fail("stopping the lock renewal should not wait for the next renewal")
+	}
+}
+
+func (suite *serviceBusSuite) TestUpdateLockExpirations() {
+	lockToken, err := uuid.NewV4()
+	suite.Require().NoError(err)
+	messages := []*Message{{ID: "no-lock"}, {ID: "locked", LockToken: &lockToken}}
+
+	expiration := time.Now().Add(time.Minute).UTC()
+	expirations := make([]time.Time, len(messages))
+	updateLockExpirations(&amqp.Message{
+		Value: map[string]interface{}{
+			expirationsFieldName: []time.Time{expiration},
+		},
+	}, messages, []int{1}, expirations)
+
+	suite.True(expirations[0].IsZero(), "a message without a lock token has no expiration")
+	suite.Equal(expiration, expirations[1])
+	if suite.NotNil(messages[1].SystemProperties) {
+		suite.Equal(expiration, *messages[1].SystemProperties.LockedUntil)
+	}
+	suite.Nil(messages[0].SystemProperties)
+}
+
+func (suite *serviceBusSuite) TestExpiredLockSkipping() {
+	logger := new(recordingLogger)
+	ns, err := NewNamespace(NamespaceWithLogger(logger))
+	suite.Require().NoError(err)
+	r := &receiver{namespace: ns, entityPath: "queue"}
+
+	lockedUntil := time.Now().Add(time.Minute)
+	locked := &Message{receiver: r, SystemProperties: &SystemProperties{LockedUntil: &lockedUntil}}
+	expiredAt := time.Now().Add(-time.Second)
+	expired := &Message{receiver: r, SystemProperties: &SystemProperties{LockedUntil: &expiredAt}}
+	suite.False(locked.LockExpired())
+	suite.True(expired.LockExpired())
+	suite.False(new(Message).LockExpired(), "a message without a lock can't lose it")
+
+	suite.False(r.skipExpiredLock(context.Background(), expired), "expired locks are only skipped with WithExpiredLockSkipping")
+
+	suite.Require().NoError(WithExpiredLockSkipping()(r))
+	suite.False(r.skipExpiredLock(context.Background(), locked))
+	suite.Empty(logger.messages)
+
+	// settled already, so no disposition is sent without a link
+	expired.settle()
+	suite.True(r.skipExpiredLock(context.Background(), expired))
+	suite.Equal([]string{"skipped message whose lock expired before it was handled"}, logger.messages)
+
+	r.mode = ReceiveAndDeleteMode
+	suite.False(expired.LockExpired(), "messages received in receive and delete mode hold no lock")
+}
+
+func (suite *serviceBusSuite) TestLockLostResponseError() {
+	err := lockLostResponseError(&rpc.Response{Code: http.StatusGone, Description: "the lock was lost"})
+	suite.True(errors.Is(err, ErrMessageLockLost))
+
+	err = lockLostResponseError(&rpc.Response{
+		Code:    http.StatusGone,
+		Message: &amqp.Message{ApplicationProperties: map[string]interface{}{errorConditionFieldName: string(ErrorSessionLockLost)}},
+	})
+	suite.True(errors.Is(err, ErrSessionLockLost))
+
+	err = lockLostResponseError(&rpc.Response{
+		Code:    http.StatusBadRequest,
+		Message: &amqp.Message{ApplicationProperties: map[string]interface{}{errorConditionFieldName: string(ErrorMessageLockLost)}},
+	})
+	suite.True(errors.Is(err, ErrMessageLockLost))
+
+	suite.Nil(lockLostResponseError(&rpc.Response{Code: http.StatusInternalServerError}))
+}
@@ -24,9 +24,12 @@ package servicebus
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/Azure/azure-amqp-common-go/uuid"
@@ -37,23 +40,85 @@ import (
 type (
 	// Message is an Service Bus message to be sent or received
 	Message struct {
-		ContentType      string
-		CorrelationID    string
-		Data             []byte
-		DeliveryCount    uint32
-		GroupID          *string
-		GroupSequence    *uint32
-		ID               string
-		Label            string
-		ReplyTo          string
-		ReplyToGroupID   string
-		To               string
-		TTL              *time.Duration
+		ContentType string
+		// CorrelationID is sent as the correlation-id of the message. In request/reply, a reply carries the ID of the
+		// request as its CorrelationID, so the requester can match replies to its requests. A correlation-id received as
+		// a UUID or an unsigned integer, as other clients may send it, is converted to its string form.
+		CorrelationID string
+		// Data is the body of a message sent as a data section, which is how a message is sent unless Value is set
+		Data []byte
+		// Value is the body of a message sent as an AMQP value, such as a map or a string, which clients in other
+		// languages may send instead of data. A message with a non-nil Value is sent with Value as its body, and its Data
+		// is ignored. Bodies sent as an AMQP sequence are not supported by the AMQP library.
+		Value interface{}
+		// DeliveryCount is the number of times Service Bus delivered the message, including the current delivery, so it
+		// is 1 on the first delivery of a received message. AMQP counts only the previous delivery attempts, so it is
+		// the delivery-count of the message header plus one. When a message whose DeliveryCount equals the
+		// MaxDeliveryCount of its entity is abandoned, or its lock expires, Service Bus moves it to the dead letter queue.
+		// It is ignored when sending.
+		DeliveryCount uint32
+		GroupID       *string
+		GroupSequence *uint32
+		// ID is sent as the message-id of the message. When the entity requires duplicate detection, Service Bus
+		// discards a message whose ID equals that of a message it accepted within the duplicate detection history
+		// window, so setting ID makes sending a message idempotent within the window. A message sent without an ID is
+		// assigned a random UUID, or an ID from NamespaceWithIDGenerator, which is stored in ID; sending the same Message
+		// again after an ambiguous failure, such as ErrConfirmTimeout, reuses it. No ID is assigned when sending to a
+		// queue or topic configured with QueueWithMessageIDAssignment(false) or TopicWithMessageIDAssignment(false).
+		ID    string
+		Label string
+		// ReplyTo is sent as the reply-to of the message, which names the queue or topic a reply to the message should be
+		// sent to
+		ReplyTo string
+		// ReplyToGroupID is sent as the reply-to-group-id of the message, which is the session ID, also known as the
+		// ReplyToSessionId, a reply to the message should be sent with when ReplyTo names an entity requiring sessions
+		ReplyToGroupID string
+		To             string
+		// TTL is how long the message lives after it is enqueued before it expires. A nil or zero TTL sends the message
+		// without a time to live, so the default message time to live of the entity applies. Service Bus caps the time to
+		// live of a message to the default of its entity, so when a message is sent with a longer TTL, TTL is set to the
+		// default of the entity and the namespace logger is warned. A negative TTL fails the send.
+		TTL *time.Duration
+		// ScheduledEnqueueTime, if not nil, is when Service Bus makes the message available to receivers. It is sent as
+		// the scheduled enqueue time of the message, in place of the one of SystemProperties, which Service Bus reports
+		// for received messages. A message sent with a ScheduledEnqueueTime is sent like any other; Queue.ScheduleMessages
+		// also reports the sequence numbers Service Bus assigns scheduled messages, which are needed to cancel them.
+		ScheduledEnqueueTime *time.Time
+		// PartitionKey, if not nil, selects the partition of a partitioned entity the message is sent to. It must be equal
+		// to the GroupID of a message sent to a session.
+		PartitionKey *string
+		// ViaPartitionKey, if not nil, selects the partition of the transfer queue a message sent via another entity is
+		// placed in
+		ViaPartitionKey *string
+		// LockToken is the lock token Service Bus assigned to the delivery of a message received in PeekLock mode, which
+		// identifies the lock in the diagnostics of Service Bus and can be logged to correlate with them. It is nil for
+		// messages which were not delivered with a lock, such as peeked messages or messages received in
+		// ReceiveAndDelete mode. The token is only valid while the lock is held, and a message can only be settled by it
+		// through the receiver link which received the message, or through the management node of its entity for
+		// deferred messages. It should be treated as read-only, as lock renewals and dispositions of deferred messages
+		// send the lock token the field holds.
 		LockToken        *uuid.UUID
 		SystemProperties *SystemProperties
-		UserProperties   map[string]interface{}
-		message          *amqp.Message
-	}
+		// UserProperties are sent as the application properties of the message, which subscription rules such as
+		// correlation filters match on, and are populated from them on receive. Values may be strings, booleans,
+		// integers, floats, []byte, time.Time or UUIDs; sending a message with a value of another type fails.
+		UserProperties map[string]interface{}
+		// Annotations are the message annotations of the message, including the ones modeled by other fields, such as
+		// SystemProperties, which are populated from them on receive. They are sent as the message annotations of the
+		// message, which allows setting annotations the other fields don't model. When an annotation is also set by
+		// another field, such as PartitionKey or ScheduledEnqueueTime, the value of that field is sent.
+		Annotations map[string]interface{}
+		message     *amqp.Message
+		receiver    *receiver
+		mgmt        *managementSettlement
+		settled     int32
+		bodyOmitted bool
+		// sessionAssigned is true when GroupID holds the session of the sender rather than one set by the caller, in
+		// which case it does not determine the partition of the message
+		sessionAssigned bool
+	}
+
+	messageContextKey struct{}
 
 	// DispositionAction represents the action to notify Azure Service Bus of the Message's disposition
 	DispositionAction func(ctx context.Context)
@@ -61,7 +126,9 @@ type (
 	// MessageErrorCondition represents a well-known collection of AMQP errors
 	MessageErrorCondition string
 
-	// SystemProperties are used to store properties that are set by the system.
+	// SystemProperties are used to store properties that are set by the system. Service Bus sets them when a message is
+	// enqueued, so the values of a message being sent are ignored, except for PartitionKey, ViaPartitionKey and
+	// ScheduledEnqueueTime.
 	SystemProperties struct {
 		LockedUntil            *time.Time `mapstructure:"x-opt-locked-until"`
 		SequenceNumber         *int64     `mapstructure:"x-opt-sequence-number"`
@@ -72,14 +139,28 @@ type (
 		ScheduledEnqueueTime   *time.Time `mapstructure:"x-opt-scheduled-enqueue-time"`
 		EnqueuedSequenceNumber *int64     `mapstructure:"x-opt-enqueue-sequence-number"`
 		ViaPartitionKey        *string    `mapstructure:"x-opt-via-partition-key"`
+		// State is the MessageState Service Bus reports for a peeked or received message, if it reports one
+		State *int32 `mapstructure:"x-opt-message-state"`
 	}
 
+	// MessageState tells whether a message in an entity can be received, as reported by Message.State
+	MessageState int32
+
 	mapStructureTag struct {
 		Name         string
 		PersistEmpty bool
 	}
 )
 
+const (
+	// MessageStateActive is the state of a message which can be received
+	MessageStateActive MessageState = 0
+	// MessageStateDeferred is the state of a deferred message, which can only be received by its sequence number
+	MessageStateDeferred MessageState = 1
+	// MessageStateScheduled is the state of a scheduled message, which can be received from its scheduled enqueue time
+	MessageStateScheduled MessageState = 2
+)
+
 // Error Conditions
 const (
 	ErrorInternalError         MessageErrorCondition = "amqp:internal-error"
@@ -94,10 +175,23 @@ const (
 	ErrorPreconditionFailed    MessageErrorCondition = "amqp:precondition-failed"
 	ErrorResourceDeleted       MessageErrorCondition = "amqp:resource-deleted"
 	ErrorIllegalState          MessageErrorCondition = "amqp:illegal-state"
+	ErrorMessageLockLost       MessageErrorCondition = "com.microsoft:message-lock-lost"
+	ErrorSessionLockLost       MessageErrorCondition = "com.microsoft:session-lock-lost"
+	ErrorDeadLetter            MessageErrorCondition = "com.microsoft:dead-letter"
+	ErrorMessageNotFound       MessageErrorCondition = "com.microsoft:message-not-found"
+	ErrorTimeout               MessageErrorCondition = "com.microsoft:timeout"
+	ErrorServerBusy            MessageErrorCondition = "com.microsoft:server-busy"
+	ErrorMessageSizeExceeded   MessageErrorCondition = "amqp:link:message-size-exceeded"
+	ErrorEntityDisabled        MessageErrorCondition = "com.microsoft:entity-disabled"
 )
 
 const (
-	lockTokenName = "x-opt-lock-token"
+	lockTokenName            = "x-opt-lock-token"
+	partitionKeyName         = "x-opt-partition-key"
+	viaPartitionKeyName      = "x-opt-via-partition-key"
+	scheduledEnqueueTimeName = "x-opt-scheduled-enqueue-time"
+	// brokerAnnotationPrefix prefixes the annotations managed by Service Bus, which can't be modified by a disposition
+	brokerAnnotationPrefix = "x-opt-"
 )
 
 // NewMessageFromString builds an Message from a string message
@@ -112,11 +206,93 @@ func NewMessage(data []byte) *Message {
 	}
 }
 
+// NewMessageWithValue builds a Message whose body is sent as an AMQP value, such as a map which a client in another
+// language reads as its native type
+func NewMessageWithValue(value interface{}) *Message {
+	return &Message{
+		Value: value,
+	}
+}
+
+// SequenceNumber returns the unique number Service Bus assigned to the message when it was enqueued, or nil if the
+// message was not received from Service Bus
+func (m *Message) SequenceNumber() *int64 {
+	if m.SystemProperties == nil {
+		return nil
+	}
+	return m.SystemProperties.SequenceNumber
+}
+
+// EnqueuedTime returns when Service Bus enqueued the message, or nil if the message was not received from Service Bus
+func (m *Message) EnqueuedTime() *time.Time {
+	if m.SystemProperties == nil {
+		return nil
+	}
+	return m.SystemProperties.EnqueuedTime
+}
+
+// BodyOmitted returns true if the body of the message was discarded when it was peeked with PeekWithoutBody, so its
+// Data and Value are nil regardless of what was sent
+func (m *Message) BodyOmitted() bool {
+	return m.bodyOmitted
+}
+
+// omitBody discards the body of the message
+func (m *Message) omitBody() {
+	m.Data = nil
+	m.Value = nil
+	if m.message != nil {
+		m.message.Data = nil
+		m.message.Value = nil
+	}
+	m.bodyOmitted = true
+}
+
+// State returns whether the message can be received. When Service Bus does not report the state of a message, a message
+// whose scheduled enqueue time has not passed yet is reported as scheduled, and other messages as active.
+func (m *Message) State() MessageState {
+	if m.SystemProperties == nil {
+		return MessageStateActive
+	}
+	if m.SystemProperties.State != nil {
+		return MessageState(*m.SystemProperties.State)
+	}
+	if scheduled := m.SystemProperties.ScheduledEnqueueTime; scheduled != nil && scheduled.After(time.Now()) {
+		return MessageStateScheduled
+	}
+	return MessageStateActive
+}
+
+// MessageFromContext returns the Message being handled when called with the context passed to a Handler. The Message
+// controls the lock held on it, so code deep within a Handler can renew or settle it without it being threaded through.
+func MessageFromContext(ctx context.Context) (*Message, bool) {
+	msg, ok := ctx.Value(messageContextKey{}).(*Message)
+	return msg, ok
+}
+
+func withMessage(ctx context.Context, msg *Message) context.Context {
+	return context.WithValue(ctx, messageContextKey{}, msg)
+}
+
 // Complete will notify Azure Service Bus that the message was successfully handled and should be deleted from the queue
 func (m *Message) Complete() DispositionAction {
 	return func(ctx context.Context) {
-		span, _ := m.startSpanFromContext(ctx, "sb.Message.Complete")
+		if !m.settle() {
+			return
+		}
+
+		span, ctx := m.startSpanFromContext(ctx, "sb.Message.Complete")
 		defer span.Finish()
+		m.logDisposition("complete")
+
+		if m.receiver != nil {
+			m.receiver.redelivery.settled(m)
+		}
+
+		if m.mgmt != nil {
+			m.mgmt.settle(ctx, m, completedDisposition, nil)
+			return
+		}
 
 		m.message.Accept()
 	}
@@ -125,14 +301,67 @@ func (m *Message) Complete() DispositionAction {
 // Abandon will notify Azure Service Bus the message failed but should be re-queued for delivery.
 func (m *Message) Abandon() DispositionAction {
 	return func(ctx context.Context) {
-		span, _ := m.startSpanFromContext(ctx, "sb.Message.Abandon")
+		if !m.settle() {
+			return
+		}
+
+		span, ctx := m.startSpanFromContext(ctx, "sb.Message.Abandon")
 		defer span.Finish()
+		m.logDisposition("abandon")
+
+		if m.receiver != nil {
+			m.receiver.redelivery.abandoned(m)
+		}
+
+		if m.mgmt != nil {
+			m.mgmt.settle(ctx, m, abandonedDisposition, nil)
+			return
+		}
 
 		m.message.Modify(false, false, nil)
 	}
 }
 
-// TODO: Defer - will move to the "defer" queue and user will need to track the sequence number
+// AbandonWithModifications will notify Azure Service Bus the message failed, like Abandon, and update the properties of
+// the message with props, so the next delivery of the message carries them. The properties are merged into the existing
+// properties of the message. Properties prefixed with "x-opt-" are managed by Service Bus and are not modified.
+func (m *Message) AbandonWithModifications(props map[string]interface{}) DispositionAction {
+	modified := make(map[string]interface{}, len(props))
+	for key, val := range props {
+		if strings.HasPrefix(key, brokerAnnotationPrefix) {
+			continue
+		}
+		modified[key] = val
+	}
+
+	return func(ctx context.Context) {
+		if !m.settle() {
+			return
+		}
+
+		span, ctx := m.startSpanFromContext(ctx, "sb.Message.AbandonWithModifications")
+		defer span.Finish()
+		m.logDisposition("abandon")
+
+		if m.receiver != nil {
+			m.receiver.redelivery.abandoned(m)
+		}
+
+		if m.mgmt != nil {
+			m.mgmt.settle(ctx, m, abandonedDisposition, map[string]interface{}{
+				propertiesToModifyFieldName: modified,
+			})
+			return
+		}
+
+		annotations := make(amqp.Annotations, len(modified))
+		for key, val := range modified {
+			annotations[key] = val
+		}
+		m.message.Modify(false, false, annotations)
+	}
+}
+
 // FailButRetryElsewhere will notify Azure Service Bus the message failed but should be re-queued for deliver to any
 // other link but this one.
 //func (m *Message) FailButRetryElsewhere() DispositionAction {
@@ -157,8 +386,20 @@ func (m *Message) Abandon() DispositionAction {
 // DeadLetter will notify Azure Service Bus the message failed and should not re-queued
 func (m *Message) DeadLetter(err error) DispositionAction {
 	return func(ctx context.Context) {
-		span, _ := m.startSpanFromContext(ctx, "sb.Message.DeadLetter")
+		if !m.settle() {
+			return
+		}
+
+		span, ctx := m.startSpanFromContext(ctx, "sb.Message.DeadLetter")
 		defer span.Finish()
+		m.logDisposition("dead-letter")
+
+		if m.mgmt != nil {
+			m.mgmt.settle(ctx, m, suspendedDisposition, map[string]interface{}{
+				deadLetterDescriptionFieldName: err.Error(),
+			})
+			return
+		}
 
 		amqpErr := amqp.Error{
 			Condition:   amqp.ErrorCondition(ErrorInternalError),
@@ -180,8 +421,21 @@ func (m *Message) DeadLetterWithInfo(err error, condition MessageErrorCondition,
 	}
 
 	return func(ctx context.Context) {
-		span, _ := m.startSpanFromContext(ctx, "sb.Message.DeadLetterWithInfo")
+		if !m.settle() {
+			return
+		}
+
+		span, ctx := m.startSpanFromContext(ctx, "sb.Message.DeadLetterWithInfo")
 		defer span.Finish()
+		m.logDisposition("dead-letter")
+
+		if m.mgmt != nil {
+			m.mgmt.settle(ctx, m, suspendedDisposition, map[string]interface{}{
+				deadLetterReasonFieldName:      string(condition),
+				deadLetterDescriptionFieldName: err.Error(),
+			})
+			return
+		}
 
 		amqpErr := amqp.Error{
 			Condition:   amqp.ErrorCondition(condition),
@@ -192,14 +446,75 @@ func (m *Message) DeadLetterWithInfo(err error, condition MessageErrorCondition,
 	}
 }
 
+// logDisposition reports the disposition of the message to the logger of the namespace it was received from
+func (m *Message) logDisposition(disposition string) {
+	var ns *Namespace
+	var entityPath string
+	switch {
+	case m.mgmt != nil:
+		ns, entityPath = m.mgmt.namespace, m.mgmt.entityPath
+	case m.receiver != nil:
+		ns, entityPath = m.receiver.namespace, m.receiver.entityPath
+	default:
+		return
+	}
+	ns.getLogger().Debug("message settled", "entity", entityPath, "message-id", m.ID, "disposition", disposition)
+}
+
+// settle marks the message as settled, and returns false if it already was. Only the first disposition of a message is
+// sent to Service Bus.
+func (m *Message) settle() bool {
+	return atomic.CompareAndSwapInt32(&m.settled, 0, 1)
+}
+
+// isSettled returns true if a disposition of the message was sent
+func (m *Message) isSettled() bool {
+	return atomic.LoadInt32(&m.settled) == 1
+}
+
+// DeadLetterWithReason will notify Azure Service Bus the message failed and should be moved to the dead letter queue,
+// with its DeadLetterReason and DeadLetterErrorDescription set to reason and description. If description is empty,
+// the message of err is used. DeadLetterWithInfo, which predates it, takes an error condition and arbitrary data
+// instead.
+func (m *Message) DeadLetterWithReason(err error, reason, description string) DispositionAction {
+	if description == "" && err != nil {
+		description = err.Error()
+	}
+
+	return func(ctx context.Context) {
+		if !m.settle() {
+			return
+		}
+
+		span, ctx := m.startSpanFromContext(ctx, "sb.Message.DeadLetterWithReason")
+		defer span.Finish()
+		m.logDisposition("dead-letter")
+
+		if m.mgmt != nil {
+			m.mgmt.settle(ctx, m, suspendedDisposition, map[string]interface{}{
+				deadLetterReasonFieldName:      reason,
+				deadLetterDescriptionFieldName: description,
+			})
+			return
+		}
+
+		amqpErr := amqp.Error{
+			Condition:   amqp.ErrorCondition(ErrorDeadLetter),
+			Description: description,
+			Info: map[string]interface{}{
+				deadLetterReasonName:           reason,
+				deadLetterErrorDescriptionName: description,
+			},
+		}
+		m.message.Reject(&amqpErr)
+	}
+}
+
 // ScheduleAt will ensure Azure Service Bus delivers the message after the time specified
-// (usually within 1 minute after the specified time)
+// (usually within 1 minute after the specified time). It sets the ScheduledEnqueueTime of the message.
 func (m *Message) ScheduleAt(t time.Time) {
-	if m.SystemProperties == nil {
-		m.SystemProperties = new(SystemProperties)
-	}
 	utcTime := t.UTC()
-	m.SystemProperties.ScheduledEnqueueTime = &utcTime
+	m.ScheduledEnqueueTime = &utcTime
 }
 
 // Set implements opentracing.TextMapWriter and sets properties on the event to be propagated to the message broker
@@ -210,11 +525,15 @@ func (m *Message) Set(key, value string) {
 	m.UserProperties[key] = value
 }
 
-// ForeachKey implements the opentracing.TextMapReader and gets properties on the event to be propagated from the message broker
+// ForeachKey implements the opentracing.TextMapReader and gets properties on the event to be propagated from the message broker.
+// Properties which don't hold strings can't carry trace context, so they are skipped.
 func (m *Message) ForeachKey(handler func(key, val string) error) error {
 	for key, value := range m.UserProperties {
-		err := handler(key, value.(string))
-		if err != nil {
+		str, ok := value.(string)
+		if !ok {
+			continue
+		}
+		if err := handler(key, str); err != nil {
 			return err
 		}
 	}
@@ -223,12 +542,15 @@ func (m *Message) ForeachKey(handler func(key, val string) error) error {
 
 func (m *Message) toMsg() (*amqp.Message, error) {
 	amqpMsg := m.message
-	if amqpMsg == nil {
+	if amqpMsg == nil && m.Value != nil {
+		amqpMsg = &amqp.Message{Value: m.Value}
+	} else if amqpMsg == nil {
 		amqpMsg = amqp.NewMessage(m.Data)
 	}
 
-	amqpMsg.Properties = &amqp.MessageProperties{
-		MessageID: m.ID,
+	amqpMsg.Properties = new(amqp.MessageProperties)
+	if m.ID != "" {
+		amqpMsg.Properties.MessageID = m.ID
 	}
 
 	if m.GroupID != nil {
@@ -239,7 +561,9 @@ func (m *Message) toMsg() (*amqp.Message, error) {
 		amqpMsg.Properties.GroupSequence = *m.GroupSequence
 	}
 
-	amqpMsg.Properties.CorrelationID = m.CorrelationID
+	if m.CorrelationID != "" {
+		amqpMsg.Properties.CorrelationID = m.CorrelationID
+	}
 	amqpMsg.Properties.ContentType = m.ContentType
 	amqpMsg.Properties.Subject = m.Label
 	amqpMsg.Properties.To = m.To
@@ -249,16 +573,60 @@ func (m *Message) toMsg() (*amqp.Message, error) {
 	if len(m.UserProperties) > 0 {
 		amqpMsg.ApplicationProperties = make(map[string]interface{})
 		for key, value := range m.UserProperties {
-			amqpMsg.ApplicationProperties[key] = value
+			encoded, err := userPropertyValue(key, value)
+			if err != nil {
+				return nil, err
+			}
+			amqpMsg.ApplicationProperties[key] = encoded
 		}
 	}
 
+	if len(m.Annotations) > 0 {
+		amqpMsg.Annotations = annotationsFromMap(m.Annotations)
+	}
+
 	if m.SystemProperties != nil {
 		sysPropMap, err := encodeStructureToMap(m.SystemProperties)
 		if err != nil {
 			return nil, err
 		}
-		amqpMsg.Annotations = annotationsFromMap(sysPropMap)
+		if len(m.Annotations) == 0 {
+			amqpMsg.Annotations = make(amqp.Annotations)
+		}
+		for key, val := range sysPropMap {
+			amqpMsg.Annotations[key] = val
+		}
+	}
+
+	if m.ScheduledEnqueueTime != nil {
+		if amqpMsg.Annotations == nil {
+			amqpMsg.Annotations = make(amqp.Annotations)
+		}
+		amqpMsg.Annotations[scheduledEnqueueTimeName] = m.ScheduledEnqueueTime.UTC()
+	}
+
+	if m.PartitionKey != nil || m.ViaPartitionKey != nil {
+		if amqpMsg.Annotations == nil {
+			amqpMsg.Annotations = make(amqp.Annotations)
+		}
+		if m.PartitionKey != nil {
+			amqpMsg.Annotations[partitionKeyName] = *m.PartitionKey
+		}
+		if m.ViaPartitionKey != nil {
+			amqpMsg.Annotations[viaPartitionKeyName] = *m.ViaPartitionKey
+		}
+	}
+
+	if m.GroupID != nil && !m.sessionAssigned {
+		// Service Bus places the messages of a session in the partition of the session ID, so an explicit partition key
+		// must agree with it and a missing one is derived from it
+		if pk, ok := amqpMsg.Annotations[partitionKeyName].(string); ok && pk != *m.GroupID {
+			return nil, &partitionKeyMismatchError{partitionKey: pk, sessionID: *m.GroupID}
+		}
+		if amqpMsg.Annotations == nil {
+			amqpMsg.Annotations = make(amqp.Annotations)
+		}
+		amqpMsg.Annotations[partitionKeyName] = *m.GroupID
 	}
 
 	if m.LockToken != nil {
@@ -268,7 +636,7 @@ func (m *Message) toMsg() (*amqp.Message, error) {
 		amqpMsg.DeliveryAnnotations[lockTokenName] = *m.LockToken
 	}
 
-	if m.TTL != nil {
+	if m.TTL != nil && *m.TTL > 0 {
 		if amqpMsg.Header == nil {
 			amqpMsg.Header = new(amqp.MessageHeader)
 		}
@@ -278,6 +646,20 @@ func (m *Message) toMsg() (*amqp.Message, error) {
 	return amqpMsg, nil
 }
 
+// userPropertyValue converts the value of a user property to a type which AMQP encodes in application properties, which
+// only hold simple values
+func userPropertyValue(key string, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, string, bool, []byte, time.Time, amqp.UUID,
+		int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return value, nil
+	case uuid.UUID:
+		return amqp.UUID(v), nil
+	default:
+		return nil, fmt.Errorf("user property %q has unsupported type %T", key, value)
+	}
+}
+
 func annotationsFromMap(m map[string]interface{}) amqp.Annotations {
 	a := make(amqp.Annotations)
 	for key, val := range m {
@@ -287,7 +669,7 @@ func annotationsFromMap(m map[string]interface{}) amqp.Annotations {
 }
 
 func messageFromAMQPMessage(msg *amqp.Message) (*Message, error) {
-	return newMessage(msg.Data[0], msg)
+	return newMessage(msg.GetData(), msg)
 }
 
 func newMessage(data []byte, amqpMsg *amqp.Message) (*Message, error) {
@@ -299,6 +681,7 @@ func newMessage(data []byte, amqpMsg *amqp.Message) (*Message, error) {
 	if amqpMsg == nil {
 		return msg, nil
 	}
+	msg.Value = amqpMsg.Value
 
 	if amqpMsg.Properties != nil {
 		if id, ok := amqpMsg.Properties.MessageID.(string); ok {
@@ -306,36 +689,109 @@ func newMessage(data []byte, amqpMsg *amqp.Message) (*Message, error) {
 		}
 		msg.GroupID = &amqpMsg.Properties.GroupID
 		msg.GroupSequence = &amqpMsg.Properties.GroupSequence
-		if id, ok := amqpMsg.Properties.CorrelationID.(string); ok {
-			msg.CorrelationID = id
-		}
+		msg.CorrelationID = correlationIDString(amqpMsg.Properties.CorrelationID)
 		msg.ContentType = amqpMsg.Properties.ContentType
 		msg.Label = amqpMsg.Properties.Subject
 		msg.To = amqpMsg.Properties.To
 		msg.ReplyTo = amqpMsg.Properties.ReplyTo
 		msg.ReplyToGroupID = amqpMsg.Properties.ReplyToGroupID
+	}
+
+	if len(amqpMsg.ApplicationProperties) > 0 {
+		msg.UserProperties = make(map[string]interface{}, len(amqpMsg.ApplicationProperties))
+		for key, value := range amqpMsg.ApplicationProperties {
+			if id, ok := value.(amqp.UUID); ok {
+				value = uuid.UUID(id)
+			}
+			msg.UserProperties[key] = value
+		}
+	}
+
+	// the header may be omitted when all of its fields have their default values, as on the first delivery
+	msg.DeliveryCount = 1
+	if amqpMsg.Header != nil {
 		msg.DeliveryCount = amqpMsg.Header.DeliveryCount + 1
 		msg.TTL = &amqpMsg.Header.TTL
 	}
 
+	if len(amqpMsg.Annotations) > 0 {
+		msg.Annotations = make(map[string]interface{}, len(amqpMsg.Annotations))
+		for key, value := range amqpMsg.Annotations {
+			// annotation keys are symbols, which are decoded as a string type
+			if k := reflect.ValueOf(key); k.Kind() == reflect.String {
+				msg.Annotations[k.String()] = value
+			}
+		}
+	}
+
 	if amqpMsg.Annotations != nil {
 		if err := mapstructure.Decode(amqpMsg.Annotations, &msg.SystemProperties); err != nil {
 			return msg, err
 		}
 	}
 
-	lockToken, err := lockTokenFromMessageTag(amqpMsg)
-	if err != nil {
-		return msg, err
+	if msg.SystemProperties != nil {
+		msg.PartitionKey = msg.SystemProperties.PartitionKey
+		msg.ViaPartitionKey = msg.SystemProperties.ViaPartitionKey
+	}
+
+	// messages which were not delivered over a link, such as peeked messages, carry no lock token
+	if len(amqpMsg.DeliveryTag) > 0 {
+		lockToken, err := lockTokenFromMessageTag(amqpMsg)
+		if err != nil {
+			return msg, err
+		}
+		msg.LockToken = lockToken
 	}
-	msg.LockToken = lockToken
 
 	return msg, nil
 }
 
+// correlationIDString returns the string form of a correlation-id, which AMQP allows to be a string, a UUID, an unsigned
+// integer or binary
+func correlationIDString(id interface{}) string {
+	switch id := id.(type) {
+	case string:
+		return id
+	case amqp.UUID:
+		return uuid.UUID(id).String()
+	case uint64:
+		return strconv.FormatUint(id, 10)
+	case []byte:
+		return string(id)
+	default:
+		return ""
+	}
+}
+
+// lockTokenFromMessageTag extracts the lock token of a message received over a link. Service Bus may annotate the
+// message with the lock token, which is an AMQP UUID in RFC 4122 byte order. Otherwise the lock token is the delivery
+// tag, which is a GUID serialized in the .NET byte order.
 func lockTokenFromMessageTag(msg *amqp.Message) (*uuid.UUID, error) {
-	if len(msg.DeliveryTag) != 16 {
-		return nil, fmt.Errorf("the message contained an invalid delivery tag: %v", msg.DeliveryTag)
+	if annotated, ok := msg.DeliveryAnnotations[lockTokenName]; ok && annotated != nil {
+		return lockTokenFromAnnotation(annotated)
+	}
+	return lockTokenFromDotNetGUID(msg.DeliveryTag)
+}
+
+func lockTokenFromAnnotation(annotated interface{}) (*uuid.UUID, error) {
+	var lockToken uuid.UUID
+	switch token := annotated.(type) {
+	case amqp.UUID:
+		lockToken = uuid.UUID(token)
+	case uuid.UUID:
+		lockToken = token
+	case [16]byte:
+		lockToken = uuid.UUID(token)
+	default:
+		return nil, fmt.Errorf("the message lock token annotation has unsupported type %T", annotated)
+	}
+	return validLockToken(lockToken)
+}
+
+func lockTokenFromDotNetGUID(tag []byte) (*uuid.UUID, error) {
+	if len(tag) != 16 {
+		return nil, fmt.Errorf("the message delivery tag must be a 16 byte lock token, but was %d bytes: %x", len(tag), tag)
 	}
 
 	var swapIndex = func(indexOne, indexTwo int, array *[16]byte) {
@@ -346,15 +802,20 @@ func lockTokenFromMessageTag(msg *amqp.Message) (*uuid.UUID, error) {
 
 	// Get lock token from the deliveryTag
 	var lockTokenBytes [16]byte
-	copy(lockTokenBytes[:], msg.DeliveryTag[:16])
+	copy(lockTokenBytes[:], tag)
 	// translate from .net guid byte serialisation format to amqp rfc standard
 	swapIndex(0, 3, &lockTokenBytes)
 	swapIndex(1, 2, &lockTokenBytes)
 	swapIndex(4, 5, &lockTokenBytes)
 	swapIndex(6, 7, &lockTokenBytes)
-	amqpUUID := uuid.UUID(lockTokenBytes)
+	return validLockToken(uuid.UUID(lockTokenBytes))
+}
 
-	return &amqpUUID, nil
+func validLockToken(lockToken uuid.UUID) (*uuid.UUID, error) {
+	if lockToken == (uuid.UUID{}) {
+		return nil, errors.New("the message lock token is empty")
+	}
+	return &lockToken, nil
 }
 
 func encodeStructureToMap(structPointer interface{}) (map[string]interface{}, error) {
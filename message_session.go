@@ -1,12 +1,17 @@
 package servicebus
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"sync"
 	"time"
 
+	"github.com/Azure/azure-amqp-common-go/log"
 	"github.com/Azure/azure-amqp-common-go/rpc"
 	"pack.ag/amqp"
 )
@@ -20,15 +25,44 @@ type MessageSession struct {
 	lockExpiration time.Time
 	done           chan struct{}
 	cancel         sync.Once
+	stateMu        sync.Mutex
+	stateETag      *string
+	stateVersion   uint64
+	// activityMu guards lastActivity, when the session was locked or the last handler returned, handling, the number
+	// of messages being handled, and inFlight, those messages
+	activityMu   sync.Mutex
+	lastActivity time.Time
+	handling     int
+	inFlight     map[*Message]struct{}
+}
+
+type messageSessionContextKey struct{}
+
+// MessageSessionFromContext returns the MessageSession being processed when called with the context passed to the
+// Handler of a SessionHandler. It allows code deep within a Handler to renew the session lock or update the session
+// state without the MessageSession being threaded through.
+func MessageSessionFromContext(ctx context.Context) (*MessageSession, bool) {
+	ms, ok := ctx.Value(messageSessionContextKey{}).(*MessageSession)
+	return ms, ok
+}
+
+func withMessageSession(ctx context.Context, ms *MessageSession) context.Context {
+	return context.WithValue(ctx, messageSessionContextKey{}, ms)
 }
 
 func newMessageSession(r *receiver, e *entity, sessionID *string) (retval *MessageSession, _ error) {
+	if r != nil {
+		// the receiver may have received another session, whose lock the messages of this one don't share
+		r.renewedSessionLock(time.Time{})
+	}
+
 	retval = &MessageSession{
 		receiver:       r,
 		entity:         e,
 		sessionID:      sessionID,
 		lockExpiration: time.Now(),
 		done:           make(chan struct{}),
+		lastActivity:   time.Now(),
 	}
 
 	return
@@ -38,6 +72,8 @@ func newMessageSession(r *receiver, e *entity, sessionID *string) (retval *Messa
 // - A Handler recognizes that no further messages will come to this session.
 // - A Handler has given up on receiving more messages before a session. Future messages should be delegated to the next
 //   available session client.
+// Once the handlers of the messages in flight have returned, the link receiving the session is closed, which releases
+// the lock on the session.
 func (ms *MessageSession) Close() {
 	ms.cancel.Do(func() {
 		close(ms.done)
@@ -52,6 +88,13 @@ func (ms *MessageSession) LockedUntil() time.Time {
 	return ms.lockExpiration
 }
 
+// LockExpiresIn returns the time remaining until the Session lock held by this receiver expires, as measured by the local
+// clock. The expiration reported by Service Bus is compensated for the skew of the local clock, so the result can be
+// used to schedule renewal of the lock.
+func (ms *MessageSession) LockExpiresIn() time.Duration {
+	return time.Until(ms.entity.namespace.toLocalTime(ms.LockedUntil()))
+}
+
 // RenewLock requests that the Service Bus Server renews this client's lock on an existing Session.
 func (ms *MessageSession) RenewLock(ctx context.Context) error {
 	ms.mu.Lock()
@@ -77,12 +120,16 @@ func (ms *MessageSession) RenewLock(ctx context.Context) error {
 
 	resp, err := link.RetryableRPC(ctx, 5, 5*time.Second, msg)
 	if err != nil {
+		if isLockLostError(err) {
+			return ErrSessionLockLost
+		}
 		return err
 	}
 
 	if rawMessageValue, ok := resp.Message.Value.(map[string]interface{}); ok {
 		if rawExpiration, ok := rawMessageValue["expiration"]; ok {
 			if ms.lockExpiration, ok = rawExpiration.(time.Time); ok {
+				ms.refreshMessageLocks(ms.lockExpiration)
 				return nil
 			}
 			return errors.New("\"expiration\" not of expected type time.Time")
@@ -93,8 +140,241 @@ func (ms *MessageSession) RenewLock(ctx context.Context) error {
 	return errors.New("value not of expected type map[string]interface{}")
 }
 
+// renewLockWhileOpen renews the lock on the session in the background until the returned stop func is called, the
+// session is closed or ctx is done. The lock is renewed when half of the time left on it has elapsed. Stop waits for the
+// renewal to finish.
+func (ms *MessageSession) renewLockWhileOpen(ctx context.Context) (stop func()) {
+	if !ms.receiver.sessionLockRenewal {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			timer := time.NewTimer(ms.nextLockRenewal())
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-ms.done:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			if err := ms.RenewLock(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.For(ctx).Error(err)
+				if errors.Is(err, ErrSessionLockLost) {
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// nextLockRenewal returns how long to wait before renewing the lock on the session, which is half the time left on the
+// lock. Until the lock was first renewed, its expiration is unknown and it is renewed after minAutoRenewalInterval.
+func (ms *MessageSession) nextLockRenewal() time.Duration {
+	next := ms.LockExpiresIn() / 2
+	if next < minAutoRenewalInterval {
+		return minAutoRenewalInterval
+	}
+	return next
+}
+
+// trackActivity wraps handler so the time since the last message was handled is known to closeWhenIdle, and the
+// messages being handled are known to refreshMessageLocks
+func (ms *MessageSession) trackActivity(handler Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+		ms.activityMu.Lock()
+		ms.handling++
+		if ms.inFlight == nil {
+			ms.inFlight = make(map[*Message]struct{})
+		}
+		ms.inFlight[msg] = struct{}{}
+		ms.activityMu.Unlock()
+
+		defer func() {
+			ms.activityMu.Lock()
+			ms.handling--
+			delete(ms.inFlight, msg)
+			ms.lastActivity = time.Now()
+			ms.activityMu.Unlock()
+		}()
+		return handler.Handle(ctx, msg)
+	})
+}
+
+// refreshMessageLocks sets the LockedUntil of the messages being handled to the new expiration of the lock on the
+// session, which their locks share, and records it for the messages the receiver has yet to dispatch
+func (ms *MessageSession) refreshMessageLocks(lockedUntil time.Time) {
+	ms.receiver.renewedSessionLock(lockedUntil)
+
+	ms.activityMu.Lock()
+	defer ms.activityMu.Unlock()
+
+	for msg := range ms.inFlight {
+		if msg.SystemProperties == nil {
+			continue
+		}
+		expiration := lockedUntil
+		msg.SystemProperties.LockedUntil = &expiration
+	}
+}
+
+// idleFor returns how long it has been since the session was locked or the last handler returned, which is zero while a
+// message is being handled
+func (ms *MessageSession) idleFor() time.Duration {
+	ms.activityMu.Lock()
+	defer ms.activityMu.Unlock()
+
+	if ms.handling > 0 {
+		return 0
+	}
+	return time.Since(ms.lastActivity)
+}
+
+// closeWhenIdle closes the session in the background once it was idle for the receiver's session idle timeout, until
+// the returned stop func is called, the session is closed or ctx is done. Stop waits for the watch to finish.
+func (ms *MessageSession) closeWhenIdle(ctx context.Context) (stop func()) {
+	timeout := ms.receiver.sessionIdleTimeout
+	if timeout <= 0 {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			idle := ms.idleFor()
+			if idle >= timeout {
+				ms.Close()
+				return
+			}
+
+			timer := time.NewTimer(timeout - idle)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-ms.done:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// RenewLockWithRetry renews the lock on the session, retrying transient failures as allowed by policy within the
+// deadline of ctx. It stops retrying if the lock was lost.
+func (ms *MessageSession) RenewLockWithRetry(ctx context.Context, policy RetryPolicy) error {
+	return policy.do(ctx, ms.RenewLock, isLockLostError)
+}
+
 // SetState updates the current State associated with this Session.
 func (ms *MessageSession) SetState(ctx context.Context, state []byte) error {
+	ms.stateMu.Lock()
+	defer ms.stateMu.Unlock()
+
+	if ms.entity.versionedSessionState && ms.stateETag == nil {
+		// the counter must continue from the stored state, which has not been read yet
+		raw, err := ms.readRawState(ctx)
+		if err != nil {
+			return err
+		}
+		ms.stateVersion, _ = decodeVersionedState(raw)
+	}
+
+	return ms.writeState(ctx, ms.stateVersion+1, state)
+}
+
+// SetStateIfUnchanged updates the current State associated with this Session only if it has not changed since it was
+// last read with State. If another receiver has updated the State in the meantime, ErrSessionStateConflict is returned
+// and the State is left untouched; the caller should read the State again and reapply its changes.
+//
+// Service Bus does not provide an ETag for session state, so the check is performed by comparing the stored State to the
+// one last read by this MessageSession. When the entity was configured with versioned session state, a version counter
+// embedded in the stored State is compared instead, which also detects updates that wrote identical State.
+func (ms *MessageSession) SetStateIfUnchanged(ctx context.Context, state []byte) error {
+	ms.stateMu.Lock()
+	defer ms.stateMu.Unlock()
+
+	if ms.stateETag == nil {
+		return errors.New("the session state must be read with State before it can be conditionally updated")
+	}
+
+	raw, err := ms.readRawState(ctx)
+	if err != nil {
+		return err
+	}
+
+	version, current := ms.decodeState(raw)
+	if etag := sessionStateETag(version, current, ms.entity.versionedSessionState); etag != *ms.stateETag {
+		return ErrSessionStateConflict
+	}
+
+	return ms.writeState(ctx, version+1, state)
+}
+
+// State retrieves the current State associated with this Session.
+// https://docs.microsoft.com/en-us/azure/service-bus-messaging/service-bus-amqp-request-response#get-session-state
+func (ms *MessageSession) State(ctx context.Context) ([]byte, error) {
+	ms.stateMu.Lock()
+	defer ms.stateMu.Unlock()
+
+	raw, err := ms.readRawState(ctx)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	version, state := ms.decodeState(raw)
+	etag := sessionStateETag(version, state, ms.entity.versionedSessionState)
+	ms.stateETag = &etag
+	ms.stateVersion = version
+	return state, nil
+}
+
+func (ms *MessageSession) writeState(ctx context.Context, version uint64, state []byte) error {
+	raw := state
+	if ms.entity.versionedSessionState {
+		raw = encodeVersionedState(version, state)
+	}
+
+	if err := ms.writeRawState(ctx, raw); err != nil {
+		return err
+	}
+
+	etag := sessionStateETag(version, state, ms.entity.versionedSessionState)
+	ms.stateETag = &etag
+	ms.stateVersion = version
+	return nil
+}
+
+func (ms *MessageSession) decodeState(raw []byte) (uint64, []byte) {
+	if !ms.entity.versionedSessionState {
+		return 0, raw
+	}
+	return decodeVersionedState(raw)
+}
+
+func (ms *MessageSession) writeRawState(ctx context.Context, state []byte) error {
 	link, err := rpc.NewLinkWithSession(ms.receiver.connection, ms.receiver.session.Session, ms.entity.ManagementPath())
 	if err != nil {
 		return err
@@ -125,9 +405,7 @@ func (ms *MessageSession) SetState(ctx context.Context, state []byte) error {
 	return nil
 }
 
-// State retrieves the current State associated with this Session.
-// https://docs.microsoft.com/en-us/azure/service-bus-messaging/service-bus-amqp-request-response#get-session-state
-func (ms *MessageSession) State(ctx context.Context) ([]byte, error) {
+func (ms *MessageSession) readRawState(ctx context.Context) ([]byte, error) {
 	link, err := rpc.NewLinkWithSession(ms.receiver.connection, ms.receiver.session.Session, ms.entity.ManagementPath())
 	if err != nil {
 		return []byte{}, err
@@ -167,3 +445,34 @@ func (ms *MessageSession) State(ctx context.Context) ([]byte, error) {
 func (ms *MessageSession) SessionID() *string {
 	return ms.sessionID
 }
+
+// versionedStateHeader prefixes session state written with an embedded version counter
+var versionedStateHeader = []byte("sbv1")
+
+// encodeVersionedState prefixes state with a header and the big endian version counter
+func encodeVersionedState(version uint64, state []byte) []byte {
+	raw := make([]byte, len(versionedStateHeader)+8+len(state))
+	n := copy(raw, versionedStateHeader)
+	binary.BigEndian.PutUint64(raw[n:], version)
+	copy(raw[n+8:], state)
+	return raw
+}
+
+// decodeVersionedState splits raw session state into the embedded version counter and the state. State that was not
+// written with a version counter is reported as version 0.
+func decodeVersionedState(raw []byte) (uint64, []byte) {
+	headerLen := len(versionedStateHeader)
+	if len(raw) < headerLen+8 || !bytes.Equal(raw[:headerLen], versionedStateHeader) {
+		return 0, raw
+	}
+	return binary.BigEndian.Uint64(raw[headerLen:]), raw[headerLen+8:]
+}
+
+// sessionStateETag derives the value used to detect concurrent changes to session state
+func sessionStateETag(version uint64, state []byte, versioned bool) string {
+	if versioned {
+		return fmt.Sprintf("v%d", version)
+	}
+	sum := sha256.Sum256(state)
+	return hex.EncodeToString(sum[:])
+}
@@ -15,6 +15,7 @@ func (suite *serviceBusSuite) TestMessageSession() {
 		"TestStateRoundTrip": testStateRoundTrip,
 		"TestEmptyState":     testEmptyLock,
 		"TestRenewLock":      testRenewLock,
+		"TestStateConflict":  testStateConflict,
 	}
 
 	ns := suite.getNewSasInstance()
@@ -84,6 +85,21 @@ func testStateRoundTrip(ctx context.Context, t *testing.T, ms *MessageSession) {
 	}
 }
 
+func testStateConflict(ctx context.Context, t *testing.T, ms *MessageSession) {
+	_, err := ms.State(ctx)
+	require.NoError(t, err)
+
+	other, err := newMessageSession(ms.receiver, ms.entity, ms.SessionID())
+	require.NoError(t, err)
+	require.NoError(t, other.SetState(ctx, []byte("written elsewhere")))
+
+	assert.Equal(t, ErrSessionStateConflict, ms.SetStateIfUnchanged(ctx, []byte("lost update")))
+
+	_, err = ms.State(ctx)
+	require.NoError(t, err)
+	assert.NoError(t, ms.SetStateIfUnchanged(ctx, []byte("applied update")))
+}
+
 func testRenewLock(ctx context.Context, t *testing.T, ms *MessageSession) {
 	original := ms.LockedUntil()
 	require.NoError(t, ms.RenewLock(ctx))
@@ -110,3 +126,123 @@ func testEmptyLock(ctx context.Context, t *testing.T, ms *MessageSession) {
 	require.NoError(t, err)
 	assert.Nil(t, currentState)
 }
+
+func (suite *serviceBusSuite) TestVersionedSessionStateEncoding() {
+	raw := encodeVersionedState(42, []byte("state"))
+	version, state := decodeVersionedState(raw)
+	suite.Equal(uint64(42), version)
+	suite.Equal([]byte("state"), state)
+
+	version, state = decodeVersionedState([]byte("unversioned state"))
+	suite.Equal(uint64(0), version)
+	suite.Equal([]byte("unversioned state"), state)
+
+	version, state = decodeVersionedState(nil)
+	suite.Equal(uint64(0), version)
+	suite.Nil(state)
+
+	suite.Equal(sessionStateETag(1, []byte("a"), false), sessionStateETag(2, []byte("a"), false))
+	suite.NotEqual(sessionStateETag(1, []byte("a"), false), sessionStateETag(1, []byte("b"), false))
+	suite.NotEqual(sessionStateETag(1, []byte("a"), true), sessionStateETag(2, []byte("a"), true))
+}
+
+func (suite *serviceBusSuite) TestSessionLockRenewal() {
+	ns := &Namespace{}
+	r := &receiver{namespace: ns}
+	ms, err := newMessageSession(r, &entity{namespace: ns}, nil)
+	suite.Require().NoError(err)
+
+	suite.Equal(minAutoRenewalInterval, ms.nextLockRenewal(), "a lock whose expiration is unknown should be renewed soon")
+	ms.lockExpiration = time.Now().Add(time.Minute)
+	suite.InDelta(float64(30*time.Second), float64(ms.nextLockRenewal()), float64(time.Second))
+
+	// without WithSessionLockRenewal, nothing is renewed
+	ms.renewLockWhileOpen(context.Background())()
+
+	suite.Require().NoError(WithSessionLockRenewal()(r))
+	stop := ms.renewLockWhileOpen(context.Background())
+	ms.Close()
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		suite.Fail("renewal should stop once the session is closed")
+	}
+}
+
+func (suite *serviceBusSuite) TestSessionLockRenewalRefreshesMessageLocks() {
+	ns := &Namespace{}
+	r := &receiver{namespace: ns}
+	ms, err := newMessageSession(r, &entity{namespace: ns}, nil)
+	suite.Require().NoError(err)
+
+	delivered := time.Now().Add(-time.Second)
+	prefetched := &Message{receiver: r, SystemProperties: &SystemProperties{LockedUntil: &delivered}}
+	handled := &Message{receiver: r, SystemProperties: &SystemProperties{LockedUntil: &delivered}}
+	suite.True(prefetched.LockExpired())
+
+	renewed := time.Now().Add(time.Minute)
+	handling := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	handler := ms.trackActivity(HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+		close(handling)
+		<-release
+		return nil
+	}))
+	go func() {
+		handler.Handle(context.Background(), handled)
+		close(done)
+	}()
+	<-handling
+	ms.refreshMessageLocks(renewed)
+	close(release)
+	<-done
+
+	suite.True(renewed.Equal(*handled.SystemProperties.LockedUntil), "the lock of a message being handled should be refreshed")
+	suite.False(prefetched.LockExpired(), "the lock of a prefetched message should be extended by the session lock")
+
+	_, err = newMessageSession(r, &entity{namespace: ns}, nil)
+	suite.Require().NoError(err)
+	suite.True(prefetched.LockExpired(), "the lock of another session should not extend the messages of the next one")
+}
+
+func (suite *serviceBusSuite) TestSessionIdleTimeout() {
+	ns := &Namespace{}
+	r := &receiver{namespace: ns}
+	suite.Error(WithSessionIdleTimeout(0)(r))
+	suite.Require().NoError(WithSessionIdleTimeout(50 * time.Millisecond)(r))
+	ms, err := newMessageSession(r, &entity{namespace: ns}, nil)
+	suite.Require().NoError(err)
+
+	handling := make(chan struct{})
+	release := make(chan struct{})
+	handler := ms.trackActivity(HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+		close(handling)
+		<-release
+		return nil
+	}))
+
+	stop := ms.closeWhenIdle(context.Background())
+	defer stop()
+	go handler.Handle(context.Background(), &Message{})
+	<-handling
+
+	select {
+	case <-ms.done:
+		suite.Fail("the session should not be closed while a message is handled")
+	case <-time.After(150 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-ms.done:
+		suite.True(ms.idleFor() >= 50*time.Millisecond)
+	case <-time.After(time.Second):
+		suite.Fail("the session should be closed once it was idle for the timeout")
+	}
+}
@@ -1,11 +1,15 @@
 package servicebus
 
 import (
+	"context"
+	"errors"
+	"testing"
 	"time"
 
 	"github.com/Azure/azure-amqp-common-go/uuid"
 	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/mitchellh/mapstructure"
+	"github.com/stretchr/testify/assert"
 	"pack.ag/amqp"
 )
 
@@ -68,7 +72,7 @@ func (suite *serviceBusSuite) TestMessageToAMQPMessage() {
 			LockedUntil:            &until,
 			SequenceNumber:         to.Int64Ptr(1),
 			PartitionID:            &pID,
-			PartitionKey:           to.StringPtr("key"),
+			PartitionKey:           to.StringPtr("12"),
 			EnqueuedTime:           &until,
 			DeadLetterSource:       to.StringPtr("deadLetterSource"),
 			ScheduledEnqueueTime:   &until,
@@ -104,6 +108,68 @@ func (suite *serviceBusSuite) TestMessageToAMQPMessage() {
 	}
 }
 
+func (suite *serviceBusSuite) TestMessageScheduledEnqueueTimeIsUTC() {
+	local := time.Date(2018, 6, 1, 12, 0, 0, 0, time.FixedZone("UTC+2", 2*60*60))
+	msg := NewMessageFromString("foo")
+	msg.ScheduledEnqueueTime = &local
+
+	aMsg, err := msg.toMsg()
+	suite.Require().NoError(err)
+	scheduled, ok := aMsg.Annotations[scheduledEnqueueTimeName].(time.Time)
+	suite.Require().True(ok)
+	suite.Equal(time.UTC, scheduled.Location())
+	suite.True(local.Equal(scheduled))
+
+	earlier := local.Add(-time.Hour)
+	msg = NewMessageFromString("foo")
+	msg.SystemProperties = &SystemProperties{ScheduledEnqueueTime: &earlier}
+	msg.ScheduleAt(local)
+	suite.True(local.Equal(*msg.ScheduledEnqueueTime))
+	suite.True(earlier.Equal(*msg.SystemProperties.ScheduledEnqueueTime), "ScheduleAt should only set ScheduledEnqueueTime")
+
+	aMsg, err = msg.toMsg()
+	suite.Require().NoError(err)
+	suite.True(local.Equal(aMsg.Annotations[scheduledEnqueueTimeName].(time.Time)), "ScheduledEnqueueTime should be sent")
+}
+
+func (suite *serviceBusSuite) TestMessagePartitionKeys() {
+	msg := NewMessageFromString("foo")
+	msg.PartitionKey = to.StringPtr("pk")
+	msg.ViaPartitionKey = to.StringPtr("via")
+	aMsg, err := msg.toMsg()
+	suite.Require().NoError(err)
+	suite.Equal("pk", aMsg.Annotations[partitionKeyName])
+	suite.Equal("via", aMsg.Annotations[viaPartitionKeyName])
+	suite.Nil(msg.SequenceNumber())
+	suite.Nil(msg.EnqueuedTime())
+
+	msg.GroupID = to.StringPtr("session")
+	_, err = msg.toMsg()
+	suite.True(errors.Is(err, ErrPartitionKeyMismatch), "the partition key must agree with the session ID")
+
+	msg.PartitionKey = to.StringPtr("session")
+	_, err = msg.toMsg()
+	suite.NoError(err)
+}
+
+func (suite *serviceBusSuite) TestMessagePartitionKeyFromSession() {
+	msg := NewMessageFromString("foo")
+	aMsg, err := msg.toMsg()
+	if suite.NoError(err) {
+		suite.Nil(aMsg.Annotations[partitionKeyName], "no partition key without a session")
+	}
+
+	msg.GroupID = to.StringPtr("session")
+	aMsg, err = msg.toMsg()
+	if suite.NoError(err) {
+		suite.Equal("session", aMsg.Annotations[partitionKeyName])
+	}
+
+	msg.SystemProperties = &SystemProperties{PartitionKey: to.StringPtr("other")}
+	_, err = msg.toMsg()
+	suite.EqualError(err, `the partition key "other" of the message must be equal to its session ID "session"`)
+}
+
 var (
 	// ServiceBus encoded the lock token in .Net's serialisation format but requries it to submitted in
 	// amqps (RFC 4122) format. These are both the same GUID encoded in both formats and are used to
@@ -167,6 +233,11 @@ func (suite *serviceBusSuite) TestAMQPMessageToMessage() {
 		suite.Equal(msg.To, aMsg.Properties.To, "to")
 		suite.Equal(msg.Data, aMsg.Data[0], "data")
 		suite.Equal(*msg.LockToken, uuid.UUID(amqpEncodedLockTokenGUID), "locktoken")
+		suite.Equal("key", *msg.PartitionKey, "partitionKey")
+		suite.Equal("via", *msg.ViaPartitionKey, "viaPartitionKey")
+		suite.Equal(int64(1), *msg.SequenceNumber(), "sequenceNumber")
+		suite.Equal("foo", msg.UserProperties["test"], "userProperties")
+		suite.Equal(until, *msg.EnqueuedTime(), "enqueuedTime")
 
 		sysPropMap, err := encodeStructureToMap(msg.SystemProperties)
 		if suite.NoError(err) {
@@ -177,3 +248,378 @@ func (suite *serviceBusSuite) TestAMQPMessageToMessage() {
 
 	}
 }
+
+func (suite *serviceBusSuite) TestMessageCodecs() {
+	type order struct {
+		ID    string
+		Count int
+	}
+
+	msg, err := NewMessageWithCodec(order{ID: "abc", Count: 2}, JSONCodec{})
+	suite.Require().NoError(err)
+	suite.Equal("application/json", msg.ContentType)
+
+	var decoded order
+	suite.Require().NoError(msg.Unmarshal(&decoded, nil))
+	suite.Equal(order{ID: "abc", Count: 2}, decoded)
+
+	msg, err = NewMessageWithCodec("hello", RawCodec{})
+	suite.Require().NoError(err)
+	suite.Equal("application/octet-stream", msg.ContentType)
+	var body string
+	suite.Require().NoError(msg.Unmarshal(&body, JSONCodec{}), "the codec registered for the content type should be used")
+	suite.Equal("hello", body)
+
+	_, err = NewMessageWithCodec(42, RawCodec{})
+	suite.Error(err)
+
+	msg = NewMessageFromString(`{"ID":"def"}`)
+	suite.Error(msg.Unmarshal(&decoded, nil), "a message without a content type needs a codec")
+	suite.Require().NoError(msg.Unmarshal(&decoded, JSONCodec{}))
+	suite.Equal("def", decoded.ID)
+}
+
+func (suite *serviceBusSuite) TestMessageFromJSON() {
+	msg, err := NewMessageFromJSON(map[string]int{"count": 3})
+	suite.Require().NoError(err)
+	suite.Equal("application/json", msg.ContentType)
+	suite.Equal(`{"count":3}`, string(msg.Data))
+
+	amqpMsg, err := msg.toMsg()
+	suite.Require().NoError(err)
+	received, err := messageFromAMQPMessage(amqpMsg)
+	suite.Require().NoError(err)
+	var decoded map[string]int
+	suite.Require().NoError(received.DecodeJSON(&decoded))
+	suite.Equal(3, decoded["count"])
+
+	received.ContentType = "application/json; charset=utf-8"
+	suite.NoError(received.DecodeJSON(&decoded))
+	received.ContentType = "text/plain"
+	suite.Error(received.DecodeJSON(&decoded))
+}
+
+func (suite *serviceBusSuite) TestMessageUserProperties() {
+	id, err := uuid.NewV4()
+	suite.Require().NoError(err)
+	now := time.Now().UTC()
+
+	msg := NewMessageFromString("foo")
+	msg.UserProperties = map[string]interface{}{
+		"region":   "west",
+		"priority": int64(3),
+		"ratio":    0.5,
+		"urgent":   true,
+		"raw":      []byte{1, 2},
+		"at":       now,
+		"id":       id,
+	}
+	aMsg, err := msg.toMsg()
+	suite.Require().NoError(err)
+	suite.Equal(amqp.UUID(id), aMsg.ApplicationProperties["id"])
+
+	received, err := messageFromAMQPMessage(aMsg)
+	suite.Require().NoError(err)
+	suite.Equal(msg.UserProperties, received.UserProperties)
+
+	msg.UserProperties = map[string]interface{}{"nested": map[string]string{"a": "b"}}
+	_, err = msg.toMsg()
+	suite.EqualError(err, `user property "nested" has unsupported type map[string]string`)
+}
+
+func (suite *serviceBusSuite) TestMessageAnnotations() {
+	partitionKey := "pk"
+	msg := NewMessageFromString("foo")
+	msg.PartitionKey = &partitionKey
+	msg.Annotations = map[string]interface{}{
+		"x-opt-custom":   "value",
+		partitionKeyName: "ignored",
+	}
+	aMsg, err := msg.toMsg()
+	suite.Require().NoError(err)
+	suite.Equal("value", aMsg.Annotations["x-opt-custom"])
+	suite.Equal(partitionKey, aMsg.Annotations[partitionKeyName], "the struct field should take precedence")
+
+	aMsg.Annotations["x-opt-enqueue-sequence-number"] = int64(42)
+	received, err := messageFromAMQPMessage(aMsg)
+	suite.Require().NoError(err)
+	suite.Equal("value", received.Annotations["x-opt-custom"])
+	suite.Equal(int64(42), received.Annotations["x-opt-enqueue-sequence-number"])
+	if suite.NotNil(received.SystemProperties.EnqueuedSequenceNumber) {
+		suite.Equal(int64(42), *received.SystemProperties.EnqueuedSequenceNumber)
+	}
+}
+
+func (suite *serviceBusSuite) TestMessageValueBody() {
+	value := map[string]interface{}{"order": int32(7)}
+	aMsg, err := NewMessageWithValue(value).toMsg()
+	suite.Require().NoError(err)
+	suite.Equal(value, aMsg.Value)
+	suite.Empty(aMsg.Data)
+
+	aMsg, err = NewMessageFromString("foo").toMsg()
+	suite.Require().NoError(err)
+	suite.Nil(aMsg.Value)
+	suite.Equal([][]byte{[]byte("foo")}, aMsg.Data)
+
+	received, err := messageFromAMQPMessage(&amqp.Message{Value: value})
+	suite.Require().NoError(err)
+	suite.Equal(value, received.Value)
+	suite.Empty(received.Data)
+}
+
+func (suite *serviceBusSuite) TestMessageCorrelation() {
+	request := NewMessageFromString("ping")
+	request.ID = "request-1"
+	request.ReplyTo = "replies"
+	request.ReplyToGroupID = "session-1"
+	aMsg, err := request.toMsg()
+	suite.Require().NoError(err)
+	suite.Equal("replies", aMsg.Properties.ReplyTo)
+	suite.Equal("session-1", aMsg.Properties.ReplyToGroupID)
+	suite.Nil(aMsg.Properties.CorrelationID, "an empty correlation ID should not be sent")
+
+	reply := NewMessageFromString("pong")
+	reply.CorrelationID = request.ID
+	aMsg, err = reply.toMsg()
+	suite.Require().NoError(err)
+	received, err := messageFromAMQPMessage(aMsg)
+	suite.Require().NoError(err)
+	suite.Equal(request.ID, received.CorrelationID)
+
+	id := amqp.UUID{0x6b, 0xa7, 0xb8, 0x10, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}
+	received, err = messageFromAMQPMessage(&amqp.Message{Properties: &amqp.MessageProperties{CorrelationID: id}})
+	suite.Require().NoError(err)
+	suite.Equal("6ba7b810-9dad-11d1-80b4-00c04fd430c8", received.CorrelationID)
+
+	received, err = messageFromAMQPMessage(&amqp.Message{Properties: &amqp.MessageProperties{CorrelationID: uint64(42)}})
+	suite.Require().NoError(err)
+	suite.Equal("42", received.CorrelationID)
+}
+
+func (suite *serviceBusSuite) TestForwardedMessage() {
+	ttl := time.Hour
+	received, err := messageFromAMQPMessage(&amqp.Message{
+		Data: [][]byte{[]byte("order")},
+		Properties: &amqp.MessageProperties{
+			MessageID:     "id-1",
+			ContentType:   "application/json",
+			Subject:       "created",
+			CorrelationID: "request-1",
+		},
+		Header:                &amqp.MessageHeader{TTL: ttl},
+		ApplicationProperties: map[string]interface{}{"tenant": "contoso"},
+		Annotations:           map[interface{}]interface{}{"x-opt-sequence-number": int64(42)},
+	})
+	suite.Require().NoError(err)
+
+	forwarded := forwardedMessage(received)
+	suite.Equal([]byte("order"), forwarded.Data)
+	suite.Equal("id-1", forwarded.ID)
+	suite.Equal("application/json", forwarded.ContentType)
+	suite.Equal("created", forwarded.Label)
+	suite.Equal("request-1", forwarded.CorrelationID)
+	suite.Equal(ttl, *forwarded.TTL)
+	suite.Equal("contoso", forwarded.UserProperties["tenant"])
+	suite.Nil(forwarded.Annotations, "annotations describe the message in the entity it was received from")
+	suite.Nil(forwarded.SystemProperties)
+
+	forwarded.UserProperties["tenant"] = "fabrikam"
+	suite.Equal("contoso", received.UserProperties["tenant"], "the properties of the received message should not be changed")
+
+	_, err = ForwardMessages(context.Background(), nil, nil, 1)
+	suite.Error(err)
+
+	f := new(forwarder)
+	suite.Require().NoError(ForwardWithMessageID()(f))
+	suite.True(f.keepMessageID)
+}
+
+func (suite *serviceBusSuite) TestMessageOmitBody() {
+	msg, err := messageFromAMQPMessage(&amqp.Message{Data: [][]byte{[]byte("large")}, ApplicationProperties: map[string]interface{}{"kind": "report"}})
+	suite.Require().NoError(err)
+	suite.False(msg.BodyOmitted())
+
+	msg.omitBody()
+	suite.True(msg.BodyOmitted())
+	suite.Nil(msg.Data)
+	suite.Nil(msg.message.Data)
+	suite.Equal("report", msg.UserProperties["kind"], "properties should be kept")
+}
+
+func (suite *serviceBusSuite) TestMessageState() {
+	suite.Equal(MessageStateActive, NewMessageFromString("foo").State())
+
+	deferred := int32(MessageStateDeferred)
+	msg := &Message{SystemProperties: &SystemProperties{State: &deferred}}
+	suite.Equal(MessageStateDeferred, msg.State())
+
+	later := time.Now().Add(time.Hour)
+	msg = &Message{SystemProperties: &SystemProperties{ScheduledEnqueueTime: &later}}
+	suite.Equal(MessageStateScheduled, msg.State(), "a message scheduled later should be scheduled without a reported state")
+
+	earlier := time.Now().Add(-time.Hour)
+	msg = &Message{SystemProperties: &SystemProperties{ScheduledEnqueueTime: &earlier}}
+	suite.Equal(MessageStateActive, msg.State())
+}
+
+func (suite *serviceBusSuite) TestMessageDeliveryCount() {
+	msg, err := messageFromAMQPMessage(&amqp.Message{Data: [][]byte{[]byte("foo")}})
+	suite.Require().NoError(err)
+	suite.Equal(uint32(1), msg.DeliveryCount, "a message without a header is on its first delivery")
+
+	msg, err = messageFromAMQPMessage(&amqp.Message{Header: &amqp.MessageHeader{DeliveryCount: 4}, Data: [][]byte{[]byte("foo")}})
+	suite.Require().NoError(err)
+	suite.Equal(uint32(5), msg.DeliveryCount, "the current delivery should be counted")
+}
+
+func (suite *serviceBusSuite) TestMessageTraceCarrier() {
+	const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	msg := NewMessageFromString("hello")
+	msg.UserProperties = map[string]interface{}{"attempt": 3}
+
+	carrier := msg.TraceCarrier()
+	carrier.Set("traceparent", traceParent)
+	suite.Equal(traceParent, carrier.Get("traceparent"))
+	suite.Equal("", carrier.Get("tracestate"))
+	suite.Equal("", carrier.Get("attempt"))
+	suite.Equal([]string{"traceparent"}, carrier.Keys())
+
+	visited := make(map[string]string)
+	suite.NoError(msg.ForeachKey(func(key, val string) error {
+		visited[key] = val
+		return nil
+	}))
+	suite.Equal(map[string]string{"traceparent": traceParent}, visited)
+}
+
+func (suite *serviceBusSuite) TestMessageDeadLetterProperties() {
+	msg := NewMessageFromString("foo")
+	suite.Empty(msg.DeadLetterReason())
+	suite.Empty(msg.DeadLetterErrorDescription())
+
+	msg.UserProperties = map[string]interface{}{
+		"DeadLetterReason":           "MaxDeliveryCountExceeded",
+		"DeadLetterErrorDescription": "Message could not be consumed after 10 delivery attempts.",
+	}
+	suite.Equal("MaxDeliveryCountExceeded", msg.DeadLetterReason())
+	suite.Equal("Message could not be consumed after 10 delivery attempts.", msg.DeadLetterErrorDescription())
+}
+
+func (suite *serviceBusSuite) TestLockTokenFromMessage() {
+	dotNetTag := dotNetEncodedLockTokenGUID
+	expected := uuid.UUID(amqpEncodedLockTokenGUID)
+
+	tests := map[string]struct {
+		msg      *amqp.Message
+		expected *uuid.UUID
+		err      string
+	}{
+		"DotNetDeliveryTag": {
+			msg:      &amqp.Message{DeliveryTag: dotNetTag},
+			expected: &expected,
+		},
+		"AMQPUUIDAnnotation": {
+			msg: &amqp.Message{
+				DeliveryTag:         []byte{1, 2, 3},
+				DeliveryAnnotations: amqp.Annotations{lockTokenName: amqp.UUID(amqpEncodedLockTokenGUID)},
+			},
+			expected: &expected,
+		},
+		"UUIDAnnotation": {
+			msg: &amqp.Message{
+				DeliveryAnnotations: amqp.Annotations{lockTokenName: expected},
+			},
+			expected: &expected,
+		},
+		"ShortDeliveryTag": {
+			msg: &amqp.Message{DeliveryTag: dotNetTag[:8]},
+			err: "the message delivery tag must be a 16 byte lock token, but was 8 bytes: cd5931bbfefd4dcd",
+		},
+		"EmptyDeliveryTag": {
+			msg: &amqp.Message{DeliveryTag: make([]byte, 16)},
+			err: "the message lock token is empty",
+		},
+		"UnsupportedAnnotation": {
+			msg: &amqp.Message{
+				DeliveryAnnotations: amqp.Annotations{lockTokenName: int64(42)},
+			},
+			err: "the message lock token annotation has unsupported type int64",
+		},
+	}
+
+	for name, tt := range tests {
+		suite.T().Run(name, func(t *testing.T) {
+			lockToken, err := lockTokenFromMessageTag(tt.msg)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				assert.Nil(t, lockToken)
+				return
+			}
+
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.expected, lockToken)
+			}
+		})
+	}
+}
+
+func (suite *serviceBusSuite) TestConditionErrors() {
+	amqpErr := &amqp.Error{Condition: amqp.ErrorCondition(ErrorMessageLockLost), Description: "lock expired"}
+	err := wrapError(amqpErr)
+	suite.True(errors.Is(err, ErrMessageLockLost))
+	suite.False(errors.Is(err, ErrSessionLockLost))
+	var unwrapped *amqp.Error
+	suite.Require().True(errors.As(err, &unwrapped))
+	suite.Equal(amqpErr, unwrapped)
+	suite.Equal(err, wrapError(err), "wrapping should not nest condition errors")
+
+	suite.True(errors.Is(wrapError(&amqp.Error{Condition: amqp.ErrorCondition(ErrorEntityDisabled)}), ErrEntityDisabled))
+
+	detached := wrapError(&amqp.DetachError{RemoteError: &amqp.Error{Condition: amqp.ErrorCondition(ErrorServerBusy)}})
+	suite.True(errors.Is(detached, ErrServerBusy))
+
+	tests := map[string]struct {
+		err       error
+		retryable bool
+	}{
+		"Nil":           {err: nil},
+		"ServerBusy":    {err: detached, retryable: true},
+		"Timeout":       {err: &amqp.Error{Condition: amqp.ErrorCondition(ErrorTimeout)}, retryable: true},
+		"InternalError": {err: &amqp.Error{Condition: amqp.ErrorCondition(ErrorInternalError)}, retryable: true},
+		"ConnClosed":    {err: amqp.ErrConnClosed, retryable: true},
+		"LockLost":      {err: err},
+		"SizeExceeded":  {err: &amqp.Error{Condition: amqp.ErrorCondition(ErrorMessageSizeExceeded)}},
+		"NotFound":      {err: &amqp.Error{Condition: amqp.ErrorCondition(ErrorMessageNotFound)}},
+		"Disabled":      {err: &amqp.Error{Condition: amqp.ErrorCondition(ErrorEntityDisabled)}},
+		"Unknown":       {err: errors.New("boom")},
+	}
+
+	for name, tt := range tests {
+		suite.T().Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.retryable, IsRetryable(tt.err))
+		})
+	}
+}
+
+func (suite *serviceBusSuite) TestNonRecoverableErrors() {
+	tests := map[string]struct {
+		err            error
+		nonRecoverable bool
+	}{
+		"LinkClosed":      {err: amqp.ErrLinkClosed},
+		"IdleDetach":      {err: &amqp.DetachError{}},
+		"ServerBusy":      {err: &amqp.DetachError{RemoteError: &amqp.Error{Condition: amqp.ErrorCondition(ErrorServerBusy)}}},
+		"Unauthorized":    {err: &amqp.Error{Condition: amqp.ErrorCondition(ErrorUnauthorizedAccess)}, nonRecoverable: true},
+		"EntityDeleted":   {err: &amqp.DetachError{RemoteError: &amqp.Error{Condition: amqp.ErrorCondition(ErrorNotFound)}}, nonRecoverable: true},
+		"WrappedNotFound": {err: wrapError(&amqp.Error{Condition: amqp.ErrorCondition(ErrorNotFound)}), nonRecoverable: true},
+	}
+
+	for name, tt := range tests {
+		suite.T().Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.nonRecoverable, isNonRecoverableError(tt.err))
+		})
+	}
+
+	suite.Error(WithReconnectObserver(nil)(new(receiver)))
+}
@@ -29,7 +29,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -37,10 +40,16 @@ import (
 	"github.com/Azure/azure-amqp-common-go/log"
 )
 
+var iso8601DurationPattern = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
 const (
 	serviceBusSchema = "http://schemas.microsoft.com/netservices/2010/10/servicebus/connect"
 	atomSchema       = "http://www.w3.org/2005/Atom"
 	applicationXML   = "application/xml"
+
+	// listPageSize is the number of entities requested by each page when listing entities, which is the most Service
+	// Bus returns in a page
+	listPageSize = 100
 )
 
 type (
@@ -48,6 +57,7 @@ type (
 	entityManager struct {
 		TokenProvider auth.TokenProvider
 		Host          string
+		namespace     *Namespace
 	}
 
 	// BaseEntityDescription provides common fields which are part of Queues, Topics and Subscriptions
@@ -118,11 +128,11 @@ func (em *entityManager) Get(ctx context.Context, entityPath string) (*http.Resp
 }
 
 // Put performs an HTTP PUT for a given entity path and body
-func (em *entityManager) Put(ctx context.Context, entityPath string, body []byte) (*http.Response, error) {
+func (em *entityManager) Put(ctx context.Context, entityPath string, body []byte, mw ...func(*http.Request) *http.Request) (*http.Response, error) {
 	span, ctx := em.startSpanFromContext(ctx, "sb.EntityManger.Put")
 	defer span.Finish()
 
-	return em.Execute(ctx, http.MethodPut, entityPath, bytes.NewReader(body))
+	return em.Execute(ctx, http.MethodPut, entityPath, bytes.NewReader(body), mw...)
 }
 
 // Delete performs an HTTP DELETE for a given entity path
@@ -141,14 +151,60 @@ func (em *entityManager) Post(ctx context.Context, entityPath string, body []byt
 	return em.Execute(ctx, http.MethodPost, entityPath, bytes.NewReader(body))
 }
 
-// Execute performs an HTTP request given a http method, path and body
-func (em *entityManager) Execute(ctx context.Context, method string, entityPath string, body io.Reader) (*http.Response, error) {
+// Execute performs an HTTP request given a http method, path and body. Each of mw is applied to the request before it is
+// authorized and sent.
+// When the namespace has a retry policy, requests which fail to be sent, or which Service Bus fails with a transient
+// status, are sent again as the policy allows. The response of the last attempt is returned.
+func (em *entityManager) Execute(ctx context.Context, method string, entityPath string, body io.Reader, mw ...func(*http.Request) *http.Request) (*http.Response, error) {
+	if em.namespace != nil && em.namespace.isClosed() {
+		return nil, ErrNamespaceClosed
+	}
+
+	if em.namespace == nil || em.namespace.retryPolicy == nil {
+		return em.execute(ctx, method, entityPath, body, mw...)
+	}
+
+	var payload []byte
+	if body != nil {
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		payload = b
+	}
+
+	var res *http.Response
+	var err error
+	_ = em.namespace.retryPolicy.doLogged(ctx, em.namespace.getLogger(), method+" "+entityPath, func(ctx context.Context) error {
+		if res != nil && res.Body != nil {
+			_ = res.Body.Close()
+		}
+
+		var body io.Reader
+		if payload != nil {
+			body = bytes.NewReader(payload)
+		}
+		res, err = em.execute(ctx, method, entityPath, body, mw...)
+		if err != nil {
+			return err
+		}
+		return transientResponseError(res)
+	}, func(error) bool {
+		return ctx.Err() != nil
+	})
+	return res, err
+}
+
+func (em *entityManager) execute(ctx context.Context, method string, entityPath string, body io.Reader, mw ...func(*http.Request) *http.Request) (*http.Response, error) {
 	span, ctx := em.startSpanFromContext(ctx, "sb.EntityManger.Execute")
 	defer span.Finish()
 
 	client := &http.Client{
 		Timeout: 60 * time.Second,
 	}
+	if em.namespace != nil && em.namespace.httpTransport != nil {
+		client.Transport = em.namespace.httpTransport
+	}
 	req, err := http.NewRequest(method, em.Host+strings.TrimPrefix(entityPath, "/"), body)
 	if err != nil {
 		log.For(ctx).Error(err)
@@ -157,6 +213,9 @@ func (em *entityManager) Execute(ctx context.Context, method string, entityPath
 
 	req = addAtomXMLContentType(req)
 	req = addAPIVersion201704(req)
+	for _, m := range mw {
+		req = m(req)
+	}
 	applyRequestInfo(span, req)
 	req, err = em.addAuthorization(req)
 	if err != nil {
@@ -172,9 +231,101 @@ func (em *entityManager) Execute(ctx context.Context, method string, entityPath
 		log.For(ctx).Error(err)
 	}
 
+	if em.namespace != nil {
+		em.namespace.observeServerDate(res)
+		if em.namespace.mgmtObserver != nil {
+			em.namespace.observeManagementResponse(ctx, method+" "+entityPath, res)
+		}
+	}
+
 	return res, err
 }
 
+// transientResponseError returns an error if Service Bus failed a management request with a status which may change by
+// sending the request again. Throttling is reported with the delay Service Bus asked for.
+func transientResponseError(res *http.Response) error {
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return &serverBusyError{retryAfter: retryAfter(res.Header.Get("Retry-After"))}
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return fmt.Errorf("servicebus: management request failed with status %d", res.StatusCode)
+	default:
+		return nil
+	}
+}
+
+// retryAfter parses the value of a Retry-After header, which is either a number of seconds or a date. It returns
+// serverBusyBackoff if the value is missing or malformed.
+func retryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+		return 0
+	}
+	return serverBusyBackoff
+}
+
+// observeManagementResponse passes a copy of the body of a management response to the configured observer, and
+// restores the body so it can still be read by the caller
+func (ns *Namespace) observeManagementResponse(ctx context.Context, op string, res *http.Response) {
+	if res == nil {
+		return
+	}
+
+	var body []byte
+	if res.Body != nil {
+		b, err := ioutil.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if err != nil {
+			log.For(ctx).Error(err)
+		}
+		body = b
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	ns.mgmtObserver(op, res.StatusCode, body)
+}
+
+// exists reports whether the entity at entityPath exists. Service Bus answers a request for a missing entity with an
+// empty feed rather than a not found status, so only the root element of the body is decoded to tell an entry from a
+// feed. Any status other than success or not found, such as when the request is not authorized, is returned as an error.
+func (em *entityManager) exists(ctx context.Context, entityPath string) (bool, error) {
+	res, err := em.Get(ctx, entityPath)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		log.For(ctx).Error(err)
+		return false, err
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return false, err
+		}
+		return false, fmt.Errorf("servicebus: management request failed with status %d: %v", res.StatusCode, formatManagementError(b))
+	}
+
+	decoder := xml.NewDecoder(res.Body)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return false, err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name.Local == "entry", nil
+		}
+	}
+}
+
 func isEmptyFeed(b []byte) bool {
 	var emptyFeed queueFeed
 	feedErr := xml.Unmarshal(b, &emptyFeed)
@@ -187,7 +338,11 @@ func (em *entityManager) addAuthorization(req *http.Request) (*http.Request, err
 		return nil, err
 	}
 
-	req.Header.Add("Authorization", signature.Token)
+	if signature.TokenType == auth.CBSTokenTypeJWT {
+		req.Header.Add("Authorization", "Bearer "+signature.Token)
+	} else {
+		req.Header.Add("Authorization", signature.Token)
+	}
 	return req, nil
 }
 
@@ -205,6 +360,20 @@ func addAPIVersion201704(req *http.Request) *http.Request {
 	return req
 }
 
+// listPagePath adds the $skip and $top query parameters selecting a page of a feed of entities to path
+func listPagePath(path string, skip, top int) string {
+	return fmt.Sprintf("%s?$skip=%d&$top=%d", path, skip, top)
+}
+
+// withIfMatch adds an If-Match header to the request, which makes a PUT update an existing entity rather than fail
+// with a conflict
+func withIfMatch(etag string) func(*http.Request) *http.Request {
+	return func(req *http.Request) *http.Request {
+		req.Header.Set("If-Match", etag)
+		return req
+	}
+}
+
 func xmlDoc(content []byte) []byte {
 	return []byte(xml.Header + string(content))
 }
@@ -220,11 +389,50 @@ func ptrString(toPtr string) *string {
 	return &toPtr
 }
 
+// int32OrZero dereferences a pointer to an int32, returning 0 for nil
+func int32OrZero(ptr *int32) int32 {
+	if ptr == nil {
+		return 0
+	}
+	return *ptr
+}
+
+// int64OrZero dereferences a pointer to an int64, returning 0 for nil
+func int64OrZero(ptr *int64) int64 {
+	if ptr == nil {
+		return 0
+	}
+	return *ptr
+}
+
 // durationTo8601Seconds takes a duration and returns a string period of whole seconds (int cast of float)
 func durationTo8601Seconds(duration time.Duration) string {
 	return fmt.Sprintf("PT%dS", duration/time.Second)
 }
 
+// iso8601DurationSeconds parses an ISO 8601 duration as used by Service Bus, such as PT10M or P10675199DT2H48M5.4775807S,
+// and returns its length in seconds. Seconds are returned as a float as the longest durations do not fit a
+// time.Duration.
+func iso8601DurationSeconds(duration string) (float64, bool) {
+	parts := iso8601DurationPattern.FindStringSubmatch(duration)
+	if parts == nil || duration == "P" || duration == "PT" {
+		return 0, false
+	}
+
+	var seconds float64
+	for i, unit := range []float64{24 * 60 * 60, 60 * 60, 60, 1} {
+		if parts[i+1] == "" {
+			continue
+		}
+		value, err := strconv.ParseFloat(parts[i+1], 64)
+		if err != nil {
+			return 0, false
+		}
+		seconds += value * unit
+	}
+	return seconds, true
+}
+
 func formatManagementError(body []byte) error {
 	var mgmtError managementError
 	unmarshalErr := xml.Unmarshal(body, &mgmtError)
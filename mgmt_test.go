@@ -28,6 +28,7 @@ import (
 
 	"github.com/Azure/azure-service-bus-go/atom"
 	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/Azure/go-autorest/autorest/to"
 )
 
 func (suite *serviceBusSuite) TestFeedUnmarshal() {
@@ -62,3 +63,64 @@ func (suite *serviceBusSuite) TestEntryUnmarshal() {
 		suite.Contains(entry.Content.Body, item)
 	}
 }
+
+func (suite *serviceBusSuite) TestISO8601DurationSeconds() {
+	cases := map[string]float64{
+		"PT10M":                      600,
+		"PT600S":                     600,
+		"PT1H30M":                    5400,
+		"P1DT1S":                     86401,
+		"PT0.5S":                     0.5,
+		"P10675199DT2H48M5.4775807S": 10675199*24*60*60 + 2*60*60 + 48*60 + 5.4775807,
+	}
+	for duration, expected := range cases {
+		seconds, ok := iso8601DurationSeconds(duration)
+		suite.True(ok, duration)
+		suite.InDelta(expected, seconds, 0.0001, duration)
+	}
+
+	for _, duration := range []string{"", "P", "PT", "10M", "Active", "PT1.5M"} {
+		_, ok := iso8601DurationSeconds(duration)
+		suite.False(ok, duration)
+	}
+}
+
+func (suite *serviceBusSuite) TestRetryAfter() {
+	suite.Equal(5*time.Second, retryAfter("5"))
+	suite.Equal(serverBusyBackoff, retryAfter(""))
+	suite.Equal(serverBusyBackoff, retryAfter("soon"))
+	suite.Equal(time.Duration(0), retryAfter("Wed, 21 Oct 2015 07:28:00 GMT"))
+}
+
+func (suite *serviceBusSuite) TestEntityDescriptionDiffAndMerge() {
+	window := 10 * time.Minute
+	desired := new(QueueDescription)
+	for _, opt := range []QueueManagementOption{QueueEntityWithLockDuration(&window), QueueEntityWithMaxDeliveryCount(5)} {
+		suite.Require().NoError(opt(desired))
+	}
+
+	existing := &QueueDescription{
+		LockDuration:       ptrString("PT10M"),
+		MaxDeliveryCount:   to.Int32Ptr(10),
+		MaxSizeInMegabytes: to.Int32Ptr(1024),
+		SizeInBytes:        to.Int64Ptr(42),
+	}
+
+	diffs, err := diffEntityDescriptions(QueueKind, "foo", desired, existing)
+	suite.NoError(err)
+	suite.Equal([]string{"MaxDeliveryCount: 10 -> 5"}, diffs)
+
+	mergeEntityDescriptions(existing, desired)
+	suite.Equal(int32(5), *existing.MaxDeliveryCount)
+	suite.Equal("PT600S", *existing.LockDuration)
+	suite.Equal(int32(1024), *existing.MaxSizeInMegabytes)
+	suite.Nil(existing.SizeInBytes)
+
+	diffs, err = diffEntityDescriptions(QueueKind, "foo", desired, existing)
+	suite.NoError(err)
+	suite.Empty(diffs)
+
+	suite.Require().NoError(QueueEntityWithRequiredSessions()(desired))
+	_, err = diffEntityDescriptions(QueueKind, "foo", desired, existing)
+	suite.EqualError(err, `queue "foo": RequiresSession can only be set when the queue is created`)
+}
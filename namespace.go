@@ -24,13 +24,23 @@ package servicebus
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"runtime"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/Azure/azure-amqp-common-go/aad"
 	"github.com/Azure/azure-amqp-common-go/auth"
 	"github.com/Azure/azure-amqp-common-go/cbs"
 	"github.com/Azure/azure-amqp-common-go/conn"
+	"github.com/Azure/azure-amqp-common-go/log"
 	"github.com/Azure/azure-amqp-common-go/sas"
+	"github.com/Azure/azure-amqp-common-go/uuid"
+	"github.com/Azure/go-autorest/autorest/adal"
 	"github.com/Azure/go-autorest/autorest/azure"
 	"pack.ag/amqp"
 )
@@ -51,19 +61,76 @@ const (
 
 	// Megabytes is a helper for specifying MaxSizeInMegabytes and equals 1024, thus 5 GB is 5 * Megabytes
 	Megabytes = 1024
+
+	// AzureADResourceURI is the resource Azure AD tokens must be issued for to authorize requests to Service Bus
+	AzureADResourceURI = "https://servicebus.azure.net/"
+
+	// claimRefreshInterval is how often the claim authorizing a long lived link is negotiated again, well before the
+	// token it was negotiated with expires
+	claimRefreshInterval = 15 * time.Minute
+
+	// minMaxFrameSize is the smallest max frame size AMQP allows a connection to be opened with
+	minMaxFrameSize = 512
 )
 
 type (
 	// Namespace provides a simplified facade over the AMQP implementation of Azure Service Bus and is the entry point
-	// for using Queues, Topics and Subscriptions
+	// for using Queues, Topics and Subscriptions.
+	//
+	// The capabilities and properties Service Bus offers when a connection is opened are not exposed, as the AMQP client
+	// reads them from the open frame of Service Bus without making them available. Features can't be detected before
+	// they are used; an operation Service Bus does not support fails with the error it reports.
 	Namespace struct {
 		Name          string
 		TokenProvider auth.TokenProvider
 		Environment   azure.Environment
+		idGenerator   func() string
+		clock         clockSkew
+		mgmtObserver  func(op string, status int, body []byte)
+		retryPolicy   *RetryPolicy
+		logger        Logger
+		connOptions   ConnectionOptions
+		useWebSocket  bool
+		proxyURL      *url.URL
+		httpTransport http.RoundTripper
+		sendersMu     sync.Mutex
+		senders       map[string]*sender
+		linksMu       sync.Mutex
+		closed        bool
+		openLinks     map[interface{}]func(context.Context) error
+	}
+
+	// ConnectionOptions configures the AMQP connections of a namespace. A zero field keeps the default of the AMQP
+	// client, so the zero value configures connections as they are without options.
+	ConnectionOptions struct {
+		// IdleTimeout is the longest period Service Bus may leave the connection without sending a frame. It is
+		// advertised to Service Bus when the connection is opened, and Service Bus sends empty frames as heartbeats at
+		// half of it, so an IdleTimeout below the idle timeout of a proxy or NAT keeps the connection from being
+		// dropped while it carries no messages. A connection on which no frame arrives for IdleTimeout is closed.
+		IdleTimeout time.Duration
+		// MaxFrameSize is the largest frame, in bytes, Service Bus may send on the connection. It must be at least 512.
+		MaxFrameSize uint32
+		// ChannelMax is the highest channel number of the connection, which bounds the number of sessions it can hold
+		// to ChannelMax + 1.
+		ChannelMax uint16
+	}
+
+	// connectionLimits are the values of the amqp.ConnIdleTimeout, amqp.ConnMaxFrameSize and amqp.ConnMaxSessions
+	// options of the connections of a namespace
+	connectionLimits struct {
+		idleTimeout  time.Duration
+		maxFrameSize uint32
+		maxSessions  int
 	}
 
 	// NamespaceOption provides structure for configuring a new Service Bus namespace
 	NamespaceOption func(h *Namespace) error
+
+	// rotatingTokenProvider is a token provider whose shared access key can be replaced while it is in use
+	rotatingTokenProvider struct {
+		mu       sync.RWMutex
+		provider auth.TokenProvider
+	}
 )
 
 // NamespaceWithConnectionString configures a namespace with the information provided in a Service Bus connection string
@@ -80,11 +147,119 @@ func NamespaceWithConnectionString(connStr string) NamespaceOption {
 		if err != nil {
 			return err
 		}
+		ns.TokenProvider = &rotatingTokenProvider{provider: provider}
+		return nil
+	}
+}
+
+// NamespaceWithAzureAD configures a namespace to authorize with Azure AD tokens, rather than shared access keys.
+// namespaceFQDN is the fully qualified domain name of the namespace, such as "mynamespace.servicebus.windows.net", and
+// token must be issued for AzureADResourceURI. The token is refreshed as it nears expiry, and links are authorized
+// again periodically so they outlive the token they were opened with.
+//
+// The identity of the token needs a role assignment on the namespace or entity: "Azure Service Bus Data Sender" to
+// send, "Azure Service Bus Data Receiver" to receive, or "Azure Service Bus Data Owner" for both and for management
+// operations.
+func NamespaceWithAzureAD(namespaceFQDN string, token *adal.ServicePrincipalToken) NamespaceOption {
+	return func(ns *Namespace) error {
+		if token == nil {
+			return errors.New("token must not be nil")
+		}
+
+		parts := strings.SplitN(namespaceFQDN, ".", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("%q is not the fully qualified domain name of a namespace", namespaceFQDN)
+		}
+
+		provider, err := aad.NewJWTProvider(aad.JWTProviderWithAADToken(token))
+		if err != nil {
+			return err
+		}
+
+		ns.Name = parts[0]
+		ns.Environment.ServiceBusEndpointSuffix = parts[1]
 		ns.TokenProvider = provider
 		return nil
 	}
 }
 
+// NamespaceWithIDGenerator configures a namespace to use the generator, rather than random UUIDs, to create the IDs of
+// messages sent without an ID, unless IDs are not assigned (see QueueWithMessageIDAssignment), and the IDs of the AMQP
+// sessions used to group sent messages. This allows IDs to be deterministic, which is useful for tests and for
+// deduplication schemes built on content hashes, or to send messages with sortable IDs like ULIDs. generator must not
+// return an empty ID.
+func NamespaceWithIDGenerator(generator func() string) NamespaceOption {
+	return func(ns *Namespace) error {
+		if generator == nil {
+			return errors.New("generator must not be nil")
+		}
+		ns.idGenerator = generator
+		return nil
+	}
+}
+
+// NamespaceWithMessageIDFactory configures a namespace to use factory to create the IDs of messages sent without one.
+// It configures factory with NamespaceWithIDGenerator, so factory also creates the IDs of the AMQP sessions used to
+// group sent messages.
+//
+// Deprecated: use NamespaceWithIDGenerator, which NamespaceWithMessageIDFactory is equivalent to.
+func NamespaceWithMessageIDFactory(factory func() string) NamespaceOption {
+	return NamespaceWithIDGenerator(factory)
+}
+
+// NamespaceWithManagementResponseObserver configures a namespace to call observer with the raw response of each
+// management request, which is useful for debugging responses the client fails to parse. op is the HTTP method and the
+// entity path of the request. Response bodies are only buffered when an observer is configured.
+func NamespaceWithManagementResponseObserver(observer func(op string, status int, body []byte)) NamespaceOption {
+	return func(ns *Namespace) error {
+		ns.mgmtObserver = observer
+		return nil
+	}
+}
+
+// NamespaceWithRetryPolicy configures a namespace to retry sends, management requests and the recovery of links as
+// allowed by policy. Without it, each operation retries as it always has. Use RetryPolicyNone to handle retries in the
+// caller instead.
+func NamespaceWithRetryPolicy(policy RetryPolicy) NamespaceOption {
+	return func(ns *Namespace) error {
+		if policy.MaxAttempts < 1 {
+			return errors.New("retry policy must allow at least 1 attempt")
+		}
+		if policy.Jitter < 0 || policy.Jitter > 1 {
+			return errors.New("retry policy jitter must be between 0 and 1")
+		}
+		ns.retryPolicy = &policy
+		return nil
+	}
+}
+
+// NamespaceWithLogger configures a namespace to report its events to logger, such as links being opened and closed,
+// claims being refreshed, messages being settled and operations being retried. Without it, events are discarded.
+func NamespaceWithLogger(logger Logger) NamespaceOption {
+	return func(ns *Namespace) error {
+		if logger == nil {
+			return errors.New("logger must not be nil")
+		}
+		ns.logger = logger
+		return nil
+	}
+}
+
+// NamespaceWithConnectionOptions configures the AMQP connections of a namespace with opts. Without it, connections use
+// the defaults of the AMQP client.
+func NamespaceWithConnectionOptions(opts ConnectionOptions) NamespaceOption {
+	return func(ns *Namespace) error {
+		if opts.IdleTimeout < 0 {
+			return errors.New("idle timeout must not be negative")
+		}
+		if opts.MaxFrameSize != 0 && opts.MaxFrameSize < minMaxFrameSize {
+			return fmt.Errorf("max frame size must be at least %d bytes", minMaxFrameSize)
+		}
+		ns.connOptions = opts
+		return nil
+	}
+}
+
 // NewNamespace creates a new namespace configured through NamespaceOption(s)
 func NewNamespace(opts ...NamespaceOption) (*Namespace, error) {
 	ns := &Namespace{
@@ -101,17 +276,158 @@ func NewNamespace(opts ...NamespaceOption) (*Namespace, error) {
 	return ns, nil
 }
 
+// Close closes the senders, receivers and management links opened through the namespace, including those of its
+// queues, topics and subscriptions and the senders of Send, along with their connections. Operations started after
+// Close, and receivers which were listening, fail with ErrNamespaceClosed. The first error encountered closing a link is
+// returned.
+func (ns *Namespace) Close(ctx context.Context) error {
+	span, ctx := ns.startSpanFromContext(ctx, "sb.Namespace.Close")
+	defer span.Finish()
+
+	ns.linksMu.Lock()
+	ns.closed = true
+	links := ns.openLinks
+	ns.openLinks = nil
+	ns.linksMu.Unlock()
+
+	ns.sendersMu.Lock()
+	ns.senders = nil
+	ns.sendersMu.Unlock()
+
+	var firstErr error
+	for _, closeLink := range links {
+		if err := closeLink(ctx); err != nil && firstErr == nil {
+			log.For(ctx).Error(err)
+			firstErr = err
+		}
+	}
+	ns.getLogger().Info("namespace closed", "links", len(links))
+	return firstErr
+}
+
+// trackLink registers a link opened through the namespace, which closeLink closes when the namespace is closed. If the
+// namespace is closed already, ErrNamespaceClosed is returned and the caller must close the link itself.
+func (ns *Namespace) trackLink(link interface{}, closeLink func(context.Context) error) error {
+	ns.linksMu.Lock()
+	defer ns.linksMu.Unlock()
+
+	if ns.closed {
+		return ErrNamespaceClosed
+	}
+	if ns.openLinks == nil {
+		ns.openLinks = make(map[interface{}]func(context.Context) error)
+	}
+	ns.openLinks[link] = closeLink
+	return nil
+}
+
+// untrackLink forgets a link which was closed
+func (ns *Namespace) untrackLink(link interface{}) {
+	ns.linksMu.Lock()
+	defer ns.linksMu.Unlock()
+
+	delete(ns.openLinks, link)
+}
+
+// isClosed returns true once the namespace was closed
+func (ns *Namespace) isClosed() bool {
+	ns.linksMu.Lock()
+	defer ns.linksMu.Unlock()
+
+	return ns.closed
+}
+
 func (ns *Namespace) newConnection() (*amqp.Client, error) {
+	if ns.isClosed() {
+		return nil, ErrNamespaceClosed
+	}
+
+	if ns.useWebSocket {
+		return ns.newWebSocketConnection()
+	}
+
 	host := ns.getAMQPHostURI()
-	return amqp.Dial(host,
+	return amqp.Dial(host, ns.connectionOptions()...)
+}
+
+// connectionOptions returns the options of the AMQP connections of the namespace
+func (ns *Namespace) connectionOptions() []amqp.ConnOption {
+	limits := ns.connectionLimits()
+	opts := []amqp.ConnOption{
 		amqp.ConnSASLAnonymous(),
-		amqp.ConnMaxSessions(65535),
+		amqp.ConnMaxSessions(limits.maxSessions),
 		amqp.ConnProperty("product", "MSGolangClient"),
 		amqp.ConnProperty("version", Version),
 		amqp.ConnProperty("platform", runtime.GOOS),
 		amqp.ConnProperty("framework", runtime.Version()),
 		amqp.ConnProperty("user-agent", rootUserAgent),
-	)
+	}
+	if limits.idleTimeout > 0 {
+		opts = append(opts, amqp.ConnIdleTimeout(limits.idleTimeout))
+	}
+	if limits.maxFrameSize > 0 {
+		opts = append(opts, amqp.ConnMaxFrameSize(limits.maxFrameSize))
+	}
+	return opts
+}
+
+// connectionLimits resolves the ConnectionOptions of the namespace to the values of the AMQP connection options it is
+// dialed with. A zero idle timeout or max frame size leaves the default of the AMQP client in place.
+func (ns *Namespace) connectionLimits() connectionLimits {
+	limits := connectionLimits{
+		idleTimeout:  ns.connOptions.IdleTimeout,
+		maxFrameSize: ns.connOptions.MaxFrameSize,
+		maxSessions:  65535,
+	}
+	if ns.connOptions.ChannelMax != 0 {
+		limits.maxSessions = int(ns.connOptions.ChannelMax) + 1
+	}
+	return limits
+}
+
+// newID creates a new ID from the configured ID generator or, by default, a random UUID
+func (ns *Namespace) newID() (string, error) {
+	if ns.idGenerator == nil {
+		id, err := uuid.NewV4()
+		if err != nil {
+			return "", err
+		}
+		return id.String(), nil
+	}
+
+	id := ns.idGenerator()
+	if id == "" {
+		return "", errors.New("the configured ID generator returned an empty ID")
+	}
+	return id, nil
+}
+
+// UpdateSASKey replaces the shared access key the namespace was configured with by NamespaceWithConnectionString.
+// Tokens created from then on are signed with the new key. Open links are not interrupted, and are authorized with the
+// new key when their claim is next refreshed, so the old key should stay valid for claimRefreshInterval after the
+// update.
+func (ns *Namespace) UpdateSASKey(keyName, key string) error {
+	rotating, ok := ns.TokenProvider.(*rotatingTokenProvider)
+	if !ok {
+		return errors.New("the namespace is not authorized with a shared access key from a connection string")
+	}
+
+	provider, err := sas.NewTokenProvider(sas.TokenProviderWithKey(keyName, key))
+	if err != nil {
+		return err
+	}
+
+	rotating.mu.Lock()
+	defer rotating.mu.Unlock()
+	rotating.provider = provider
+	return nil
+}
+
+// GetToken implements auth.TokenProvider with the current key
+func (p *rotatingTokenProvider) GetToken(uri string) (*auth.Token, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.provider.GetToken(uri)
 }
 
 func (ns *Namespace) negotiateClaim(ctx context.Context, conn *amqp.Client, entityPath string) error {
@@ -122,6 +438,39 @@ func (ns *Namespace) negotiateClaim(ctx context.Context, conn *amqp.Client, enti
 	return cbs.NegotiateClaim(ctx, audience, conn, ns.TokenProvider)
 }
 
+// refreshClaim negotiates the claim for entityPath on conn every claimRefreshInterval, so Service Bus doesn't close the
+// links of the connection when the token they were authorized with expires. It stops when the returned func is called.
+func (ns *Namespace) refreshClaim(conn *amqp.Client, entityPath string) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(claimRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				refreshCtx, cancelRefresh := context.WithTimeout(ctx, 30*time.Second)
+				if err := ns.negotiateClaim(refreshCtx, conn, entityPath); err != nil {
+					log.For(refreshCtx).Error(err)
+					ns.getLogger().Warn("claim refresh failed", "entity", entityPath, "error", err)
+				} else {
+					ns.getLogger().Debug("claim refreshed", "entity", entityPath)
+				}
+				cancelRefresh()
+			}
+		}
+	}()
+	return cancel
+}
+
+// newEntityManager creates an entityManager for management requests against the namespace
+func (ns *Namespace) newEntityManager() *entityManager {
+	em := newEntityManager(ns.getHTTPSHostURI(), ns.TokenProvider)
+	em.namespace = ns
+	return em
+}
+
 func (ns *Namespace) getAMQPHostURI() string {
 	return fmt.Sprintf("amqps://%s.%s/", ns.Name, ns.Environment.ServiceBusEndpointSuffix)
 }
@@ -0,0 +1,132 @@
+package servicebus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"time"
+
+	"github.com/Azure/azure-amqp-common-go/log"
+	"github.com/Azure/azure-service-bus-go/atom"
+	"github.com/Azure/go-autorest/autorest/date"
+)
+
+const namespaceInfoPath = "$namespaceinfo"
+
+type (
+	// NamespaceRuntimeInfo describes the tier and capacity of a namespace, and how many entities it holds
+	NamespaceRuntimeInfo struct {
+		Name           string
+		SKU            string
+		MessagingUnits int32
+		CreatedTime    time.Time
+		ModifiedTime   time.Time
+		QueueCount     int
+		TopicCount     int
+	}
+
+	// namespaceInfoEntry is the Atom entry returned for the $namespaceinfo path
+	namespaceInfoEntry struct {
+		*atom.Entry
+		Content *namespaceInfoContent `xml:"content"`
+	}
+
+	namespaceInfoContent struct {
+		XMLName       xml.Name      `xml:"content"`
+		Type          string        `xml:"type,attr"`
+		NamespaceInfo namespaceInfo `xml:"NamespaceInfo"`
+	}
+
+	namespaceInfo struct {
+		XMLName        xml.Name   `xml:"NamespaceInfo"`
+		Name           string     `xml:"Name"`
+		MessagingSKU   string     `xml:"MessagingSKU"`
+		MessagingUnits *int32     `xml:"MessagingUnits,omitempty"`
+		CreatedTime    *date.Time `xml:"CreatedTime,omitempty"`
+		ModifiedTime   *date.Time `xml:"ModifiedTime,omitempty"`
+	}
+)
+
+// RuntimeInfo fetches the tier and messaging units of the namespace, and counts its queues and topics.
+//
+// Service Bus does not report how many entities a namespace holds, and its entity feeds carry no total, so the queues
+// and topics are counted by listing them. That costs a management request for every 100 queues and every 100 topics,
+// each transferring the full descriptions of the entities, so RuntimeInfo should not be polled on namespaces with
+// many entities.
+func (ns *Namespace) RuntimeInfo(ctx context.Context) (*NamespaceRuntimeInfo, error) {
+	span, ctx := ns.startSpanFromContext(ctx, "sb.Namespace.RuntimeInfo")
+	defer span.Finish()
+
+	res, err := ns.newEntityManager().Get(ctx, namespaceInfoPath)
+	if res != nil {
+		defer res.Body.Close()
+	}
+
+	if err != nil {
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+
+	var entry namespaceInfoEntry
+	if err := xml.Unmarshal(b, &entry); err != nil || entry.Content == nil {
+		return nil, formatManagementError(b)
+	}
+	info := namespaceInfoToRuntimeInfo(&entry.Content.NamespaceInfo)
+
+	queues, err := ns.NewQueueManager().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	info.QueueCount = len(queues)
+
+	topics, err := ns.NewTopicManager().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	info.TopicCount = len(topics)
+
+	return info, nil
+}
+
+func namespaceInfoToRuntimeInfo(ni *namespaceInfo) *NamespaceRuntimeInfo {
+	info := &NamespaceRuntimeInfo{
+		Name:           ni.Name,
+		SKU:            ni.MessagingSKU,
+		MessagingUnits: int32OrZero(ni.MessagingUnits),
+	}
+	if ni.CreatedTime != nil {
+		info.CreatedTime = ni.CreatedTime.Time
+	}
+	if ni.ModifiedTime != nil {
+		info.ModifiedTime = ni.ModifiedTime.Time
+	}
+	return info
+}
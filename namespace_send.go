@@ -0,0 +1,74 @@
+package servicebus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+
+	"github.com/Azure/azure-amqp-common-go/log"
+)
+
+// Send sends a message to the Queue or Topic at entityPath, such as "myqueue" or "mytopic". It is meant for
+// destinations only known at runtime, for which the type of the entity may not be known. The sender link opened for
+// an entity path is kept open and reused by later sends to the same path until the Namespace is closed.
+func (ns *Namespace) Send(ctx context.Context, entityPath string, msg *Message) error {
+	span, ctx := ns.startSpanFromContext(ctx, "sb.Namespace.Send")
+	defer span.Finish()
+
+	s, err := ns.senderFor(ctx, entityPath)
+	if err != nil {
+		log.For(ctx).Error(err)
+		return err
+	}
+	return s.Send(ctx, msg)
+}
+
+// senderFor returns the cached sender of entityPath, opening one if it does not exist yet. The sender is opened without
+// holding sendersMu, so an entity which is slow to open does not hold up sends to the others; if another send opened a
+// sender for entityPath in the meantime, that one is used and the new one closed.
+func (ns *Namespace) senderFor(ctx context.Context, entityPath string) (*sender, error) {
+	ns.sendersMu.Lock()
+	s, ok := ns.senders[entityPath]
+	ns.sendersMu.Unlock()
+	if ok {
+		return s, nil
+	}
+
+	s, err := ns.newSender(ctx, entityPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ns.sendersMu.Lock()
+	defer ns.sendersMu.Unlock()
+
+	if cached, ok := ns.senders[entityPath]; ok {
+		_ = s.Close(ctx)
+		return cached, nil
+	}
+	if ns.senders == nil {
+		ns.senders = make(map[string]*sender)
+	}
+	ns.senders[entityPath] = s
+	return s, nil
+}
@@ -23,7 +23,16 @@ package servicebus
 //	SOFTWARE
 
 import (
+	"bufio"
 	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
@@ -38,6 +47,11 @@ type (
 	serviceBusSuite struct {
 		test.BaseSuite
 	}
+
+	// recordingLogger records the messages of the events it receives
+	recordingLogger struct {
+		messages []string
+	}
 )
 
 func TestSB(t *testing.T) {
@@ -58,6 +72,399 @@ func (suite *serviceBusSuite) TestCreateNamespaceFromConnectionString() {
 	}
 }
 
+func (suite *serviceBusSuite) TestUpdateSASKey() {
+	ns := suite.getNewSasInstance()
+	before, err := ns.TokenProvider.GetToken("https://foo.servicebus.windows.net/bar")
+	suite.Require().NoError(err)
+
+	suite.Require().NoError(ns.UpdateSASKey("rotated", "c2VjcmV0"))
+	after, err := ns.TokenProvider.GetToken("https://foo.servicebus.windows.net/bar")
+	suite.Require().NoError(err)
+	suite.NotEqual(before.Token, after.Token)
+	suite.Contains(after.Token, "skn=rotated")
+
+	aad, err := NewNamespace(NamespaceWithAzureAD("foo.servicebus.windows.net", suite.Token))
+	suite.Require().NoError(err)
+	suite.Error(aad.UpdateSASKey("rotated", "c2VjcmV0"))
+}
+
+func (suite *serviceBusSuite) TestNamespaceWithIDGenerator() {
+	var count int
+	ns, err := NewNamespace(NamespaceWithIDGenerator(func() string {
+		count++
+		return fmt.Sprintf("id-%d", count)
+	}))
+	suite.Require().NoError(err)
+
+	for _, expected := range []string{"id-1", "id-2"} {
+		id, err := ns.newID()
+		if suite.NoError(err) {
+			suite.Equal(expected, id)
+		}
+	}
+
+	ns, err = NewNamespace(NamespaceWithIDGenerator(func() string { return "" }))
+	suite.Require().NoError(err)
+	_, err = ns.newID()
+	suite.Error(err)
+}
+
+func (suite *serviceBusSuite) TestNamespaceWithAzureAD() {
+	_, err := NewNamespace(NamespaceWithAzureAD("foo.servicebus.windows.net", nil))
+	suite.Error(err)
+	_, err = NewNamespace(NamespaceWithAzureAD("foo", suite.Token))
+	suite.Error(err)
+
+	ns, err := NewNamespace(NamespaceWithAzureAD("foo.servicebus.chinacloudapi.cn", suite.Token))
+	suite.Require().NoError(err)
+	suite.Equal("foo", ns.Name)
+	suite.Equal("amqps://foo.servicebus.chinacloudapi.cn/", ns.getAMQPHostURI())
+}
+
+func (suite *serviceBusSuite) TestNamespaceWithConnectionOptions() {
+	_, err := NewNamespace(NamespaceWithConnectionOptions(ConnectionOptions{IdleTimeout: -time.Second}))
+	suite.Error(err)
+	_, err = NewNamespace(NamespaceWithConnectionOptions(ConnectionOptions{MaxFrameSize: 256}))
+	suite.Error(err)
+
+	ns, err := NewNamespace()
+	suite.Require().NoError(err)
+	defaults := len(ns.connectionOptions())
+	suite.Equal(connectionLimits{maxSessions: 65535}, ns.connectionLimits(), "the defaults of the AMQP client should be kept")
+
+	ns, err = NewNamespace(NamespaceWithConnectionOptions(ConnectionOptions{
+		IdleTimeout:  30 * time.Second,
+		MaxFrameSize: 64 * 1024,
+		ChannelMax:   255,
+	}))
+	suite.Require().NoError(err)
+	suite.Equal(connectionLimits{
+		idleTimeout:  30 * time.Second,
+		maxFrameSize: 64 * 1024,
+		maxSessions:  256,
+	}, ns.connectionLimits(), "a channel max of 255 should allow 256 sessions")
+	suite.Len(ns.connectionOptions(), defaults+2, "the idle timeout and max frame size should be added to the defaults")
+}
+
+func (suite *serviceBusSuite) TestNamespaceWithWebSocket() {
+	ns, err := NewNamespace(NamespaceWithWebSocket())
+	suite.Require().NoError(err)
+	ns.Name = "foo"
+	suite.True(ns.useWebSocket)
+	suite.Equal("wss://foo.servicebus.windows.net/$servicebus/websocket", ns.getWebSocketURI())
+}
+
+func (suite *serviceBusSuite) TestDialThroughProxy() {
+	_, err := NewNamespace(NamespaceWithHTTPProxy("socks5://proxy:1080"))
+	suite.Error(err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	suite.Require().NoError(err)
+	defer listener.Close()
+
+	requests := make(chan *http.Request, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		requests <- req
+		if req.Header.Get("Proxy-Authorization") == "" {
+			_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nhello"))
+	}()
+
+	ns, err := NewNamespace(NamespaceWithHTTPProxy("http://user:secret@" + listener.Addr().String()))
+	suite.Require().NoError(err)
+	suite.True(ns.useWebSocket, "AMQP connections should be tunneled over WebSocket")
+	transport, ok := ns.httpTransport.(*http.Transport)
+	suite.Require().True(ok)
+	managementProxy, err := transport.Proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: "foo.servicebus.windows.net"}})
+	suite.Require().NoError(err)
+	suite.Equal(listener.Addr().String(), managementProxy.Host, "management requests should be sent through the proxy")
+
+	proxy, err := ns.proxyFor(&url.URL{Scheme: "https", Host: "foo.servicebus.windows.net"})
+	suite.Require().NoError(err)
+	conn, err := dialThroughProxy(proxy, "foo.servicebus.windows.net:443", time.Second)
+	suite.Require().NoError(err)
+	defer conn.Close()
+
+	req := <-requests
+	suite.Equal(http.MethodConnect, req.Method)
+	suite.Equal("foo.servicebus.windows.net:443", req.Host)
+	suite.Equal("Basic dXNlcjpzZWNyZXQ=", req.Header.Get("Proxy-Authorization"))
+
+	greeting := make([]byte, 5)
+	_, err = io.ReadFull(conn, greeting)
+	suite.Require().NoError(err)
+	suite.Equal("hello", string(greeting), "data after the response should be read from the tunnel")
+}
+
+func (suite *serviceBusSuite) TestNamespaceWithLogger() {
+	_, err := NewNamespace(NamespaceWithLogger(nil))
+	suite.Error(err)
+
+	logger := new(recordingLogger)
+	ns, err := NewNamespace(NamespaceWithLogger(logger))
+	suite.Require().NoError(err)
+
+	policy := RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond}
+	err = policy.doLogged(context.Background(), ns.getLogger(), "test", func(context.Context) error {
+		return errors.New("transient")
+	}, func(error) bool { return false })
+	suite.Error(err)
+
+	msg := NewMessageFromString("hello")
+	msg.mgmt = &managementSettlement{namespace: ns, entityPath: "queue"}
+	msg.logDisposition("complete")
+
+	suite.Equal([]string{"retrying operation", "retrying operation", "message settled"}, logger.messages)
+
+	silent, err := NewNamespace()
+	suite.Require().NoError(err)
+	suite.Equal(nopLogger{}, silent.getLogger())
+}
+
+func (suite *serviceBusSuite) TestNamespaceClose() {
+	ns, err := NewNamespace()
+	suite.Require().NoError(err)
+
+	var closed []string
+	for _, name := range []string{"first", "second"} {
+		name := name
+		suite.Require().NoError(ns.trackLink(name, func(context.Context) error {
+			closed = append(closed, name)
+			return fmt.Errorf("closing %s failed", name)
+		}))
+	}
+	ns.untrackLink("second")
+
+	ctx := context.Background()
+	err = ns.Close(ctx)
+	suite.EqualError(err, "closing first failed")
+	suite.Equal([]string{"first"}, closed, "links which were closed already should not be closed again")
+
+	suite.Equal(ErrNamespaceClosed, ns.trackLink("third", func(context.Context) error { return nil }))
+	_, err = ns.newConnection()
+	suite.Equal(ErrNamespaceClosed, err)
+	suite.Equal(ErrNamespaceClosed, ns.Send(ctx, "queue", NewMessageFromString("hello")))
+	_, err = ns.NewQueueManager().Get(ctx, "queue")
+	suite.Equal(ErrNamespaceClosed, err)
+	suite.NoError(ns.Close(ctx), "closing a closed namespace should do nothing")
+}
+
+func (suite *serviceBusSuite) TestNamespaceRuntimeInfo() {
+	var entry namespaceInfoEntry
+	err := xml.Unmarshal([]byte(`
+		<entry xmlns="http://www.w3.org/2005/Atom">
+			<title type="text">sbdjtest</title>
+			<content type="application/xml">
+				<NamespaceInfo xmlns="http://schemas.microsoft.com/netservices/2010/10/servicebus/connect">
+					<CreatedTime>2018-05-02T20:54:59.35Z</CreatedTime>
+					<MessagingSKU>Premium</MessagingSKU>
+					<MessagingUnits>2</MessagingUnits>
+					<ModifiedTime>2018-05-03T20:54:59.35Z</ModifiedTime>
+					<Name>sbdjtest</Name>
+				</NamespaceInfo>
+			</content>
+		</entry>`), &entry)
+	suite.Require().NoError(err)
+	suite.Require().NotNil(entry.Content)
+
+	info := namespaceInfoToRuntimeInfo(&entry.Content.NamespaceInfo)
+	suite.Equal("sbdjtest", info.Name)
+	suite.Equal("Premium", info.SKU)
+	suite.Equal(int32(2), info.MessagingUnits)
+	suite.Equal(2018, info.CreatedTime.Year())
+
+	ns := suite.getNewSasInstance()
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	live, err := ns.RuntimeInfo(ctx)
+	if suite.NoError(err) {
+		suite.Equal(ns.Name, live.Name)
+		suite.NotEmpty(live.SKU)
+	}
+}
+
+func (suite *serviceBusSuite) TestClockSkewEstimate() {
+	var clock clockSkew
+	local := time.Now()
+	suite.Equal(time.Duration(0), clock.offset())
+
+	// server timestamps arrive with latency, so the largest offset observed is the best estimate
+	clock.observe(local.Add(2*time.Second), local.Add(300*time.Millisecond))
+	clock.observe(local.Add(3*time.Second), local.Add(1*time.Second))
+	suite.Equal(2*time.Second, clock.offset())
+
+	for i := 0; i < clockSkewSamples; i++ {
+		clock.observe(local.Add(-time.Second), local)
+	}
+	suite.Equal(-time.Second, clock.offset(), "old observations should age out")
+}
+
+func (suite *serviceBusSuite) TestMeasureClockSkewThroughTransport() {
+	ns, err := NewNamespace()
+	suite.Require().NoError(err)
+	ns.Name = "foo"
+
+	serverTime := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	var requested string
+	ns.httpTransport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		requested = req.Method + " " + req.URL.Host
+		header := make(http.Header)
+		header.Set("Date", serverTime.Format(http.TimeFormat))
+		return &http.Response{StatusCode: http.StatusUnauthorized, Header: header, Body: http.NoBody, Request: req}, nil
+	})
+
+	suite.Require().NoError(ns.measureClockSkew(context.Background()))
+	suite.Equal("HEAD foo."+ns.Environment.ServiceBusEndpointSuffix, requested, "the namespace transport should be used")
+	suite.InDelta(float64(time.Hour), float64(ns.ClockSkew()), float64(2*time.Second))
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func (suite *serviceBusSuite) TestNamespaceWithManagementResponseObserver() {
+	var observed []string
+	ns, err := NewNamespace(NamespaceWithManagementResponseObserver(func(op string, status int, body []byte) {
+		observed = append(observed, fmt.Sprintf("%s %d %s", op, status, body))
+	}))
+	suite.Require().NoError(err)
+
+	res := &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("<entry/>"))}
+	ns.observeManagementResponse(context.Background(), "GET foo", res)
+	suite.Equal([]string{"GET foo 200 <entry/>"}, observed)
+
+	body, err := ioutil.ReadAll(res.Body)
+	suite.Require().NoError(err)
+	suite.Equal("<entry/>", string(body), "the body should still be readable after it is observed")
+}
+
+func (suite *serviceBusSuite) TestNextDeliveryIsFair() {
+	sources := make([]chan delivery, 3)
+	for i := range sources {
+		sources[i] = make(chan delivery, 1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// sources 0 and 2 always have a message ready
+	var order []int
+	next := 0
+	for n := 0; n < 4; n++ {
+		sources[0] <- delivery{}
+		sources[2] <- delivery{}
+		i, _, err := nextDelivery(ctx, sources, next)
+		suite.Require().NoError(err)
+		order = append(order, i)
+		next = i + 1
+		for _, source := range sources {
+			select {
+			case <-source:
+			default:
+			}
+		}
+	}
+	suite.Equal([]int{0, 2, 0, 2}, order)
+
+	go func() {
+		sources[1] <- delivery{err: errors.New("boom")}
+	}()
+	i, d, err := nextDelivery(ctx, sources, 0)
+	suite.NoError(err)
+	suite.Equal(1, i)
+	suite.EqualError(d.err, "boom")
+
+	cancel()
+	_, _, err = nextDelivery(ctx, sources, 0)
+	suite.Equal(context.Canceled, err)
+}
+
+func (suite *serviceBusSuite) TestNamespaceApply() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	queueName := suite.randEntityName()
+	topicName := suite.randEntityName()
+	defer suite.cleanupQueue(queueName)
+	defer suite.cleanupTopic(topicName)
+
+	spec := func(maxDeliveryCount int32) NamespaceSpec {
+		return NamespaceSpec{
+			Queues: []QueueSpec{
+				{Name: queueName, Options: []QueueManagementOption{QueueEntityWithMaxDeliveryCount(maxDeliveryCount)}},
+			},
+			Topics: []TopicSpec{
+				{
+					Name: topicName,
+					Subscriptions: []SubscriptionSpec{
+						{
+							Name: "sub",
+							Rules: []RuleSpec{
+								{Name: "red", Filter: FilterDescription{Type: "SqlFilter", SQLExpression: ptrString("color = 'red'")}},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	ns := suite.getNewSasInstance()
+	res, err := ns.Apply(ctx, spec(5))
+	suite.Require().NoError(err)
+	actions := make(map[string]ApplyAction)
+	for _, change := range res.Changes {
+		actions[change.Path] = change.Action
+	}
+	suite.Equal(map[string]ApplyAction{
+		queueName:                        EntityCreated,
+		topicName:                        EntityCreated,
+		topicName + "/Subscriptions/sub": EntityCreated,
+		topicName + "/Subscriptions/sub/Rules/red":      EntityCreated,
+		topicName + "/Subscriptions/sub/Rules/$Default": EntityDeleted,
+	}, actions)
+
+	res, err = ns.Apply(ctx, spec(5))
+	suite.Require().NoError(err)
+	suite.False(res.Changed(), "applying the same spec again should not change anything")
+
+	res, err = ns.Apply(ctx, spec(7))
+	suite.Require().NoError(err)
+	suite.True(res.Changed())
+	suite.Equal(EntityChange{
+		Kind:   QueueKind,
+		Path:   queueName,
+		Action: EntityUpdated,
+		Diffs:  []string{"MaxDeliveryCount: 5 -> 7"},
+	}, res.Changes[0])
+}
+
+func (l *recordingLogger) Debug(msg string, keyvals ...interface{}) {
+	l.messages = append(l.messages, msg)
+}
+
+func (l *recordingLogger) Info(msg string, keyvals ...interface{}) {
+	l.messages = append(l.messages, msg)
+}
+
+func (l *recordingLogger) Warn(msg string, keyvals ...interface{}) {
+	l.messages = append(l.messages, msg)
+}
+
 // TearDownSuite destroys created resources during the run of the suite
 func (suite *serviceBusSuite) TearDownSuite() {
 	suite.BaseSuite.TearDownSuite()
@@ -2,11 +2,45 @@ package servicebus
 
 // Operations
 const (
-	serviceBuslockRenewalOperationName = "com.microsoft:renew-lock"
+	serviceBuslockRenewalOperationName   = "com.microsoft:renew-lock"
+	peekMessageOperationName             = "com.microsoft:peek-message"
+	scheduleMessageOperationName         = "com.microsoft:schedule-message"
+	cancelScheduledOperationName         = "com.microsoft:cancel-scheduled-message"
+	receiveBySequenceNumberOperationName = "com.microsoft:receive-by-sequence-number"
+	updateDispositionOperationName       = "com.microsoft:update-disposition"
+	getMessageSessionsOperationName      = "com.microsoft:get-message-sessions"
+	getSessionStateOperationName         = "com.microsoft:get-session-state"
 )
 
 // Field Descriptions
 const (
-	operationFieldName  = "operation"
-	lockTokensFieldName = "lock-tokens"
+	operationFieldName             = "operation"
+	lockTokensFieldName            = "lock-tokens"
+	serverTimeoutFieldName         = "com.microsoft:server-timeout"
+	fromSequenceNumberFieldName    = "from-sequence-number"
+	messageCountFieldName          = "message-count"
+	messagesFieldName              = "messages"
+	messageFieldName               = "message"
+	expirationsFieldName           = "expirations"
+	messageIDFieldName             = "message-id"
+	sessionIDFieldName             = "session-id"
+	partitionKeyFieldName          = "partition-key"
+	sequenceNumbersFieldName       = "sequence-numbers"
+	receiverSettleModeFieldName    = "receiver-settle-mode"
+	lockTokenFieldName             = "lock-token"
+	dispositionStatusFieldName     = "disposition-status"
+	deadLetterReasonFieldName      = "deadletter-reason"
+	deadLetterDescriptionFieldName = "deadletter-description"
+	propertiesToModifyFieldName    = "properties-to-modify"
+	lastUpdatedTimeFieldName       = "last-updated-time"
+	skipFieldName                  = "skip"
+	topFieldName                   = "top"
+	sessionIDsFieldName            = "sessions-ids"
+	sessionStateFieldName          = "session-state"
+	errorConditionFieldName        = "errorCondition"
+)
+
+// Link Properties
+const (
+	sessionAcceptTimeoutPropertyName = "com.microsoft:timeout"
 )
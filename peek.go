@@ -0,0 +1,164 @@
+package servicebus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/Azure/azure-amqp-common-go/log"
+)
+
+type (
+	// MessageIterator pages through the messages of an entity without locking or removing them. Messages are fetched a
+	// page at a time as Next is called.
+	MessageIterator struct {
+		link             *managementLink
+		next             int64
+		page             []*Message
+		done             bool
+		includeScheduled bool
+		omitBody         bool
+	}
+
+	// PeekOption configures a MessageIterator
+	PeekOption func(*MessageIterator) error
+)
+
+// PeekWithScheduledMessages configures the iterator to also return scheduled messages, which are in the entity but
+// can't be received before their scheduled enqueue time. The ScheduledEnqueueTime of a scheduled message is set, and its
+// State is MessageStateScheduled, which tells it apart from the messages which can be received.
+func PeekWithScheduledMessages() PeekOption {
+	return func(mi *MessageIterator) error {
+		mi.includeScheduled = true
+		return nil
+	}
+}
+
+// PeekWithoutBody configures the iterator to discard the bodies of the messages it returns, for tools which only inspect
+// properties and annotations. Service Bus can't peek messages without their bodies, so each page is still transferred
+// whole and this does not reduce the bandwidth used; it bounds the memory held by the peeked messages to their headers.
+// The Data and Value of the returned messages are nil, and their BodyOmitted returns true.
+func PeekWithoutBody() PeekOption {
+	return func(mi *MessageIterator) error {
+		mi.omitBody = true
+		return nil
+	}
+}
+
+// Peek returns a MessageIterator over the messages of the Queue, starting at its head. Peeked messages are not locked
+// and remain available to receivers, so dispositions have no effect on them. Scheduled messages are skipped unless
+// PeekWithScheduledMessages is used. The iterator must be closed when it is no longer needed.
+func (q *Queue) Peek(ctx context.Context, opts ...PeekOption) (*MessageIterator, error) {
+	return q.PeekFromSequenceNumber(ctx, 1, opts...)
+}
+
+// PeekFromSequenceNumber returns a MessageIterator over the messages of the Queue, starting at the message with the
+// given sequence number, or the next one after it. See Peek.
+func (q *Queue) PeekFromSequenceNumber(ctx context.Context, seq int64, opts ...PeekOption) (*MessageIterator, error) {
+	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.PeekFromSequenceNumber")
+	defer span.Finish()
+
+	return q.namespace.newMessageIterator(ctx, q.Name, seq, opts...)
+}
+
+// PeekDeadLetter returns a MessageIterator over the messages of the dead letter queue of the Queue, starting at its head,
+// so the messages can be inspected without being received. DeadLetterReason and DeadLetterErrorDescription of a peeked
+// message tell why it was dead lettered. The count of dead lettered messages is reported by the RuntimeInfo of the
+// QueueManager. See Peek.
+func (q *Queue) PeekDeadLetter(ctx context.Context) (*MessageIterator, error) {
+	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.PeekDeadLetter")
+	defer span.Finish()
+
+	return q.namespace.newMessageIterator(ctx, deadLetterPath(q.Name), 1)
+}
+
+func (ns *Namespace) newMessageIterator(ctx context.Context, entityPath string, seq int64, opts ...PeekOption) (*MessageIterator, error) {
+	mi := &MessageIterator{
+		next: seq,
+	}
+	for _, opt := range opts {
+		if err := opt(mi); err != nil {
+			log.For(ctx).Error(err)
+			return nil, err
+		}
+	}
+
+	link, err := ns.newManagementLink(ctx, entityPath)
+	if err != nil {
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+	mi.link = link
+	return mi, nil
+}
+
+// Next returns the next message, or io.EOF once the last message of the entity was returned
+func (mi *MessageIterator) Next(ctx context.Context) (*Message, error) {
+	for {
+		if len(mi.page) == 0 {
+			if mi.done {
+				return nil, io.EOF
+			}
+
+			page, err := mi.link.peek(ctx, mi.next, peekPageSize)
+			if err != nil {
+				log.For(ctx).Error(err)
+				return nil, err
+			}
+
+			if len(page) == 0 {
+				mi.done = true
+				return nil, io.EOF
+			}
+			mi.page = page
+		}
+
+		msg := mi.page[0]
+		if msg.SystemProperties == nil || msg.SystemProperties.SequenceNumber == nil {
+			return nil, errors.New("peeked message did not contain a sequence number")
+		}
+		mi.page = mi.page[1:]
+		mi.next = *msg.SystemProperties.SequenceNumber + 1
+
+		if msg.State() == MessageStateScheduled {
+			if !mi.includeScheduled {
+				continue
+			}
+			msg.ScheduledEnqueueTime = msg.SystemProperties.ScheduledEnqueueTime
+		}
+
+		if mi.omitBody {
+			msg.omitBody()
+		}
+		return msg, nil
+	}
+}
+
+// Close releases the link the iterator peeks through
+func (mi *MessageIterator) Close(ctx context.Context) error {
+	mi.done = true
+	mi.page = nil
+	return mi.link.Close(ctx)
+}
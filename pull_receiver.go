@@ -0,0 +1,105 @@
+package servicebus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"io"
+
+	"github.com/Azure/azure-amqp-common-go/log"
+	"pack.ag/amqp"
+)
+
+type (
+	// Receiver receives the messages of an entity one at a time as Next is called, as an alternative to handling them
+	// with a Handler. Messages are received in the receive mode of the entity; in PeekLock mode, the caller settles each
+	// message with Complete, Abandon, DeadLetter or Defer, which are sent over the link of the Receiver, so the
+	// Receiver must stay open until its messages are settled. A Receiver must be closed when it is no longer needed.
+	Receiver struct {
+		r *receiver
+	}
+)
+
+// NewReceiver opens a Receiver for the messages of the queue. The Receiver has its own connection, independent of
+// Receive and the other receive methods of the queue.
+func (q *Queue) NewReceiver(ctx context.Context, opts ...ReceiveOption) (*Receiver, error) {
+	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.NewReceiver")
+	defer span.Finish()
+
+	r, err := q.namespace.newReceiver(ctx, q.Name, q.receiverOptions(receiverOptions(opts))...)
+	if err != nil {
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+	return &Receiver{r: r}, nil
+}
+
+// Next waits for the next message and returns it. When ctx is done before a message arrives, io.EOF is returned, so
+// Next can drive a loop which ends with ctx. If the link fails, it is recovered before waiting again, unless the error
+// can't be recovered from, such as the entity having been deleted, which is returned.
+func (rc *Receiver) Next(ctx context.Context) (*Message, error) {
+	span, ctx := rc.r.startConsumerSpanFromContext(ctx, "sb.Receiver.Next")
+	defer span.Finish()
+
+	for {
+		amqpMsg, err := rc.r.listenForMessage(ctx)
+		if err == nil {
+			return rc.r.received(ctx, amqpMsg), nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, io.EOF
+		}
+		if isNonRecoverableError(err) {
+			log.For(ctx).Error(err)
+			return nil, wrapError(err)
+		}
+		if retryErr := rc.r.recoverWithRetry(ctx, err); retryErr != nil {
+			if ctx.Err() != nil {
+				return nil, io.EOF
+			}
+			log.For(ctx).Error(retryErr)
+			return nil, wrapError(retryErr)
+		}
+	}
+}
+
+// Close closes the link and connection of the Receiver. Messages which were received but not settled are delivered
+// again once their locks expire.
+func (rc *Receiver) Close(ctx context.Context) error {
+	return rc.r.Close(ctx)
+}
+
+// received returns the Message for a message delivered to the receiver, whose dispositions are sent over its link
+func (r *receiver) received(ctx context.Context, msg *amqp.Message) *Message {
+	event, err := messageFromAMQPMessage(msg)
+	if err != nil {
+		log.For(ctx).Error(err)
+	}
+	event.receiver = r
+	if r.mode == ReceiveAndDeleteMode {
+		// Service Bus settled the message when it was delivered, so its dispositions have no effect
+		event.settle()
+	}
+	return event
+}
@@ -25,8 +25,11 @@ package servicebus
 import (
 	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"sync"
+	"time"
 
 	"github.com/Azure/azure-amqp-common-go/log"
 	"github.com/Azure/go-autorest/autorest/date"
@@ -37,6 +40,23 @@ type (
 		Name                  string
 		namespace             *Namespace
 		renewMessageLockMutex sync.Mutex
+		versionedSessionState bool
+		emptyPollBackoff      pollBackoff
+		lockLost              lockLostHandling
+		redelivery            *redeliveryTracker
+		dispositionWatchdog   dispositionWatchdog
+		assignMessageIDs      *bool
+		propertiesMu          sync.Mutex
+		properties            *entityProperties
+	}
+
+	// entityProperties are the values of the description of an entity which its senders adapt to. They are looked up
+	// once per entity, see entity.describe.
+	entityProperties struct {
+		// defaultMessageTTL is the default message time to live of the entity, or 0 if it is unbounded or unknown
+		defaultMessageTTL time.Duration
+		// duplicateDetectionWindow is the duplicate detection history time window of the entity, or 0 if it is unknown
+		duplicateDetectionWindow time.Duration
 	}
 
 	// Queue represents a Service Bus Queue entity, which offers First In, First Out (FIFO) message delivery to one or
@@ -47,10 +67,22 @@ type (
 		*entity
 		sender            *sender
 		receiver          *receiver
+		batchReceiver     *receiver
+		mgmtLink          *managementLink
 		receiverMu        sync.Mutex
 		senderMu          sync.Mutex
+		mgmtLinkMu        sync.Mutex
 		receiveMode       ReceiveMode
 		requiredSessionID *string
+		routingProperty   string
+		router            func(key string) Handler
+		middleware        []func(Handler) Handler
+		sendMiddleware    []func(SendFunc) SendFunc
+		dedupWindow       time.Duration
+		sentMessages      *sentMessageTracker
+		sentMessagesOnce  sync.Once
+		maxPendingSends   int
+		pendingSends      chan struct{}
 	}
 
 	// queueContent is a specialized Queue body for an Atom entry
@@ -64,26 +96,32 @@ type (
 	QueueDescription struct {
 		XMLName xml.Name `xml:"QueueDescription"`
 		BaseEntityDescription
-		LockDuration                        *string       `xml:"LockDuration,omitempty"`               // LockDuration - ISO 8601 timespan duration of a peek-lock; that is, the amount of time that the message is locked for other receivers. The maximum value for LockDuration is 5 minutes; the default value is 1 minute.
-		MaxSizeInMegabytes                  *int32        `xml:"MaxSizeInMegabytes,omitempty"`         // MaxSizeInMegabytes - The maximum size of the queue in megabytes, which is the size of memory allocated for the queue. Default is 1024.
-		RequiresDuplicateDetection          *bool         `xml:"RequiresDuplicateDetection,omitempty"` // RequiresDuplicateDetection - A value indicating if this queue requires duplicate detection.
-		RequiresSession                     *bool         `xml:"RequiresSession,omitempty"`
-		DefaultMessageTimeToLive            *string       `xml:"DefaultMessageTimeToLive,omitempty"`            // DefaultMessageTimeToLive - ISO 8601 default message timespan to live value. This is the duration after which the message expires, starting from when the message is sent to Service Bus. This is the default value used when TimeToLive is not set on a message itself.
-		DeadLetteringOnMessageExpiration    *bool         `xml:"DeadLetteringOnMessageExpiration,omitempty"`    // DeadLetteringOnMessageExpiration - A value that indicates whether this queue has dead letter support when a message expires.
-		DuplicateDetectionHistoryTimeWindow *string       `xml:"DuplicateDetectionHistoryTimeWindow,omitempty"` // DuplicateDetectionHistoryTimeWindow - ISO 8601 timeSpan structure that defines the duration of the duplicate detection history. The default value is 10 minutes.
-		MaxDeliveryCount                    *int32        `xml:"MaxDeliveryCount,omitempty"`                    // MaxDeliveryCount - The maximum delivery count. A message is automatically deadlettered after this number of deliveries. default value is 10.
-		EnableBatchedOperations             *bool         `xml:"EnableBatchedOperations,omitempty"`             // EnableBatchedOperations - Value that indicates whether server-side batched operations are enabled.
-		SizeInBytes                         *int64        `xml:"SizeInBytes,omitempty"`                         // SizeInBytes - The size of the queue, in bytes.
-		MessageCount                        *int64        `xml:"MessageCount,omitempty"`                        // MessageCount - The number of messages in the queue.
-		IsAnonymousAccessible               *bool         `xml:"IsAnonymousAccessible,omitempty"`
-		Status                              *EntityStatus `xml:"Status,omitempty"`
-		CreatedAt                           *date.Time    `xml:"CreatedAt,omitempty"`
-		UpdatedAt                           *date.Time    `xml:"UpdatedAt,omitempty"`
-		SupportOrdering                     *bool         `xml:"SupportOrdering,omitempty"`
-		AutoDeleteOnIdle                    *string       `xml:"AutoDeleteOnIdle,omitempty"`
-		EnablePartitioning                  *bool         `xml:"EnablePartitioning,omitempty"`
-		EnableExpress                       *bool         `xml:"EnableExpress,omitempty"`
-		CountDetails                        *CountDetails `xml:"CountDetails,omitempty"`
+		LockDuration                        *string             `xml:"LockDuration,omitempty"`               // LockDuration - ISO 8601 timespan duration of a peek-lock; that is, the amount of time that the message is locked for other receivers. The maximum value for LockDuration is 5 minutes; the default value is 1 minute.
+		MaxSizeInMegabytes                  *int32              `xml:"MaxSizeInMegabytes,omitempty"`         // MaxSizeInMegabytes - The maximum size of the queue in megabytes, which is the size of memory allocated for the queue. Default is 1024.
+		RequiresDuplicateDetection          *bool               `xml:"RequiresDuplicateDetection,omitempty"` // RequiresDuplicateDetection - A value indicating if this queue requires duplicate detection.
+		RequiresSession                     *bool               `xml:"RequiresSession,omitempty"`
+		DefaultMessageTimeToLive            *string             `xml:"DefaultMessageTimeToLive,omitempty"`            // DefaultMessageTimeToLive - ISO 8601 default message timespan to live value. This is the duration after which the message expires, starting from when the message is sent to Service Bus. This is the default value used when TimeToLive is not set on a message itself.
+		DeadLetteringOnMessageExpiration    *bool               `xml:"DeadLetteringOnMessageExpiration,omitempty"`    // DeadLetteringOnMessageExpiration - A value that indicates whether this queue has dead letter support when a message expires.
+		DuplicateDetectionHistoryTimeWindow *string             `xml:"DuplicateDetectionHistoryTimeWindow,omitempty"` // DuplicateDetectionHistoryTimeWindow - ISO 8601 timeSpan structure that defines the duration of the duplicate detection history. The default value is 10 minutes.
+		MaxDeliveryCount                    *int32              `xml:"MaxDeliveryCount,omitempty"`                    // MaxDeliveryCount - The maximum delivery count. A message is automatically deadlettered after this number of deliveries. default value is 10.
+		EnableBatchedOperations             *bool               `xml:"EnableBatchedOperations,omitempty"`             // EnableBatchedOperations - Value that indicates whether server-side batched operations are enabled.
+		SizeInBytes                         *int64              `xml:"SizeInBytes,omitempty"`                         // SizeInBytes - The size of the queue, in bytes.
+		MessageCount                        *int64              `xml:"MessageCount,omitempty"`                        // MessageCount - The number of messages in the queue.
+		IsAnonymousAccessible               *bool               `xml:"IsAnonymousAccessible,omitempty"`
+		AuthorizationRules                  []AuthorizationRule `xml:"AuthorizationRules>AuthorizationRule,omitempty"` // AuthorizationRules - The shared access authorization rules of the entity, which grant the holders of their keys rights on it.
+		Status                              *EntityStatus       `xml:"Status,omitempty"`
+		ForwardTo                           *string             `xml:"ForwardTo,omitempty"`    // ForwardTo - The name of the entity which Service Bus automatically forwards the messages of the queue to.
+		UserMetadata                        *string             `xml:"UserMetadata,omitempty"` // UserMetadata - Custom metadata stored with the queue, which Service Bus does not interpret.
+		CreatedAt                           *date.Time          `xml:"CreatedAt,omitempty"`
+		UpdatedAt                           *date.Time          `xml:"UpdatedAt,omitempty"`
+		AccessedAt                          *date.Time          `xml:"AccessedAt,omitempty"` // AccessedAt - The last time a message was sent to or received from the queue.
+		SupportOrdering                     *bool               `xml:"SupportOrdering,omitempty"`
+		AutoDeleteOnIdle                    *string             `xml:"AutoDeleteOnIdle,omitempty"`
+		EnablePartitioning                  *bool               `xml:"EnablePartitioning,omitempty"`
+		EntityAvailabilityStatus            *string             `xml:"EntityAvailabilityStatus,omitempty"` // EntityAvailabilityStatus - Whether the queue is Available, or its Limited, Renaming, Restoring or Unknown availability when it is not.
+		EnableExpress                       *bool               `xml:"EnableExpress,omitempty"`
+		CountDetails                        *CountDetails       `xml:"CountDetails,omitempty"`
+		ForwardDeadLetteredMessagesTo       *string             `xml:"ForwardDeadLetteredMessagesTo,omitempty"` // ForwardDeadLetteredMessagesTo - The name of the entity which Service Bus automatically forwards dead lettered messages of the queue to.
 	}
 
 	// QueueOption represents named options for assisting Queue message handling
@@ -104,6 +142,9 @@ const (
 // QueueWithReceiveAndDelete configures a queue to pop and delete messages off of the queue upon receiving the message.
 // This differs from the default, PeekLock, where PeekLock receives a message, locks it for a period of time, then sends
 // a disposition to the broker when the message has been processed.
+//
+// Messages are delivered at most once, as a message is deleted even if its Handler fails. Dispositions such as Complete
+// and Abandon have no effect on messages received in this mode, and their locks can't be renewed.
 func QueueWithReceiveAndDelete() QueueOption {
 	return func(q *Queue) error {
 		q.receiveMode = ReceiveAndDeleteMode
@@ -111,6 +152,177 @@ func QueueWithReceiveAndDelete() QueueOption {
 	}
 }
 
+// QueueWithVersionedSessionState configures the queue to embed a version counter in the session state it writes, so that
+// MessageSession.SetStateIfUnchanged detects every concurrent update, including ones that wrote identical state. All
+// receivers of the queue's sessions should use this option, as the stored state includes the counter.
+func QueueWithVersionedSessionState() QueueOption {
+	return func(q *Queue) error {
+		q.versionedSessionState = true
+		return nil
+	}
+}
+
+// QueueWithMessageIDAssignment configures whether an ID is assigned to messages sent without one, which they are by
+// default. Disabling it saves creating IDs for messages sent to a queue which doesn't require duplicate detection, where
+// they are only useful to the application.
+func QueueWithMessageIDAssignment(enabled bool) QueueOption {
+	return func(q *Queue) error {
+		q.assignMessageIDs = &enabled
+		return nil
+	}
+}
+
+// QueueWithReceiveMiddleware configures the queue to wrap the Handler of every receive with middleware. The first
+// middleware is the outermost, so it sees each message first and its disposition last. Middleware may short-circuit
+// the pipeline by returning a DispositionAction without calling the Handler it wraps. Calling this option multiple times
+// appends to the chain.
+func QueueWithReceiveMiddleware(mw ...func(Handler) Handler) QueueOption {
+	return func(q *Queue) error {
+		for _, m := range mw {
+			if m == nil {
+				return errors.New("middleware must not be nil")
+			}
+		}
+		q.middleware = append(q.middleware, mw...)
+		return nil
+	}
+}
+
+// QueueWithSendMiddleware configures the queue to pass every message it sends through middleware before the message is
+// serialized. The first middleware is the outermost, so it sees each message first. Middleware may mutate the message,
+// for example to stamp user properties, or abort the send by returning an error without calling the SendFunc it wraps.
+// Calling this option multiple times appends to the chain.
+func QueueWithSendMiddleware(mw ...func(SendFunc) SendFunc) QueueOption {
+	return func(q *Queue) error {
+		for _, m := range mw {
+			if m == nil {
+				return errors.New("middleware must not be nil")
+			}
+		}
+		q.sendMiddleware = append(q.sendMiddleware, mw...)
+		return nil
+	}
+}
+
+// QueueWithEmptyPollBackoff configures the receive loop of the queue to poll for messages rather than wait on them
+// indefinitely. Each poll waits up to initial for a message. When none arrives, the loop backs off before polling again,
+// starting at initial and doubling up to max. The backoff is reset when a message arrives. This reduces the work done
+// by consumers of queues which rarely have messages.
+func QueueWithEmptyPollBackoff(initial, max time.Duration) QueueOption {
+	return func(q *Queue) error {
+		backoff, err := newPollBackoff(initial, max)
+		if err != nil {
+			return err
+		}
+		q.emptyPollBackoff = backoff
+		return nil
+	}
+}
+
+// QueueWithRedeliveryBackoff configures a queue to hold back a message abandoned by this Queue when it is delivered
+// again too soon. Service Bus makes an abandoned message available again immediately, so the hold approximates a
+// visibility timeout: it starts at base and doubles each time the message is abandoned, up to max. Messages are tracked
+// by sequence number in memory, and only the most recently abandoned messages are remembered.
+//
+// A held message blocks the receive loop, so the messages after it wait too, and its lock keeps running while it is
+// held; max should be well below the lock duration of the queue.
+func QueueWithRedeliveryBackoff(base, max time.Duration) QueueOption {
+	return func(q *Queue) error {
+		tracker, err := newRedeliveryTracker(base, max)
+		if err != nil {
+			return err
+		}
+		q.redelivery = tracker
+		return nil
+	}
+}
+
+// QueueWithDispositionDeadline configures a queue to call onViolation for each received message which was not
+// completed, abandoned or dead lettered within d after it was delivered, which catches handlers that forget to settle
+// a message and leave it to hold its lock until it expires. onViolation is called while the Handler still runs, so it
+// can only warn then; the DispositionAction it returns, if not nil, is applied once the Handler returned and only if
+// the Handler provided no disposition, in place of completing the message. Returning msg.Abandon() releases such a
+// message for redelivery, and returning nil only warns. If onViolation is nil, such messages are abandoned.
+func QueueWithDispositionDeadline(d time.Duration, onViolation func(ctx context.Context, msg *Message) DispositionAction) QueueOption {
+	return func(q *Queue) error {
+		if d <= 0 {
+			return errors.New("disposition deadline must be greater than 0")
+		}
+		if onViolation == nil {
+			onViolation = func(_ context.Context, msg *Message) DispositionAction {
+				return msg.Abandon()
+			}
+		}
+		q.dispositionWatchdog = dispositionWatchdog{
+			deadline:    d,
+			onViolation: onViolation,
+		}
+		return nil
+	}
+}
+
+// QueueWithLockLostHandler configures what happens when a Handler returns after the lock on its message expired, in
+// which case Service Bus may have delivered the message to another receiver. The policy determines whether the
+// disposition is still sent, and onLockLost, if not nil, is called with ErrMessageLockLost so the application can
+// reconcile the side effects of handling the message, which may be handled again elsewhere.
+//
+// Whether a lock expired is judged by the local clock, compensated for the skew measured against Service Bus, as the
+// AMQP library doesn't report the outcome of dispositions sent over a receive link. The lock of a message of a session
+// is the lock of the session, so it is extended when the session lock is renewed. onLockLost is also called when
+// Service Bus refuses the disposition of a deferred message received with ReceiveDeferred because its lock was lost.
+func QueueWithLockLostHandler(policy LockLostPolicy, onLockLost func(ctx context.Context, msg *Message, err error)) QueueOption {
+	return func(q *Queue) error {
+		q.lockLost = lockLostHandling{
+			policy:     policy,
+			onLockLost: onLockLost,
+		}
+		return nil
+	}
+}
+
+// QueueWithRoutingKey configures a queue to dispatch each received message to the Handler returned by router for the
+// value of the message's user property named by property. Messages without the property, or for which router returns
+// nil, are handled by the Handler provided to Receive, ReceiveOne or ReceiveOneSession.
+func QueueWithRoutingKey(property string, router func(key string) Handler) QueueOption {
+	return func(q *Queue) error {
+		if property == "" {
+			return errors.New("routing property must not be empty")
+		}
+		if router == nil {
+			return errors.New("router must not be nil")
+		}
+		q.routingProperty = property
+		q.router = router
+		return nil
+	}
+}
+
+// QueueWithDuplicateDetectionWindow configures the duplicate detection history time window used by SendWithResult to
+// determine if a message was likely discarded as a duplicate. By default, the window configured on the entity is used,
+// or 10 minutes, the default of Service Bus, if the entity can't be looked up.
+func QueueWithDuplicateDetectionWindow(window time.Duration) QueueOption {
+	return func(q *Queue) error {
+		if window <= 0 {
+			return errors.New("duplicate detection window must be greater than 0")
+		}
+		q.dedupWindow = window
+		return nil
+	}
+}
+
+// QueueWithMaxPendingSends configures the number of messages sent with SendAsync which may await confirmation at once.
+// SendAsync blocks while that many sends are pending, which bounds the memory used by producers which send faster than
+// Service Bus confirms. The default is 256.
+func QueueWithMaxPendingSends(max int) QueueOption {
+	return func(q *Queue) error {
+		if max < 1 {
+			return errors.New("max pending sends must be greater than 0")
+		}
+		q.maxPendingSends = max
+		return nil
+	}
+}
+
 //// QueueWithRequiredSession configures a queue to use a session
 //func QueueWithRequiredSession(sessionID string) QueueOption {
 //	return func(q *Queue) error {
@@ -126,7 +338,8 @@ func (ns *Namespace) NewQueue(name string, opts ...QueueOption) (*Queue, error)
 			namespace: ns,
 			Name:      name,
 		},
-		receiveMode: PeekLockMode,
+		receiveMode:     PeekLockMode,
+		maxPendingSends: defaultMaxPendingSends,
 	}
 
 	for _, opt := range opts {
@@ -134,6 +347,7 @@ func (ns *Namespace) NewQueue(name string, opts ...QueueOption) (*Queue, error)
 			return nil, err
 		}
 	}
+	queue.pendingSends = make(chan struct{}, queue.maxPendingSends)
 	return queue, nil
 }
 
@@ -147,38 +361,368 @@ func (q *Queue) Send(ctx context.Context, event *Message) error {
 		log.For(ctx).Error(err)
 		return err
 	}
-	return q.sender.Send(ctx, event)
+	return q.sendFuncFor(func(ctx context.Context, msg *Message) error {
+		return q.sender.Send(ctx, msg)
+	})(ctx, event)
+}
+
+// SendWithOptions sends a message to the Queue, bounding how long to wait for the message to be transferred and for
+// Service Bus to confirm it was accepted by the timeouts of so. If the timeouts elapse, ErrConfirmTimeout is returned,
+// as the message may have been accepted. The AMQP library does not report when a transfer completes, so the two
+// timeouts bound the send together: a slow transfer shortens the wait for its confirmation, and the transfer may take
+// up to TransferTimeout + ConfirmTimeout.
+func (q *Queue) SendWithOptions(ctx context.Context, msg *Message, so SendOptions) error {
+	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.SendWithOptions")
+	defer span.Finish()
+
+	if err := q.ensureSender(ctx); err != nil {
+		log.For(ctx).Error(err)
+		return err
+	}
+	return q.sendFuncFor(func(ctx context.Context, msg *Message) error {
+		return q.sender.SendWithOptions(ctx, msg, so)
+	})(ctx, msg)
+}
+
+// SendResultWithPeekCheck configures SendWithResult to check that a message which was not sent before by this client
+// landed in the Queue, by peeking the messages enqueued since the last check for its ID. A message which is not found
+// is reported as deduplicated, so duplicates sent by other clients are detected as well.
+//
+// The check is best effort and has a cost: the first check peeks the whole Queue, and every check peeks the messages
+// sent by other clients since the previous one. A message which was received and settled before it could be peeked is
+// reported as deduplicated, and as sequence numbers only grow within a partition, the check does not suit partitioned
+// queues. If the check fails, it is logged and the message is not reported as deduplicated.
+func SendResultWithPeekCheck() SendResultOption {
+	return func(so *sendResultOptions) error {
+		so.peekCheck = true
+		return nil
+	}
+}
+
+// SendWithResult sends a message to the Queue and reports if the message was likely discarded by duplicate detection.
+//
+// Service Bus does not tell a sender that a message was discarded as a duplicate, so the result is best effort: the IDs
+// of messages sent through SendWithResult are remembered for the duplicate detection window (see
+// QueueWithDuplicateDetectionWindow) and a message reusing one of them is reported as deduplicated. Duplicates sent by
+// other clients, or through Send, are only detected with SendResultWithPeekCheck.
+func (q *Queue) SendWithResult(ctx context.Context, msg *Message, opts ...SendResultOption) (*SendResult, error) {
+	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.SendWithResult")
+	defer span.Finish()
+
+	so := new(sendResultOptions)
+	for _, opt := range opts {
+		if err := opt(so); err != nil {
+			log.For(ctx).Error(err)
+			return nil, err
+		}
+	}
+
+	if err := q.ensureSender(ctx); err != nil {
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+
+	q.sentMessagesOnce.Do(func() {
+		window := q.dedupWindow
+		if window == 0 {
+			window = q.describe(ctx, q.fetchProperties).duplicateDetectionWindow
+		}
+		if window == 0 {
+			window = defaultDuplicateDetectionWindow
+		}
+		q.sentMessages = newSentMessageTracker(window)
+	})
+
+	if msg.ID == "" {
+		id, err := q.namespace.newID()
+		if err != nil {
+			log.For(ctx).Error(err)
+			return nil, err
+		}
+		msg.ID = id
+	}
+
+	// read before sending, so the message is enqueued after the sequence number the check starts at
+	peekFrom := q.sentMessages.peekFrom()
+	deduplicated := q.sentMessages.track(msg.ID, time.Now())
+	send := q.sendFuncFor(func(ctx context.Context, msg *Message) error {
+		return q.sender.Send(ctx, msg)
+	})
+	if err := send(ctx, msg); err != nil {
+		if !deduplicated {
+			q.sentMessages.forget(msg.ID)
+		}
+		return nil, err
+	}
+
+	if so.peekCheck && !deduplicated {
+		landed, err := q.peekForSentMessage(ctx, msg.ID, peekFrom)
+		if err != nil {
+			q.namespace.getLogger().Warn("failed to check that a sent message was not deduplicated",
+				"entity", q.Name, "message-id", msg.ID, "error", err)
+		} else {
+			deduplicated = !landed
+		}
+	}
+
+	return &SendResult{
+		MessageID:    msg.ID,
+		Deduplicated: deduplicated,
+	}, nil
+}
+
+// SendAsync sends a message to the Queue without waiting for Service Bus to confirm it, which allows many sends to be
+// pipelined. The returned channel delivers the outcome of the send once it is known; a nil Err means the message was
+// accepted. SendAsync blocks while the maximum number of sends are pending (see QueueWithMaxPendingSends), and the send
+// is bounded by ctx, so ctx should outlive the confirmation.
+func (q *Queue) SendAsync(ctx context.Context, msg *Message) <-chan AsyncSendResult {
+	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.SendAsync")
+	defer span.Finish()
+
+	results := make(chan AsyncSendResult, 1)
+	if err := q.ensureSender(ctx); err != nil {
+		log.For(ctx).Error(err)
+		results <- AsyncSendResult{MessageID: msg.ID, Err: err}
+		return results
+	}
+
+	select {
+	case <-ctx.Done():
+		results <- AsyncSendResult{MessageID: msg.ID, Err: ctx.Err()}
+		return results
+	case q.pendingSends <- struct{}{}:
+	}
+
+	send := q.sendFuncFor(func(ctx context.Context, msg *Message) error {
+		return q.sender.Send(ctx, msg)
+	})
+	go func() {
+		err := send(ctx, msg)
+		<-q.pendingSends
+		if err != nil {
+			log.For(ctx).Error(err)
+		}
+		results <- AsyncSendResult{MessageID: msg.ID, Err: err}
+	}()
+	return results
+}
+
+// ScheduleMessages schedules messages to be enqueued at enqueueTime, and returns the sequence numbers Service Bus
+// assigned them, in the order of the messages. The sequence numbers can be used to cancel the messages with
+// CancelScheduledMessages until they are enqueued.
+func (q *Queue) ScheduleMessages(ctx context.Context, enqueueTime time.Time, messages ...*Message) ([]int64, error) {
+	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.ScheduleMessages")
+	defer span.Finish()
+
+	if len(messages) == 0 {
+		return nil, nil
+	}
+
+	if err := q.ensureSender(ctx); err != nil {
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+
+	utcTime := enqueueTime.UTC()
+	for _, msg := range messages {
+		if err := q.sender.prepare(ctx, msg); err != nil {
+			return nil, err
+		}
+		msg.ScheduledEnqueueTime = &utcTime
+	}
+	return q.sender.schedule(ctx, messages...)
+}
+
+// CancelScheduledMessages cancels the enqueuing of scheduled messages identified by their sequence numbers. If Service
+// Bus refuses to cancel some of them, for example because they were already enqueued, a *CancelScheduledError
+// identifies them; the others are canceled.
+func (q *Queue) CancelScheduledMessages(ctx context.Context, sequenceNumbers ...int64) error {
+	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.CancelScheduledMessages")
+	defer span.Finish()
+
+	if len(sequenceNumbers) == 0 {
+		return nil
+	}
+
+	link, err := q.namespace.newManagementLink(ctx, q.Name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = link.Close(ctx)
+	}()
+
+	err = link.cancelScheduled(ctx, sequenceNumbers...)
+	if err == nil {
+		return nil
+	}
+
+	if len(sequenceNumbers) == 1 {
+		return &CancelScheduledError{Rejected: sequenceNumbers, Err: err}
+	}
+
+	// a refused request does not identify the messages at fault, so cancel them one at a time to find which were refused
+	cancelErr := &CancelScheduledError{}
+	for _, sequenceNumber := range sequenceNumbers {
+		if err := link.cancelScheduled(ctx, sequenceNumber); err != nil {
+			cancelErr.Rejected = append(cancelErr.Rejected, sequenceNumber)
+			if cancelErr.Err == nil {
+				cancelErr.Err = err
+			}
+		}
+	}
+
+	if len(cancelErr.Rejected) == 0 {
+		return nil
+	}
+	log.For(ctx).Error(cancelErr)
+	return cancelErr
 }
 
 // ReceiveOne will listen to receive a single message. ReceiveOne will only wait as long as the context allows.
-func (q *Queue) ReceiveOne(ctx context.Context, handler Handler) error {
+//
+// The handler is called with the message and its disposition is applied before ReceiveOne returns, which suits workers
+// which poll for one message at a time. If no message arrives before the context is done, the error of the context is
+// returned, such as context.DeadlineExceeded.
+func (q *Queue) ReceiveOne(ctx context.Context, handler Handler, opts ...ReceiveOption) error {
 	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.ReceiveOne")
 	defer span.Finish()
 
-	if err := q.ensureReceiver(ctx); err != nil {
+	if err := q.ensureReceiver(ctx, receiverOptions(opts)...); err != nil {
 		return err
 	}
 
-	return q.receiver.ReceiveOne(ctx, handler)
+	return q.receiver.ReceiveOne(ctx, q.handlerFor(handler))
 }
 
 // Receive subscribes for messages sent to the Queue
-func (q *Queue) Receive(ctx context.Context, handler Handler) error {
+func (q *Queue) Receive(ctx context.Context, handler Handler, opts ...ReceiveOption) error {
 	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.Receive")
 	defer span.Finish()
 
-	err := q.ensureReceiver(ctx)
+	err := q.ensureReceiver(ctx, receiverOptions(opts)...)
 	if err != nil {
 		return err
 	}
 
-	handle := q.receiver.Listen(ctx, handler)
+	handle := q.receiver.Listen(ctx, q.handlerFor(handler))
 	<-handle.Done()
 	return handle.Err()
 }
 
+// ReceiveToChannel starts receiving messages from the queue and delivers them to the returned message channel, which
+// buffers up to bufferSize messages. When the buffer is full, the receiver stops pulling messages from Service Bus
+// until the consumer catches up. Messages delivered through the channel are not settled automatically; the consumer
+// is responsible for calling Complete, Abandon or DeadLetter on each of them.
+//
+// The error channel receives at most one error, the reason receiving stopped, and is closed afterwards. The returned
+// func stops receiving, abandons any messages remaining in the buffer and closes the message channel. It should always
+// be called once the consumer is done with the channels.
+func (q *Queue) ReceiveToChannel(ctx context.Context, bufferSize int) (<-chan *Message, <-chan error, func()) {
+	if bufferSize < 0 {
+		bufferSize = 0
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	messages := make(chan *Message, bufferSize)
+	errs := make(chan error, 1)
+
+	var (
+		mu     sync.Mutex
+		closed bool
+	)
+
+	handler := HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if closed {
+			return msg.Abandon()
+		}
+
+		select {
+		case messages <- msg:
+			// settlement is left to the consumer of the channel
+			return func(context.Context) {}
+		case <-ctx.Done():
+			return msg.Abandon()
+		}
+	})
+
+	stop := func() {
+		cancel()
+
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return
+		}
+		closed = true
+		close(messages)
+
+		for msg := range messages {
+			msg.Abandon()(context.Background())
+		}
+	}
+
+	go func() {
+		defer close(errs)
+		if err := q.Receive(ctx, handler); err != nil && err != context.Canceled {
+			errs <- err
+		}
+	}()
+
+	return messages, errs, stop
+}
+
+// ListSessions returns the IDs of the sessions of the Queue which hold messages. Receive the messages of a session
+// with ReceiveOneSession.
+func (q *Queue) ListSessions(ctx context.Context) ([]string, error) {
+	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.ListSessions")
+	defer span.Finish()
+
+	return q.namespace.listSessions(ctx, q.Name, allSessionsWithMessages)
+}
+
+// ListSessionsUpdatedSince returns the IDs of the sessions of the Queue whose state was updated after since
+func (q *Queue) ListSessionsUpdatedSince(ctx context.Context, since time.Time) ([]string, error) {
+	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.ListSessionsUpdatedSince")
+	defer span.Finish()
+
+	return q.namespace.listSessions(ctx, q.Name, since.UTC())
+}
+
+// GetSessionState returns the state of a session of the Queue without accepting the session, such as a checkpoint saved
+// by the session's handler with MessageSession.SetState. If no state was ever set on the session, nil is returned.
+func (q *Queue) GetSessionState(ctx context.Context, sessionID string) ([]byte, error) {
+	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.GetSessionState")
+	defer span.Finish()
+
+	link, err := q.namespace.newManagementLink(ctx, q.Name)
+	if err != nil {
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+	defer func() {
+		_ = link.Close(ctx)
+	}()
+
+	state, err := link.getSessionState(ctx, sessionID)
+	if err != nil {
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+
+	if q.versionedSessionState {
+		_, state = decodeVersionedState(state)
+	}
+	return state, nil
+}
+
 // ReceiveOneSession waits for the lock on a particular session to become available, takes it, then process the session.
-func (q *Queue) ReceiveOneSession(ctx context.Context, sessionID *string, handler SessionHandler) error {
+// With WithSessionAcceptTimeout, ReceiveOneSession returns ErrNoSessionAvailable when no session becomes available in
+// time, rather than waiting until the context is done.
+func (q *Queue) ReceiveOneSession(ctx context.Context, sessionID *string, handler SessionHandler, opts ...ReceiveOption) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
@@ -187,7 +731,7 @@ func (q *Queue) ReceiveOneSession(ctx context.Context, sessionID *string, handle
 
 	// Establish a receiver that reads a particular session.
 	q.requiredSessionID = sessionID
-	if err := q.ensureReceiver(ctx, receiverWithSession(sessionID)); err != nil {
+	if err := q.ensureReceiver(ctx, append(receiverOptions(opts), receiverWithSession(sessionID))...); err != nil {
 		return err
 	}
 
@@ -202,18 +746,36 @@ func (q *Queue) ReceiveOneSession(ctx context.Context, sessionID *string, handle
 	}
 
 	defer handler.End()
-	handle := q.receiver.Listen(ctx, handler)
+	defer ms.renewLockWhileOpen(ctx)()
+	defer ms.closeWhenIdle(ctx)()
+	ctx = withMessageSession(ctx, ms)
+	r := q.receiver
+	handle := r.Listen(ctx, ms.trackActivity(q.handlerFor(handler)))
 
 	select {
 	case <-handle.Done():
 		return handle.Err()
 	case <-ms.done:
+		q.releaseReceiver(r)
 		return nil
 	}
 }
 
+// releaseReceiver closes the receiver of a session which was closed, once the handlers of the messages in flight have
+// returned, so the lock on the session is released
+func (q *Queue) releaseReceiver(r *receiver) {
+	q.receiverMu.Lock()
+	if q.receiver == r {
+		q.receiver = nil
+	}
+	q.receiverMu.Unlock()
+
+	// the context of the handlers may be done already, so wait for them without it
+	_ = r.Drain(context.Background())
+}
+
 // ReceiveSessions is the session-based counterpart of `Receive`. It subscribes to a Queue and waits for new sessions to
-// become available.
+// become available. Sessions are processed one at a time; use ReceiveSessionsConcurrently to process several at once.
 func (q *Queue) ReceiveSessions(ctx context.Context, handler SessionHandler) error {
 	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.ReceiveSessions")
 	defer span.Finish()
@@ -225,6 +787,210 @@ func (q *Queue) ReceiveSessions(ctx context.Context, handler SessionHandler) err
 	}
 }
 
+// ReceiveSessionsConcurrently processes up to maxConcurrent sessions of the Queue at a time, each locked by a receiver
+// link of its own and handled by a SessionHandler returned by handlerFactory, so handlers need not be safe for
+// concurrent use. When a session is closed, another session is accepted in its place.
+//
+// When ctx is done, no more sessions are accepted and messages are no longer dispatched, the handlers of the messages in
+// flight are waited for, and the links are closed before ctx.Err() is returned. If processing a session fails with an
+// error other than ErrNoSessionAvailable, the other sessions are drained the same way and the error is returned.
+func (q *Queue) ReceiveSessionsConcurrently(ctx context.Context, maxConcurrent int, handlerFactory func() SessionHandler, opts ...ReceiveOption) error {
+	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.ReceiveSessionsConcurrently")
+	defer span.Finish()
+
+	if maxConcurrent < 1 {
+		return errors.New("maxConcurrent must be greater than 0")
+	}
+	if handlerFactory == nil {
+		return errors.New("handlerFactory must not be nil")
+	}
+
+	workerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, maxConcurrent)
+	var wg sync.WaitGroup
+	wg.Add(maxConcurrent)
+	for i := 0; i < maxConcurrent; i++ {
+		go func() {
+			defer wg.Done()
+			for workerCtx.Err() == nil {
+				err := q.receiveNextSession(workerCtx, handlerFactory(), opts)
+				if err == nil || errors.Is(err, ErrNoSessionAvailable) || workerCtx.Err() != nil {
+					continue
+				}
+				log.For(workerCtx).Error(err)
+				errs <- err
+				cancel()
+				return
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	if err, ok := <-errs; ok {
+		return err
+	}
+	return ctx.Err()
+}
+
+// receiveNextSession locks the next available session on a receiver link of its own and dispatches its messages to
+// handler until the session is closed or ctx is done. The link is closed once the handlers of the messages in flight
+// have returned.
+func (q *Queue) receiveNextSession(ctx context.Context, handler SessionHandler, opts []ReceiveOption) error {
+	r, err := q.namespace.newReceiver(ctx, q.Name, q.receiverOptions(append(receiverOptions(opts), receiverWithSession(nil)))...)
+	if err != nil {
+		return err
+	}
+
+	ms, err := newMessageSession(r, q.entity, nil)
+	if err != nil {
+		_ = r.Close(ctx)
+		return err
+	}
+
+	if err := handler.Start(ms); err != nil {
+		_ = r.Close(ctx)
+		return err
+	}
+
+	stopRenewal := ms.renewLockWhileOpen(ctx)
+	stopIdleWatch := ms.closeWhenIdle(ctx)
+	handle := r.Listen(withMessageSession(ctx, ms), ms.trackActivity(q.handlerFor(handler)))
+	select {
+	case <-handle.Done():
+		err = handle.Err()
+	case <-ms.done:
+	}
+	stopIdleWatch()
+
+	// the context of the handlers may be done already, so wait for them without it
+	_ = r.Drain(context.Background())
+	stopRenewal()
+	handler.End()
+	return err
+}
+
+// OldestMessageEnqueuedTime returns the time at which the message at the head of the Queue was enqueued. The head of
+// the Queue is peeked, so no lock is taken on the message and it remains available to receivers. If the Queue is
+// empty, nil is returned.
+//
+// The first call opens a connection to the management node of the Queue, which is kept open, and its claim refreshed,
+// until the Queue is closed, so the age of the Queue can be polled without authorizing a new connection for each call.
+func (q *Queue) OldestMessageEnqueuedTime(ctx context.Context) (*time.Time, error) {
+	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.OldestMessageEnqueuedTime")
+	defer span.Finish()
+
+	q.mgmtLinkMu.Lock()
+	defer q.mgmtLinkMu.Unlock()
+
+	if q.mgmtLink == nil {
+		link, err := q.namespace.newManagementLink(ctx, q.Name)
+		if err != nil {
+			log.For(ctx).Error(err)
+			return nil, err
+		}
+		link.stopClaimRefresh = q.namespace.refreshClaim(link.conn, link.address)
+		q.mgmtLink = link
+	}
+
+	messages, err := q.mgmtLink.peek(ctx, 1, 1)
+	if err != nil {
+		// the link may be broken, so open a new one on the next call
+		_ = q.mgmtLink.Close(ctx)
+		q.mgmtLink = nil
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+
+	if len(messages) == 0 {
+		return nil, nil
+	}
+
+	msg := messages[0]
+	if msg.SystemProperties == nil || msg.SystemProperties.EnqueuedTime == nil {
+		return nil, errors.New("peeked message did not contain an enqueued time")
+	}
+	return msg.SystemProperties.EnqueuedTime, nil
+}
+
+// PeekWhere looks through the messages of the queue, in order, without locking or removing them, and returns up to max
+// of the messages for which pred returns true. Messages are fetched a page at a time, so large backlogs can be searched
+// as long as ctx allows; if ctx expires, the messages matched so far are returned along with the error.
+func (q *Queue) PeekWhere(ctx context.Context, pred func(*Message) bool, max int) ([]*Message, error) {
+	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.PeekWhere")
+	defer span.Finish()
+
+	if pred == nil {
+		return nil, errors.New("predicate must not be nil")
+	}
+	if max <= 0 {
+		return nil, errors.New("max must be greater than 0")
+	}
+
+	iter, err := q.Peek(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = iter.Close(ctx)
+	}()
+
+	var matched []*Message
+	for len(matched) < max {
+		if err := ctx.Err(); err != nil {
+			return matched, err
+		}
+
+		msg, err := iter.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return matched, err
+		}
+
+		if pred(msg) {
+			matched = append(matched, msg)
+		}
+	}
+	return matched, nil
+}
+
+// handlerFor wraps the handler provided by the caller with the message handling configured on the Queue
+func (q *Queue) handlerFor(handler Handler) Handler {
+	if q.router != nil {
+		handler = &routingHandler{
+			property: q.routingProperty,
+			router:   q.router,
+			fallback: handler,
+		}
+	}
+
+	for i := len(q.middleware) - 1; i >= 0; i-- {
+		handler = q.middleware[i](handler)
+	}
+	return handler
+}
+
+func (q *Queue) sendFuncFor(send SendFunc) SendFunc {
+	for i := len(q.sendMiddleware) - 1; i >= 0; i-- {
+		send = q.sendMiddleware[i](send)
+	}
+	return send
+}
+
+// receiverOptions adds the receive configuration of the Queue to opts
+func (q *Queue) receiverOptions(opts []receiverOption) []receiverOption {
+	return append(opts,
+		receiverWithReceiveMode(q.receiveMode),
+		receiverWithEmptyPollBackoff(q.emptyPollBackoff),
+		receiverWithLockLostHandling(q.lockLost),
+		receiverWithRedeliveryTracker(q.redelivery),
+		receiverWithDispositionWatchdog(q.dispositionWatchdog))
+}
+
 func (q *Queue) ensureReceiver(ctx context.Context, opts ...receiverOption) error {
 	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.ensureReceiver")
 	defer span.Finish()
@@ -232,9 +998,7 @@ func (q *Queue) ensureReceiver(ctx context.Context, opts ...receiverOption) erro
 	q.receiverMu.Lock()
 	defer q.receiverMu.Unlock()
 
-	opts = append(opts, receiverWithReceiveMode(q.receiveMode))
-
-	receiver, err := q.namespace.newReceiver(ctx, q.Name, opts...)
+	receiver, err := q.namespace.newReceiver(ctx, q.Name, q.receiverOptions(opts)...)
 	if err != nil {
 		log.For(ctx).Error(err)
 		return err
@@ -244,24 +1008,110 @@ func (q *Queue) ensureReceiver(ctx context.Context, opts ...receiverOption) erro
 	return nil
 }
 
-// Close the underlying connection to Service Bus
+// Close the underlying connection to Service Bus. The sender link, which the first send opens and later sends reuse, is
+// opened again by the next send.
 func (q *Queue) Close(ctx context.Context) error {
 	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.Close")
 	defer span.Finish()
 
 	if q.receiver != nil {
 		if err := q.receiver.Close(ctx); err != nil {
-			_ = q.sender.Close(ctx)
+			_ = q.closeBatchReceiver(ctx)
+			_ = q.closeSender(ctx)
+			_ = q.closeManagementLink(ctx)
 			log.For(ctx).Error(err)
 			return err
 		}
 	}
 
-	if q.sender != nil {
-		return q.sender.Close(ctx)
+	if err := q.closeBatchReceiver(ctx); err != nil {
+		_ = q.closeSender(ctx)
+		_ = q.closeManagementLink(ctx)
+		log.For(ctx).Error(err)
+		return err
 	}
 
-	return nil
+	if err := q.closeSender(ctx); err != nil {
+		_ = q.closeManagementLink(ctx)
+		log.For(ctx).Error(err)
+		return err
+	}
+
+	return q.closeManagementLink(ctx)
+}
+
+// closeSender closes the sender link of the Queue, if one is open, so the next send opens a new one
+func (q *Queue) closeSender(ctx context.Context) error {
+	q.senderMu.Lock()
+	defer q.senderMu.Unlock()
+
+	if q.sender == nil {
+		return nil
+	}
+	s := q.sender
+	q.sender = nil
+	return s.Close(ctx)
+}
+
+// closeManagementLink closes the management link kept open by OldestMessageEnqueuedTime, if there is one
+func (q *Queue) closeManagementLink(ctx context.Context) error {
+	q.mgmtLinkMu.Lock()
+	defer q.mgmtLinkMu.Unlock()
+
+	if q.mgmtLink == nil {
+		return nil
+	}
+	link := q.mgmtLink
+	q.mgmtLink = nil
+	return link.Close(ctx)
+}
+
+// Drain closes the Queue gracefully. It stops Receive from dispatching new messages to its handler, waits until the
+// handlers of the messages in flight have returned, renewing their locks if WithAutoLockRenewal is used, then closes the
+// underlying connection to Service Bus like Close. If ctx is done first, the handlers in flight are cancelled, the
+// connection is closed, and ctx.Err() is returned. Receive returns once its handlers have returned.
+//
+// Messages which the link prefetched, but were not yet dispatched to the handler, are not settled. In PeekLock mode
+// Service Bus delivers them again after their locks expire, counting the delivery; in ReceiveAndDelete mode they are
+// lost, as they were deleted when they were prefetched.
+func (q *Queue) Drain(ctx context.Context) error {
+	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.Drain")
+	defer span.Finish()
+
+	// the drained receiver is closed, so the next receive opens a new one rather than using it
+	q.receiverMu.Lock()
+	r := q.receiver
+	q.receiver = nil
+	q.receiverMu.Unlock()
+
+	var drainErr error
+	if r != nil {
+		drainErr = r.Drain(ctx)
+	}
+
+	if err := q.closeSender(ctx); err != nil && drainErr == nil {
+		drainErr = err
+	}
+
+	if err := q.closeManagementLink(ctx); err != nil && drainErr == nil {
+		drainErr = err
+	}
+
+	if drainErr != nil {
+		log.For(ctx).Error(drainErr)
+	}
+	return drainErr
+}
+
+func (q *Queue) fetchProperties(ctx context.Context) (*entityProperties, error) {
+	qe, err := q.namespace.NewQueueManager().Get(ctx, q.Name)
+	if err != nil {
+		return nil, err
+	}
+	if qe == nil {
+		return nil, fmt.Errorf("queue %q was not found", q.Name)
+	}
+	return newEntityProperties(qe.DefaultMessageTimeToLive, qe.DuplicateDetectionHistoryTimeWindow), nil
 }
 
 func (q *Queue) ensureSender(ctx context.Context) error {
@@ -271,7 +1121,12 @@ func (q *Queue) ensureSender(ctx context.Context) error {
 	q.senderMu.Lock()
 	defer q.senderMu.Unlock()
 
-	var opts []senderOption
+	opts := []senderOption{
+		sendWithMessageIDAssignment(q.assignsMessageIDs()),
+		sendWithDefaultMessageTTL(func(ctx context.Context) (time.Duration, bool) {
+			return q.defaultMessageTTL(ctx, q.fetchProperties)
+		}),
+	}
 	if q.requiredSessionID != nil {
 		opts = append(opts, sendWithSession(*q.requiredSessionID))
 	}
@@ -288,5 +1143,5 @@ func (q *Queue) ensureSender(ctx context.Context) error {
 }
 
 func (e *entity) ManagementPath() string {
-	return fmt.Sprintf("%s/$management", e.Name)
+	return managementPath(e.Name)
 }
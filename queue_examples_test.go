@@ -36,20 +36,11 @@ func ExampleQueue_getOrBuildQueue() {
 	defer cancel()
 
 	qm := ns.NewQueueManager()
-	qe, err := qm.Get(ctx, queueName)
-	if err != nil {
+	if _, err := qm.EnsureExists(ctx, queueName); err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	if qe == nil {
-		_, err := qm.Put(ctx, queueName)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-	}
-
 	q, err := ns.NewQueue(queueName)
 	if err != nil {
 		fmt.Println(err)
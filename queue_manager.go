@@ -4,8 +4,11 @@ import (
 	"context"
 	"encoding/xml"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/Azure/azure-amqp-common-go/log"
@@ -37,6 +40,19 @@ type (
 		Content *queueContent `xml:"content"`
 	}
 
+	// QueueRuntimeInfo holds the message counts and size of a queue, which change as messages are sent and received.
+	// Counts missing from the response of Service Bus are zero.
+	QueueRuntimeInfo struct {
+		Name                           string
+		MessageCount                   int64
+		ActiveMessageCount             int64
+		DeadLetterMessageCount         int64
+		ScheduledMessageCount          int64
+		TransferMessageCount           int64
+		TransferDeadLetterMessageCount int64
+		SizeInBytes                    int64
+	}
+
 	// QueueManagementOption represents named configuration options for queue mutation
 	QueueManagementOption func(*QueueDescription) error
 )
@@ -116,6 +132,31 @@ func QueueEntityWithDeadLetteringOnMessageExpiration() QueueManagementOption {
 	}
 }
 
+// QueueEntityWithAutoForward configures the queue to automatically forward its messages to the queue or topic named
+// target. The target must exist when the queue is created.
+func QueueEntityWithAutoForward(target string) QueueManagementOption {
+	return func(q *QueueDescription) error {
+		if target == "" {
+			return errors.New("QueueEntityWithAutoForward: target must not be empty")
+		}
+		q.ForwardTo = &target
+		return nil
+	}
+}
+
+// QueueEntityWithForwardDeadLetteredMessagesTo configures the queue to automatically forward the messages of its dead
+// letter queue, such as expired messages when combined with QueueEntityWithDeadLetteringOnMessageExpiration, to the
+// queue or topic named target. The target must exist when the queue is created.
+func QueueEntityWithForwardDeadLetteredMessagesTo(target string) QueueManagementOption {
+	return func(q *QueueDescription) error {
+		if target == "" {
+			return errors.New("QueueEntityWithForwardDeadLetteredMessagesTo: target must not be empty")
+		}
+		q.ForwardDeadLetteredMessagesTo = &target
+		return nil
+	}
+}
+
 // QueueEntityWithAutoDeleteOnIdle configures the queue to automatically delete after the specified idle interval. The
 // minimum duration is 5 minutes.
 func QueueEntityWithAutoDeleteOnIdle(window *time.Duration) QueueManagementOption {
@@ -167,10 +208,25 @@ func QueueEntityWithMaxDeliveryCount(count int32) QueueManagementOption {
 	}
 }
 
+// QueueEntityWithStatus configures the status of the queue, which is Active, Disabled, SendDisabled or ReceiveDisabled.
+// Sending to a queue which is Disabled or SendDisabled, or receiving from one which is Disabled or ReceiveDisabled,
+// fails with ErrEntityDisabled.
+func QueueEntityWithStatus(status EntityStatus) QueueManagementOption {
+	return func(q *QueueDescription) error {
+		switch status {
+		case Active, Disabled, SendDisabled, ReceiveDisabled:
+			q.Status = &status
+			return nil
+		default:
+			return fmt.Errorf("QueueEntityWithStatus: status must be Active, Disabled, SendDisabled or ReceiveDisabled, not %q", status)
+		}
+	}
+}
+
 // NewQueueManager creates a new QueueManager for a Service Bus Namespace
 func (ns *Namespace) NewQueueManager() *QueueManager {
 	return &QueueManager{
-		entityManager: newEntityManager(ns.getHTTPSHostURI(), ns.TokenProvider),
+		entityManager: ns.newEntityManager(),
 	}
 }
 
@@ -200,6 +256,160 @@ func (qm *QueueManager) Put(ctx context.Context, name string, opts ...QueueManag
 		}
 	}
 
+	if err := qm.validateForwarding(ctx, name, qd); err != nil {
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+
+	return qm.put(ctx, name, qd)
+}
+
+// EnsureExists returns the Service Bus Queue with the given name, and creates it with opts if it does not exist. opts
+// are not applied to a queue which already exists. If the queue is created concurrently, such as by another instance of
+// an application, Service Bus refuses to create it again, and the queue created concurrently is returned.
+func (qm *QueueManager) EnsureExists(ctx context.Context, name string, opts ...QueueManagementOption) (*QueueEntity, error) {
+	span, ctx := qm.startSpanFromContext(ctx, "sb.QueueManager.EnsureExists")
+	defer span.Finish()
+
+	qe, err := qm.Get(ctx, name)
+	if err != nil || qe != nil {
+		return qe, err
+	}
+
+	qe, err = qm.Put(ctx, name, opts...)
+	var conflict *entityConflictError
+	if !errors.As(err, &conflict) {
+		return qe, err
+	}
+
+	qe, getErr := qm.Get(ctx, name)
+	if getErr != nil {
+		return nil, getErr
+	}
+	if qe == nil {
+		return nil, err
+	}
+	return qe, nil
+}
+
+// Update changes the properties of an existing Service Bus Queue which are set by opts, and leaves its other properties
+// as they are. RequiresSession, RequiresDuplicateDetection and EnablePartitioning can only be set when a queue is
+// created, so changing them returns an error without updating the queue. An error is returned if the queue does not
+// exist.
+func (qm *QueueManager) Update(ctx context.Context, name string, opts ...QueueManagementOption) (*QueueEntity, error) {
+	span, ctx := qm.startSpanFromContext(ctx, "sb.QueueManager.Update")
+	defer span.Finish()
+
+	desired := new(QueueDescription)
+	for _, opt := range opts {
+		if err := opt(desired); err != nil {
+			log.For(ctx).Error(err)
+			return nil, err
+		}
+	}
+
+	existing, err := qm.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		return nil, fmt.Errorf("queue %q does not exist", name)
+	}
+
+	if _, err := diffEntityDescriptions(QueueKind, name, desired, existing.QueueDescription); err != nil {
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+
+	if err := qm.validateForwarding(ctx, name, desired); err != nil {
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+
+	updated := *existing.QueueDescription
+	mergeEntityDescriptions(&updated, desired)
+	return qm.put(ctx, name, &updated, withIfMatch("*"))
+}
+
+// SetStatus changes the status of an existing Service Bus Queue, leaving its other properties as they are. Setting a
+// queue SendDisabled stops producers from sending to it while consumers drain it; setting it Active again resumes
+// traffic.
+func (qm *QueueManager) SetStatus(ctx context.Context, name string, status EntityStatus) (*QueueEntity, error) {
+	span, ctx := qm.startSpanFromContext(ctx, "sb.QueueManager.SetStatus")
+	defer span.Finish()
+
+	return qm.Update(ctx, name, QueueEntityWithStatus(status))
+}
+
+// validateForwarding checks that the entities a queue forwards messages to exist, and that the queue doesn't forward
+// messages to itself, either directly or through a target queue which forwards its messages back
+func (qm *QueueManager) validateForwarding(ctx context.Context, name string, qd *QueueDescription) error {
+	for _, target := range []*string{qd.ForwardTo, qd.ForwardDeadLetteredMessagesTo} {
+		if target == nil {
+			continue
+		}
+
+		targetName := forwardTargetName(*target)
+		if strings.EqualFold(targetName, name) {
+			return fmt.Errorf("queue %q can't forward messages to itself", name)
+		}
+
+		exists, targetForwardTo, err := qm.forwardTarget(ctx, targetName)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("queue %q can't forward messages to %q: the entity does not exist", name, targetName)
+		}
+		if targetForwardTo != nil && strings.EqualFold(forwardTargetName(*targetForwardTo), name) {
+			return fmt.Errorf("queue %q can't forward messages to %q, which forwards its messages back to %q", name, targetName, name)
+		}
+	}
+	return nil
+}
+
+// forwardTarget returns whether the queue or topic at path exists and, if it is a queue, the entity it forwards its
+// messages to
+func (qm *QueueManager) forwardTarget(ctx context.Context, path string) (bool, *string, error) {
+	res, err := qm.entityManager.Get(ctx, path)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return false, nil, err
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		return false, nil, nil
+	}
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return false, nil, err
+	}
+
+	if isEmptyFeed(b) {
+		return false, nil, nil
+	}
+
+	var entry queueEntry
+	if err := xml.Unmarshal(b, &entry); err != nil || entry.Content == nil {
+		// the target is not a queue, such as a topic
+		return true, nil, nil
+	}
+	return true, entry.Content.QueueDescription.ForwardTo, nil
+}
+
+// forwardTargetName returns the entity path of a forwarding target, which Service Bus reports as an absolute URI
+func forwardTargetName(target string) string {
+	if u, err := url.Parse(target); err == nil && u.Host != "" {
+		return strings.TrimPrefix(u.Path, "/")
+	}
+	return target
+}
+
+// put creates or updates a Service Bus Queue from a complete description
+func (qm *QueueManager) put(ctx context.Context, name string, qd *QueueDescription, mw ...func(*http.Request) *http.Request) (*QueueEntity, error) {
 	qd.ServiceBusSchema = to.StringPtr(serviceBusSchema)
 
 	qe := &queueEntry{
@@ -219,7 +429,7 @@ func (qm *QueueManager) Put(ctx context.Context, name string, opts ...QueueManag
 	}
 
 	reqBytes = xmlDoc(reqBytes)
-	res, err := qm.entityManager.Put(ctx, "/"+name, reqBytes)
+	res, err := qm.entityManager.Put(ctx, "/"+name, reqBytes, mw...)
 	if res != nil {
 		defer res.Body.Close()
 	}
@@ -235,6 +445,10 @@ func (qm *QueueManager) Put(ctx context.Context, name string, opts ...QueueManag
 		return nil, err
 	}
 
+	if res.StatusCode == http.StatusConflict {
+		return nil, &entityConflictError{err: formatManagementError(b)}
+	}
+
 	var entry queueEntry
 	err = xml.Unmarshal(b, &entry)
 	if err != nil {
@@ -243,38 +457,62 @@ func (qm *QueueManager) Put(ctx context.Context, name string, opts ...QueueManag
 	return queueEntryToEntity(&entry), nil
 }
 
-// List fetches all of the queues for a Service Bus Namespace
+// List fetches all of the queues for a Service Bus Namespace, following the pages Service Bus returns them in
 func (qm *QueueManager) List(ctx context.Context) ([]*QueueEntity, error) {
 	span, ctx := qm.startSpanFromContext(ctx, "sb.QueueManager.List")
 	defer span.Finish()
 
-	res, err := qm.entityManager.Get(ctx, `/$Resources/Queues`)
+	var queues []*QueueEntity
+	for skip := 0; ; skip += listPageSize {
+		page, more, err := qm.ListPaged(ctx, skip, listPageSize)
+		if err != nil {
+			return nil, err
+		}
+		queues = append(queues, page...)
+		if !more {
+			return queues, nil
+		}
+	}
+}
+
+// ListPaged fetches a page of up to top Service Bus Queues, skipping the first skip queues of the namespace. Queues are
+// listed in lexical order of their names, so pages are stable while no queues are created or deleted. more is true if
+// the page is full, in which case the next page, starting at skip+top, may hold more queues.
+func (qm *QueueManager) ListPaged(ctx context.Context, skip, top int) (queues []*QueueEntity, more bool, err error) {
+	span, ctx := qm.startSpanFromContext(ctx, "sb.QueueManager.ListPaged")
+	defer span.Finish()
+
+	if skip < 0 || top < 1 {
+		return nil, false, errors.New("skip must not be negative and top must be greater than zero")
+	}
+
+	res, err := qm.entityManager.Get(ctx, listPagePath(`/$Resources/Queues`, skip, top))
 	if res != nil {
 		defer res.Body.Close()
 	}
 
 	if err != nil {
 		log.For(ctx).Error(err)
-		return nil, err
+		return nil, false, err
 	}
 
 	b, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		log.For(ctx).Error(err)
-		return nil, err
+		return nil, false, err
 	}
 
 	var feed queueFeed
 	err = xml.Unmarshal(b, &feed)
 	if err != nil {
-		return nil, formatManagementError(b)
+		return nil, false, formatManagementError(b)
 	}
 
 	qd := make([]*QueueEntity, len(feed.Entries))
 	for idx, entry := range feed.Entries {
 		qd[idx] = queueEntryToEntity(&entry)
 	}
-	return qd, nil
+	return qd, len(qd) == top, nil
 }
 
 // Get fetches a Service Bus Queue entity by name
@@ -313,3 +551,42 @@ func (qm *QueueManager) Get(ctx context.Context, name string) (*QueueEntity, err
 
 	return queueEntryToEntity(&entry), nil
 }
+
+// Exists reports whether a Service Bus Queue exists, without decoding its description. Failing to determine whether the
+// queue exists, including when the request is not authorized, is returned as an error rather than as false.
+func (qm *QueueManager) Exists(ctx context.Context, name string) (bool, error) {
+	span, ctx := qm.startSpanFromContext(ctx, "sb.QueueManager.Exists")
+	defer span.Finish()
+
+	return qm.entityManager.exists(ctx, name)
+}
+
+// RuntimeInfo fetches the message counts and size of a Service Bus Queue by name. It returns nil if the queue does not
+// exist.
+func (qm *QueueManager) RuntimeInfo(ctx context.Context, name string) (*QueueRuntimeInfo, error) {
+	span, ctx := qm.startSpanFromContext(ctx, "sb.QueueManager.RuntimeInfo")
+	defer span.Finish()
+
+	qe, err := qm.Get(ctx, name)
+	if err != nil || qe == nil {
+		return nil, err
+	}
+	return queueEntityToRuntimeInfo(qe), nil
+}
+
+func queueEntityToRuntimeInfo(qe *QueueEntity) *QueueRuntimeInfo {
+	info := &QueueRuntimeInfo{
+		Name:         qe.Name,
+		MessageCount: int64OrZero(qe.MessageCount),
+		SizeInBytes:  int64OrZero(qe.SizeInBytes),
+	}
+
+	if details := qe.CountDetails; details != nil {
+		info.ActiveMessageCount = int64(int32OrZero(details.ActiveMessageCount))
+		info.DeadLetterMessageCount = int64(int32OrZero(details.DeadLetterMessageCount))
+		info.ScheduledMessageCount = int64(int32OrZero(details.ScheduledMessageCount))
+		info.TransferMessageCount = int64(int32OrZero(details.TransferMessageCount))
+		info.TransferDeadLetterMessageCount = int64(int32OrZero(details.TransferDeadLetterMessageCount))
+	}
+	return info
+}
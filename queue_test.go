@@ -25,16 +25,24 @@ package servicebus
 import (
 	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"math/rand"
+	"os"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/Azure/azure-amqp-common-go/uuid"
 	"github.com/Azure/azure-sdk-for-go/services/servicebus/mgmt/2015-08-01/servicebus"
 	"github.com/Azure/azure-service-bus-go/atom"
 	"github.com/Azure/azure-service-bus-go/internal/test"
+	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/stretchr/testify/assert"
+	"pack.ag/amqp"
 )
 
 const (
@@ -55,8 +63,11 @@ const (
             <MessageCount>0</MessageCount>
             <IsAnonymousAccessible>false</IsAnonymousAccessible>
             <Status>Active</Status>
+            <ForwardTo>bar</ForwardTo>
+            <UserMetadata>owner=billing</UserMetadata>
             <CreatedAt>2018-05-04T16:38:27.913Z</CreatedAt>
             <UpdatedAt>2018-05-04T16:38:41.897Z</UpdatedAt>
+            <AccessedAt>2018-05-04T16:40:00.123Z</AccessedAt>
             <SupportOrdering>true</SupportOrdering>
             <AutoDeleteOnIdle>P14D</AutoDeleteOnIdle>
             <EnablePartitioning>false</EnablePartitioning>
@@ -220,11 +231,1168 @@ func (suite *serviceBusSuite) TestQueueUnmarshal() {
 	suite.Equal(int64(0), *q.SizeInBytes)
 	suite.Equal(int64(0), *q.MessageCount)
 	suite.EqualValues(servicebus.EntityStatusActive, *q.Status)
+	suite.Equal("bar", *q.ForwardTo)
+	suite.Equal("owner=billing", *q.UserMetadata)
+	suite.Equal(time.Date(2018, 5, 4, 16, 38, 27, 913000000, time.UTC), q.CreatedAt.Time)
+	suite.Equal(time.Date(2018, 5, 4, 16, 38, 41, 897000000, time.UTC), q.UpdatedAt.Time)
+	suite.Equal(time.Date(2018, 5, 4, 16, 40, 0, 123000000, time.UTC), q.AccessedAt.Time)
+	suite.Equal(true, *q.SupportOrdering)
+	suite.Equal("P14D", *q.AutoDeleteOnIdle)
+	suite.Equal(false, *q.EnablePartitioning)
+	suite.Equal("Available", *q.EntityAvailabilityStatus)
+	suite.Equal(false, *q.EnableExpress)
+}
+
+func (suite *serviceBusSuite) TestAuthorizationRuleUnmarshal() {
+	var q QueueDescription
+	err := xml.Unmarshal([]byte(`
+		<QueueDescription xmlns="http://schemas.microsoft.com/netservices/2010/10/servicebus/connect" xmlns:i="http://www.w3.org/2001/XMLSchema-instance">
+			<AuthorizationRules>
+				<AuthorizationRule i:type="SharedAccessAuthorizationRule">
+					<ClaimType>SharedAccessKey</ClaimType>
+					<ClaimValue>None</ClaimValue>
+					<Rights>
+						<AccessRights>Listen</AccessRights>
+						<AccessRights>Send</AccessRights>
+					</Rights>
+					<CreatedTime>2018-05-02T20:54:59.35Z</CreatedTime>
+					<KeyName>consumer</KeyName>
+					<ModifiedTime>2018-05-02T20:54:59.35Z</ModifiedTime>
+					<PrimaryKey>primary</PrimaryKey>
+					<SecondaryKey>secondary</SecondaryKey>
+				</AuthorizationRule>
+			</AuthorizationRules>
+		</QueueDescription>`), &q)
+	suite.Require().NoError(err)
+	suite.Require().Len(q.AuthorizationRules, 1)
+
+	rule := q.AuthorizationRules[0]
+	suite.Equal(sharedAccessAuthorizationRuleType, rule.Type)
+	suite.Equal("consumer", rule.KeyName)
+	suite.Equal([]AccessRight{ListenRight, SendRight}, rule.Rights)
+	suite.Equal("primary", rule.PrimaryKey)
+	suite.Equal("secondary", rule.SecondaryKey)
+
+	generated, err := newAuthorizationRule(AuthorizationRule{KeyName: "consumer", Rights: []AccessRight{ListenRight}})
+	suite.Require().NoError(err)
+	suite.Len(generated.PrimaryKey, 44, "a generated key should encode 32 bytes")
+	suite.NotEqual(generated.PrimaryKey, generated.SecondaryKey)
+
+	_, err = newAuthorizationRule(AuthorizationRule{KeyName: "consumer", Rights: []AccessRight{"Read"}})
+	suite.Error(err)
+}
+
+func (suite *serviceBusSuite) TestQueueRuntimeInfo() {
+	var q QueueDescription
+	err := xml.Unmarshal([]byte(`
+		<QueueDescription xmlns="http://schemas.microsoft.com/netservices/2010/10/servicebus/connect">
+			<SizeInBytes>256</SizeInBytes>
+			<MessageCount>7</MessageCount>
+			<CountDetails xmlns:d2p1="http://schemas.microsoft.com/netservices/2011/06/servicebus">
+				<d2p1:ActiveMessageCount>4</d2p1:ActiveMessageCount>
+				<d2p1:DeadLetterMessageCount>2</d2p1:DeadLetterMessageCount>
+				<d2p1:ScheduledMessageCount>1</d2p1:ScheduledMessageCount>
+			</CountDetails>
+		</QueueDescription>`), &q)
+	suite.Require().NoError(err)
+
+	info := queueEntityToRuntimeInfo(&QueueEntity{QueueDescription: &q, Name: "foo"})
+	suite.Equal(&QueueRuntimeInfo{
+		Name:                   "foo",
+		MessageCount:           7,
+		ActiveMessageCount:     4,
+		DeadLetterMessageCount: 2,
+		ScheduledMessageCount:  1,
+		SizeInBytes:            256,
+	}, info)
+}
+
+func (suite *serviceBusSuite) TestQueueWithRoutingKey() {
+	var routed, fallback []string
+	router := func(key string) Handler {
+		if key != "orders" {
+			return nil
+		}
+		return HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+			routed = append(routed, string(msg.Data))
+			return nil
+		})
+	}
+
+	ns := suite.getNewSasInstance()
+	q, err := ns.NewQueue("foo", QueueWithRoutingKey("kind", router))
+	suite.Require().NoError(err)
+
+	handler := q.handlerFor(HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+		fallback = append(fallback, string(msg.Data))
+		return nil
+	}))
+
+	order := NewMessageFromString("order")
+	order.Set("kind", "orders")
+	invoice := NewMessageFromString("invoice")
+	invoice.Set("kind", "invoices")
+	for _, msg := range []*Message{order, invoice, NewMessageFromString("plain")} {
+		handler.Handle(context.Background(), msg)
+	}
+
+	suite.Equal([]string{"order"}, routed)
+	suite.Equal([]string{"invoice", "plain"}, fallback)
+}
+
+func (suite *serviceBusSuite) TestQueuePartitionedSessionColocation() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	ns := suite.getNewSasInstance()
+	queueName := suite.randEntityName()
+	cleanup := makeQueue(ctx, suite.T(), ns, queueName, QueueEntityWithPartitioning(), QueueEntityWithRequiredSessions())
+	defer cleanup()
+
+	q, err := ns.NewQueue(queueName)
+	suite.Require().NoError(err)
+	defer q.Close(ctx)
+
+	const numMessages = 5
+	sessionID := "colocated"
+	for i := 0; i < numMessages; i++ {
+		msg := NewMessageFromString(fmt.Sprintf("hello %d", i))
+		msg.GroupID = &sessionID
+		suite.Require().NoError(q.Send(ctx, msg))
+	}
+
+	partitions := make(map[int16]bool)
+	var received int
+	err = q.ReceiveOneSession(ctx, &sessionID, NewSessionHandler(
+		HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+			if suite.NotNil(msg.SystemProperties.PartitionKey) {
+				suite.Equal(sessionID, *msg.SystemProperties.PartitionKey)
+			}
+			if suite.NotNil(msg.SystemProperties.PartitionID) {
+				partitions[*msg.SystemProperties.PartitionID] = true
+			}
+
+			received++
+			if received == numMessages {
+				if ms, ok := MessageSessionFromContext(ctx); ok {
+					ms.Close()
+				}
+			}
+			return msg.Complete()
+		}),
+		func(*MessageSession) error { return nil },
+		func() {}))
+	suite.NoError(err)
+	suite.Equal(numMessages, received)
+	suite.Len(partitions, 1, "the messages of a session should be in a single partition")
+}
+
+func (suite *serviceBusSuite) TestQueueListSessions() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	ns := suite.getNewSasInstance()
+	queueName := suite.randEntityName()
+	cleanup := makeQueue(ctx, suite.T(), ns, queueName, QueueEntityWithRequiredSessions())
+	defer cleanup()
+
+	q, err := ns.NewQueue(queueName)
+	suite.Require().NoError(err)
+	defer q.Close(ctx)
+
+	sessionIDs := []string{"first", "second"}
+	for _, sessionID := range sessionIDs {
+		msg := NewMessageFromString("hello")
+		msg.GroupID = to.StringPtr(sessionID)
+		suite.Require().NoError(q.Send(ctx, msg))
+	}
+
+	listed, err := q.ListSessions(ctx)
+	suite.Require().NoError(err)
+	suite.ElementsMatch(sessionIDs, listed)
+
+	listed, err = q.ListSessionsUpdatedSince(ctx, time.Now().Add(time.Hour))
+	suite.Require().NoError(err)
+	suite.Empty(listed)
+
+	for _, sessionID := range sessionIDs {
+		sessionID := sessionID
+		err = q.ReceiveOneSession(ctx, &sessionID, NewSessionHandler(
+			HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+				if ms, ok := MessageSessionFromContext(ctx); ok {
+					ms.Close()
+				}
+				return msg.Complete()
+			}),
+			func(*MessageSession) error { return nil },
+			func() {}))
+		suite.NoError(err)
+	}
+}
+
+func (suite *serviceBusSuite) TestQueueGetSessionState() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	ns := suite.getNewSasInstance()
+	queueName := suite.randEntityName()
+	cleanup := makeQueue(ctx, suite.T(), ns, queueName, QueueEntityWithRequiredSessions())
+	defer cleanup()
+
+	q, err := ns.NewQueue(queueName)
+	suite.Require().NoError(err)
+	defer q.Close(ctx)
+
+	sessionID := "checkpointed"
+	msg := NewMessageFromString("hello")
+	msg.GroupID = &sessionID
+	suite.Require().NoError(q.Send(ctx, msg))
+
+	state, err := q.GetSessionState(ctx, sessionID)
+	suite.Require().NoError(err)
+	suite.Nil(state)
+
+	checkpoint := []byte("step 3")
+	err = q.ReceiveOneSession(ctx, &sessionID, NewSessionHandler(
+		HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+			if ms, ok := MessageSessionFromContext(ctx); ok {
+				suite.NoError(ms.SetState(ctx, checkpoint))
+				ms.Close()
+			}
+			return msg.Abandon()
+		}),
+		func(*MessageSession) error { return nil },
+		func() {}))
+	suite.Require().NoError(err)
+
+	state, err = q.GetSessionState(ctx, sessionID)
+	suite.Require().NoError(err)
+	suite.Equal(checkpoint, state)
+}
+
+func (suite *serviceBusSuite) TestQueueReceiveBatch() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	ns := suite.getNewSasInstance()
+	queueName := suite.randEntityName()
+	cleanup := makeQueue(ctx, suite.T(), ns, queueName)
+	defer cleanup()
+
+	q, err := ns.NewQueue(queueName)
+	suite.Require().NoError(err)
+	defer q.Close(ctx)
+
+	for i := 0; i < 3; i++ {
+		suite.Require().NoError(q.Send(ctx, NewMessageFromString(fmt.Sprintf("batch %d", i))))
+	}
+
+	msgs, err := q.ReceiveBatch(ctx, 5, 10*time.Second)
+	suite.Require().NoError(err)
+	suite.Len(msgs, 3)
+	suite.Require().NoError(q.CompleteBatch(ctx, msgs))
+
+	batchReceiver := q.batchReceiver
+	msgs, err = q.ReceiveBatch(ctx, 5, 2*time.Second)
+	suite.Require().NoError(err)
+	suite.Empty(msgs)
+	suite.True(batchReceiver == q.batchReceiver, "the receive link should be reused by batches of the same size")
+
+	_, err = q.ReceiveBatch(ctx, 2, time.Second)
+	suite.Require().NoError(err)
+	suite.False(batchReceiver == q.batchReceiver, "the receive link should be opened again when the batch size changes")
+
+	_, err = q.ReceiveBatch(ctx, 0, time.Second)
+	suite.Error(err)
+}
+
+func (suite *serviceBusSuite) TestQueueNewReceiver() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	ns := suite.getNewSasInstance()
+	queueName := suite.randEntityName()
+	cleanup := makeQueue(ctx, suite.T(), ns, queueName)
+	defer cleanup()
+
+	q, err := ns.NewQueue(queueName)
+	suite.Require().NoError(err)
+	defer q.Close(ctx)
+
+	for i := 0; i < 2; i++ {
+		suite.Require().NoError(q.Send(ctx, NewMessageFromString(fmt.Sprintf("next %d", i))))
+	}
+
+	rc, err := q.NewReceiver(ctx)
+	suite.Require().NoError(err)
+	defer rc.Close(ctx)
+
+	for i := 0; i < 2; i++ {
+		msg, err := rc.Next(ctx)
+		suite.Require().NoError(err)
+		suite.Equal(fmt.Sprintf("next %d", i), string(msg.Data))
+		msg.Complete()(ctx)
+	}
+
+	emptyCtx, emptyCancel := context.WithTimeout(ctx, 2*time.Second)
+	defer emptyCancel()
+	_, err = rc.Next(emptyCtx)
+	suite.Equal(io.EOF, err)
+}
+
+// BenchmarkQueueSend compares sending over the sender link the Queue keeps open with opening a link for every send
+func BenchmarkQueueSend(b *testing.B) {
+	connStr := os.Getenv("SERVICEBUS_CONNECTION_STRING")
+	if connStr == "" {
+		b.Skip("environment variable SERVICEBUS_CONNECTION_STRING was not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	ns, err := getNewSasInstance(connStr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	qm := ns.NewQueueManager()
+	queueName := test.RandomString("gobench", 6)
+	if _, err := qm.Put(ctx, queueName); err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		_ = qm.Delete(context.Background(), queueName)
+	}()
+
+	b.Run("CachedLink", func(b *testing.B) {
+		q, err := ns.NewQueue(queueName)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer q.Close(ctx)
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := q.Send(ctx, NewMessageFromString("cached")); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("LinkPerSend", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s, err := ns.newSender(ctx, queueName)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := s.Send(ctx, NewMessageFromString("per send")); err != nil {
+				b.Fatal(err)
+			}
+			_ = s.Close(ctx)
+		}
+	})
+}
+
+func (suite *serviceBusSuite) TestQueueSendAfterClose() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	ns := suite.getNewSasInstance()
+	queueName := suite.randEntityName()
+	cleanup := makeQueue(ctx, suite.T(), ns, queueName)
+	defer cleanup()
+
+	q, err := ns.NewQueue(queueName)
+	suite.Require().NoError(err)
+	defer q.Close(ctx)
+
+	suite.Require().NoError(q.Send(ctx, NewMessageFromString("before close")))
+	first := q.sender
+	suite.Require().NoError(q.Send(ctx, NewMessageFromString("same link")))
+	suite.True(first == q.sender, "expected the sender link to be reused")
+
+	suite.Require().NoError(q.Close(ctx))
+	suite.Nil(q.sender)
+	suite.Require().NoError(q.Send(ctx, NewMessageFromString("after close")))
+	suite.NotNil(q.sender)
+}
+
+func (suite *serviceBusSuite) TestNamespaceSend() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	ns := suite.getNewSasInstance()
+	queueName := suite.randEntityName()
+	cleanup := makeQueue(ctx, suite.T(), ns, queueName)
+	defer cleanup()
+	defer ns.Close(ctx)
+
+	for i := 0; i < 2; i++ {
+		suite.Require().NoError(ns.Send(ctx, queueName, NewMessageFromString(fmt.Sprintf("by name %d", i))))
+	}
+	suite.Len(ns.senders, 1)
+
+	q, err := ns.NewQueue(queueName)
+	suite.Require().NoError(err)
+	defer q.Close(ctx)
+
+	msgs, err := q.ReceiveBatch(ctx, 2, 10*time.Second)
+	suite.Require().NoError(err)
+	if suite.Len(msgs, 2) {
+		for i, msg := range msgs {
+			suite.Equal(fmt.Sprintf("by name %d", i), string(msg.Data))
+		}
+	}
+
+	suite.NoError(ns.Close(ctx))
+	suite.Len(ns.senders, 0)
+}
+
+func (suite *serviceBusSuite) TestQueueAbandonBatch() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	ns := suite.getNewSasInstance()
+	queueName := suite.randEntityName()
+	cleanup := makeQueue(ctx, suite.T(), ns, queueName)
+	defer cleanup()
+
+	q, err := ns.NewQueue(queueName)
+	suite.Require().NoError(err)
+	defer q.Close(ctx)
+
+	var sequenceNumbers []int64
+	for i := 0; i < 2; i++ {
+		suite.Require().NoError(q.Send(ctx, NewMessageFromString(fmt.Sprintf("deferred %d", i))))
+	}
+	for i := 0; i < 2; i++ {
+		err = q.ReceiveOne(ctx, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+			sequenceNumbers = append(sequenceNumbers, *msg.SystemProperties.SequenceNumber)
+			return msg.Defer()
+		}))
+		suite.Require().NoError(err)
+	}
+
+	deferred, err := q.ReceiveDeferred(ctx, sequenceNumbers...)
+	suite.Require().NoError(err)
+	suite.Require().NoError(q.AbandonBatch(ctx, deferred))
+
+	deferred, err = q.ReceiveDeferred(ctx, sequenceNumbers...)
+	suite.Require().NoError(err)
+	suite.Require().Len(deferred, 2)
+	suite.Require().NoError(q.CompleteBatch(ctx, deferred))
+
+	err = q.CompleteBatch(ctx, deferred)
+	suite.NoError(err, "settled messages are skipped")
+}
+
+func (suite *serviceBusSuite) TestSettleBatchLeavesFailedMessagesUnsettled() {
+	ns := suite.getNewSasInstance()
+	suite.Require().NoError(ns.Close(context.Background()))
+
+	lockToken, err := uuid.NewV4()
+	suite.Require().NoError(err)
+	otherLockToken, err := uuid.NewV4()
+	suite.Require().NoError(err)
+	msg := &Message{LockToken: &lockToken, mgmt: &managementSettlement{namespace: ns, entityPath: "foo"}}
+	other := &Message{LockToken: &otherLockToken, mgmt: &managementSettlement{namespace: ns, entityPath: "bar"}}
+	err = settleBatch(context.Background(), []*Message{msg, other}, "complete", completedDisposition, (*Message).Complete)
+
+	var batchErr *DispositionBatchError
+	suite.Require().True(errors.As(err, &batchErr), "a failed request should be reported as a *DispositionBatchError")
+	suite.ElementsMatch([]uuid.UUID{lockToken, otherLockToken}, batchErr.Rejected, "every entity should be tried")
+	suite.Error(batchErr.Err)
+	suite.False(msg.isSettled(), "a message whose settlement failed should be settled again by a retry")
+	suite.False(other.isSettled())
+}
+
+func (suite *serviceBusSuite) TestQueueSessionReceiveDeferred() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	ns := suite.getNewSasInstance()
+	queueName := suite.randEntityName()
+	cleanup := makeQueue(ctx, suite.T(), ns, queueName, QueueEntityWithRequiredSessions())
+	defer cleanup()
+
+	q, err := ns.NewQueue(queueName)
+	suite.Require().NoError(err)
+	defer q.Close(ctx)
+
+	sessionID := "deferring"
+	for _, body := range []string{"first", "second"} {
+		msg := NewMessageFromString(body)
+		msg.GroupID = &sessionID
+		suite.Require().NoError(q.Send(ctx, msg))
+	}
+
+	var deferredSequenceNumber int64
+	var completed []string
+	err = q.ReceiveOneSession(ctx, &sessionID, NewSessionHandler(
+		HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+			if string(msg.Data) == "first" {
+				deferredSequenceNumber = *msg.SystemProperties.SequenceNumber
+				return msg.Defer()
+			}
+
+			// the handler runs on a receiver goroutine, so failures are recorded without stopping it
+			ms, ok := MessageSessionFromContext(ctx)
+			if !suite.True(ok) {
+				return msg.Abandon()
+			}
+			defer ms.Close()
+
+			deferred, err := ms.ReceiveDeferred(ctx, deferredSequenceNumber)
+			if !suite.NoError(err) || !suite.Len(deferred, 1) {
+				return msg.Abandon()
+			}
+			suite.NotNil(deferred[0].LockToken, "the deferred message should carry its lock token")
+			deferred[0].Complete()(ctx)
+			completed = append(completed, string(deferred[0].Data), string(msg.Data))
+			return msg.Complete()
+		}),
+		func(*MessageSession) error { return nil },
+		func() {}))
+	suite.Require().NoError(err)
+	suite.Equal([]string{"first", "second"}, completed)
+
+	peeked, err := q.Peek(ctx)
+	suite.Require().NoError(err)
+	defer peeked.Close(ctx)
+	_, err = peeked.Next(ctx)
+	suite.Equal(io.EOF, err, "the deferred message should have been completed")
+}
+
+func (suite *serviceBusSuite) TestManagementSettlementWithSession() {
+	settlement := &managementSettlement{}
+	suite.Nil(settlement.withSession(nil))
+
+	sessionID := "session"
+	settlement.sessionID = &sessionID
+	properties := map[string]interface{}{deadLetterReasonFieldName: "reason"}
+	withSession := settlement.withSession(properties)
+	suite.Equal("session", withSession[sessionIDFieldName])
+	suite.Equal("reason", withSession[deadLetterReasonFieldName])
+	suite.NotContains(properties, sessionIDFieldName, "the properties of the caller should not be modified")
+}
+
+func (suite *serviceBusSuite) TestQueueSessionAcceptTimeout() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	ns := suite.getNewSasInstance()
+	queueName := suite.randEntityName()
+	cleanup := makeQueue(ctx, suite.T(), ns, queueName, QueueEntityWithRequiredSessions())
+	defer cleanup()
+
+	q, err := ns.NewQueue(queueName)
+	suite.Require().NoError(err)
+	defer q.Close(ctx)
+
+	started := false
+	start := time.Now()
+	err = q.ReceiveOneSession(ctx, nil, NewSessionHandler(
+		HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+			return msg.Complete()
+		}),
+		func(*MessageSession) error {
+			started = true
+			return nil
+		},
+		func() {}), WithSessionAcceptTimeout(5*time.Second))
+	suite.True(errors.Is(err, ErrNoSessionAvailable), "expected ErrNoSessionAvailable, got %v", err)
+	suite.False(started)
+	suite.True(time.Since(start) < defaultTimeout)
+
+	suite.Error(q.ReceiveOneSession(ctx, nil, nil, WithSessionAcceptTimeout(0)))
+}
+
+func (suite *serviceBusSuite) TestQueueReceiveSessionsConcurrently() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	ns := suite.getNewSasInstance()
+	queueName := suite.randEntityName()
+	cleanup := makeQueue(ctx, suite.T(), ns, queueName, QueueEntityWithRequiredSessions())
+	defer cleanup()
+
+	q, err := ns.NewQueue(queueName)
+	suite.Require().NoError(err)
+	defer q.Close(ctx)
+
+	sessionIDs := []string{"one", "two", "three"}
+	for _, sessionID := range sessionIDs {
+		msg := NewMessageFromString(sessionID)
+		msg.GroupID = to.StringPtr(sessionID)
+		suite.Require().NoError(q.Send(ctx, msg))
+	}
+
+	receiveCtx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	var mu sync.Mutex
+	var active, maxActive int
+	handled := make(map[string]bool)
+	factory := func() SessionHandler {
+		return NewSessionHandler(
+			HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+				mu.Lock()
+				handled[string(msg.Data)] = true
+				if len(handled) == len(sessionIDs) {
+					stop()
+				}
+				mu.Unlock()
+
+				if ms, ok := MessageSessionFromContext(ctx); ok {
+					ms.Close()
+				}
+				return msg.Complete()
+			}),
+			func(*MessageSession) error {
+				mu.Lock()
+				defer mu.Unlock()
+				if active++; active > maxActive {
+					maxActive = active
+				}
+				return nil
+			},
+			func() {
+				mu.Lock()
+				defer mu.Unlock()
+				active--
+			})
+	}
+
+	suite.Error(q.ReceiveSessionsConcurrently(ctx, 0, factory))
+	err = q.ReceiveSessionsConcurrently(receiveCtx, 2, factory, WithSessionAcceptTimeout(5*time.Second))
+	suite.Equal(context.Canceled, err)
+	suite.Len(handled, len(sessionIDs))
+	suite.True(maxActive <= 2, "at most 2 sessions should be processed at a time, but %d were", maxActive)
+	suite.Equal(0, active, "every started session should have ended")
+}
+
+func (suite *serviceBusSuite) TestQueueWithReceiveMiddleware() {
+	var calls []string
+	record := func(name string) func(Handler) Handler {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+				calls = append(calls, name)
+				return next.Handle(ctx, msg)
+			})
+		}
+	}
+
+	var deadLettered *Message
+	shortCircuit := func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+			if string(msg.Data) == "poison" {
+				deadLettered = msg
+				return func(context.Context) {}
+			}
+			return next.Handle(ctx, msg)
+		})
+	}
+
+	ns := suite.getNewSasInstance()
+	q, err := ns.NewQueue("foo", QueueWithReceiveMiddleware(record("outer"), record("inner")), QueueWithReceiveMiddleware(shortCircuit))
+	suite.Require().NoError(err)
+
+	handler := q.handlerFor(HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+		calls = append(calls, "handler")
+		return nil
+	}))
+
+	handler.Handle(context.Background(), NewMessageFromString("hello"))
+	suite.Equal([]string{"outer", "inner", "handler"}, calls)
+
+	calls = nil
+	poison := NewMessageFromString("poison")
+	suite.NotNil(handler.Handle(context.Background(), poison))
+	suite.Equal([]string{"outer", "inner"}, calls)
+	suite.True(poison == deadLettered, "middleware should see the original message")
+
+	_, err = ns.NewQueue("foo", QueueWithReceiveMiddleware(nil))
+	suite.Error(err)
+}
+
+func (suite *serviceBusSuite) TestQueueWithSendMiddleware() {
+	stamp := func(next SendFunc) SendFunc {
+		return func(ctx context.Context, msg *Message) error {
+			msg.Set("stamped", "true")
+			return next(ctx, msg)
+		}
+	}
+
+	errInvalid := errors.New("invalid message")
+	validate := func(next SendFunc) SendFunc {
+		return func(ctx context.Context, msg *Message) error {
+			if len(msg.Data) == 0 {
+				return errInvalid
+			}
+			return next(ctx, msg)
+		}
+	}
+
+	ns := suite.getNewSasInstance()
+	q, err := ns.NewQueue("foo", QueueWithSendMiddleware(stamp, validate))
+	suite.Require().NoError(err)
+
+	var sent []*Message
+	send := q.sendFuncFor(func(ctx context.Context, msg *Message) error {
+		sent = append(sent, msg)
+		return nil
+	})
+
+	msg := NewMessageFromString("hello")
+	suite.NoError(send(context.Background(), msg))
+	suite.Equal("true", msg.UserProperties["stamped"])
+
+	suite.Equal(errInvalid, send(context.Background(), NewMessage(nil)))
+	suite.Equal([]*Message{msg}, sent)
+}
+
+func (suite *serviceBusSuite) TestQueueWithEmptyPollBackoff() {
+	ns := suite.getNewSasInstance()
+	q, err := ns.NewQueue("foo", QueueWithEmptyPollBackoff(time.Second, time.Minute))
+	suite.Require().NoError(err)
+	suite.Equal(pollBackoff{initial: time.Second, max: time.Minute}, q.emptyPollBackoff)
+
+	_, err = ns.NewQueue("foo", QueueWithEmptyPollBackoff(0, time.Minute))
+	suite.Error(err)
+	_, err = ns.NewQueue("foo", QueueWithEmptyPollBackoff(time.Minute, time.Second))
+	suite.Error(err)
+}
+
+func (suite *serviceBusSuite) TestQueueWithLockLostHandler() {
+	var lost []error
+	onLockLost := func(_ context.Context, _ *Message, err error) {
+		lost = append(lost, err)
+	}
+
+	ns := suite.getNewSasInstance()
+	q, err := ns.NewQueue("foo", QueueWithLockLostHandler(LockLostSkipDisposition, onLockLost))
+	suite.Require().NoError(err)
+
+	r := &receiver{namespace: ns, lockLost: q.lockLost}
+	expired := time.Now().Add(-time.Second)
+	held := time.Now().Add(time.Minute)
+
+	suite.False(r.skipDispositionOfLostLock(context.Background(), &Message{SystemProperties: &SystemProperties{LockedUntil: &held}}))
+	suite.Empty(lost)
+
+	suite.True(r.skipDispositionOfLostLock(context.Background(), &Message{SystemProperties: &SystemProperties{LockedUntil: &expired}}))
+	suite.Equal([]error{ErrMessageLockLost}, lost)
+
+	r.lockLost.policy = LockLostSettleAnyway
+	suite.False(r.skipDispositionOfLostLock(context.Background(), &Message{SystemProperties: &SystemProperties{LockedUntil: &expired}}))
+	suite.Len(lost, 2)
+}
+
+func (suite *serviceBusSuite) TestQueueWithRedeliveryBackoff() {
+	ns := suite.getNewSasInstance()
+	_, err := ns.NewQueue("foo", QueueWithRedeliveryBackoff(time.Minute, time.Second))
+	suite.Error(err)
+
+	q, err := ns.NewQueue("foo", QueueWithRedeliveryBackoff(time.Second, 3*time.Second))
+	suite.Require().NoError(err)
+	tracker := q.redelivery
+	tracker.capacity = 2
+
+	msg := &Message{SystemProperties: &SystemProperties{SequenceNumber: to.Int64Ptr(1)}}
+	now := time.Now()
+	suite.Equal(time.Duration(0), tracker.holdFor(msg, now))
+
+	tracker.abandoned(msg)
+	suite.InDelta(float64(time.Second), float64(tracker.holdFor(msg, time.Now())), float64(100*time.Millisecond))
+	tracker.abandoned(msg)
+	suite.InDelta(float64(2*time.Second), float64(tracker.holdFor(msg, time.Now())), float64(100*time.Millisecond))
+	tracker.abandoned(msg)
+	suite.InDelta(float64(3*time.Second), float64(tracker.holdFor(msg, time.Now())), float64(100*time.Millisecond), "the hold should not exceed max")
+	suite.True(tracker.holdFor(msg, time.Now().Add(time.Minute)) < 0)
+
+	tracker.settled(msg)
+	suite.Equal(time.Duration(0), tracker.holdFor(msg, time.Now()))
+
+	for i := int64(1); i <= 3; i++ {
+		tracker.abandoned(&Message{SystemProperties: &SystemProperties{SequenceNumber: to.Int64Ptr(i)}})
+	}
+	suite.Len(tracker.entries, 2)
+	suite.Equal(time.Duration(0), tracker.holdFor(msg, time.Now()), "the least recently abandoned message should be forgotten")
+}
+
+func (suite *serviceBusSuite) TestQueueWithDispositionDeadline() {
+	ns := suite.getNewSasInstance()
+	_, err := ns.NewQueue("foo", QueueWithDispositionDeadline(0, nil))
+	suite.Error(err)
+
+	violations := make(chan *Message, 2)
+	q, err := ns.NewQueue("foo", QueueWithDispositionDeadline(10*time.Millisecond, func(_ context.Context, msg *Message) DispositionAction {
+		violations <- msg
+		return nil
+	}))
+	suite.Require().NoError(err)
+
+	settled, forgotten := &Message{ID: "settled"}, &Message{ID: "forgotten"}
+	q.dispositionWatchdog.watch(context.Background(), settled)
+	q.dispositionWatchdog.watch(context.Background(), forgotten)
+	suite.True(settled.settle())
+	suite.False(settled.settle(), "a message should only be settled once")
+
+	select {
+	case msg := <-violations:
+		suite.Equal("forgotten", msg.ID)
+	case <-time.After(time.Second):
+		suite.Fail("the forgotten message was not reported")
+	}
+
+	select {
+	case msg := <-violations:
+		suite.Failf("unexpected violation", "the settled message %q was reported", msg.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	applied := make(chan *Message, 1)
+	q, err = ns.NewQueue("foo", QueueWithDispositionDeadline(10*time.Millisecond, func(_ context.Context, msg *Message) DispositionAction {
+		return func(context.Context) {
+			applied <- msg
+		}
+	}))
+	suite.Require().NoError(err)
+
+	slow := &Message{ID: "slow"}
+	handlerReturned := q.dispositionWatchdog.watch(context.Background(), slow)
+	select {
+	case <-applied:
+		suite.Fail("the violation disposition should not be applied while the handler runs")
+	case <-time.After(50 * time.Millisecond):
+	}
+	action := handlerReturned()
+	suite.Require().NotNil(action, "the violation disposition should be handed back once the handler returned")
+	action(context.Background())
+	suite.Equal("slow", (<-applied).ID)
+
+	quick := &Message{ID: "quick"}
+	suite.Nil(q.dispositionWatchdog.watch(context.Background(), quick)(), "a handler within the deadline should not be reported")
+}
+
+func (suite *serviceBusSuite) TestWithPrefetchCount() {
+	r := &receiver{prefetch: 1}
+	suite.Error(WithPrefetchCount(0)(r))
+	suite.Equal(uint32(1), r.prefetch)
+	suite.Require().NoError(WithPrefetchCount(50)(r))
+	suite.Equal(uint32(50), r.prefetch)
+}
+
+func (suite *serviceBusSuite) TestConcurrentHandlers() {
+	suite.Error(WithConcurrentHandlers(0)(new(receiver)))
+
+	ns, err := NewNamespace()
+	suite.Require().NoError(err)
+	r := &receiver{namespace: ns, mode: ReceiveAndDeleteMode}
+	suite.Require().NoError(WithConcurrentHandlers(3)(r))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var started sync.WaitGroup
+	started.Add(3)
+	release := make(chan struct{})
+	var handled int32
+	messages := make(chan *amqp.Message)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.handleMessages(ctx, ctx.Done(), messages, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+			started.Done()
+			<-release
+			atomic.AddInt32(&handled, 1)
+			return nil
+		}))
+	}()
+
+	for i := 0; i < 3; i++ {
+		messages <- &amqp.Message{Data: [][]byte{[]byte("hello")}}
+	}
+	// all three handlers run at once, or the wait would never return
+	started.Wait()
+
+	cancel()
+	select {
+	case <-done:
+		suite.Fail("handleMessages returned before the handlers in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	<-done
+	suite.Equal(int32(3), atomic.LoadInt32(&handled))
+}
+
+func (suite *serviceBusSuite) TestDrainKeepsHandlersRunning() {
+	ns, err := NewNamespace()
+	suite.Require().NoError(err)
+	r := &receiver{namespace: ns, mode: ReceiveAndDeleteMode}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stop := make(chan struct{})
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var handlerErr error
+	messages := make(chan *amqp.Message)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.handleMessages(ctx, stop, messages, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+			close(started)
+			<-release
+			handlerErr = ctx.Err()
+			return nil
+		}))
+	}()
+
+	messages <- &amqp.Message{Data: [][]byte{[]byte("hello")}}
+	<-started
+
+	// draining stops dispatching without cancelling the handler in flight
+	close(stop)
+	close(release)
+	<-done
+	suite.NoError(handlerErr)
+
+	select {
+	case messages <- &amqp.Message{Data: [][]byte{[]byte("late")}}:
+		suite.Fail("a message was dispatched after draining")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func (suite *serviceBusSuite) TestMessageBatch() {
+	first := &amqp.Message{
+		Properties:  &amqp.MessageProperties{MessageID: "1", GroupID: "session"},
+		Annotations: amqp.Annotations{partitionKeyName: "session"},
+	}
+	batch := newMessageBatch(first)
+	suite.True(batch.accepts(first, make([]byte, 1024)))
+	batch.add(0, make([]byte, 1024))
+
+	other := &amqp.Message{Properties: &amqp.MessageProperties{GroupID: "other"}}
+	suite.False(batch.accepts(other, make([]byte, 1024)), "messages of other sessions should not be batched together")
+	suite.False(batch.accepts(first, make([]byte, maxBatchSize)), "the batch should not exceed the size limit")
+
+	msg, err := batch.toMsg()
+	suite.Require().NoError(err)
+	suite.Equal(batchMessageFormat, msg.Format)
+	suite.Len(msg.Data, 1)
+	suite.Equal("1", msg.Properties.MessageID)
+	suite.Equal("session", msg.Properties.GroupID)
+	suite.Equal("session", msg.Annotations[partitionKeyName])
+}
+
+func (suite *serviceBusSuite) TestAssignsMessageIDs() {
+	suite.True(new(entity).assignsMessageIDs(), "IDs should be assigned by default")
+
+	q, err := suite.getNewSasInstance().NewQueue("foo", QueueWithMessageIDAssignment(false))
+	suite.Require().NoError(err)
+	suite.False(q.assignsMessageIDs())
+
+	q, err = suite.getNewSasInstance().NewQueue("foo", QueueWithMessageIDAssignment(true))
+	suite.Require().NoError(err)
+	suite.True(q.assignsMessageIDs())
+}
+
+func (suite *serviceBusSuite) TestSenderPrepareMessageID() {
+	ns, err := NewNamespace(NamespaceWithIDGenerator(func() string { return "generated" }))
+	suite.Require().NoError(err)
+	s := &sender{namespace: ns, session: &session{SessionID: "session"}}
+
+	msg := NewMessageFromString("hello")
+	msg.ID = "order-42"
+	suite.Require().NoError(s.prepare(context.Background(), msg))
+	suite.Equal("order-42", msg.ID, "an ID set by the caller should be sent as is")
+
+	msg = NewMessageFromString("hello")
+	suite.Require().NoError(s.prepare(context.Background(), msg))
+	suite.Equal("generated", msg.ID)
+
+	ns.idGenerator = func() string { return "other" }
+	suite.Require().NoError(s.prepare(context.Background(), msg))
+	suite.Equal("generated", msg.ID, "sending the message again should reuse its ID")
+
+	aMsg, err := msg.toMsg()
+	suite.Require().NoError(err)
+	suite.Equal("generated", aMsg.Properties.MessageID)
+
+	s.skipIDAssignment = true
+	msg = NewMessageFromString("hello")
+	suite.Require().NoError(s.prepare(context.Background(), msg))
+	suite.Empty(msg.ID, "no ID should be assigned when assignment is disabled")
+}
+
+func (suite *serviceBusSuite) TestSenderPreparePartitionKey() {
+	ns, err := NewNamespace()
+	suite.Require().NoError(err)
+	s := &sender{namespace: ns, session: &session{SessionID: "random"}}
+
+	msg := NewMessageFromString("hello")
+	msg.PartitionKey = to.StringPtr("pk")
+	suite.Require().NoError(s.prepare(context.Background(), msg))
+	aMsg, err := msg.toMsg()
+	suite.Require().NoError(err, "the session of the sender should not be checked against the partition key")
+	suite.Equal("pk", aMsg.Annotations[partitionKeyName])
+	suite.Equal("random", aMsg.Properties.GroupID)
+
+	msg = NewMessageFromString("hello")
+	suite.Require().NoError(s.prepare(context.Background(), msg))
+	aMsg, err = msg.toMsg()
+	suite.Require().NoError(err)
+	suite.Nil(aMsg.Annotations[partitionKeyName], "the session of the sender should not pin the partition of the message")
+
+	msg = NewMessageFromString("hello")
+	msg.GroupID = to.StringPtr("session")
+	msg.PartitionKey = to.StringPtr("pk")
+	suite.Require().NoError(s.prepare(context.Background(), msg))
+	_, err = msg.toMsg()
+	suite.True(errors.Is(err, ErrPartitionKeyMismatch), "the session set by the caller should be checked")
+
+	bound := &sender{namespace: ns, session: &session{SessionID: "bound"}, sessionID: to.StringPtr("bound")}
+	msg = NewMessageFromString("hello")
+	suite.Require().NoError(bound.prepare(context.Background(), msg))
+	aMsg, err = msg.toMsg()
+	suite.Require().NoError(err)
+	suite.Equal("bound", aMsg.Annotations[partitionKeyName], "the session a sender is bound to should place the message")
+}
+
+func (suite *serviceBusSuite) TestNamespaceWithMessageIDFactory() {
+	_, err := NewNamespace(NamespaceWithMessageIDFactory(nil))
+	suite.Error(err)
+
+	ns, err := NewNamespace(NamespaceWithMessageIDFactory(func() string { return "01ARZ3NDEKTSV4RRFFQ69G5FAV" }))
+	suite.Require().NoError(err)
+	s := &sender{namespace: ns, session: &session{SessionID: "session"}}
+
+	msg := NewMessageFromString("hello")
+	suite.Require().NoError(s.prepare(context.Background(), msg))
+	suite.Equal("01ARZ3NDEKTSV4RRFFQ69G5FAV", msg.ID, "the factory should configure the ID generator")
+
+	ns.idGenerator = func() string { return "" }
+	suite.Error(s.prepare(context.Background(), NewMessageFromString("hello")))
+}
+
+func (suite *serviceBusSuite) TestSendWithPartialOptions() {
+	s := new(sender)
+	for _, so := range []SendOptions{
+		{TransferTimeout: time.Second},
+		{ConfirmTimeout: time.Second},
+		{TransferTimeout: -time.Second, ConfirmTimeout: time.Second},
+	} {
+		suite.Error(s.SendWithOptions(context.Background(), NewMessageFromString("hello"), so), "%+v should be rejected", so)
+	}
+}
+
+func (suite *serviceBusSuite) TestSendWithOptionsConfirmTimeout() {
+	ns, err := NewNamespace()
+	suite.Require().NoError(err)
+	so := SendOptions{TransferTimeout: 10 * time.Millisecond, ConfirmTimeout: 10 * time.Millisecond}
+
+	// like the AMQP link, a transfer which is never settled returns the error of its context
+	unsettled := &sender{namespace: ns, session: &session{SessionID: "session"}, sender: senderLinkFunc(func(ctx context.Context, _ *amqp.Message) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})}
+	err = unsettled.SendWithOptions(context.Background(), NewMessageFromString("hello"), so)
+	suite.Equal(ErrConfirmTimeout, err, "a send whose outcome is unknown once the timeouts elapsed may have landed")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = unsettled.SendWithOptions(ctx, NewMessageFromString("hello"), so)
+	suite.Equal(context.Canceled, err, "the error of the context of the caller should be returned as is")
+
+	refused := errors.New("refused")
+	failing := &sender{namespace: ns, session: &session{SessionID: "session"}, sender: senderLinkFunc(func(context.Context, *amqp.Message) error {
+		return refused
+	})}
+	suite.Equal(refused, failing.SendWithOptions(context.Background(), NewMessageFromString("hello"), so))
+}
+
+// senderLinkFunc is a senderLink which transfers messages with the func
+type senderLinkFunc func(ctx context.Context, msg *amqp.Message) error
+
+func (f senderLinkFunc) Send(ctx context.Context, msg *amqp.Message) error {
+	return f(ctx, msg)
+}
+
+func (f senderLinkFunc) Close(context.Context) error {
+	return nil
+}
+
+func (suite *serviceBusSuite) TestSenderPrepareTTL() {
+	logger := new(recordingLogger)
+	ns, err := NewNamespace(NamespaceWithLogger(logger))
+	suite.Require().NoError(err)
+
+	lookups := 0
+	e := new(entity)
+	s := &sender{namespace: ns, session: &session{SessionID: "session"}, defaultTTL: func(ctx context.Context) (time.Duration, bool) {
+		return e.defaultMessageTTL(ctx, func(context.Context) (*entityProperties, error) {
+			lookups++
+			return newEntityProperties(ptrString("PT1H"), ptrString("PT10M")), nil
+		})
+	}}
+
+	ttl := 2 * time.Hour
+	msg := NewMessageFromString("hello")
+	msg.TTL = &ttl
+	suite.Require().NoError(s.prepare(context.Background(), msg))
+	suite.Equal(time.Hour, *msg.TTL, "the TTL should be capped to the default of the entity")
+	suite.Equal(2*time.Hour, ttl, "the TTL of the caller should not be modified")
+	suite.Equal([]string{"message time to live exceeds the default of the entity and was capped"}, logger.messages)
+
+	short := time.Minute
+	msg.TTL = &short
+	suite.Require().NoError(s.prepare(context.Background(), msg))
+	suite.Equal(time.Minute, *msg.TTL)
+	suite.Equal(1, lookups, "the default of the entity should be cached")
+	suite.Equal(10*time.Minute, e.describe(context.Background(), nil).duplicateDetectionWindow)
+	suite.Equal(1, lookups, "the description of the entity should be shared by the features relying on it")
+
+	zero := time.Duration(0)
+	msg.TTL = &zero
+	suite.Require().NoError(s.prepare(context.Background(), msg))
+	aMsg, err := msg.toMsg()
+	suite.Require().NoError(err)
+	suite.Nil(aMsg.Header, "a zero TTL should use the default of the entity")
+
+	negative := -time.Second
+	msg.TTL = &negative
+	suite.Error(s.prepare(context.Background(), msg))
+
+	suite.Equal(time.Duration(0), ttlFromISO8601("P10675199DT2H48M5.4775807S"), "an unbounded default should not cap")
+	suite.Equal(14*24*time.Hour, ttlFromISO8601("P14D"))
+}
+
+func (suite *serviceBusSuite) TestSentMessageTracker() {
+	tracker := newSentMessageTracker(time.Minute)
+	start := time.Now()
+
+	suite.False(tracker.track("foo", start))
+	suite.True(tracker.track("foo", start.Add(30*time.Second)))
+	suite.False(tracker.track("bar", start.Add(30*time.Second)))
+	suite.False(tracker.track("foo", start.Add(61*time.Second)), "outside of the window the message is not a duplicate")
+
+	tracker.forget("bar")
+	suite.False(tracker.track("bar", start.Add(62*time.Second)))
+
+	suite.Equal(int64(1), tracker.peekFrom(), "the first peek check should start at the head of the queue")
+	tracker.peeked(7)
+	tracker.peeked(5)
+	suite.Equal(int64(8), tracker.peekFrom(), "peek checks should start after the highest sequence number seen")
 }
 
 func (suite *serviceBusSuite) TestQueueManagementWrites() {
 	tests := map[string]func(context.Context, *testing.T, *QueueManager, string){
-		"TestPutDefaultQueue": testPutQueue,
+		"TestPutDefaultQueue":   testPutQueue,
+		"TestEnsureQueueExists": testEnsureQueueExists,
 	}
 
 	ns := suite.getNewSasInstance()
@@ -248,10 +1416,25 @@ func testPutQueue(ctx context.Context, t *testing.T, qm *QueueManager, name stri
 	}
 }
 
+func testEnsureQueueExists(ctx context.Context, t *testing.T, qm *QueueManager, name string) {
+	created, err := qm.EnsureExists(ctx, name, QueueEntityWithMaxDeliveryCount(3))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int32(3), *created.MaxDeliveryCount)
+
+	existing, err := qm.EnsureExists(ctx, name, QueueEntityWithMaxDeliveryCount(5))
+	if assert.NoError(t, err) {
+		assert.Equal(t, int32(3), *existing.MaxDeliveryCount, "options should not be applied to an existing queue")
+	}
+}
+
 func (suite *serviceBusSuite) TestQueueManagementReads() {
 	tests := map[string]func(context.Context, *testing.T, *QueueManager, []string){
-		"TestGetQueue":   testGetQueue,
-		"TestListQueues": testListQueues,
+		"TestGetQueue":    testGetQueue,
+		"TestQueueExists": testQueueExists,
+		"TestListQueues":  testListQueues,
+		"TestListPaged":   testListQueuesPaged,
 	}
 
 	ns := suite.getNewSasInstance()
@@ -287,6 +1470,16 @@ func testGetQueue(ctx context.Context, t *testing.T, qm *QueueManager, names []s
 	assert.Equal(t, q.Name, names[0])
 }
 
+func testQueueExists(ctx context.Context, t *testing.T, qm *QueueManager, names []string) {
+	exists, err := qm.Exists(ctx, names[0])
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = qm.Exists(ctx, "notexists-"+names[0])
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
 func testListQueues(ctx context.Context, t *testing.T, qm *QueueManager, names []string) {
 	qs, err := qm.List(ctx)
 	assert.Nil(t, err)
@@ -301,6 +1494,29 @@ func testListQueues(ctx context.Context, t *testing.T, qm *QueueManager, names [
 	}
 }
 
+func testListQueuesPaged(ctx context.Context, t *testing.T, qm *QueueManager, names []string) {
+	_, _, err := qm.ListPaged(ctx, 0, 0)
+	assert.Error(t, err)
+
+	var queueNames []string
+	for skip := 0; ; skip++ {
+		page, more, err := qm.ListPaged(ctx, skip, 1)
+		if !assert.NoError(t, err) {
+			return
+		}
+		for _, q := range page {
+			queueNames = append(queueNames, q.Name)
+		}
+		if !more {
+			break
+		}
+	}
+
+	for _, name := range names {
+		assert.Contains(t, queueNames, name)
+	}
+}
+
 func (suite *serviceBusSuite) randEntityName() string {
 	return suite.RandomName("goq", 6)
 }
@@ -316,6 +1532,11 @@ func (suite *serviceBusSuite) TestQueueManagement() {
 		"TestQueueWithLockDuration":                     testQueueWithLockDuration,
 		"TestQueueWithAutoDeleteOnIdle":                 testQueueWithAutoDeleteOnIdle,
 		"TestQueueWithPartitioning":                     testQueueWithPartitioning,
+		"TestQueueUpdate":                               testQueueUpdate,
+		"TestQueueWithAutoForward":                      testQueueWithAutoForward,
+		"TestQueueForwardingValidation":                 testQueueForwardingValidation,
+		"TestQueueAuthorizationRules":                   testQueueAuthorizationRules,
+		"TestQueueSetStatus":                            testQueueSetStatus,
 	}
 
 	ns := suite.getNewSasInstance()
@@ -333,6 +1554,63 @@ func (suite *serviceBusSuite) TestQueueManagement() {
 	}
 }
 
+func testQueueAuthorizationRules(ctx context.Context, t *testing.T, qm *QueueManager, name string) {
+	buildQueue(ctx, t, qm, name)
+
+	_, err := qm.PutAuthorizationRule(ctx, name, AuthorizationRule{KeyName: "manager", Rights: []AccessRight{ManageRight}})
+	assert.Error(t, err, "the Manage right requires the Send and Listen rights")
+
+	rule, err := qm.PutAuthorizationRule(ctx, name, AuthorizationRule{KeyName: "sender", Rights: []AccessRight{SendRight}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []AccessRight{SendRight}, rule.Rights)
+	assert.NotEmpty(t, rule.PrimaryKey, "the primary key should be generated")
+	assert.NotEmpty(t, rule.SecondaryKey, "the secondary key should be generated")
+
+	_, err = qm.Update(ctx, name, QueueEntityWithMaxDeliveryCount(4))
+	assert.NoError(t, err)
+
+	rules, err := qm.ListAuthorizationRules(ctx, name)
+	if assert.NoError(t, err) && assert.Len(t, rules, 1, "updating the queue should keep its rules") {
+		assert.Equal(t, rule.PrimaryKey, rules[0].PrimaryKey)
+	}
+
+	assert.NoError(t, qm.DeleteAuthorizationRule(ctx, name, "sender"))
+	rules, err = qm.ListAuthorizationRules(ctx, name)
+	if assert.NoError(t, err) {
+		assert.Empty(t, rules)
+	}
+}
+
+func testQueueSetStatus(ctx context.Context, t *testing.T, qm *QueueManager, name string) {
+	buildQueue(ctx, t, qm, name)
+
+	_, err := qm.SetStatus(ctx, name, Creating)
+	assert.Error(t, err, "only Active, Disabled, SendDisabled and ReceiveDisabled can be set")
+
+	qe, err := qm.SetStatus(ctx, name, SendDisabled)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, SendDisabled, *qe.Status)
+
+	q, err := qm.namespace.NewQueue(name)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		_ = q.Close(context.Background())
+	}()
+	err = q.Send(ctx, NewMessageFromString("quiesced"))
+	assert.True(t, errors.Is(err, ErrEntityDisabled), "sending to a send disabled queue should fail with ErrEntityDisabled, not %v", err)
+
+	qe, err = qm.SetStatus(ctx, name, Active)
+	if assert.NoError(t, err) {
+		assert.Equal(t, Active, *qe.Status)
+	}
+}
+
 func testDefaultQueue(ctx context.Context, t *testing.T, qm *QueueManager, name string) {
 	q := buildQueue(ctx, t, qm, name)
 	assert.False(t, *q.EnableExpress, "should not have Express enabled")
@@ -353,14 +1631,55 @@ func testQueueWithAutoDeleteOnIdle(ctx context.Context, t *testing.T, qm *QueueM
 	assert.Equal(t, "PT20M", *q.AutoDeleteOnIdle)
 }
 
-func testQueueWithRequiredSessions(ctx context.Context, t *testing.T, qm *QueueManager, name string) {
-	q := buildQueue(ctx, t, qm, name, QueueEntityWithRequiredSessions())
-	assert.True(t, *q.RequiresSession)
+func testQueueWithRequiredSessions(ctx context.Context, t *testing.T, qm *QueueManager, name string) {
+	q := buildQueue(ctx, t, qm, name, QueueEntityWithRequiredSessions())
+	assert.True(t, *q.RequiresSession)
+}
+
+func testQueueWithDeadLetteringOnMessageExpiration(ctx context.Context, t *testing.T, qm *QueueManager, name string) {
+	q := buildQueue(ctx, t, qm, name, QueueEntityWithDeadLetteringOnMessageExpiration())
+	assert.True(t, *q.DeadLetteringOnMessageExpiration)
+}
+
+func testQueueWithAutoForward(ctx context.Context, t *testing.T, qm *QueueManager, name string) {
+	target := name + "-target"
+	_, err := qm.Put(ctx, target)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		assert.NoError(t, qm.Delete(ctx, target))
+	}()
+
+	q := buildQueue(ctx, t, qm, name,
+		QueueEntityWithDeadLetteringOnMessageExpiration(),
+		QueueEntityWithAutoForward(target),
+		QueueEntityWithForwardDeadLetteredMessagesTo(target))
+	assert.True(t, *q.DeadLetteringOnMessageExpiration)
+	if assert.NotNil(t, q.ForwardTo) {
+		assert.Equal(t, target, forwardTargetName(*q.ForwardTo))
+	}
+	if assert.NotNil(t, q.ForwardDeadLetteredMessagesTo) {
+		assert.Equal(t, target, forwardTargetName(*q.ForwardDeadLetteredMessagesTo))
+	}
+
+	_, err = qm.Update(ctx, target, QueueEntityWithAutoForward(name))
+	assert.Error(t, err, "forwarding back to the source queue should be refused")
 }
 
-func testQueueWithDeadLetteringOnMessageExpiration(ctx context.Context, t *testing.T, qm *QueueManager, name string) {
-	q := buildQueue(ctx, t, qm, name, QueueEntityWithDeadLetteringOnMessageExpiration())
-	assert.True(t, *q.DeadLetteringOnMessageExpiration)
+func testQueueForwardingValidation(ctx context.Context, t *testing.T, qm *QueueManager, name string) {
+	_, err := qm.Put(ctx, name, QueueEntityWithAutoForward(name))
+	assert.Error(t, err, "forwarding to itself should be refused")
+
+	_, err = qm.Put(ctx, name, QueueEntityWithForwardDeadLetteredMessagesTo(name+"-missing"))
+	assert.Error(t, err, "forwarding to a missing entity should be refused")
+
+	q, err := qm.Get(ctx, name)
+	assert.NoError(t, err)
+	assert.Nil(t, q)
+
+	assert.Equal(t, "target", forwardTargetName("sb://example.servicebus.windows.net/target"))
+	assert.Equal(t, "target", forwardTargetName("target"))
 }
 
 func testQueueWithPartitioning(ctx context.Context, t *testing.T, qm *QueueManager, name string) {
@@ -392,6 +1711,24 @@ func testQueueWithLockDuration(ctx context.Context, t *testing.T, qm *QueueManag
 	assert.Equal(t, "PT3M", *q.LockDuration)
 }
 
+func testQueueUpdate(ctx context.Context, t *testing.T, qm *QueueManager, name string) {
+	buildQueue(ctx, t, qm, name, QueueEntityWithMaxDeliveryCount(5))
+
+	window := time.Duration(3 * time.Minute)
+	q, err := qm.Update(ctx, name, QueueEntityWithLockDuration(&window))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "PT3M", *q.LockDuration)
+	assert.Equal(t, int32(5), *q.MaxDeliveryCount, "properties which are not updated should be kept")
+
+	_, err = qm.Update(ctx, name, QueueEntityWithRequiredSessions())
+	assert.Error(t, err, "sessions can only be required when the queue is created")
+
+	_, err = qm.Update(ctx, name+"-missing", QueueEntityWithLockDuration(&window))
+	assert.Error(t, err)
+}
+
 func buildQueue(ctx context.Context, t *testing.T, qm *QueueManager, name string, opts ...QueueManagementOption) *QueueEntity {
 	_, err := qm.Put(ctx, name, opts...)
 	if !assert.NoError(t, err) {
@@ -412,6 +1749,23 @@ func (suite *serviceBusSuite) TestQueueClient() {
 		"DuplicateDetection": testDuplicateDetection,
 		"MessageProperties":  testMessageProperties,
 		"Retry":              testRequeueOnFail,
+		"OldestEnqueuedTime": testOldestMessageEnqueuedTime,
+		"ReceiveToChannel":   testReceiveToChannel,
+		"SendWithOptions":    testSendWithOptions,
+		"PeekWhere":          testPeekWhere,
+		"SendAsync":          testSendAsync,
+		"SendBatch":          testSendBatch,
+		"SendScheduled":      testSendScheduled,
+		"ScheduleAndCancel":  testScheduleAndCancel,
+		"Peek":               testPeek,
+		"PeekScheduled":      testPeekScheduled,
+		"DeadLetterReceiver": testDeadLetterReceiver,
+		"DeadLetterReason":   testDeadLetterWithReason,
+		"PeekDeadLetter":     testPeekDeadLetter,
+		"ForwardDeadLetter":  testForwardDeadLetterMessages,
+		"ReceiveDeferred":    testReceiveDeferred,
+		"AbandonModified":    testAbandonWithModifications,
+		"ReceiveOneTimeout":  testReceiveOneTimeout,
 	}
 
 	timeouts := map[string]time.Duration{
@@ -483,6 +1837,452 @@ func testRequeueOnFail(ctx context.Context, t *testing.T, q *Queue) {
 	}
 }
 
+func testOldestMessageEnqueuedTime(ctx context.Context, t *testing.T, q *Queue) {
+	enqueued, err := q.OldestMessageEnqueuedTime(ctx)
+	if assert.NoError(t, err) {
+		assert.Nil(t, enqueued)
+	}
+
+	if assert.NoError(t, q.Send(ctx, NewMessageFromString("Hello World!"))) {
+		enqueued, err := q.OldestMessageEnqueuedTime(ctx)
+		if assert.NoError(t, err) && assert.NotNil(t, enqueued) {
+			assert.WithinDuration(t, time.Now(), *enqueued, 1*time.Minute)
+		}
+
+		err = q.ReceiveOne(ctx, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+			return msg.Complete()
+		}))
+		assert.NoError(t, err)
+	}
+}
+
+func testPeekWhere(ctx context.Context, t *testing.T, q *Queue) {
+	for _, correlationID := range []string{"a", "b", "c", "b"} {
+		msg := NewMessageFromString("hello " + correlationID)
+		msg.CorrelationID = correlationID
+		if !assert.NoError(t, q.Send(ctx, msg)) {
+			return
+		}
+	}
+
+	matched, err := q.PeekWhere(ctx, func(msg *Message) bool {
+		return msg.CorrelationID == "b"
+	}, 10)
+	if assert.NoError(t, err) && assert.Len(t, matched, 2) {
+		assert.Equal(t, "hello b", string(matched[0].Data))
+	}
+
+	matched, err = q.PeekWhere(ctx, func(msg *Message) bool { return true }, 1)
+	if assert.NoError(t, err) && assert.Len(t, matched, 1) {
+		assert.Equal(t, "hello a", string(matched[0].Data))
+	}
+
+	for i := 0; i < 4; i++ {
+		err := q.ReceiveOne(ctx, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+			return msg.Complete()
+		}))
+		assert.NoError(t, err)
+	}
+}
+
+func testSendWithOptions(ctx context.Context, t *testing.T, q *Queue) {
+	so := SendOptions{
+		TransferTimeout: 30 * time.Second,
+		ConfirmTimeout:  30 * time.Second,
+	}
+	if assert.NoError(t, q.SendWithOptions(ctx, NewMessageFromString("Hello World!"), so)) {
+		err := q.ReceiveOne(ctx, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+			return msg.Complete()
+		}))
+		assert.NoError(t, err)
+	}
+}
+
+func testSendAsync(ctx context.Context, t *testing.T, q *Queue) {
+	const numMessages = 10
+	results := make([]<-chan AsyncSendResult, numMessages)
+	for i := range results {
+		results[i] = q.SendAsync(ctx, NewMessageFromString(fmt.Sprintf("hello %d", i)))
+	}
+
+	for _, result := range results {
+		select {
+		case res := <-result:
+			assert.NoError(t, res.Err)
+			assert.NotEmpty(t, res.MessageID)
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		}
+	}
+
+	for i := 0; i < numMessages; i++ {
+		err := q.ReceiveOne(ctx, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+			return msg.Complete()
+		}))
+		assert.NoError(t, err)
+	}
+}
+
+func testSendBatch(ctx context.Context, t *testing.T, q *Queue) {
+	const numMessages = 100
+	messages := make([]*Message, numMessages)
+	for i := range messages {
+		messages[i] = NewMessageFromString(fmt.Sprintf("hello %d", i))
+	}
+	if !assert.NoError(t, q.SendBatch(ctx, messages)) {
+		return
+	}
+
+	for i := 0; i < numMessages; i++ {
+		err := q.ReceiveOne(ctx, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+			return msg.Complete()
+		}))
+		assert.NoError(t, err)
+	}
+}
+
+func testSendScheduled(ctx context.Context, t *testing.T, q *Queue) {
+	// a time in the past is delivered immediately
+	past := time.Now().Add(-time.Minute)
+	msg := NewMessageFromString("hello")
+	msg.ScheduledEnqueueTime = &past
+	if !assert.NoError(t, q.Send(ctx, msg)) {
+		return
+	}
+
+	err := q.ReceiveOne(ctx, HandlerFunc(func(ctx context.Context, received *Message) DispositionAction {
+		assert.Equal(t, msg.ID, received.ID)
+		return received.Complete()
+	}))
+	assert.NoError(t, err)
+}
+
+func testScheduleAndCancel(ctx context.Context, t *testing.T, q *Queue) {
+	messages := []*Message{NewMessageFromString("one"), NewMessageFromString("two")}
+	sequenceNumbers, err := q.ScheduleMessages(ctx, time.Now().Add(time.Hour), messages...)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, sequenceNumbers, len(messages))
+
+	assert.NoError(t, q.CancelScheduledMessages(ctx, sequenceNumbers...))
+
+	err = q.CancelScheduledMessages(ctx, sequenceNumbers[0], math.MaxInt64)
+	if cancelErr, ok := err.(*CancelScheduledError); assert.True(t, ok, "expected a *CancelScheduledError, got %v", err) {
+		assert.Contains(t, cancelErr.Rejected, int64(math.MaxInt64))
+	}
+}
+
+func testPeekScheduled(ctx context.Context, t *testing.T, q *Queue) {
+	if !assert.NoError(t, q.Send(ctx, NewMessageFromString("active"))) {
+		return
+	}
+	sequenceNumbers, err := q.ScheduleMessages(ctx, time.Now().Add(time.Hour), NewMessageFromString("scheduled"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer q.CancelScheduledMessages(ctx, sequenceNumbers...)
+
+	matched, err := q.PeekWhere(ctx, func(*Message) bool { return true }, 10)
+	if assert.NoError(t, err) && assert.Len(t, matched, 1, "scheduled messages should be skipped by default") {
+		assert.Equal(t, "active", string(matched[0].Data))
+		assert.Equal(t, MessageStateActive, matched[0].State())
+	}
+
+	iter, err := q.Peek(ctx, PeekWithScheduledMessages())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer iter.Close(ctx)
+
+	var scheduled []*Message
+	for {
+		msg, err := iter.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+		if msg.State() == MessageStateScheduled {
+			scheduled = append(scheduled, msg)
+		}
+	}
+	if assert.Len(t, scheduled, 1) {
+		assert.Equal(t, "scheduled", string(scheduled[0].Data))
+		assert.NotNil(t, scheduled[0].ScheduledEnqueueTime)
+	}
+
+	info, err := q.namespace.NewQueueManager().RuntimeInfo(ctx, q.Name)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(1), info.ScheduledMessageCount)
+	}
+
+	err = q.ReceiveOne(ctx, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+		return msg.Complete()
+	}))
+	assert.NoError(t, err)
+}
+
+func testPeek(ctx context.Context, t *testing.T, q *Queue) {
+	const numMessages = 3
+	for i := 0; i < numMessages; i++ {
+		if !assert.NoError(t, q.Send(ctx, NewMessageFromString(fmt.Sprintf("hello %d", i)))) {
+			return
+		}
+	}
+
+	iter, err := q.Peek(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer iter.Close(ctx)
+
+	var seqs []int64
+	for {
+		msg, err := iter.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, fmt.Sprintf("hello %d", len(seqs)), string(msg.Data))
+		seqs = append(seqs, *msg.SystemProperties.SequenceNumber)
+		// dispositions have no effect on peeked messages
+		msg.Complete()(ctx)
+	}
+	assert.Len(t, seqs, numMessages)
+
+	fromSecond, err := q.PeekFromSequenceNumber(ctx, seqs[1])
+	if assert.NoError(t, err) {
+		msg, err := fromSecond.Next(ctx)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "hello 1", string(msg.Data))
+		}
+		assert.NoError(t, fromSecond.Close(ctx))
+	}
+
+	for i := 0; i < numMessages; i++ {
+		err := q.ReceiveOne(ctx, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+			return msg.Complete()
+		}))
+		assert.NoError(t, err)
+	}
+}
+
+func testDeadLetterReceiver(ctx context.Context, t *testing.T, q *Queue) {
+	if !assert.NoError(t, q.Send(ctx, NewMessageFromString("poison"))) {
+		return
+	}
+
+	err := q.ReceiveOne(ctx, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+		return msg.DeadLetter(errors.New("could not handle the message"))
+	}))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	dlq := q.NewDeadLetterReceiver()
+	defer dlq.Close(ctx)
+	err = dlq.ReceiveOne(ctx, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+		assert.Equal(t, "poison", string(msg.Data))
+		assert.Equal(t, "could not handle the message", msg.DeadLetterErrorDescription())
+		return msg.Complete()
+	}))
+	assert.NoError(t, err)
+}
+
+func testForwardDeadLetterMessages(ctx context.Context, t *testing.T, q *Queue) {
+	msg := NewMessageFromString("poison")
+	msg.ID = "poison-1"
+	msg.ContentType = "text/plain"
+	msg.Label = "order"
+	msg.UserProperties = map[string]interface{}{"tenant": "contoso"}
+	if !assert.NoError(t, q.Send(ctx, msg)) {
+		return
+	}
+
+	err := q.ReceiveOne(ctx, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+		return msg.DeadLetter(errors.New("could not handle the message"))
+	}))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	dlq := q.NewDeadLetterReceiver()
+	defer dlq.Close(ctx)
+	rc, err := dlq.NewReceiver(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer rc.Close(ctx)
+
+	forwardCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	forwarded, err := ForwardMessages(forwardCtx, rc, q.Send, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, forwarded, "forwarding should stop when no more messages arrive")
+
+	err = q.ReceiveOne(ctx, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+		assert.Equal(t, "poison", string(msg.Data))
+		assert.NotEqual(t, "poison-1", msg.ID, "the copy should be sent with a new ID")
+		assert.Equal(t, "text/plain", msg.ContentType)
+		assert.Equal(t, "order", msg.Label)
+		assert.Equal(t, "contoso", msg.UserProperties["tenant"])
+		assert.Equal(t, "could not handle the message", msg.DeadLetterErrorDescription())
+		return msg.Complete()
+	}))
+	assert.NoError(t, err)
+}
+
+func testDeadLetterWithReason(ctx context.Context, t *testing.T, q *Queue) {
+	if !assert.NoError(t, q.Send(ctx, NewMessageFromString("{"))) {
+		return
+	}
+
+	err := q.ReceiveOne(ctx, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+		return msg.DeadLetterWithReason(errors.New("unexpected end of JSON input"), "SchemaValidationFailed", "")
+	}))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	dlq := q.NewDeadLetterReceiver()
+	defer dlq.Close(ctx)
+	err = dlq.ReceiveOne(ctx, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+		assert.Equal(t, "SchemaValidationFailed", msg.DeadLetterReason())
+		assert.Equal(t, "unexpected end of JSON input", msg.DeadLetterErrorDescription())
+		return msg.Complete()
+	}))
+	assert.NoError(t, err)
+}
+
+func testPeekDeadLetter(ctx context.Context, t *testing.T, q *Queue) {
+	if !assert.NoError(t, q.Send(ctx, NewMessageFromString("poison"))) {
+		return
+	}
+
+	err := q.ReceiveOne(ctx, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+		return msg.DeadLetterWithReason(errors.New("could not handle the message"), "HandlerFailed", "")
+	}))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	iter, err := q.PeekDeadLetter(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer iter.Close(ctx)
+
+	msg, err := iter.Next(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "poison", string(msg.Data))
+		assert.Equal(t, "HandlerFailed", msg.DeadLetterReason())
+		assert.Equal(t, "could not handle the message", msg.DeadLetterErrorDescription())
+	}
+	_, err = iter.Next(ctx)
+	assert.Equal(t, io.EOF, err)
+
+	info, err := q.namespace.NewQueueManager().RuntimeInfo(ctx, q.Name)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(1), info.DeadLetterMessageCount, "peeking should leave the message in the dead letter queue")
+	}
+}
+
+func testAbandonWithModifications(ctx context.Context, t *testing.T, q *Queue) {
+	msg := NewMessageFromString("retry me")
+	msg.UserProperties = map[string]interface{}{"origin": "test"}
+	if !assert.NoError(t, q.Send(ctx, msg)) {
+		return
+	}
+
+	err := q.ReceiveOne(ctx, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+		return msg.AbandonWithModifications(map[string]interface{}{
+			"retries":               int32(1),
+			"x-opt-sequence-number": int64(0),
+		})
+	}))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	err = q.ReceiveOne(ctx, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+		assert.Equal(t, int32(1), msg.UserProperties["retries"])
+		assert.Equal(t, "test", msg.UserProperties["origin"])
+		assert.NotEqual(t, int64(0), *msg.SystemProperties.SequenceNumber)
+		return msg.Complete()
+	}))
+	assert.NoError(t, err)
+}
+
+func testReceiveOneTimeout(ctx context.Context, t *testing.T, q *Queue) {
+	receiveCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	called := false
+	err := q.ReceiveOne(receiveCtx, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+		called = true
+		return msg.Complete()
+	}))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.False(t, called, "the handler should not be called when no message arrived")
+}
+
+func testReceiveDeferred(ctx context.Context, t *testing.T, q *Queue) {
+	if !assert.NoError(t, q.Send(ctx, NewMessageFromString("later"))) {
+		return
+	}
+
+	var sequenceNumber int64
+	err := q.ReceiveOne(ctx, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+		sequenceNumber = *msg.SystemProperties.SequenceNumber
+		return msg.Defer()
+	}))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	messages, err := q.ReceiveDeferred(ctx, sequenceNumber)
+	if !assert.NoError(t, err) || !assert.Len(t, messages, 1) {
+		return
+	}
+	msg := messages[0]
+	assert.Equal(t, "later", string(msg.Data))
+	assert.NotNil(t, msg.LockToken)
+	assert.NoError(t, msg.RenewLock(ctx))
+	msg.Complete()(ctx)
+}
+
+func testReceiveToChannel(ctx context.Context, t *testing.T, q *Queue) {
+	const numMessages = 5
+	for i := 0; i < numMessages; i++ {
+		if !assert.NoError(t, q.Send(ctx, NewMessageFromString(fmt.Sprintf("hello %d", i)))) {
+			return
+		}
+	}
+
+	messages, errs, stop := q.ReceiveToChannel(ctx, 2)
+	defer stop()
+
+	for i := 0; i < numMessages; i++ {
+		select {
+		case msg := <-messages:
+			msg.Complete()(ctx)
+		case err := <-errs:
+			assert.NoError(t, err)
+			return
+		case <-ctx.Done():
+			assert.FailNow(t, "timed out waiting for messages", ctx.Err())
+		}
+	}
+
+	stop()
+	_, ok := <-messages
+	assert.False(t, ok, "message channel should be closed after stop")
+}
+
 func testMessageProperties(ctx context.Context, t *testing.T, q *Queue) {
 	if assert.NoError(t, q.Send(ctx, NewMessageFromString("Hello World!"))) {
 		err := q.ReceiveOne(context.Background(),
@@ -552,7 +2352,8 @@ func testDuplicateDetection(ctx context.Context, t *testing.T, queue *Queue) {
 
 func (suite *serviceBusSuite) TestQueueWithReceiveAndDelete() {
 	tests := map[string]func(context.Context, *testing.T, *Queue){
-		"SimpleSendAndReceive": testQueueSendAndReceiveWithReceiveAndDelete,
+		"SimpleSendAndReceive":     testQueueSendAndReceiveWithReceiveAndDelete,
+		"DispositionsHaveNoEffect": testQueueReceiveAndDeleteDispositions,
 	}
 
 	ns := suite.getNewSasInstance()
@@ -615,6 +2416,19 @@ func testQueueSendAndReceiveWithReceiveAndDelete(ctx context.Context, t *testing
 	}
 }
 
+func testQueueReceiveAndDeleteDispositions(ctx context.Context, t *testing.T, queue *Queue) {
+	if !assert.NoError(t, queue.Send(ctx, NewMessageFromString("hello"))) {
+		return
+	}
+
+	err := queue.ReceiveOne(ctx, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+		assert.Error(t, msg.RenewLock(ctx), "a message received in receive and delete mode holds no lock")
+		// the message was deleted on delivery, so abandoning it does not make it available again
+		return msg.Abandon()
+	}))
+	assert.NoError(t, err)
+}
+
 func makeQueue(ctx context.Context, t *testing.T, ns *Namespace, name string, opts ...QueueManagementOption) func() {
 	qm := ns.NewQueueManager()
 	entity, err := qm.Get(ctx, name)
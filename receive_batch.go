@@ -0,0 +1,225 @@
+package servicebus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Azure/azure-amqp-common-go/log"
+	"github.com/Azure/azure-amqp-common-go/uuid"
+	"pack.ag/amqp"
+)
+
+// ReceiveBatch receives up to maxMessages messages from the queue and returns them without calling a handler. The
+// credit of the receive link is set to maxMessages, so Service Bus delivers the messages ahead of each other rather than
+// one at a time. ReceiveBatch returns once maxMessages messages were received, or when maxWait elapsed with the
+// messages received until then, which may be none. The receive link is kept open for the next call, and opened again
+// when maxMessages changes; messages received over the previous link which are not settled yet can then no longer be
+// settled, and are delivered again once their locks expire.
+//
+// The returned messages are not settled. In PeekLock mode, the caller is responsible for settling each of them, with
+// CompleteBatch or the dispositions of Message, before their locks expire. If ctx is done before maxWait elapses, the
+// messages received so far are returned along with the error of ctx.
+func (q *Queue) ReceiveBatch(ctx context.Context, maxMessages int, maxWait time.Duration) ([]*Message, error) {
+	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.ReceiveBatch")
+	defer span.Finish()
+
+	if maxMessages <= 0 {
+		return nil, errors.New("maxMessages must be greater than 0")
+	}
+	if maxWait <= 0 {
+		return nil, errors.New("maxWait must be greater than 0")
+	}
+
+	r, err := q.ensureBatchReceiver(ctx, uint32(maxMessages))
+	if err != nil {
+		return nil, err
+	}
+
+	return r.receiveBatch(ctx, maxMessages, maxWait)
+}
+
+// ensureBatchReceiver returns the receiver of ReceiveBatch, opening it if it isn't open yet or its link credit differs
+// from prefetch, in which case the previous receiver is closed
+func (q *Queue) ensureBatchReceiver(ctx context.Context, prefetch uint32) (*receiver, error) {
+	q.receiverMu.Lock()
+	defer q.receiverMu.Unlock()
+
+	if q.batchReceiver != nil {
+		if q.batchReceiver.prefetch == prefetch {
+			return q.batchReceiver, nil
+		}
+		if err := q.batchReceiver.Close(ctx); err != nil {
+			log.For(ctx).Error(err)
+		}
+		q.batchReceiver = nil
+	}
+
+	opts := receiverOptions([]ReceiveOption{WithPrefetchCount(prefetch)})
+	r, err := q.namespace.newReceiver(ctx, q.Name, q.receiverOptions(opts)...)
+	if err != nil {
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+
+	q.batchReceiver = r
+	return r, nil
+}
+
+// closeBatchReceiver closes the receiver of ReceiveBatch, if one is open
+func (q *Queue) closeBatchReceiver(ctx context.Context) error {
+	q.receiverMu.Lock()
+	defer q.receiverMu.Unlock()
+
+	if q.batchReceiver == nil {
+		return nil
+	}
+
+	err := q.batchReceiver.Close(ctx)
+	q.batchReceiver = nil
+	return err
+}
+
+// CompleteBatch completes msgs, which were received from the queue with ReceiveBatch, Receive or ReceiveDeferred.
+// Messages which were already settled are skipped.
+//
+// Service Bus only accepts the disposition of a message received over a receive link on that link, so those messages
+// are accepted on the link they were delivered by; the dispositions are pipelined and don't wait on each other.
+// Messages received through the management node, such as deferred messages, are completed with a single
+// update-disposition request per entity. If Service Bus refuses to settle some of them, for example because their
+// locks were lost, or if the request for an entity fails, a *DispositionBatchError identifies those messages once the
+// messages of every entity were tried; the others are completed. The messages it identifies are not marked settled, so
+// they can be passed to CompleteBatch again.
+func (q *Queue) CompleteBatch(ctx context.Context, msgs []*Message) error {
+	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.CompleteBatch")
+	defer span.Finish()
+
+	return settleBatch(ctx, msgs, "complete", completedDisposition, (*Message).Complete)
+}
+
+// AbandonBatch abandons msgs, so Service Bus delivers them again, like CompleteBatch completes them.
+func (q *Queue) AbandonBatch(ctx context.Context, msgs []*Message) error {
+	span, ctx := q.startSpanFromContext(ctx, "sb.Queue.AbandonBatch")
+	defer span.Finish()
+
+	return settleBatch(ctx, msgs, "abandon", abandonedDisposition, (*Message).Abandon)
+}
+
+// receiveBatch receives messages until maxMessages were received or maxWait elapsed
+func (r *receiver) receiveBatch(ctx context.Context, maxMessages int, maxWait time.Duration) ([]*Message, error) {
+	waitCtx, cancel := context.WithTimeout(ctx, maxWait)
+	defer cancel()
+
+	messages := make([]*Message, 0, maxMessages)
+	for len(messages) < maxMessages {
+		msg, err := r.listenForMessage(waitCtx)
+		if err != nil {
+			if ctx.Err() == nil && waitCtx.Err() != nil {
+				break
+			}
+			return messages, err
+		}
+
+		messages = append(messages, r.received(ctx, msg))
+	}
+	return messages, nil
+}
+
+// settleBatch settles the messages received over a receive link on their links with the DispositionAction returned by
+// onLink, and the messages received through the management node with one update-disposition request per entity. The
+// latter are only marked settled once Service Bus accepted their lock tokens, so a refused message can be settled again.
+func settleBatch(ctx context.Context, msgs []*Message, disposition string, status dispositionStatus, onLink func(*Message) DispositionAction) error {
+	for _, msg := range msgs {
+		if msg != nil && msg.mgmt != nil && msg.LockToken == nil {
+			return errNoLockToken
+		}
+	}
+
+	settlements := make(map[string]*managementSettlement)
+	pending := make(map[string][]*Message)
+	seen := make(map[*Message]bool)
+	for _, msg := range msgs {
+		if msg == nil || msg.isSettled() || seen[msg] {
+			continue
+		}
+		seen[msg] = true
+
+		if msg.mgmt == nil {
+			onLink(msg)(ctx)
+			continue
+		}
+
+		entityPath := msg.mgmt.entityPath
+		settlements[entityPath] = msg.mgmt
+		pending[entityPath] = append(pending[entityPath], msg)
+	}
+
+	// every entity is settled, in a stable order, so a failure does not leave the others untried
+	entityPaths := make([]string, 0, len(settlements))
+	for entityPath := range settlements {
+		entityPaths = append(entityPaths, entityPath)
+	}
+	sort.Strings(entityPaths)
+
+	batchErr := &DispositionBatchError{}
+	for _, entityPath := range entityPaths {
+		lockTokens := make([]amqp.UUID, len(pending[entityPath]))
+		for i, msg := range pending[entityPath] {
+			lockTokens[i] = amqp.UUID(*msg.LockToken)
+		}
+
+		rejected, err := settlements[entityPath].updateDispositions(ctx, status, lockTokens)
+		if err != nil {
+			log.For(ctx).Error(err)
+			if len(rejected) == 0 {
+				// the request failed as a whole, so none of the messages of the entity were settled
+				rejected = lockTokens
+				err = fmt.Errorf("failed settling %d messages of %q: %v", len(lockTokens), entityPath, err)
+			}
+		}
+
+		refused := make(map[amqp.UUID]bool, len(rejected))
+		for _, lockToken := range rejected {
+			refused[lockToken] = true
+			batchErr.Rejected = append(batchErr.Rejected, uuid.UUID(lockToken))
+		}
+		if err != nil && batchErr.Err == nil {
+			batchErr.Err = err
+		}
+
+		for _, msg := range pending[entityPath] {
+			if !refused[amqp.UUID(*msg.LockToken)] && msg.settle() {
+				msg.logDisposition(disposition)
+			}
+		}
+	}
+
+	if len(batchErr.Rejected) == 0 {
+		return nil
+	}
+	return batchErr
+}
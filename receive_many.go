@@ -0,0 +1,186 @@
+package servicebus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/Azure/azure-amqp-common-go/log"
+	"pack.ag/amqp"
+)
+
+// delivery is the result of a single receive from one of many entities
+type delivery struct {
+	msg *amqp.Message
+	err error
+}
+
+// ReceiveFromMany receives messages from several entities, such as queues or subscriptions (addressed as
+// "topic/Subscriptions/subscription"), with a single loop. The receivers of all entities share one connection, and
+// messages are dispatched to handler one at a time along with the name of the entity they were received from.
+//
+// Each entity is received from with a credit of one, and at most one of its received messages waits to be dispatched
+// while handler runs; the lock of a waiting message is not renewed, so handler should be quick compared to the lock
+// duration of the entities. When messages of several entities are waiting, they are dispatched in turn, starting after
+// the entity served last; otherwise the first message to arrive is dispatched. Messages are received in PeekLock mode
+// and settled with the DispositionAction returned by handler, or completed if it returns nil. ReceiveFromMany returns
+// when ctx is done or when receiving from any of the entities fails.
+func (ns *Namespace) ReceiveFromMany(ctx context.Context, entities []string, handler func(ctx context.Context, entity string, msg *Message) DispositionAction) error {
+	span, ctx := ns.startSpanFromContext(ctx, "sb.Namespace.ReceiveFromMany")
+	defer span.Finish()
+
+	if len(entities) == 0 {
+		return errors.New("at least one entity must be provided")
+	}
+	if handler == nil {
+		return errors.New("handler must not be nil")
+	}
+
+	ns.ensureClockSkewMeasured()
+	conn, err := ns.newConnection()
+	if err != nil {
+		log.For(ctx).Error(err)
+		return err
+	}
+	defer conn.Close()
+
+	if err := ns.trackLink(conn, func(context.Context) error { return conn.Close() }); err != nil {
+		return err
+	}
+	defer ns.untrackLink(conn)
+
+	amqpSession, err := conn.NewSession()
+	if err != nil {
+		log.For(ctx).Error(err)
+		return err
+	}
+
+	sess, err := ns.newSession(amqpSession)
+	if err != nil {
+		log.For(ctx).Error(err)
+		return err
+	}
+
+	receivers := make([]*receiver, len(entities))
+	for i, entity := range entities {
+		if err := ns.negotiateClaim(ctx, conn, entity); err != nil {
+			log.For(ctx).Error(err)
+			return err
+		}
+
+		amqpReceiver, err := amqpSession.NewReceiver(
+			amqp.LinkSourceAddress(entity),
+			amqp.LinkSenderSettle(amqp.ModeUnsettled),
+			amqp.LinkReceiverSettle(amqp.ModeSecond),
+			amqp.LinkCredit(1))
+		if err != nil {
+			log.For(ctx).Error(err)
+			return err
+		}
+
+		receivers[i] = &receiver{
+			namespace:  ns,
+			connection: conn,
+			session:    sess,
+			receiver:   amqpReceiver,
+			entityPath: entity,
+			mode:       PeekLockMode,
+			prefetch:   1,
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	deliveries := make([]chan delivery, len(receivers))
+	for i, r := range receivers {
+		deliveries[i] = make(chan delivery)
+		go receiveDeliveries(ctx, r, deliveries[i])
+	}
+
+	next := 0
+	for {
+		i, d, err := nextDelivery(ctx, deliveries, next)
+		if err != nil {
+			return err
+		}
+		next = i + 1
+
+		r := receivers[i]
+		if d.err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("failed receiving from %q: %v", r.entityPath, d.err)
+		}
+
+		r.handleMessage(ctx, d.msg, HandlerFunc(func(ctx context.Context, msg *Message) DispositionAction {
+			return handler(ctx, r.entityPath, msg)
+		}))
+	}
+}
+
+// receiveDeliveries receives messages with r until ctx is done or receiving fails. out is unbuffered, so the next
+// message is only received once the previous one was dispatched.
+func receiveDeliveries(ctx context.Context, r *receiver, out chan<- delivery) {
+	for {
+		msg, err := r.listenForMessage(ctx)
+		select {
+		case out <- delivery{msg: msg, err: err}:
+		case <-ctx.Done():
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// nextDelivery returns the first delivery ready in sources, checking them in turn from start so the sources with waiting
+// deliveries are served one after the other. If none is ready, it waits for the first delivery from any source.
+func nextDelivery(ctx context.Context, sources []chan delivery, start int) (int, delivery, error) {
+	for k := range sources {
+		i := (start + k) % len(sources)
+		select {
+		case d := <-sources[i]:
+			return i, d, nil
+		default:
+		}
+	}
+
+	cases := make([]reflect.SelectCase, len(sources)+1)
+	for i, source := range sources {
+		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(source)}
+	}
+	cases[len(sources)] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())}
+
+	chosen, value, _ := reflect.Select(cases)
+	if chosen == len(sources) {
+		return -1, delivery{}, ctx.Err()
+	}
+	return chosen, value.Interface().(delivery), nil
+}
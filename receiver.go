@@ -24,10 +24,11 @@ package servicebus
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
-	"github.com/Azure/azure-amqp-common-go"
 	"github.com/Azure/azure-amqp-common-go/log"
 	"github.com/opentracing/opentracing-go"
 	"pack.ag/amqp"
@@ -45,21 +46,85 @@ type (
 		Name        string
 		useSessions bool
 		sessionID   *string
+		// lastError is the error which stopped the listener, guarded by lastErrorMu
 		lastError   error
+		lastErrorMu sync.Mutex
 		mode        ReceiveMode
 		prefetch    uint32
+		pollBackoff pollBackoff
+		lockLost    lockLostHandling
+		redelivery  *redeliveryTracker
+		watchdog    dispositionWatchdog
+		autoRenewal time.Duration
+		// sessionLockRenewal renews the lock on the session being received in the background
+		sessionLockRenewal bool
+		// sessionIdleTimeout closes the session being received when no message was handled for its duration
+		sessionIdleTimeout time.Duration
+		// sessionLockedUntil is when the lock on the session being received expires as of its last renewal, which the
+		// locks of the messages of the session share. It is guarded by sessionLockMu.
+		sessionLockedUntil time.Time
+		sessionLockMu      sync.RWMutex
+		// skipExpiredLocks abandons messages whose locks expired before they were dispatched, rather than handling them
+		skipExpiredLocks bool
+		// concurrency is how many messages are handled at once by Listen
+		concurrency int
+		// reconnectObserver is called before each attempt to rebuild a failed link
+		reconnectObserver func(attempt int, err error)
+		// stopDispatch stops Listen from dispatching messages to its handler, and handled is closed once the handlers of
+		// the messages in flight have returned. Both are guarded by dispatchMu, as Drain may run while Listen starts.
+		stopDispatch func()
+		handled      chan struct{}
+		dispatchMu   sync.Mutex
+		// sessionAcceptTimeout bounds how long Service Bus waits for a session to become available
+		sessionAcceptTimeout time.Duration
+		// stopClaimRefresh stops the periodic authorization of the connection
+		stopClaimRefresh func()
+	}
+
+	// dispositionWatchdog reports messages which were not settled within a deadline after they were delivered
+	dispositionWatchdog struct {
+		deadline    time.Duration
+		onViolation func(ctx context.Context, msg *Message) DispositionAction
+	}
+
+	// lockLostHandling configures what a receiver does when the lock on a message expired before it is settled
+	lockLostHandling struct {
+		policy     LockLostPolicy
+		onLockLost func(ctx context.Context, msg *Message, err error)
+	}
+
+	// LockLostPolicy determines whether the disposition of a message whose lock expired is still sent to Service Bus
+	LockLostPolicy int
+
+	// pollBackoff configures how long a receive loop waits for a message before backing off, and how long it backs off
+	pollBackoff struct {
+		initial time.Duration
+		max     time.Duration
 	}
 
 	// receiverOption provides a structure for configuring receivers
 	receiverOption func(receiver *receiver) error
 
+	// ReceiveOption configures a single call to receive messages from an entity
+	ReceiveOption func(receiver *receiver) error
+
 	// ListenerHandle provides the ability to close or listen to the close of a Receiver
 	listenerHandle struct {
-		r   *receiver
-		ctx context.Context
+		r       *receiver
+		ctx     context.Context
+		handled chan struct{}
 	}
 )
 
+const (
+	// LockLostSettleAnyway sends the disposition of a message whose lock expired. Service Bus rejects it if the message
+	// was delivered again, which is the default behavior.
+	LockLostSettleAnyway LockLostPolicy = iota
+	// LockLostSkipDisposition does not send the disposition of a message whose lock expired, leaving the message to be
+	// settled by the receiver it was delivered to next.
+	LockLostSkipDisposition
+)
+
 // newReceiver creates a new Service Bus message listener given an AMQP client and an entity path
 func (ns *Namespace) newReceiver(ctx context.Context, entityPath string, opts ...receiverOption) (*receiver, error) {
 	span, ctx := ns.startSpanFromContext(ctx, "sb.Hub.newReceiver")
@@ -78,8 +143,20 @@ func (ns *Namespace) newReceiver(ctx context.Context, entityPath string, opts ..
 		}
 	}
 
-	err := receiver.newSessionAndLink(ctx)
-	return receiver, err
+	if err := receiver.newSessionAndLink(ctx); err != nil {
+		return receiver, err
+	}
+
+	err := ns.trackLink(receiver, func(ctx context.Context) error {
+		// listeners report that the namespace was closed rather than that their context was cancelled
+		receiver.setLastError(ErrNamespaceClosed)
+		return receiver.Close(ctx)
+	})
+	if err != nil {
+		_ = receiver.Close(ctx)
+		return nil, err
+	}
+	return receiver, nil
 }
 
 // Close will close the AMQP session and link of the receiver
@@ -87,10 +164,41 @@ func (r *receiver) Close(ctx context.Context) error {
 	if r.done != nil {
 		r.done()
 	}
+	if r.stopClaimRefresh != nil {
+		r.stopClaimRefresh()
+	}
 
+	r.namespace.untrackLink(r)
+	r.namespace.getLogger().Info("receiver link closed", "entity", r.entityPath)
 	return r.connection.Close()
 }
 
+// Drain stops dispatching messages to the handler of Listen, waits until the handlers of the messages in flight have
+// returned or ctx is done, then closes the receiver. ctx.Err() is returned if the handlers did not return in time.
+func (r *receiver) Drain(ctx context.Context) error {
+	r.dispatchMu.Lock()
+	stopDispatch, handled := r.stopDispatch, r.handled
+	r.dispatchMu.Unlock()
+
+	if stopDispatch != nil {
+		stopDispatch()
+	}
+
+	var drainErr error
+	if handled != nil {
+		select {
+		case <-handled:
+		case <-ctx.Done():
+			drainErr = ctx.Err()
+		}
+	}
+
+	if err := r.Close(ctx); err != nil {
+		return err
+	}
+	return drainErr
+}
+
 // Recover will attempt to close the current session and link, then rebuild them
 func (r *receiver) Recover(ctx context.Context) error {
 	span, ctx := r.startConsumerSpanFromContext(ctx, "sb.receiver.Recover")
@@ -112,8 +220,12 @@ func (r *receiver) ReceiveOne(ctx context.Context, handler Handler) error {
 
 	amqpMsg, err := r.listenForMessage(ctx)
 	if err != nil {
+		if ctx.Err() != nil {
+			// no message arrived before the context was done
+			return ctx.Err()
+		}
 		log.For(ctx).Error(err)
-		return err
+		return wrapError(err)
 	}
 
 	r.handleMessage(ctx, amqpMsg, handler)
@@ -129,36 +241,73 @@ func (r *receiver) Listen(ctx context.Context, handler Handler) *listenerHandle
 	span, ctx := r.startConsumerSpanFromContext(ctx, "sb.receiver.Listen")
 	defer span.Finish()
 
+	// dispatching stops when the receiver is drained, while the handlers of the messages in flight keep running until
+	// the receiver is closed
+	dispatchCtx, stopDispatch := context.WithCancel(ctx)
 	messages := make(chan *amqp.Message)
-	go r.listenForMessages(ctx, messages)
-	go r.handleMessages(ctx, messages, handler)
+	handled := make(chan struct{})
+	r.dispatchMu.Lock()
+	r.stopDispatch = stopDispatch
+	r.handled = handled
+	r.dispatchMu.Unlock()
+
+	go r.listenForMessages(dispatchCtx, messages)
+	go func() {
+		defer close(handled)
+		r.handleMessages(ctx, dispatchCtx.Done(), messages, handler)
+	}()
 
 	return &listenerHandle{
-		r:   r,
-		ctx: ctx,
+		r:       r,
+		ctx:     ctx,
+		handled: handled,
 	}
 }
 
-func (r *receiver) handleMessages(ctx context.Context, messages chan *amqp.Message, handler Handler) {
+// handleMessages dispatches messages to the handler until stop is closed, using as many workers as the concurrency of
+// the receiver. It returns once the handlers of the messages in flight have returned.
+func (r *receiver) handleMessages(ctx context.Context, stop <-chan struct{}, messages chan *amqp.Message, handler Handler) {
 	span, ctx := r.startConsumerSpanFromContext(ctx, "sb.receiver.handleMessages")
 	defer span.Finish()
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case msg := <-messages:
-			r.handleMessage(ctx, msg, handler)
-		}
+
+	workers := r.concurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				case msg := <-messages:
+					r.handleMessage(ctx, msg, handler)
+				}
+			}
+		}()
 	}
+	wg.Wait()
 }
 
 func (r *receiver) handleMessage(ctx context.Context, msg *amqp.Message, handler Handler) {
 	const optName = "sb.receiver.handleMessage"
+	receivedAt := time.Now()
 	event, err := messageFromAMQPMessage(msg)
 	if err != nil {
 		_, ctx := r.startConsumerSpanFromContext(ctx, optName)
 		log.For(ctx).Error(err)
 	}
+	event.receiver = r
+	if r.mode == ReceiveAndDeleteMode {
+		// Service Bus settled the message when it was delivered, so its dispositions have no effect
+		event.settle()
+	}
+	ctx = withMessage(ctx, event)
+
 	var span opentracing.Span
 	wireContext, err := extractWireContext(event)
 	if err == nil {
@@ -171,12 +320,35 @@ func (r *receiver) handleMessage(ctx context.Context, msg *amqp.Message, handler
 	id := messageID(msg)
 	span.SetTag("amqp.message-id", id)
 
+	if err := r.redelivery.wait(ctx, event); err != nil {
+		return
+	}
+
+	if r.skipExpiredLock(ctx, event) {
+		return
+	}
+
+	violationAction := func() DispositionAction { return nil }
+	if r.mode != ReceiveAndDeleteMode {
+		violationAction = r.watchdog.watch(ctx, event)
+	}
+
+	stopRenewal := r.renewLockWhileHandled(ctx, event, receivedAt)
 	dispositionAction := handler.Handle(ctx, event)
+	stopRenewal()
+	if violation := violationAction(); dispositionAction == nil {
+		// a handler which missed the disposition deadline and provided no disposition gets the watchdog's
+		dispositionAction = violation
+	}
 
 	if r.mode == ReceiveAndDeleteMode {
 		return
 	}
 
+	if r.skipDispositionOfLostLock(ctx, event) {
+		return
+	}
+
 	if dispositionAction != nil {
 		dispositionAction(ctx)
 	} else {
@@ -185,6 +357,75 @@ func (r *receiver) handleMessage(ctx context.Context, msg *amqp.Message, handler
 	}
 }
 
+// skipExpiredLock abandons a message whose lock expired before it was dispatched, and returns true if it should not be
+// handled
+func (r *receiver) skipExpiredLock(ctx context.Context, msg *Message) bool {
+	if !r.skipExpiredLocks || !msg.LockExpired() {
+		return false
+	}
+
+	r.namespace.getLogger().Warn("skipped message whose lock expired before it was handled",
+		"entity", r.entityPath, "message-id", msg.ID, "locked-until", *msg.SystemProperties.LockedUntil)
+	// the message is released without being tracked as abandoned by its handler, so its redelivery is not delayed
+	if msg.settle() {
+		msg.message.Modify(false, false, nil)
+	}
+	return true
+}
+
+// skipDispositionOfLostLock reports a message whose lock expired while it was handled to the configured callback, and
+// returns true if its disposition should not be sent
+func (r *receiver) skipDispositionOfLostLock(ctx context.Context, msg *Message) bool {
+	if r.lockLost.onLockLost == nil && r.lockLost.policy == LockLostSettleAnyway {
+		return false
+	}
+
+	lockedUntil, ok := msg.lockedUntil()
+	if !ok || r.namespace.toLocalTime(lockedUntil).After(time.Now()) {
+		return false
+	}
+
+	if r.lockLost.onLockLost != nil {
+		r.lockLost.onLockLost(ctx, msg, ErrMessageLockLost)
+	}
+	return r.lockLost.policy == LockLostSkipDisposition
+}
+
+// watch reports the message to the violation callback if it is not settled within the deadline. The disposition the
+// callback returns is not applied while the handler still works on the message; the returned func, called once the
+// handler returned, stops the watch and hands it back to be used if the handler did not provide a disposition.
+func (w dispositionWatchdog) watch(ctx context.Context, msg *Message) (handlerReturned func() DispositionAction) {
+	if w.deadline <= 0 {
+		return func() DispositionAction { return nil }
+	}
+
+	var (
+		mu       sync.Mutex
+		returned bool
+		pending  DispositionAction
+	)
+	timer := time.AfterFunc(w.deadline, func() {
+		if msg.isSettled() {
+			return
+		}
+
+		action := w.onViolation(ctx, msg)
+		mu.Lock()
+		defer mu.Unlock()
+		if !returned {
+			pending = action
+		}
+	})
+
+	return func() DispositionAction {
+		timer.Stop()
+		mu.Lock()
+		defer mu.Unlock()
+		returned = true
+		return pending
+	}
+}
+
 func extractWireContext(reader opentracing.TextMapReader) (opentracing.SpanContext, error) {
 	return opentracing.GlobalTracer().Extract(opentracing.TextMap, reader)
 }
@@ -193,10 +434,29 @@ func (r *receiver) listenForMessages(ctx context.Context, msgChan chan *amqp.Mes
 	span, ctx := r.startConsumerSpanFromContext(ctx, "sb.receiver.listenForMessages")
 	defer span.Finish()
 
+	delay := r.pollBackoff.initial
 	for {
-		msg, err := r.listenForMessage(ctx)
+		msg, err := r.poll(ctx)
+		if err == nil && msg != nil {
+			delay = r.pollBackoff.initial
+			select {
+			case <-ctx.Done():
+				return
+			case msgChan <- msg:
+			}
+			continue
+		}
+
 		if err == nil {
-			msgChan <- msg
+			// no message arrived, back off before polling again
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > r.pollBackoff.max {
+				delay = r.pollBackoff.max
+			}
 			continue
 		}
 
@@ -205,28 +465,16 @@ func (r *receiver) listenForMessages(ctx context.Context, msgChan chan *amqp.Mes
 			log.For(ctx).Debug("context done")
 			return
 		default:
-			_, retryErr := common.Retry(10, 10*time.Second, func() (interface{}, error) {
-				sp, ctx := r.startConsumerSpanFromContext(ctx, "sb.receiver.listenForMessages.tryRecover")
-				defer sp.Finish()
-
-				log.For(ctx).Debug("recovering connection")
-				err := r.Recover(ctx)
-				if err == nil {
-					log.For(ctx).Debug("recovered connection")
-					return nil, nil
-				}
-
-				select {
-				case <-ctx.Done():
-					return nil, ctx.Err()
-				default:
-					return nil, common.Retryable(err.Error())
-				}
-			})
+			if isNonRecoverableError(err) {
+				log.For(ctx).Error(err)
+				r.setLastError(wrapError(err))
+				r.Close(ctx)
+				return
+			}
 
-			if retryErr != nil {
+			if retryErr := r.recoverWithRetry(ctx, err); retryErr != nil {
 				log.For(ctx).Debug("retried, but error was unrecoverable")
-				r.lastError = retryErr
+				r.setLastError(wrapError(retryErr))
 				r.Close(ctx)
 				return
 			}
@@ -234,6 +482,69 @@ func (r *receiver) listenForMessages(ctx context.Context, msgChan chan *amqp.Mes
 	}
 }
 
+// recoverWithRetry rebuilds the connection, session and link of the receiver after they failed with cause, retrying
+// as allowed by the retry policy of the namespace, or defaultRecoveryPolicy without one. Retries stop early when
+// rebuilding fails with an error which can't be recovered from, such as the entity having been deleted. When Service Bus
+// failed the link because it is throttling requests, the first attempt waits as long as it would before a retry.
+func (r *receiver) recoverWithRetry(ctx context.Context, cause error) error {
+	attempt := 0
+	tryRecover := func(ctx context.Context) error {
+		sp, ctx := r.startConsumerSpanFromContext(ctx, "sb.receiver.listenForMessages.tryRecover")
+		defer sp.Finish()
+
+		attempt++
+		if r.reconnectObserver != nil {
+			r.reconnectObserver(attempt, cause)
+		}
+
+		log.For(ctx).Debug("recovering connection")
+		err := r.Recover(ctx)
+		if err == nil {
+			log.For(ctx).Debug("recovered connection")
+			return nil
+		}
+		cause = err
+		return err
+	}
+
+	policy := defaultRecoveryPolicy
+	if r.namespace.retryPolicy != nil {
+		policy = *r.namespace.retryPolicy
+	}
+
+	if _, busy := serverBusyDelay(wrapError(cause)); busy {
+		// reattaching right away would only be throttled again
+		delay := policy.delay(1, wrapError(cause))
+		logThrottled(r.namespace.getLogger(), "receive", delay, cause)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
+	return policy.doLogged(ctx, r.namespace.getLogger(), "recover receiver link", tryRecover, func(err error) bool {
+		return ctx.Err() != nil || isNonRecoverableError(err)
+	})
+}
+
+// poll waits for a message. If empty poll backoff is configured, it waits at most for the initial backoff and returns a
+// nil message and error when no message arrived in time.
+func (r *receiver) poll(ctx context.Context) (*amqp.Message, error) {
+	if r.pollBackoff.initial <= 0 {
+		return r.listenForMessage(ctx)
+	}
+
+	pollCtx, cancel := context.WithTimeout(ctx, r.pollBackoff.initial)
+	defer cancel()
+
+	msg, err := r.listenForMessage(pollCtx)
+	if err != nil && ctx.Err() == nil && pollCtx.Err() != nil {
+		return nil, nil
+	}
+	return msg, err
+}
+
 func (r *receiver) listenForMessage(ctx context.Context) (*amqp.Message, error) {
 	span, ctx := r.startConsumerSpanFromContext(ctx, "sb.receiver.listenForMessage")
 	defer span.Finish()
@@ -251,6 +562,12 @@ func (r *receiver) listenForMessage(ctx context.Context) (*amqp.Message, error)
 
 // newSessionAndLink will replace the session and link on the receiver
 func (r *receiver) newSessionAndLink(ctx context.Context) error {
+	r.namespace.ensureClockSkewMeasured()
+
+	if r.stopClaimRefresh != nil {
+		r.stopClaimRefresh()
+	}
+
 	connection, err := r.namespace.newConnection()
 	if err != nil {
 		return err
@@ -263,13 +580,15 @@ func (r *receiver) newSessionAndLink(ctx context.Context) error {
 		return err
 	}
 
+	r.stopClaimRefresh = r.namespace.refreshClaim(connection, r.entityPath)
+
 	amqpSession, err := connection.NewSession()
 	if err != nil {
 		log.For(ctx).Error(err)
 		return err
 	}
 
-	r.session, err = newSession(amqpSession)
+	r.session, err = r.namespace.newSession(amqpSession)
 	if err != nil {
 		log.For(ctx).Error(err)
 		return err
@@ -292,14 +611,24 @@ func (r *receiver) newSessionAndLink(ctx context.Context) error {
 	if r.useSessions {
 		opts = append(opts, amqp.LinkSessionFilter(r.sessionID))
 		//r.session.SessionID = *r.sessionID
+		if r.sessionAcceptTimeout > 0 {
+			opts = append(opts, amqp.LinkPropertyInt64(sessionAcceptTimeoutPropertyName, int64(r.sessionAcceptTimeout/time.Millisecond)))
+		}
 	}
 
 	amqpReceiver, err := amqpSession.NewReceiver(opts...)
 	if err != nil {
+		if r.useSessions && r.sessionAcceptTimeout > 0 && isTimeoutError(err) {
+			// the connection is discarded with the receiver, so don't leave it open while waiting for another session
+			r.stopClaimRefresh()
+			_ = connection.Close()
+			return ErrNoSessionAvailable
+		}
 		return err
 	}
 
 	r.receiver = amqpReceiver
+	r.namespace.getLogger().Info("receiver link opened", "entity", r.entityPath)
 	return nil
 }
 
@@ -312,6 +641,172 @@ func receiverWithSession(sessionID *string) receiverOption {
 	}
 }
 
+func newPollBackoff(initial, max time.Duration) (pollBackoff, error) {
+	if initial <= 0 {
+		return pollBackoff{}, errors.New("initial backoff must be greater than 0")
+	}
+	if max < initial {
+		return pollBackoff{}, errors.New("max backoff must not be less than the initial backoff")
+	}
+	return pollBackoff{initial: initial, max: max}, nil
+}
+
+func receiverWithEmptyPollBackoff(backoff pollBackoff) receiverOption {
+	return func(r *receiver) error {
+		r.pollBackoff = backoff
+		return nil
+	}
+}
+
+func receiverWithLockLostHandling(handling lockLostHandling) receiverOption {
+	return func(r *receiver) error {
+		r.lockLost = handling
+		return nil
+	}
+}
+
+func receiverWithRedeliveryTracker(tracker *redeliveryTracker) receiverOption {
+	return func(r *receiver) error {
+		r.redelivery = tracker
+		return nil
+	}
+}
+
+func receiverWithDispositionWatchdog(watchdog dispositionWatchdog) receiverOption {
+	return func(r *receiver) error {
+		r.watchdog = watchdog
+		return nil
+	}
+}
+
+// WithAutoLockRenewal renews the lock on each message in the background while its handler runs, for up to maxDuration.
+// Renewal stops as soon as the message is settled or the handler returns.
+//
+// maxDuration counts from when the message is taken up for handling, which includes the time it is held back by
+// QueueWithRedeliveryBackoff, rather than from when Service Bus delivered it: a message received while all handlers are
+// busy waits for one to be free, and that wait is not counted. The lock is not renewed while the message waits.
+func WithAutoLockRenewal(maxDuration time.Duration) ReceiveOption {
+	return func(r *receiver) error {
+		if maxDuration <= 0 {
+			return errors.New("auto lock renewal max duration must be greater than zero")
+		}
+		r.autoRenewal = maxDuration
+		return nil
+	}
+}
+
+// WithSessionLockRenewal renews the lock on the session in the background while it is processed by ReceiveOneSession,
+// ReceiveSessions or ReceiveSessionsConcurrently, so a SessionHandler can take longer than the lock duration of the
+// entity. Renewal stops once the MessageSession is closed or the context of the call is done, before the End of the
+// SessionHandler is called, and when the lock was lost.
+func WithSessionLockRenewal() ReceiveOption {
+	return func(r *receiver) error {
+		r.sessionLockRenewal = true
+		return nil
+	}
+}
+
+// WithSessionIdleTimeout closes the MessageSession processed by ReceiveOneSession, ReceiveSessions or
+// ReceiveSessionsConcurrently once no message was handled for timeout, as if the SessionHandler had closed it. The End
+// of the SessionHandler is called and the link is closed, which releases the lock on the session, so the receiver can
+// move on to another session. The timeout counts from when the session was locked or the last handler returned; it
+// does not elapse while a message is being handled.
+//
+// The idle timeout is independent of the lock on the session, which expires at LockedUntil unless it is renewed. When
+// timeout is longer than the lock duration of the entity, combine it with WithSessionLockRenewal so the lock is not lost
+// while the session is idle.
+func WithSessionIdleTimeout(timeout time.Duration) ReceiveOption {
+	return func(r *receiver) error {
+		if timeout <= 0 {
+			return errors.New("session idle timeout must be greater than zero")
+		}
+		r.sessionIdleTimeout = timeout
+		return nil
+	}
+}
+
+// WithExpiredLockSkipping abandons messages whose locks expired before they are dispatched to the handler, rather than
+// handling them, which happens when a message waits in the prefetch buffer of WithPrefetchCount for longer than the lock
+// duration of the entity. Service Bus makes such a message available again once its lock expired, so the handler could
+// not settle it anyway. Each skipped message is reported as a warning to the namespace logger. Handlers can check
+// whether the lock on a message expired with Message.LockExpired.
+func WithExpiredLockSkipping() ReceiveOption {
+	return func(r *receiver) error {
+		r.skipExpiredLocks = true
+		return nil
+	}
+}
+
+// WithPrefetchCount sets how many messages Service Bus delivers to the receiver ahead of the handler, which is the
+// credit of the AMQP link. The default of 1 only requests the next message once the previous one was handled.
+//
+// Prefetching hides the latency of requesting each message, but the lock on a prefetched message expires while it waits
+// to be handled. Keep n small enough that messages are handled well within the lock duration of the entity, or combine
+// it with WithAutoLockRenewal. In PeekLock mode, prefetched messages whose locks expired are delivered again.
+func WithPrefetchCount(n uint32) ReceiveOption {
+	return func(r *receiver) error {
+		if n == 0 {
+			return errors.New("prefetch count must be greater than zero")
+		}
+		r.prefetch = n
+		return nil
+	}
+}
+
+// WithSessionAcceptTimeout bounds how long ReceiveOneSession waits for a session to become available. When no session
+// can be locked within timeout, ReceiveOneSession returns ErrNoSessionAvailable. The timeout is applied by Service Bus
+// when the receiver is attached, so it is independent of the deadline of the context of the call.
+func WithSessionAcceptTimeout(timeout time.Duration) ReceiveOption {
+	return func(r *receiver) error {
+		if timeout <= 0 {
+			return errors.New("session accept timeout must be greater than zero")
+		}
+		r.sessionAcceptTimeout = timeout
+		return nil
+	}
+}
+
+// WithReconnectObserver calls observer before each attempt to rebuild the connection and link of the receiver, after
+// they failed while receiving, such as when Service Bus detached an idle link or the connection dropped. attempt counts
+// the attempts to recover from the same failure from 1, and err is the error which failed the receiver or the previous
+// attempt. Receiving resumes once the link is rebuilt; it only stops when the retries are exhausted or the error can't
+// be recovered from, such as an authorization failure or the entity having been deleted.
+func WithReconnectObserver(observer func(attempt int, err error)) ReceiveOption {
+	return func(r *receiver) error {
+		if observer == nil {
+			return errors.New("reconnect observer must not be nil")
+		}
+		r.reconnectObserver = observer
+		return nil
+	}
+}
+
+// WithConcurrentHandlers handles up to n messages at once, each in its own goroutine and with its own disposition,
+// rather than one after the other. When the context of the receive call is done, the call returns once the handlers of
+// the messages in flight have returned. With WithAutoLockRenewal, the lock of each message in flight is renewed.
+//
+// Messages are no longer handled in the order they were delivered: a message may be handled, and settled, before
+// messages delivered ahead of it, and the messages of a session are handled out of order too. Combine it with
+// WithPrefetchCount so that messages are available to every worker without waiting for the next one to be requested.
+func WithConcurrentHandlers(n int) ReceiveOption {
+	return func(r *receiver) error {
+		if n < 1 {
+			return errors.New("concurrent handlers must be at least 1")
+		}
+		r.concurrency = n
+		return nil
+	}
+}
+
+// receiverOptions converts options given to a receive call to options applied to the receiver
+func receiverOptions(opts []ReceiveOption) []receiverOption {
+	options := make([]receiverOption, 0, len(opts))
+	for _, opt := range opts {
+		options = append(options, receiverOption(opt))
+	}
+	return options
+}
+
 func receiverWithReceiveMode(mode ReceiveMode) receiverOption {
 	return func(r *receiver) error {
 		r.mode = mode
@@ -332,15 +827,48 @@ func (lc *listenerHandle) Close(ctx context.Context) error {
 	return lc.r.Close(ctx)
 }
 
-// Done will close the channel when the listener has stopped
+// Done will close the channel when the listener has stopped and the handlers of the messages in flight have returned
 func (lc *listenerHandle) Done() <-chan struct{} {
-	return lc.ctx.Done()
+	return lc.handled
 }
 
 // Err will return the last error encountered
 func (lc *listenerHandle) Err() error {
-	if lc.r.lastError != nil {
-		return lc.r.lastError
+	if err := lc.r.getLastError(); err != nil {
+		return err
 	}
 	return lc.ctx.Err()
 }
+
+// setLastError records the error which stopped the listener of the receiver
+func (r *receiver) setLastError(err error) {
+	r.lastErrorMu.Lock()
+	defer r.lastErrorMu.Unlock()
+
+	r.lastError = err
+}
+
+// getLastError returns the error which stopped the listener of the receiver, if any
+func (r *receiver) getLastError() error {
+	r.lastErrorMu.Lock()
+	defer r.lastErrorMu.Unlock()
+
+	return r.lastError
+}
+
+// renewedSessionLock records when the lock on the session being received expires after it was renewed
+func (r *receiver) renewedSessionLock(lockedUntil time.Time) {
+	r.sessionLockMu.Lock()
+	defer r.sessionLockMu.Unlock()
+
+	r.sessionLockedUntil = lockedUntil
+}
+
+// sessionLockExpiration returns when the lock on the session being received expires as of its last renewal, or the zero
+// time if it was not renewed
+func (r *receiver) sessionLockExpiration() time.Time {
+	r.sessionLockMu.RLock()
+	defer r.sessionLockMu.RUnlock()
+
+	return r.sessionLockedUntil
+}
@@ -0,0 +1,168 @@
+package servicebus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// redeliveryTrackerCapacity bounds the number of abandoned messages remembered by a redelivery tracker
+	redeliveryTrackerCapacity = 4096
+)
+
+type (
+	// redeliveryTracker remembers when messages were abandoned, so a message delivered again too soon is held back
+	// before it is handled. Each time a message is abandoned its hold is doubled, from base up to max. The least recently
+	// abandoned messages are forgotten once capacity messages are tracked.
+	redeliveryTracker struct {
+		base     time.Duration
+		max      time.Duration
+		capacity int
+		mu       sync.Mutex
+		entries  map[string]*list.Element
+		order    *list.List
+	}
+
+	abandonedMessage struct {
+		key         string
+		abandonedAt time.Time
+		abandons    uint
+	}
+)
+
+func newRedeliveryTracker(base, max time.Duration) (*redeliveryTracker, error) {
+	if base <= 0 {
+		return nil, errors.New("base redelivery backoff must be greater than 0")
+	}
+	if max < base {
+		return nil, errors.New("max redelivery backoff must not be less than the base backoff")
+	}
+	return &redeliveryTracker{
+		base:     base,
+		max:      max,
+		capacity: redeliveryTrackerCapacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}, nil
+}
+
+// redeliveryKey identifies a message by its sequence number, or by its ID if it has none
+func redeliveryKey(msg *Message) string {
+	if msg.SystemProperties != nil && msg.SystemProperties.SequenceNumber != nil {
+		return strconv.FormatInt(*msg.SystemProperties.SequenceNumber, 10)
+	}
+	return "id:" + msg.ID
+}
+
+// abandoned records that a message was abandoned
+func (t *redeliveryTracker) abandoned(msg *Message) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := redeliveryKey(msg)
+	if elem, ok := t.entries[key]; ok {
+		entry := elem.Value.(*abandonedMessage)
+		entry.abandonedAt = time.Now()
+		entry.abandons++
+		t.order.MoveToBack(elem)
+		return
+	}
+
+	t.entries[key] = t.order.PushBack(&abandonedMessage{key: key, abandonedAt: time.Now(), abandons: 1})
+	for t.order.Len() > t.capacity {
+		oldest := t.order.Front()
+		t.order.Remove(oldest)
+		delete(t.entries, oldest.Value.(*abandonedMessage).key)
+	}
+}
+
+// settled forgets a message which will not be delivered again
+func (t *redeliveryTracker) settled(msg *Message) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := redeliveryKey(msg)
+	if elem, ok := t.entries[key]; ok {
+		t.order.Remove(elem)
+		delete(t.entries, key)
+	}
+}
+
+// holdFor returns how much longer a message should be held before it is handled
+func (t *redeliveryTracker) holdFor(msg *Message, now time.Time) time.Duration {
+	if t == nil {
+		return 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	elem, ok := t.entries[redeliveryKey(msg)]
+	if !ok {
+		return 0
+	}
+
+	entry := elem.Value.(*abandonedMessage)
+	backoff := t.base
+	for i := uint(1); i < entry.abandons && backoff < t.max; i++ {
+		backoff *= 2
+	}
+	if backoff > t.max {
+		backoff = t.max
+	}
+
+	return entry.abandonedAt.Add(backoff).Sub(now)
+}
+
+// wait holds a message which was delivered again too soon after it was abandoned. It returns an error if the context
+// is done first.
+func (t *redeliveryTracker) wait(ctx context.Context, msg *Message) error {
+	hold := t.holdFor(msg, time.Now())
+	if hold <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(hold)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
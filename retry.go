@@ -0,0 +1,159 @@
+package servicebus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+type (
+	// RetryPolicy bounds the retries of an operation which failed with a transient error. Retries stop after
+	// MaxAttempts attempts, or when the deadline of the context would pass before the next attempt. The delay before a
+	// retry starts at MinBackoff and grows by BackoffFactor each retry, up to MaxBackoff. A BackoffFactor of 0 doubles
+	// the delay. Jitter randomizes each delay by up to the given fraction of it, so clients which failed together don't
+	// retry together.
+	//
+	// When Service Bus is throttling requests, a retry waits at least as long as Service Bus asked for with the
+	// Retry-After header of a management response, or serverBusyBackoff if it did not say.
+	RetryPolicy struct {
+		MaxAttempts   int
+		MinBackoff    time.Duration
+		MaxBackoff    time.Duration
+		BackoffFactor float64
+		Jitter        float64
+	}
+)
+
+// serverBusyBackoff is how long to back off when Service Bus is throttling requests without saying for how long
+const serverBusyBackoff = 10 * time.Second
+
+// defaultRecoveryPolicy rebuilds a failed receiver link with exponential backoff when the namespace has no retry policy
+var defaultRecoveryPolicy = RetryPolicy{
+	MaxAttempts: 10,
+	MinBackoff:  time.Second,
+	MaxBackoff:  30 * time.Second,
+	Jitter:      0.1,
+}
+
+// DefaultRetryPolicy returns a RetryPolicy making up to 5 attempts, backing off from 500 milliseconds to 5 seconds
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 5,
+		MinBackoff:  500 * time.Millisecond,
+		MaxBackoff:  5 * time.Second,
+	}
+}
+
+// RetryPolicyNone returns a RetryPolicy making a single attempt, for callers who handle retries themselves
+func RetryPolicyNone() RetryPolicy {
+	return RetryPolicy{MaxAttempts: 1}
+}
+
+// backoff returns the delay before the given retry, counting from 1
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	factor := p.BackoffFactor
+	if factor <= 0 {
+		factor = 2
+	}
+
+	backoff := p.MinBackoff
+	for i := 1; i < retry && backoff < p.MaxBackoff; i++ {
+		backoff = time.Duration(float64(backoff) * factor)
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+
+	if p.Jitter > 0 {
+		backoff += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(backoff))
+	}
+	return backoff
+}
+
+// delay returns the delay before the given retry of an operation which failed with err, which is the backoff of the
+// retry unless Service Bus asked to wait longer
+func (p RetryPolicy) delay(retry int, err error) time.Duration {
+	backoff := p.backoff(retry)
+	if wait, busy := serverBusyDelay(err); busy && wait > backoff {
+		return wait
+	}
+	return backoff
+}
+
+// serverBusyDelay returns true if err reports that Service Bus is throttling requests, with how long Service Bus asked to
+// wait before the next request, or serverBusyBackoff if it did not say
+func serverBusyDelay(err error) (time.Duration, bool) {
+	if !errors.Is(err, ErrServerBusy) {
+		return 0, false
+	}
+
+	var busy *serverBusyError
+	if errors.As(err, &busy) {
+		return busy.retryAfter, true
+	}
+	return serverBusyBackoff, true
+}
+
+// logThrottled reports to logger that Service Bus throttled operation, which waits for delay before it is tried again.
+// Frequent throttling means the namespace needs more messaging units.
+func logThrottled(logger Logger, operation string, delay time.Duration, err error) {
+	logger.Warn("service bus is throttling requests", "operation", operation, "delay", delay, "error", err)
+}
+
+// do calls op until it succeeds, fails with an error for which permanent returns true, or the policy is exhausted.
+// The last error is returned.
+func (p RetryPolicy) do(ctx context.Context, op func(ctx context.Context) error, permanent func(error) bool) error {
+	return p.doLogged(ctx, nopLogger{}, "", op, permanent)
+}
+
+// doLogged is do, reporting each retry of the operation to logger
+func (p RetryPolicy) doLogged(ctx context.Context, logger Logger, operation string, op func(ctx context.Context) error, permanent func(error) bool) error {
+	if p.MaxAttempts < 1 {
+		return errors.New("retry policy must allow at least 1 attempt")
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = op(ctx); err == nil || permanent(err) || attempt >= p.MaxAttempts {
+			return err
+		}
+
+		backoff := p.delay(attempt, err)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+
+		if _, busy := serverBusyDelay(err); busy {
+			logThrottled(logger, operation, backoff, err)
+		}
+		logger.Warn("retrying operation", "operation", operation, "attempt", attempt+1, "delay", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
@@ -0,0 +1,557 @@
+package servicebus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-amqp-common-go/log"
+	"github.com/Azure/azure-amqp-common-go/rpc"
+	"github.com/Azure/azure-amqp-common-go/uuid"
+	"pack.ag/amqp"
+)
+
+const (
+	// peekPageSize is the number of messages requested by each peek when paging through an entity
+	peekPageSize = 100
+	// sessionPageSize is the number of session IDs requested by each page when listing sessions
+	sessionPageSize = 100
+)
+
+// allSessionsWithMessages is the last updated time which lists the sessions holding messages, rather than the sessions
+// whose state was updated after a time
+var allSessionsWithMessages = time.Date(9999, time.December, 31, 23, 59, 59, 999999900, time.UTC)
+
+type (
+	// managementLink is a request / response link to the $management node of an entity
+	managementLink struct {
+		conn        *amqp.Client
+		link        *rpc.Link
+		address     string
+		retryPolicy *RetryPolicy
+		logger      Logger
+		namespace   *Namespace
+		// stopClaimRefresh stops the periodic authorization of the connection of a link which is kept open
+		stopClaimRefresh func()
+	}
+)
+
+// newManagementLink opens a connection to the $management node of the entity path and authorizes it
+func (ns *Namespace) newManagementLink(ctx context.Context, entityPath string) (*managementLink, error) {
+	span, ctx := ns.startSpanFromContext(ctx, "sb.namespace.newManagementLink")
+	defer span.Finish()
+
+	address := managementPath(entityPath)
+	conn, err := ns.newConnection()
+	if err != nil {
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+
+	if err := ns.negotiateClaim(ctx, conn, address); err != nil {
+		log.For(ctx).Error(err)
+		_ = conn.Close()
+		return nil, err
+	}
+
+	link, err := rpc.NewLink(conn, address)
+	if err != nil {
+		log.For(ctx).Error(err)
+		_ = conn.Close()
+		return nil, err
+	}
+	ns.getLogger().Debug("management link opened", "entity", address)
+
+	ml := &managementLink{
+		conn:        conn,
+		link:        link,
+		address:     address,
+		retryPolicy: ns.retryPolicy,
+		logger:      ns.getLogger(),
+		namespace:   ns,
+	}
+	if err := ns.trackLink(ml, ml.Close); err != nil {
+		_ = ml.Close(ctx)
+		return nil, err
+	}
+	return ml, nil
+}
+
+// rpc sends a request to the management node and waits for the response, retrying transient failures as allowed by the
+// retry policy of the namespace
+func (ml *managementLink) rpc(ctx context.Context, req *amqp.Message) (*rpc.Response, error) {
+	span, ctx := ml.startSpanFromContext(ctx, "sb.managementLink.rpc")
+	defer span.Finish()
+
+	if operation, ok := req.ApplicationProperties[operationFieldName]; ok {
+		span.SetTag("amqp.operation", operation)
+	}
+
+	if ml.retryPolicy == nil {
+		return ml.link.RetryableRPC(ctx, 3, 1*time.Second, req)
+	}
+
+	var rsp *rpc.Response
+	err := ml.retryPolicy.doLogged(ctx, ml.logger, "management request", func(ctx context.Context) error {
+		var err error
+		rsp, err = ml.link.RPC(ctx, req)
+		return err
+	}, func(err error) bool {
+		return !IsRetryable(err)
+	})
+	return rsp, err
+}
+
+// newManagementLink opens a link to the $management node of the entity of the receiver on the session of its
+// connection. Operations which act on messages delivered to the receiver, or on its message session, must be sent on
+// it rather than on a connection of their own. Closing the link leaves the connection of the receiver open.
+func (r *receiver) newManagementLink(ctx context.Context) (*managementLink, error) {
+	span, ctx := r.startConsumerSpanFromContext(ctx, "sb.receiver.newManagementLink")
+	defer span.Finish()
+
+	address := managementPath(r.entityPath)
+	link, err := rpc.NewLinkWithSession(r.connection, r.session.Session, address)
+	if err != nil {
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+	r.namespace.getLogger().Debug("management link opened", "entity", address)
+
+	return &managementLink{
+		link:        link,
+		address:     address,
+		retryPolicy: r.namespace.retryPolicy,
+		logger:      r.namespace.getLogger(),
+	}, nil
+}
+
+// Close closes the link and the connection it was established on, unless it was opened on the connection of a
+// receiver
+func (ml *managementLink) Close(ctx context.Context) error {
+	ml.logger.Debug("management link closed", "entity", ml.address)
+	if ml.stopClaimRefresh != nil {
+		ml.stopClaimRefresh()
+	}
+	if ml.namespace != nil {
+		ml.namespace.untrackLink(ml)
+	}
+	if ml.conn == nil {
+		return ml.link.Close(ctx)
+	}
+	_ = ml.link.Close(ctx)
+	return ml.conn.Close()
+}
+
+// peek fetches up to count messages starting at fromSequenceNumber without locking or removing them from the entity. A
+// nil slice and nil error are returned when there are no more messages to be peeked.
+func (ml *managementLink) peek(ctx context.Context, fromSequenceNumber int64, count int32) ([]*Message, error) {
+	msg := &amqp.Message{
+		ApplicationProperties: map[string]interface{}{
+			operationFieldName: peekMessageOperationName,
+		},
+		Value: map[string]interface{}{
+			fromSequenceNumberFieldName: fromSequenceNumber,
+			messageCountFieldName:       count,
+		},
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		msg.ApplicationProperties[serverTimeoutFieldName] = uint(time.Until(deadline) / time.Millisecond)
+	}
+
+	rsp, err := ml.rpc(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.Code == 204 {
+		return nil, nil
+	}
+
+	if rsp.Code != 200 {
+		return nil, fmt.Errorf("error peeking messages: %v", rsp.Description)
+	}
+
+	messages, err := messagesFromManagementResponse(rsp.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, msg := range messages {
+		// peeked messages are not locked, so they can't be settled
+		msg.settle()
+	}
+	return messages, nil
+}
+
+// schedule enqueues messages to be made available at their scheduled enqueue time, and returns the sequence numbers
+// Service Bus assigned them, in the order of the messages
+func (ml *managementLink) schedule(ctx context.Context, messages ...*amqp.Message) ([]int64, error) {
+	entries := make([]interface{}, 0, len(messages))
+	for _, msg := range messages {
+		encoded, err := msg.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+
+		entry := map[string]interface{}{
+			messageFieldName: encoded,
+		}
+		if msg.Properties != nil {
+			entry[messageIDFieldName] = msg.Properties.MessageID
+			if msg.Properties.GroupID != "" {
+				entry[sessionIDFieldName] = msg.Properties.GroupID
+			}
+		}
+		if pk, ok := msg.Annotations[partitionKeyName]; ok {
+			entry[partitionKeyFieldName] = pk
+		}
+		entries = append(entries, entry)
+	}
+
+	req := &amqp.Message{
+		ApplicationProperties: map[string]interface{}{
+			operationFieldName: scheduleMessageOperationName,
+		},
+		Value: map[string]interface{}{
+			messagesFieldName: entries,
+		},
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		req.ApplicationProperties[serverTimeoutFieldName] = uint(time.Until(deadline) / time.Millisecond)
+	}
+
+	rsp, err := ml.rpc(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.Code != 200 {
+		return nil, fmt.Errorf("error scheduling messages: %v", rsp.Description)
+	}
+
+	val, ok := rsp.Message.Value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("server error: response value was not of expected type map[string]interface{}")
+	}
+
+	sequenceNumbers, ok := val[sequenceNumbersFieldName].([]int64)
+	if !ok || len(sequenceNumbers) != len(messages) {
+		return nil, fmt.Errorf("server error: response value %q did not hold a sequence number for each message", sequenceNumbersFieldName)
+	}
+	return sequenceNumbers, nil
+}
+
+// cancelScheduled cancels the enqueuing of scheduled messages
+func (ml *managementLink) cancelScheduled(ctx context.Context, sequenceNumbers ...int64) error {
+	req := &amqp.Message{
+		ApplicationProperties: map[string]interface{}{
+			operationFieldName: cancelScheduledOperationName,
+		},
+		Value: map[string]interface{}{
+			sequenceNumbersFieldName: sequenceNumbers,
+		},
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		req.ApplicationProperties[serverTimeoutFieldName] = uint(time.Until(deadline) / time.Millisecond)
+	}
+
+	rsp, err := ml.rpc(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	if rsp.Code != 200 {
+		return fmt.Errorf("error canceling scheduled messages: %v", rsp.Description)
+	}
+	return nil
+}
+
+// receiveBySequenceNumber locks and returns the deferred messages with the given sequence numbers. The deferred messages
+// of a session can only be received with the lock of the session, so sessionID must be set for them and the link must
+// be opened on the connection of the receiver holding the session.
+func (ml *managementLink) receiveBySequenceNumber(ctx context.Context, sessionID *string, sequenceNumbers ...int64) ([]*Message, error) {
+	value := map[string]interface{}{
+		sequenceNumbersFieldName:    sequenceNumbers,
+		receiverSettleModeFieldName: uint32(1), // peek lock
+	}
+	if sessionID != nil {
+		value[sessionIDFieldName] = *sessionID
+	}
+
+	req := &amqp.Message{
+		ApplicationProperties: map[string]interface{}{
+			operationFieldName: receiveBySequenceNumberOperationName,
+		},
+		Value: value,
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		req.ApplicationProperties[serverTimeoutFieldName] = uint(time.Until(deadline) / time.Millisecond)
+	}
+
+	rsp, err := ml.rpc(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.Code != 200 {
+		return nil, fmt.Errorf("error receiving deferred messages: %v", rsp.Description)
+	}
+	return messagesFromManagementResponse(rsp.Message)
+}
+
+// getMessageSessions returns a page of up to top IDs of the sessions of the entity, skipping the first skip of them.
+// Sessions whose state was updated after lastUpdated are returned, or sessions holding messages if lastUpdated is
+// allSessionsWithMessages.
+func (ml *managementLink) getMessageSessions(ctx context.Context, lastUpdated time.Time, skip, top int32) ([]string, error) {
+	req := &amqp.Message{
+		ApplicationProperties: map[string]interface{}{
+			operationFieldName: getMessageSessionsOperationName,
+		},
+		Value: map[string]interface{}{
+			lastUpdatedTimeFieldName: lastUpdated,
+			skipFieldName:            skip,
+			topFieldName:             top,
+		},
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		req.ApplicationProperties[serverTimeoutFieldName] = uint(time.Until(deadline) / time.Millisecond)
+	}
+
+	rsp, err := ml.rpc(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.Code == 204 {
+		return nil, nil
+	}
+
+	if rsp.Code != 200 {
+		return nil, fmt.Errorf("error listing sessions: %v", rsp.Description)
+	}
+
+	val, ok := rsp.Message.Value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("server error: response value was not of expected type map[string]interface{}")
+	}
+
+	sessionIDs, ok := val[sessionIDsFieldName].([]string)
+	if !ok {
+		return nil, fmt.Errorf("server error: response value %q was not of expected type []string", sessionIDsFieldName)
+	}
+	return sessionIDs, nil
+}
+
+// getSessionState returns the state of a session of the entity, or nil if no state was ever set on the session
+func (ml *managementLink) getSessionState(ctx context.Context, sessionID string) ([]byte, error) {
+	req := &amqp.Message{
+		ApplicationProperties: map[string]interface{}{
+			operationFieldName: getSessionStateOperationName,
+		},
+		Value: map[string]interface{}{
+			sessionIDFieldName: sessionID,
+		},
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		req.ApplicationProperties[serverTimeoutFieldName] = uint(time.Until(deadline) / time.Millisecond)
+	}
+
+	rsp, err := ml.rpc(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.Code == 204 {
+		return nil, nil
+	}
+
+	if rsp.Code != 200 {
+		return nil, fmt.Errorf("error getting session state: %v", rsp.Description)
+	}
+
+	val, ok := rsp.Message.Value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("server error: response value was not of expected type map[string]interface{}")
+	}
+
+	rawState, ok := val[sessionStateFieldName]
+	if !ok || rawState == nil {
+		return nil, nil
+	}
+
+	state, ok := rawState.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("server error: response value %q is not a byte array", sessionStateFieldName)
+	}
+	return state, nil
+}
+
+// listSessions returns the IDs of the sessions of an entity, following the pages Service Bus returns them in
+func (ns *Namespace) listSessions(ctx context.Context, entityPath string, lastUpdated time.Time) ([]string, error) {
+	link, err := ns.newManagementLink(ctx, entityPath)
+	if err != nil {
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+	defer func() {
+		_ = link.Close(ctx)
+	}()
+
+	var sessionIDs []string
+	for skip := int32(0); ; skip += sessionPageSize {
+		page, err := link.getMessageSessions(ctx, lastUpdated, skip, sessionPageSize)
+		if err != nil {
+			log.For(ctx).Error(err)
+			return nil, err
+		}
+		sessionIDs = append(sessionIDs, page...)
+		if len(page) < sessionPageSize {
+			return sessionIDs, nil
+		}
+	}
+}
+
+// updateDisposition settles messages which were received through the management node. properties holds additional
+// fields of the request, such as the reason for dead lettering.
+func (ml *managementLink) updateDisposition(ctx context.Context, status dispositionStatus, lockTokens []amqp.UUID, properties map[string]interface{}) error {
+	value := map[string]interface{}{
+		dispositionStatusFieldName: string(status),
+		lockTokensFieldName:        lockTokens,
+	}
+	for key, val := range properties {
+		value[key] = val
+	}
+
+	req := &amqp.Message{
+		ApplicationProperties: map[string]interface{}{
+			operationFieldName: updateDispositionOperationName,
+		},
+		Value: value,
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		req.ApplicationProperties[serverTimeoutFieldName] = uint(time.Until(deadline) / time.Millisecond)
+	}
+
+	rsp, err := ml.rpc(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	if rsp.Code != 200 {
+		if err := lockLostResponseError(rsp); err != nil {
+			return err
+		}
+		return fmt.Errorf("error updating the disposition of messages: %v", rsp.Description)
+	}
+	return nil
+}
+
+// lockLostResponseError returns a ConditionError matching ErrMessageLockLost or ErrSessionLockLost if a management
+// request failed because the lock on a message or session was lost, which Service Bus reports with the error condition
+// of the response or, for messages, with status 410 Gone. Other responses return nil.
+func lockLostResponseError(rsp *rpc.Response) error {
+	var condition MessageErrorCondition
+	if rsp.Message != nil {
+		if val, ok := rsp.Message.ApplicationProperties[errorConditionFieldName]; ok {
+			condition = MessageErrorCondition(fmt.Sprint(val))
+		}
+	}
+
+	switch {
+	case condition == ErrorMessageLockLost, condition == ErrorSessionLockLost:
+	case condition == "" && rsp.Code == http.StatusGone:
+		condition = ErrorMessageLockLost
+	default:
+		return nil
+	}
+
+	return &ConditionError{
+		Condition:   condition,
+		Description: rsp.Description,
+		Err:         &amqp.Error{Condition: amqp.ErrorCondition(condition), Description: rsp.Description},
+	}
+}
+
+// messagesFromManagementResponse decodes the messages returned by management operations. They are returned as a map with
+// a single "messages" key, holding a list of maps, each of which has the encoded message under the "message" key.
+func messagesFromManagementResponse(rsp *amqp.Message) ([]*Message, error) {
+	if rsp == nil {
+		return nil, errors.New("server error: response did not contain a message")
+	}
+
+	val, ok := rsp.Value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("server error: response value was not of expected type map[string]interface{}")
+	}
+
+	rawMessages, ok := val[messagesFieldName].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("server error: response value %q was not of expected type []interface{}", messagesFieldName)
+	}
+
+	messages := make([]*Message, 0, len(rawMessages))
+	for i, rawMessage := range rawMessages {
+		entry, ok := rawMessage.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("server error: message %d was not of expected type map[string]interface{}", i)
+		}
+
+		encoded, ok := entry[messageFieldName].([]byte)
+		if !ok {
+			return nil, fmt.Errorf("server error: message %d did not contain an encoded %q", i, messageFieldName)
+		}
+
+		amqpMsg := new(amqp.Message)
+		if err := amqpMsg.UnmarshalBinary(encoded); err != nil {
+			return nil, err
+		}
+
+		msg, err := messageFromAMQPMessage(amqpMsg)
+		if err != nil {
+			return nil, err
+		}
+
+		// messages received through the management node carry their lock token beside the encoded message
+		if lockToken, ok := entry[lockTokenFieldName].(amqp.UUID); ok {
+			id := uuid.UUID(lockToken)
+			msg.LockToken = &id
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+func managementPath(entityPath string) string {
+	return fmt.Sprintf("%s/$management", entityPath)
+}
@@ -0,0 +1,520 @@
+package servicebus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-service-bus-go/atom"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+type (
+	// RuleEntity is the Azure Service Bus description of a Subscription Rule for management activities
+	RuleEntity struct {
+		*RuleDescription
+		Name string
+	}
+
+	// RuleDescription is the content type for Subscription Rule management requests
+	RuleDescription struct {
+		XMLName xml.Name `xml:"RuleDescription"`
+		BaseEntityDescription
+		Filter    FilterDescription  `xml:"Filter"`
+		Action    *ActionDescription `xml:"Action,omitempty"`
+		CreatedAt *date.Time         `xml:"CreatedAt,omitempty"`
+	}
+
+	// FilterDescription describes the filter a Rule uses to select the messages of a Topic which are copied to a
+	// Subscription. Type is the kind of the filter, such as SqlFilter, CorrelationFilter, TrueFilter or FalseFilter, and
+	// determines which of the other fields are set.
+	FilterDescription struct {
+		XMLName            xml.Name         `xml:"Filter"`
+		Type               string           `xml:"http://www.w3.org/2001/XMLSchema-instance type,attr"`
+		SQLExpression      *string          `xml:"SqlExpression,omitempty"`
+		CompatibilityLevel *int             `xml:"CompatibilityLevel,omitempty"`
+		CorrelationID      *string          `xml:"CorrelationId,omitempty"`
+		MessageID          *string          `xml:"MessageId,omitempty"`
+		To                 *string          `xml:"To,omitempty"`
+		ReplyTo            *string          `xml:"ReplyTo,omitempty"`
+		Label              *string          `xml:"Label,omitempty"`
+		SessionID          *string          `xml:"SessionId,omitempty"`
+		ReplyToSessionID   *string          `xml:"ReplyToSessionId,omitempty"`
+		ContentType        *string          `xml:"ContentType,omitempty"`
+		Properties         []FilterProperty `xml:"Properties>KeyValueOfstringanyType,omitempty"`
+	}
+
+	// FilterProperty is a user property a correlation filter matches against
+	FilterProperty struct {
+		Key   string              `xml:"Key"`
+		Value FilterPropertyValue `xml:"Value"`
+	}
+
+	// FilterPropertyValue is the value of a FilterProperty along with its XML schema type, such as d6p1:string. The
+	// d6p1 prefix must be bound to the XML schema namespace by XMLSchemaNS for Service Bus to resolve the type.
+	FilterPropertyValue struct {
+		XMLSchemaNS string `xml:"xmlns:d6p1,attr,omitempty"`
+		Type        string `xml:"http://www.w3.org/2001/XMLSchema-instance type,attr"`
+		Value       string `xml:",chardata"`
+	}
+
+	// ActionDescription describes an action a Rule applies to the messages selected by its filter. Type is the kind of
+	// the action, such as SqlRuleAction or EmptyRuleAction.
+	ActionDescription struct {
+		Type                  string  `xml:"http://www.w3.org/2001/XMLSchema-instance type,attr"`
+		SQLExpression         *string `xml:"SqlExpression,omitempty"`
+		RequiresPreprocessing *bool   `xml:"RequiresPreprocessing,omitempty"`
+		CompatibilityLevel    *int    `xml:"CompatibilityLevel,omitempty"`
+	}
+
+	// RuleManager manages the Rules of a Subscription, which select the messages of the Topic copied to the Subscription
+	RuleManager struct {
+		*SubscriptionManager
+		Subscription string
+	}
+
+	// Filter is a typed filter a Rule uses to select messages, which is described to Service Bus as a FilterDescription
+	Filter interface {
+		ToFilterDescription() FilterDescription
+	}
+
+	// SQLFilter selects the messages for which a SQL-92 like conditional expression over their properties is true, such
+	// as "color = 'red' AND quantity > 10"
+	SQLFilter struct {
+		Expression string
+	}
+
+	// TrueFilter selects all messages
+	TrueFilter struct{}
+
+	// FalseFilter selects no messages
+	FalseFilter struct{}
+
+	// CorrelationFilter selects the messages whose system and user properties are equal to all of the properties set on
+	// the filter. At least one property must be set, which is checked before a Rule is created with the filter.
+	CorrelationFilter struct {
+		CorrelationID    *string
+		MessageID        *string
+		To               *string
+		ReplyTo          *string
+		Label            *string
+		SessionID        *string
+		ReplyToSessionID *string
+		ContentType      *string
+		// Properties are user properties to match. Values may be strings, integers, floating point numbers, booleans
+		// or times.
+		Properties map[string]interface{}
+	}
+
+	// Action is a typed action a Rule applies to the messages selected by its filter, which is described to Service Bus
+	// as an ActionDescription
+	Action interface {
+		ToActionDescription() ActionDescription
+	}
+
+	// SQLAction modifies the properties of the selected messages with a SQL-92 like expression, such as
+	// "SET priority = 'high'"
+	SQLAction struct {
+		Expression string
+	}
+
+	// filterValidator is implemented by filters which can be invalid
+	filterValidator interface {
+		Validate() error
+	}
+
+	// ruleFeed is a specialized feed containing Subscription Rules
+	ruleFeed struct {
+		*atom.Feed
+		Entries []ruleEntry `xml:"entry"`
+	}
+
+	// ruleEntry is a specialized Subscription feed Rule
+	ruleEntry struct {
+		*atom.Entry
+		Content *ruleContent `xml:"content"`
+	}
+
+	// ruleContent is a specialized Rule body for an Atom entry
+	ruleContent struct {
+		XMLName         xml.Name        `xml:"content"`
+		Type            string          `xml:"type,attr"`
+		RuleDescription RuleDescription `xml:"RuleDescription"`
+	}
+)
+
+const (
+	// DefaultRuleName is the name of the Rule Service Bus creates with a new Subscription, which selects all messages.
+	// Delete it to copy only the messages selected by other Rules to the Subscription.
+	DefaultRuleName = "$Default"
+
+	// sqlCompatibilityLevel is the version of the SQL filter syntax
+	sqlCompatibilityLevel = 20
+
+	// xmlSchemaNS is the namespace of the XML schema types of correlation filter property values
+	xmlSchemaNS = "http://www.w3.org/2001/XMLSchema"
+)
+
+// ToFilterDescription implements Filter
+func (f SQLFilter) ToFilterDescription() FilterDescription {
+	return FilterDescription{
+		Type:               "SqlFilter",
+		SQLExpression:      &f.Expression,
+		CompatibilityLevel: to.IntPtr(sqlCompatibilityLevel),
+	}
+}
+
+// ToFilterDescription implements Filter
+func (f TrueFilter) ToFilterDescription() FilterDescription {
+	return FilterDescription{
+		Type:               "TrueFilter",
+		SQLExpression:      to.StringPtr("1=1"),
+		CompatibilityLevel: to.IntPtr(sqlCompatibilityLevel),
+	}
+}
+
+// ToFilterDescription implements Filter
+func (f FalseFilter) ToFilterDescription() FilterDescription {
+	return FilterDescription{
+		Type:               "FalseFilter",
+		SQLExpression:      to.StringPtr("1=0"),
+		CompatibilityLevel: to.IntPtr(sqlCompatibilityLevel),
+	}
+}
+
+// Validate returns an error if no property of the filter is set, as such a filter would select every message, or if a
+// user property has a value of an unsupported type
+func (f CorrelationFilter) Validate() error {
+	for key, val := range f.Properties {
+		if _, _, err := filterPropertyValue(val); err != nil {
+			return fmt.Errorf("correlation filter property %q: %v", key, err)
+		}
+	}
+
+	if len(f.Properties) > 0 {
+		return nil
+	}
+	for _, p := range []*string{f.CorrelationID, f.MessageID, f.To, f.ReplyTo, f.Label, f.SessionID, f.ReplyToSessionID, f.ContentType} {
+		if p != nil {
+			return nil
+		}
+	}
+	return errors.New("correlation filter must set at least one property")
+}
+
+// ToFilterDescription implements Filter
+func (f CorrelationFilter) ToFilterDescription() FilterDescription {
+	fd := FilterDescription{
+		Type:             "CorrelationFilter",
+		CorrelationID:    f.CorrelationID,
+		MessageID:        f.MessageID,
+		To:               f.To,
+		ReplyTo:          f.ReplyTo,
+		Label:            f.Label,
+		SessionID:        f.SessionID,
+		ReplyToSessionID: f.ReplyToSessionID,
+		ContentType:      f.ContentType,
+	}
+
+	keys := make([]string, 0, len(f.Properties))
+	for key := range f.Properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		schemaType, value, err := filterPropertyValue(f.Properties[key])
+		if err != nil {
+			// invalid properties are reported by Validate
+			continue
+		}
+		fd.Properties = append(fd.Properties, FilterProperty{
+			Key: key,
+			Value: FilterPropertyValue{
+				XMLSchemaNS: xmlSchemaNS,
+				Type:        "d6p1:" + schemaType,
+				Value:       value,
+			},
+		})
+	}
+	return fd
+}
+
+// filterPropertyValue returns the XML schema type and the text of a correlation filter property value
+func filterPropertyValue(val interface{}) (string, string, error) {
+	switch v := val.(type) {
+	case string:
+		return "string", v, nil
+	case bool:
+		return "boolean", strconv.FormatBool(v), nil
+	case int:
+		return "int", strconv.Itoa(v), nil
+	case int32:
+		return "int", strconv.FormatInt(int64(v), 10), nil
+	case int64:
+		return "long", strconv.FormatInt(v, 10), nil
+	case float32:
+		return "float", strconv.FormatFloat(float64(v), 'g', -1, 32), nil
+	case float64:
+		return "double", strconv.FormatFloat(v, 'g', -1, 64), nil
+	case time.Time:
+		return "dateTime", v.UTC().Format(time.RFC3339Nano), nil
+	default:
+		return "", "", fmt.Errorf("unsupported value type %T", val)
+	}
+}
+
+// ToActionDescription implements Action
+func (a SQLAction) ToActionDescription() ActionDescription {
+	return ActionDescription{
+		Type:               "SqlRuleAction",
+		SQLExpression:      &a.Expression,
+		CompatibilityLevel: to.IntPtr(sqlCompatibilityLevel),
+	}
+}
+
+// NewRuleManager creates a RuleManager for a Subscription of the Topic
+func (sm *SubscriptionManager) NewRuleManager(subscriptionName string) *RuleManager {
+	return &RuleManager{
+		SubscriptionManager: sm,
+		Subscription:        subscriptionName,
+	}
+}
+
+// NewRuleManager creates a RuleManager for the Subscription
+func (s *Subscription) NewRuleManager() *RuleManager {
+	return s.Topic.NewSubscriptionManager().NewRuleManager(s.Name)
+}
+
+// PutRule creates or updates a Rule of the Subscription, which selects messages with filter
+func (rm *RuleManager) PutRule(ctx context.Context, name string, filter Filter) (*RuleEntity, error) {
+	return rm.SubscriptionManager.PutRule(ctx, rm.Subscription, name, filter)
+}
+
+// PutRuleWithAction creates or updates a Rule of the Subscription, which selects messages with filter and modifies them
+// with action
+func (rm *RuleManager) PutRuleWithAction(ctx context.Context, name string, filter Filter, action Action) (*RuleEntity, error) {
+	return rm.SubscriptionManager.PutRuleWithAction(ctx, rm.Subscription, name, filter, action)
+}
+
+// DeleteRule deletes a Rule of the Subscription by name
+func (rm *RuleManager) DeleteRule(ctx context.Context, name string) error {
+	return rm.SubscriptionManager.DeleteRule(ctx, rm.Subscription, name)
+}
+
+// ListRules fetches all of the Rules of the Subscription
+func (rm *RuleManager) ListRules(ctx context.Context) ([]*RuleEntity, error) {
+	return rm.SubscriptionManager.ListRules(ctx, rm.Subscription)
+}
+
+// PutRule creates a Rule on a Subscription, which selects the messages of the Topic copied to the Subscription with
+// filter
+func (sm *SubscriptionManager) PutRule(ctx context.Context, subscriptionName, ruleName string, filter Filter) (*RuleEntity, error) {
+	span, ctx := sm.startSpanFromContext(ctx, "sb.SubscriptionManager.PutRule")
+	defer span.Finish()
+
+	return sm.PutRuleWithAction(ctx, subscriptionName, ruleName, filter, nil)
+}
+
+// PutRuleWithAction creates a Rule on a Subscription, which selects the messages of the Topic copied to the
+// Subscription with filter and modifies them with action. If action is nil, the messages are not modified. The filter
+// is validated before the Rule is created.
+func (sm *SubscriptionManager) PutRuleWithAction(ctx context.Context, subscriptionName, ruleName string, filter Filter, action Action) (*RuleEntity, error) {
+	span, ctx := sm.startSpanFromContext(ctx, "sb.SubscriptionManager.PutRuleWithAction")
+	defer span.Finish()
+
+	if filter == nil {
+		return nil, errors.New("filter must not be nil")
+	}
+
+	if v, ok := filter.(filterValidator); ok {
+		if err := v.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	rd := &RuleDescription{
+		Filter: filter.ToFilterDescription(),
+	}
+	if action != nil {
+		ad := action.ToActionDescription()
+		rd.Action = &ad
+	}
+	return sm.putRule(ctx, subscriptionName, ruleName, rd)
+}
+
+// ListRules fetches all of the Rules of a Subscription
+func (sm *SubscriptionManager) ListRules(ctx context.Context, subscriptionName string) ([]*RuleEntity, error) {
+	span, ctx := sm.startSpanFromContext(ctx, "sb.SubscriptionManager.ListRules")
+	defer span.Finish()
+
+	res, err := sm.entityManager.Get(ctx, sm.getRulesResourceURI(subscriptionName))
+	if res != nil {
+		defer res.Body.Close()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var feed ruleFeed
+	err = xml.Unmarshal(b, &feed)
+	if err != nil {
+		return nil, formatManagementError(b)
+	}
+
+	rules := make([]*RuleEntity, len(feed.Entries))
+	for idx, entry := range feed.Entries {
+		rule, err := ruleEntryToEntity(&entry)
+		if err != nil {
+			return nil, err
+		}
+		rules[idx] = rule
+	}
+	return rules, nil
+}
+
+// GetWithRules fetches a Subscription along with all of its Rules. The Subscription and its Rules are requested
+// concurrently. If the Subscription does not exist, nil is returned for both.
+func (sm *SubscriptionManager) GetWithRules(ctx context.Context, name string) (*SubscriptionEntity, []*RuleEntity, error) {
+	span, ctx := sm.startSpanFromContext(ctx, "sb.SubscriptionManager.GetWithRules")
+	defer span.Finish()
+
+	type rulesResult struct {
+		rules []*RuleEntity
+		err   error
+	}
+
+	rulesChan := make(chan rulesResult, 1)
+	go func() {
+		rules, err := sm.ListRules(ctx, name)
+		rulesChan <- rulesResult{rules: rules, err: err}
+	}()
+
+	sub, err := sm.Get(ctx, name)
+	rulesRes := <-rulesChan
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if sub == nil {
+		return nil, nil, nil
+	}
+
+	if rulesRes.err != nil {
+		return nil, nil, rulesRes.err
+	}
+	return sub, rulesRes.rules, nil
+}
+
+// putRule creates a Rule on a Subscription from a complete description
+func (sm *SubscriptionManager) putRule(ctx context.Context, subscriptionName, ruleName string, rd *RuleDescription) (*RuleEntity, error) {
+	span, ctx := sm.startSpanFromContext(ctx, "sb.SubscriptionManager.putRule")
+	defer span.Finish()
+
+	rd.ServiceBusSchema = to.StringPtr(serviceBusSchema)
+
+	re := &ruleEntry{
+		Entry: &atom.Entry{
+			AtomSchema: atomSchema,
+		},
+		Content: &ruleContent{
+			Type:            applicationXML,
+			RuleDescription: *rd,
+		},
+	}
+
+	reqBytes, err := xml.Marshal(re)
+	if err != nil {
+		return nil, err
+	}
+
+	reqBytes = xmlDoc(reqBytes)
+	res, err := sm.entityManager.Put(ctx, sm.getRuleResourceURI(subscriptionName, ruleName), reqBytes)
+	if res != nil {
+		defer res.Body.Close()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var entry ruleEntry
+	err = xml.Unmarshal(b, &entry)
+	if err != nil {
+		return nil, formatManagementError(b)
+	}
+	return ruleEntryToEntity(&entry)
+}
+
+// DeleteRule deletes a Rule of a Subscription by name. Deleting DefaultRuleName stops the Subscription from receiving
+// all of the messages of the Topic.
+func (sm *SubscriptionManager) DeleteRule(ctx context.Context, subscriptionName, ruleName string) error {
+	span, ctx := sm.startSpanFromContext(ctx, "sb.SubscriptionManager.DeleteRule")
+	defer span.Finish()
+
+	res, err := sm.entityManager.Delete(ctx, sm.getRuleResourceURI(subscriptionName, ruleName))
+	if res != nil {
+		defer res.Body.Close()
+	}
+
+	return err
+}
+
+// ruleEntryToEntity returns the Rule described by the entry, or an error if Service Bus returned an entry without a
+// description
+func ruleEntryToEntity(entry *ruleEntry) (*RuleEntity, error) {
+	if entry.Content == nil {
+		return nil, errors.New("rule entry did not contain a description")
+	}
+	return &RuleEntity{
+		RuleDescription: &entry.Content.RuleDescription,
+		Name:            entry.Title,
+	}, nil
+}
+
+func (sm *SubscriptionManager) getRulesResourceURI(subscriptionName string) string {
+	return sm.getResourceURI(subscriptionName) + "/rules"
+}
+
+func (sm *SubscriptionManager) getRuleResourceURI(subscriptionName, ruleName string) string {
+	return sm.getRulesResourceURI(subscriptionName) + "/" + ruleName
+}
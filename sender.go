@@ -24,31 +24,86 @@ package servicebus
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"time"
 
 	"github.com/Azure/azure-amqp-common-go/log"
-	"github.com/Azure/azure-amqp-common-go/uuid"
 	"github.com/opentracing/opentracing-go"
 	"pack.ag/amqp"
 )
 
+const (
+	// defaultMaxPendingSends is the number of asynchronous sends which may await confirmation at once by default
+	defaultMaxPendingSends = 256
+)
+
 // sender provides session and link handling for an sending entity path
 type (
 	sender struct {
 		namespace  *Namespace
 		connection *amqp.Client
 		session    *session
-		sender     *amqp.Sender
+		sender     senderLink
 		entityPath string
 		Name       string
 		sessionID  *string
+		// skipIDAssignment leaves messages sent without an ID without one
+		skipIDAssignment bool
+		// defaultTTL returns the default message time to live of the entity, if it is known
+		defaultTTL func(context.Context) (time.Duration, bool)
+		// stopClaimRefresh stops the periodic authorization of the connection
+		stopClaimRefresh func()
+	}
+
+	// senderLink is the AMQP link messages are transferred over, which is an *amqp.Sender
+	senderLink interface {
+		Send(ctx context.Context, msg *amqp.Message) error
+		Close(ctx context.Context) error
 	}
 
+	// SendFunc sends a message. It is the unit wrapped by send middleware.
+	SendFunc func(ctx context.Context, msg *Message) error
+
 	// SendOption provides a way to customize a message on sending
 	SendOption func(event *Message) error
 
+	// SendOptions bounds the phases of a confirmed send. TransferTimeout is meant for waiting for link credit and
+	// transferring the message, and ConfirmTimeout for waiting for Service Bus to report the outcome of the transfer; as
+	// the AMQP library doesn't report when a transfer completes, the send is bounded by their sum. Both must be greater
+	// than zero; the zero SendOptions sends a message bounded only by its context.
+	SendOptions struct {
+		TransferTimeout time.Duration
+		ConfirmTimeout  time.Duration
+	}
+
+	// SendResult describes the outcome of a successful send
+	SendResult struct {
+		// MessageID is the ID of the message which was sent
+		MessageID string
+		// Deduplicated is a best effort indication that the message was discarded by the duplicate detection of the
+		// entity. Service Bus accepts duplicate messages without signaling that they were discarded, so this is only
+		// true if a message with the same ID was sent by this client within the duplicate detection window, or if the
+		// message was not found by the check of SendResultWithPeekCheck.
+		Deduplicated bool
+	}
+
+	// SendResultOption configures a call to SendWithResult
+	SendResultOption func(*sendResultOptions) error
+
+	sendResultOptions struct {
+		peekCheck bool
+	}
+
+	// AsyncSendResult is the outcome of a message sent asynchronously. Err is nil if Service Bus accepted the message.
+	AsyncSendResult struct {
+		// MessageID is the ID of the message which was sent
+		MessageID string
+		// Err is the reason the message was not accepted
+		Err error
+	}
+
 	eventer interface {
 		Set(key, value string)
 		toMsg() (*amqp.Message, error)
@@ -78,8 +133,14 @@ func (ns *Namespace) newSender(ctx context.Context, entityPath string, opts ...s
 	err := s.newSessionAndLink(ctx)
 	if err != nil {
 		log.For(ctx).Error(err)
+		return s, wrapError(err)
+	}
+
+	if err := ns.trackLink(s, s.Close); err != nil {
+		_ = s.Close(ctx)
+		return nil, err
 	}
-	return s, err
+	return s, nil
 }
 
 // Recover will attempt to close the current session and link, then rebuild them
@@ -102,6 +163,12 @@ func (s *sender) Close(ctx context.Context) error {
 	span, _ := s.startProducerSpanFromContext(ctx, "sb.sender.Close")
 	defer span.Finish()
 
+	if s.stopClaimRefresh != nil {
+		s.stopClaimRefresh()
+	}
+
+	s.namespace.untrackLink(s)
+	s.namespace.getLogger().Info("sender link closed", "entity", s.entityPath)
 	return s.connection.Close()
 }
 
@@ -112,30 +179,121 @@ func (s *sender) Send(ctx context.Context, event *Message, opts ...SendOption) e
 	span, ctx := s.startProducerSpanFromContext(ctx, "sb.sender.Send")
 	defer span.Finish()
 
-	if event.GroupID == nil {
-		event.GroupID = &s.session.SessionID
-		next := s.session.getNext()
-		event.GroupSequence = &next
+	if err := s.prepare(ctx, event); err != nil {
+		return err
 	}
 
-	if event.ID == "" {
-		id, err := uuid.NewV4()
+	for _, opt := range opts {
+		err := opt(event)
 		if err != nil {
 			log.For(ctx).Error(err)
 			return err
 		}
-		event.ID = id.String()
 	}
 
-	for _, opt := range opts {
-		err := opt(event)
+	return s.trySend(ctx, event)
+}
+
+// schedule sends messages with a scheduled enqueue time through the management node of the entity, which reports the
+// sequence numbers assigned to the messages. The sequence numbers are also set in the SystemProperties of the messages.
+func (s *sender) schedule(ctx context.Context, events ...*Message) ([]int64, error) {
+	span, ctx := s.startProducerSpanFromContext(ctx, "sb.sender.schedule")
+	defer span.Finish()
+
+	messages := make([]*amqp.Message, 0, len(events))
+	for _, event := range events {
+		if err := opentracing.GlobalTracer().Inject(span.Context(), opentracing.TextMap, event); err != nil {
+			log.For(ctx).Error(err)
+			return nil, err
+		}
+
+		if event.ID == "" {
+			// the schedule operation requires a message ID
+			id, err := s.namespace.newID()
+			if err != nil {
+				log.For(ctx).Error(err)
+				return nil, err
+			}
+			event.ID = id
+		}
+
+		msg, err := event.toMsg()
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	link, err := s.namespace.newManagementLink(ctx, s.entityPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = link.Close(ctx)
+	}()
+
+	sequenceNumbers, err := link.schedule(ctx, messages...)
+	if err != nil {
+		log.For(ctx).Error(err)
+		return nil, err
+	}
+
+	for i, event := range events {
+		if event.SystemProperties == nil {
+			event.SystemProperties = new(SystemProperties)
+		}
+		sequenceNumber := sequenceNumbers[i]
+		event.SystemProperties.SequenceNumber = &sequenceNumber
+	}
+	return sequenceNumbers, nil
+}
+
+// prepare assigns the sender's session to a message without a session, and an ID to a message without an ID unless
+// IDs are not assigned. The time to live of the message is capped to the default of the entity.
+func (s *sender) prepare(ctx context.Context, event *Message) error {
+	if event.GroupID == nil {
+		event.GroupID = &s.session.SessionID
+		next := s.session.getNext()
+		event.GroupSequence = &next
+		// the random session of a sender which is not bound to a session must not pin the partition of the message
+		event.sessionAssigned = s.sessionID == nil
+	}
+
+	if event.ID == "" && !s.skipIDAssignment {
+		id, err := s.namespace.newID()
 		if err != nil {
 			log.For(ctx).Error(err)
 			return err
 		}
+		event.ID = id
 	}
+	return s.effectiveTTL(ctx, event)
+}
 
-	return s.trySend(ctx, event)
+// SendWithOptions will send a message to the entity path, bounding the transfer and the wait for its outcome by the
+// timeouts of so. If the outcome did not arrive in time, ErrConfirmTimeout is returned. SendOptions which set only one
+// of the timeouts, or a negative one, are rejected.
+//
+// The AMQP link returns the error of its context whether it was waiting to transfer the message or for its outcome, so
+// both phases share a deadline of TransferTimeout + ConfirmTimeout. Once that deadline passed, TransferTimeout has, and
+// the message may have landed, so the send is reported with ErrConfirmTimeout rather than as a plain deadline error.
+func (s *sender) SendWithOptions(ctx context.Context, event *Message, so SendOptions, opts ...SendOption) error {
+	if so == (SendOptions{}) {
+		return s.Send(ctx, event, opts...)
+	}
+	if so.TransferTimeout <= 0 || so.ConfirmTimeout <= 0 {
+		return errors.New("SendOptions: TransferTimeout and ConfirmTimeout must both be greater than zero")
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, so.TransferTimeout+so.ConfirmTimeout)
+	defer cancel()
+
+	err := s.Send(sendCtx, event, opts...)
+	if err == nil || ctx.Err() != nil || sendCtx.Err() == nil {
+		// succeeded, or failed for a reason other than the send timeouts
+		return err
+	}
+	return ErrConfirmTimeout
 }
 
 func (s *sender) trySend(ctx context.Context, evt eventer) error {
@@ -154,11 +312,15 @@ func (s *sender) trySend(ctx context.Context, evt eventer) error {
 	}
 	sp.SetTag("sb.message-id", msg.Properties.MessageID)
 
-	for {
+	for attempt := 1; ; attempt++ {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
+			if s.namespace.isClosed() {
+				return ErrNamespaceClosed
+			}
+
 			// try as long as the context is not dead
 			err = s.sender.Send(ctx, msg)
 			if err == nil {
@@ -166,24 +328,74 @@ func (s *sender) trySend(ctx context.Context, evt eventer) error {
 				return err
 			}
 
-			switch err.(type) {
-			case *amqp.Error, *amqp.DetachError:
-				log.For(ctx).Debug("amqp error, delaying 4 seconds: " + err.Error())
-				skew := time.Duration(rand.Intn(1000)-500) * time.Millisecond
-				time.Sleep(4*time.Second + skew)
-				err := s.Recover(ctx)
-				if err != nil {
-					log.For(ctx).Debug("failed to recover connection")
+			switch e := err.(type) {
+			case *amqp.Error:
+				if isNonRetryableCondition(e.Condition) || s.retriesExhausted(attempt) {
+					log.For(ctx).Error(err)
+					return wrapError(err)
+				}
+				s.delayAndRecover(ctx, attempt, err)
+			case *amqp.DetachError:
+				if (e.RemoteError != nil && isNonRetryableCondition(e.RemoteError.Condition)) || s.retriesExhausted(attempt) {
+					log.For(ctx).Error(err)
+					return wrapError(err)
 				}
-				log.For(ctx).Debug("recovered connection")
+				s.delayAndRecover(ctx, attempt, err)
 			default:
-				fmt.Println(err.Error())
-				return err
+				if !isLinkClosed(err) || s.retriesExhausted(attempt) {
+					log.For(ctx).Error(err)
+					return err
+				}
+				// the connection, session or link was lost without a detach, so it is established again
+				s.delayAndRecover(ctx, attempt, err)
 			}
 		}
 	}
 }
 
+// isLinkClosed returns true if err reports that the connection, session or link the message was sent on is closed
+func isLinkClosed(err error) bool {
+	switch err {
+	case amqp.ErrConnClosed, amqp.ErrSessionClosed, amqp.ErrLinkClosed:
+		return true
+	default:
+		return false
+	}
+}
+
+// retriesExhausted returns true if the retry policy of the namespace does not allow another attempt to send. Without a
+// retry policy, sends are retried as long as the context allows.
+func (s *sender) retriesExhausted(attempt int) bool {
+	return s.namespace.retryPolicy != nil && attempt >= s.namespace.retryPolicy.MaxAttempts
+}
+
+// delayAndRecover waits before rebuilding the connection, session and link of the sender. Without a retry policy, it
+// waits a few seconds, or serverBusyBackoff when Service Bus is throttling requests.
+func (s *sender) delayAndRecover(ctx context.Context, attempt int, err error) {
+	delay := 4*time.Second + time.Duration(rand.Intn(1000)-500)*time.Millisecond
+	if s.namespace.retryPolicy != nil {
+		delay = s.namespace.retryPolicy.delay(attempt, wrapError(err))
+	} else if wait, busy := serverBusyDelay(wrapError(err)); busy && wait > delay {
+		delay = wait
+	}
+	if _, busy := serverBusyDelay(wrapError(err)); busy {
+		logThrottled(s.namespace.getLogger(), "send", delay, err)
+	}
+
+	log.For(ctx).Debug(fmt.Sprintf("amqp error, delaying %v: %v", delay, err))
+	s.namespace.getLogger().Warn("retrying send", "entity", s.entityPath, "attempt", attempt+1, "delay", delay, "error", err)
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(delay):
+	}
+	if err := s.Recover(ctx); err != nil {
+		log.For(ctx).Debug("failed to recover connection")
+		return
+	}
+	log.For(ctx).Debug("recovered connection")
+}
+
 func (s *sender) String() string {
 	return s.Name
 }
@@ -201,6 +413,10 @@ func (s *sender) newSessionAndLink(ctx context.Context) error {
 	span, ctx := s.startProducerSpanFromContext(ctx, "sb.sender.newSessionAndLink")
 	defer span.Finish()
 
+	if s.stopClaimRefresh != nil {
+		s.stopClaimRefresh()
+	}
+
 	connection, err := s.namespace.newConnection()
 	if err != nil {
 		log.For(ctx).Error(err)
@@ -214,6 +430,8 @@ func (s *sender) newSessionAndLink(ctx context.Context) error {
 		return err
 	}
 
+	s.stopClaimRefresh = s.namespace.refreshClaim(connection, s.getAddress())
+
 	amqpSession, err := connection.NewSession()
 	if err != nil {
 		log.For(ctx).Error(err)
@@ -228,7 +446,7 @@ func (s *sender) newSessionAndLink(ctx context.Context) error {
 		return err
 	}
 
-	s.session, err = newSession(amqpSession)
+	s.session, err = s.namespace.newSession(amqpSession)
 	if err != nil {
 		log.For(ctx).Error(err)
 		return err
@@ -238,6 +456,7 @@ func (s *sender) newSessionAndLink(ctx context.Context) error {
 	}
 
 	s.sender = amqpSender
+	s.namespace.getLogger().Info("sender link opened", "entity", s.entityPath)
 	return nil
 }
 
@@ -249,3 +468,20 @@ func sendWithSession(sessionID string) senderOption {
 		return nil
 	}
 }
+
+// sendWithDefaultMessageTTL configures the sender to cap the time to live of messages to the default message time to
+// live of the entity returned by defaultTTL
+func sendWithDefaultMessageTTL(defaultTTL func(context.Context) (time.Duration, bool)) senderOption {
+	return func(s *sender) error {
+		s.defaultTTL = defaultTTL
+		return nil
+	}
+}
+
+// sendWithMessageIDAssignment configures whether the sender assigns an ID to messages sent without one
+func sendWithMessageIDAssignment(assign bool) senderOption {
+	return func(s *sender) error {
+		s.skipIDAssignment = !assign
+		return nil
+	}
+}
@@ -25,7 +25,6 @@ package servicebus
 import (
 	"sync/atomic"
 
-	"github.com/Azure/azure-amqp-common-go/uuid"
 	"pack.ag/amqp"
 )
 
@@ -38,16 +37,16 @@ type (
 	}
 )
 
-// newSession is a constructor for a Service Bus session which will pre-populate the SessionID with a new UUID
-func newSession(amqpSession *amqp.Session) (*session, error) {
-	id, err := uuid.NewV4()
+// newSession is a constructor for a Service Bus session which will pre-populate the SessionID with a new ID
+func (ns *Namespace) newSession(amqpSession *amqp.Session) (*session, error) {
+	id, err := ns.newID()
 	if err != nil {
 		return nil, err
 	}
 
 	return &session{
 		Session:   amqpSession,
-		SessionID: id.String(),
+		SessionID: id,
 		counter:   0,
 	}, nil
 }
@@ -26,6 +26,7 @@ import (
 	"context"
 	"encoding/xml"
 	"sync"
+	"time"
 
 	"github.com/Azure/azure-amqp-common-go/log"
 	"github.com/Azure/go-autorest/autorest/date"
@@ -61,6 +62,7 @@ type (
 		UpdatedAt                                 *date.Time    `xml:"UpdatedAt,omitempty"`
 		AccessedAt                                *date.Time    `xml:"AccessedAt,omitempty"`
 		AutoDeleteOnIdle                          *string       `xml:"AutoDeleteOnIdle,omitempty"`
+		CountDetails                              *CountDetails `xml:"CountDetails,omitempty"`
 	}
 
 	// SubscriptionOption configures the Subscription Azure Service Bus client
@@ -70,6 +72,8 @@ type (
 // SubscriptionWithReceiveAndDelete configures a subscription to pop and delete messages off of the queue upon receiving the message.
 // This differs from the default, PeekLock, where PeekLock receives a message, locks it for a period of time, then sends
 // a disposition to the broker when the message has been processed.
+//
+// Dispositions such as Complete and Abandon have no effect on messages received in this mode.
 func SubscriptionWithReceiveAndDelete() SubscriptionOption {
 	return func(s *Subscription) error {
 		s.receiveMode = ReceiveAndDeleteMode
@@ -77,6 +81,30 @@ func SubscriptionWithReceiveAndDelete() SubscriptionOption {
 	}
 }
 
+// SubscriptionWithVersionedSessionState configures the subscription to embed a version counter in the session state it
+// writes, so that MessageSession.SetStateIfUnchanged detects every concurrent update, including ones that wrote identical
+// state. All receivers of the subscription's sessions should use this option, as the stored state includes the counter.
+func SubscriptionWithVersionedSessionState() SubscriptionOption {
+	return func(s *Subscription) error {
+		s.versionedSessionState = true
+		return nil
+	}
+}
+
+// SubscriptionWithEmptyPollBackoff configures the receive loop of the subscription to poll for messages rather than
+// wait on them indefinitely. Each poll waits up to initial for a message. When none arrives, the loop backs off before
+// polling again, starting at initial and doubling up to max. The backoff is reset when a message arrives.
+func SubscriptionWithEmptyPollBackoff(initial, max time.Duration) SubscriptionOption {
+	return func(s *Subscription) error {
+		backoff, err := newPollBackoff(initial, max)
+		if err != nil {
+			return err
+		}
+		s.emptyPollBackoff = backoff
+		return nil
+	}
+}
+
 // NewSubscription creates a new Topic Subscription client
 func (t *Topic) NewSubscription(name string, opts ...SubscriptionOption) (*Subscription, error) {
 	sub := &Subscription{
@@ -96,11 +124,11 @@ func (t *Topic) NewSubscription(name string, opts ...SubscriptionOption) (*Subsc
 }
 
 // ReceiveOne will listen to receive a single message. ReceiveOne will only wait as long as the context allows.
-func (s *Subscription) ReceiveOne(ctx context.Context, handler Handler) error {
+func (s *Subscription) ReceiveOne(ctx context.Context, handler Handler, opts ...ReceiveOption) error {
 	span, ctx := s.startSpanFromContext(ctx, "sb.Subscription.ReceiveOne")
 	defer span.Finish()
 
-	if err := s.ensureReceiver(ctx); err != nil {
+	if err := s.ensureReceiver(ctx, receiverOptions(opts)...); err != nil {
 		return err
 	}
 
@@ -108,11 +136,11 @@ func (s *Subscription) ReceiveOne(ctx context.Context, handler Handler) error {
 }
 
 // Receive subscribes for messages sent to the Subscription
-func (s *Subscription) Receive(ctx context.Context, handler Handler) error {
+func (s *Subscription) Receive(ctx context.Context, handler Handler, opts ...ReceiveOption) error {
 	span, ctx := s.startSpanFromContext(ctx, "sb.Subscription.Receive")
 	defer span.Finish()
 
-	if err := s.ensureReceiver(ctx); err != nil {
+	if err := s.ensureReceiver(ctx, receiverOptions(opts)...); err != nil {
 		return err
 	}
 	handle := s.receiver.Listen(ctx, handler)
@@ -121,14 +149,16 @@ func (s *Subscription) Receive(ctx context.Context, handler Handler) error {
 }
 
 // ReceiveOneSession waits for the lock on a particular session to become available, takes it, then process the session.
-func (s *Subscription) ReceiveOneSession(ctx context.Context, sessionID *string, handler SessionHandler) error {
+// With WithSessionAcceptTimeout, ReceiveOneSession returns ErrNoSessionAvailable when no session becomes available in
+// time, rather than waiting until the context is done.
+func (s *Subscription) ReceiveOneSession(ctx context.Context, sessionID *string, handler SessionHandler, opts ...ReceiveOption) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	span, ctx := s.startSpanFromContext(ctx, "sb.Subscription.ReceiveOneSession")
 	defer span.Finish()
 
-	options := make([]receiverOption, 0, 1)
+	options := receiverOptions(opts)
 	if sessionID != nil {
 		options = append(options, receiverWithSession(sessionID))
 	}
@@ -148,16 +178,34 @@ func (s *Subscription) ReceiveOneSession(ctx context.Context, sessionID *string,
 	}
 
 	defer handler.End()
-	handle := s.receiver.Listen(ctx, handler)
+	defer ms.renewLockWhileOpen(ctx)()
+	defer ms.closeWhenIdle(ctx)()
+	ctx = withMessageSession(ctx, ms)
+	r := s.receiver
+	handle := r.Listen(ctx, ms.trackActivity(handler))
 
 	select {
 	case <-handle.Done():
 		return handle.Err()
 	case <-ms.done:
+		s.releaseReceiver(r)
 		return nil
 	}
 }
 
+// releaseReceiver closes the receiver of a session which was closed, once the handlers of the messages in flight have
+// returned, so the lock on the session is released
+func (s *Subscription) releaseReceiver(r *receiver) {
+	s.receiverMu.Lock()
+	if s.receiver == r {
+		s.receiver = nil
+	}
+	s.receiverMu.Unlock()
+
+	// the context of the handlers may be done already, so wait for them without it
+	_ = r.Drain(context.Background())
+}
+
 func (s *Subscription) ensureReceiver(ctx context.Context, options ...receiverOption) error {
 	span, ctx := s.startSpanFromContext(ctx, "sb.Queue.ensureReceiver")
 	defer span.Finish()
@@ -165,9 +213,9 @@ func (s *Subscription) ensureReceiver(ctx context.Context, options ...receiverOp
 	s.receiverMu.Lock()
 	defer s.receiverMu.Unlock()
 
-	options = append(options, receiverWithReceiveMode(s.receiveMode))
+	options = append(options, receiverWithReceiveMode(s.receiveMode), receiverWithEmptyPollBackoff(s.emptyPollBackoff))
 
-	receiver, err := s.namespace.newReceiver(ctx, s.Topic.Name+"/Subscriptions/"+s.Name, options...)
+	receiver, err := s.namespace.newReceiver(ctx, s.entityPath(), options...)
 	if err != nil {
 		log.For(ctx).Error(err)
 		return err
@@ -177,6 +225,10 @@ func (s *Subscription) ensureReceiver(ctx context.Context, options ...receiverOp
 	return nil
 }
 
+func (s *Subscription) entityPath() string {
+	return s.Topic.Name + "/Subscriptions/" + s.Name
+}
+
 // Close the underlying connection to Service Bus
 func (s *Subscription) Close(ctx context.Context) error {
 	if s.receiver != nil {
@@ -184,3 +236,17 @@ func (s *Subscription) Close(ctx context.Context) error {
 	}
 	return nil
 }
+
+// Drain closes the Subscription gracefully, waiting for the handlers of the messages in flight to return before the
+// underlying connection to Service Bus is closed. See Queue.Drain.
+func (s *Subscription) Drain(ctx context.Context) error {
+	s.receiverMu.Lock()
+	r := s.receiver
+	s.receiver = nil
+	s.receiverMu.Unlock()
+
+	if r != nil {
+		return r.Drain(ctx)
+	}
+	return nil
+}
@@ -25,6 +25,22 @@ type (
 		Name string
 	}
 
+	// SubscriptionRuntimeInfo describes the messages held by a Subscription and when it was last used. Service Bus does
+	// not report how many messages each Rule matched, nor a running total of the messages a Subscription received, so
+	// the counts of messages currently held are the available signal for finding Rules which never match.
+	SubscriptionRuntimeInfo struct {
+		Name                           string
+		MessageCount                   int64
+		ActiveMessageCount             int32
+		DeadLetterMessageCount         int32
+		ScheduledMessageCount          int32
+		TransferMessageCount           int32
+		TransferDeadLetterMessageCount int32
+		CreatedAt                      time.Time
+		UpdatedAt                      time.Time
+		AccessedAt                     time.Time
+	}
+
 	// subscriptionFeed is a specialized feed containing Topic Subscriptions
 	subscriptionFeed struct {
 		*atom.Feed
@@ -51,7 +67,7 @@ type (
 // NewSubscriptionManager creates a new SubscriptionManager for a Service Bus Topic
 func (t *Topic) NewSubscriptionManager() *SubscriptionManager {
 	return &SubscriptionManager{
-		entityManager: newEntityManager(t.namespace.getHTTPSHostURI(), t.namespace.TokenProvider),
+		entityManager: t.namespace.newEntityManager(),
 		Topic:         t,
 	}
 }
@@ -63,7 +79,7 @@ func (ns *Namespace) NewSubscriptionManager(topicName string) (*SubscriptionMana
 		return nil, err
 	}
 	return &SubscriptionManager{
-		entityManager: newEntityManager(t.namespace.getHTTPSHostURI(), t.namespace.TokenProvider),
+		entityManager: t.namespace.newEntityManager(),
 		Topic:         t,
 	}, nil
 }
@@ -93,6 +109,11 @@ func (sm *SubscriptionManager) Put(ctx context.Context, name string, opts ...Sub
 		}
 	}
 
+	return sm.put(ctx, name, sd)
+}
+
+// put creates or updates a Service Bus Subscription from a complete description
+func (sm *SubscriptionManager) put(ctx context.Context, name string, sd *SubscriptionDescription, mw ...func(*http.Request) *http.Request) (*SubscriptionEntity, error) {
 	sd.ServiceBusSchema = to.StringPtr(serviceBusSchema)
 
 	qe := &subscriptionEntry{
@@ -111,7 +132,7 @@ func (sm *SubscriptionManager) Put(ctx context.Context, name string, opts ...Sub
 	}
 
 	reqBytes = xmlDoc(reqBytes)
-	res, err := sm.entityManager.Put(ctx, sm.getResourceURI(name), reqBytes)
+	res, err := sm.entityManager.Put(ctx, sm.getResourceURI(name), reqBytes, mw...)
 	if res != nil {
 		defer res.Body.Close()
 	}
@@ -199,6 +220,45 @@ func (sm *SubscriptionManager) Get(ctx context.Context, name string) (*Subscript
 	return subscriptionEntryToEntity(&entry), nil
 }
 
+// RuntimeInfo fetches the message counts and access times of a Subscription. If the Subscription does not exist, nil is
+// returned.
+func (sm *SubscriptionManager) RuntimeInfo(ctx context.Context, name string) (*SubscriptionRuntimeInfo, error) {
+	span, ctx := sm.startSpanFromContext(ctx, "sb.SubscriptionManager.RuntimeInfo")
+	defer span.Finish()
+
+	sub, err := sm.Get(ctx, name)
+	if err != nil || sub == nil {
+		return nil, err
+	}
+	return subscriptionRuntimeInfo(sub), nil
+}
+
+func subscriptionRuntimeInfo(sub *SubscriptionEntity) *SubscriptionRuntimeInfo {
+	info := &SubscriptionRuntimeInfo{
+		Name:         sub.Name,
+		MessageCount: to.Int64(sub.MessageCount),
+	}
+
+	if cd := sub.CountDetails; cd != nil {
+		info.ActiveMessageCount = to.Int32(cd.ActiveMessageCount)
+		info.DeadLetterMessageCount = to.Int32(cd.DeadLetterMessageCount)
+		info.ScheduledMessageCount = to.Int32(cd.ScheduledMessageCount)
+		info.TransferMessageCount = to.Int32(cd.TransferMessageCount)
+		info.TransferDeadLetterMessageCount = to.Int32(cd.TransferDeadLetterMessageCount)
+	}
+
+	if sub.CreatedAt != nil {
+		info.CreatedAt = sub.CreatedAt.Time
+	}
+	if sub.UpdatedAt != nil {
+		info.UpdatedAt = sub.UpdatedAt.Time
+	}
+	if sub.AccessedAt != nil {
+		info.AccessedAt = sub.AccessedAt.Time
+	}
+	return info
+}
+
 func subscriptionEntryToEntity(entry *subscriptionEntry) *SubscriptionEntity {
 	return &SubscriptionEntity{
 		SubscriptionDescription: &entry.Content.SubscriptionDescription,
@@ -232,7 +292,11 @@ func SubscriptionWithLockDuration(window *time.Duration) SubscriptionManagementO
 	}
 }
 
-// SubscriptionWithRequiredSessions will ensure the subscription requires senders and receivers to have sessionIDs
+// SubscriptionWithRequiredSessions will ensure the subscription requires senders and receivers to have sessionIDs.
+// Messages of a session are received in order with Subscription.ReceiveOneSession, which allows ordered processing of
+// the messages published to a topic. A subscription is partitioned when its topic is, in which case the messages of a
+// session are stored in the partition of their session ID; like Queue.Send, Topic.Send refuses a message whose
+// PartitionKey differs from its session ID with ErrPartitionKeyMismatch.
 func SubscriptionWithRequiredSessions() SubscriptionManagementOption {
 	return func(s *SubscriptionDescription) error {
 		s.RequiresSession = ptrBool(true)
@@ -276,3 +340,12 @@ func SubscriptionWithMessageTimeToLive(window *time.Duration) SubscriptionManage
 		return nil
 	}
 }
+
+// SubscriptionWithMaxDeliveryCount configures the subscription to have a maximum number of delivery attempts before
+// dead-lettering the message
+func SubscriptionWithMaxDeliveryCount(count int32) SubscriptionManagementOption {
+	return func(s *SubscriptionDescription) error {
+		s.MaxDeliveryCount = &count
+		return nil
+	}
+}
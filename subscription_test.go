@@ -52,6 +52,13 @@ const (
       <AccessedAt>0001-01-01T00:00:00</AccessedAt>
       <AutoDeleteOnIdle>P10675199DT2H48M5.4775807S</AutoDeleteOnIdle>
       <EntityAvailabilityStatus>Available</EntityAvailabilityStatus>
+      <CountDetails xmlns:d2p1="http://schemas.microsoft.com/netservices/2011/06/servicebus">
+        <d2p1:ActiveMessageCount>3</d2p1:ActiveMessageCount>
+        <d2p1:DeadLetterMessageCount>1</d2p1:DeadLetterMessageCount>
+        <d2p1:ScheduledMessageCount>0</d2p1:ScheduledMessageCount>
+        <d2p1:TransferMessageCount>2</d2p1:TransferMessageCount>
+        <d2p1:TransferDeadLetterMessageCount>0</d2p1:TransferDeadLetterMessageCount>
+      </CountDetails>
   </SubscriptionDescription>`
 
 	subscriptionEntryContent = `
@@ -64,6 +71,57 @@ const (
 		<content type="application/xml">` + subscriptionDescriptionContent +
 		`</content>
 	</entry>`
+
+	ruleFeedContent = `
+	<feed xmlns="http://www.w3.org/2005/Atom">
+		<title type="text">Rules</title>
+		<id>https://sbdjtest.servicebus.windows.net/foo/subscriptions/bar/rules?api-version=2017-04</id>
+		<updated>2018-05-04T22:41:54Z</updated>
+		<entry>
+			<id>https://sbdjtest.servicebus.windows.net/foo/subscriptions/bar/rules/$Default?api-version=2017-04</id>
+			<title type="text">$Default</title>
+			<published>2018-05-04T22:41:54Z</published>
+			<updated>2018-05-04T22:41:54Z</updated>
+			<content type="application/xml">
+				<RuleDescription xmlns="http://schemas.microsoft.com/netservices/2010/10/servicebus/connect" xmlns:i="http://www.w3.org/2001/XMLSchema-instance">
+					<Filter i:type="SqlFilter">
+						<SqlExpression>color = 'red'</SqlExpression>
+						<CompatibilityLevel>20</CompatibilityLevel>
+					</Filter>
+					<Action i:type="EmptyRuleAction"/>
+					<CreatedAt>2018-05-04T22:41:54.183101Z</CreatedAt>
+					<Name>$Default</Name>
+				</RuleDescription>
+			</content>
+		</entry>
+		<entry>
+			<id>https://sbdjtest.servicebus.windows.net/foo/subscriptions/bar/rules/correlated?api-version=2017-04</id>
+			<title type="text">correlated</title>
+			<published>2018-05-04T22:41:54Z</published>
+			<updated>2018-05-04T22:41:54Z</updated>
+			<content type="application/xml">
+				<RuleDescription xmlns="http://schemas.microsoft.com/netservices/2010/10/servicebus/connect" xmlns:i="http://www.w3.org/2001/XMLSchema-instance">
+					<Filter i:type="CorrelationFilter">
+						<CorrelationId>abc</CorrelationId>
+						<Label>invoice</Label>
+						<Properties>
+							<KeyValueOfstringanyType>
+								<Key>color</Key>
+								<Value i:type="d6p1:string" xmlns:d6p1="http://www.w3.org/2001/XMLSchema">red</Value>
+							</KeyValueOfstringanyType>
+						</Properties>
+					</Filter>
+					<Action i:type="SqlRuleAction">
+						<SqlExpression>SET priority = 'high'</SqlExpression>
+						<RequiresPreprocessing>false</RequiresPreprocessing>
+						<CompatibilityLevel>20</CompatibilityLevel>
+					</Action>
+					<CreatedAt>2018-05-04T22:41:54.183101Z</CreatedAt>
+					<Name>correlated</Name>
+				</RuleDescription>
+			</content>
+		</entry>
+	</feed>`
 )
 
 func (suite *serviceBusSuite) TestSubscriptionEntryUnmarshal() {
@@ -93,6 +151,97 @@ func (suite *serviceBusSuite) TestSubscriptionUnmarshal() {
 	assert.EqualValues(t, servicebus.EntityStatusActive, *s.Status)
 }
 
+func (suite *serviceBusSuite) TestSubscriptionRuntimeInfo() {
+	var entry subscriptionEntry
+	suite.Require().NoError(xml.Unmarshal([]byte(subscriptionEntryContent), &entry))
+
+	info := subscriptionRuntimeInfo(subscriptionEntryToEntity(&entry))
+	suite.Equal("gosbwg424p-tagz3cfzrp93m", info.Name)
+	suite.Equal(int64(0), info.MessageCount)
+	suite.Equal(int32(3), info.ActiveMessageCount)
+	suite.Equal(int32(1), info.DeadLetterMessageCount)
+	suite.Equal(int32(2), info.TransferMessageCount)
+	suite.Equal(time.Date(2018, 5, 4, 22, 41, 54, 183101000, time.UTC), info.CreatedAt.UTC())
+}
+
+func (suite *serviceBusSuite) TestRuleFeedUnmarshal() {
+	var feed ruleFeed
+	err := xml.Unmarshal([]byte(ruleFeedContent), &feed)
+	suite.Require().NoError(err)
+	suite.Require().Len(feed.Entries, 2)
+
+	sqlRule, err := ruleEntryToEntity(&feed.Entries[0])
+	suite.Require().NoError(err)
+	suite.Equal("$Default", sqlRule.Name)
+	suite.Equal("SqlFilter", sqlRule.Filter.Type)
+	suite.Equal("color = 'red'", *sqlRule.Filter.SQLExpression)
+	suite.Equal(20, *sqlRule.Filter.CompatibilityLevel)
+	suite.Equal("EmptyRuleAction", sqlRule.Action.Type)
+
+	correlationRule, err := ruleEntryToEntity(&feed.Entries[1])
+	suite.Require().NoError(err)
+	suite.Equal("correlated", correlationRule.Name)
+	suite.Equal("CorrelationFilter", correlationRule.Filter.Type)
+	suite.Equal("abc", *correlationRule.Filter.CorrelationID)
+	suite.Equal("invoice", *correlationRule.Filter.Label)
+	suite.Nil(correlationRule.Filter.SQLExpression)
+	if suite.Len(correlationRule.Filter.Properties, 1) {
+		suite.Equal("color", correlationRule.Filter.Properties[0].Key)
+		suite.Equal("red", correlationRule.Filter.Properties[0].Value.Value)
+	}
+	suite.Equal("SqlRuleAction", correlationRule.Action.Type)
+	suite.Equal("SET priority = 'high'", *correlationRule.Action.SQLExpression)
+
+	_, err = ruleEntryToEntity(&ruleEntry{})
+	suite.Error(err, "an entry without a description should be refused")
+}
+
+func (suite *serviceBusSuite) TestFilterDescriptions() {
+	sql := SQLFilter{Expression: "quantity > 10"}.ToFilterDescription()
+	suite.Equal("SqlFilter", sql.Type)
+	suite.Equal("quantity > 10", *sql.SQLExpression)
+	suite.Equal(20, *sql.CompatibilityLevel)
+
+	suite.Equal("TrueFilter", TrueFilter{}.ToFilterDescription().Type)
+	suite.Equal("1=1", *TrueFilter{}.ToFilterDescription().SQLExpression)
+	suite.Equal("FalseFilter", FalseFilter{}.ToFilterDescription().Type)
+	suite.Equal("1=0", *FalseFilter{}.ToFilterDescription().SQLExpression)
+}
+
+func (suite *serviceBusSuite) TestCorrelationFilter() {
+	suite.Error(CorrelationFilter{}.Validate(), "an empty correlation filter would select every message")
+	suite.Error(CorrelationFilter{Label: ptrString("invoice"), Properties: map[string]interface{}{"bad": []int{1}}}.Validate())
+	suite.NoError(CorrelationFilter{Label: ptrString("invoice")}.Validate())
+
+	filter := CorrelationFilter{
+		CorrelationID: ptrString("abc"),
+		Properties: map[string]interface{}{
+			"color":    "red",
+			"quantity": 10,
+		},
+	}
+	suite.Require().NoError(filter.Validate())
+
+	fd := filter.ToFilterDescription()
+	suite.Equal("CorrelationFilter", fd.Type)
+	suite.Equal("abc", *fd.CorrelationID)
+	if suite.Len(fd.Properties, 2) {
+		suite.Equal("color", fd.Properties[0].Key)
+		suite.Equal("d6p1:string", fd.Properties[0].Value.Type)
+		suite.Equal("quantity", fd.Properties[1].Key)
+		suite.Equal("d6p1:int", fd.Properties[1].Value.Type)
+		suite.Equal("10", fd.Properties[1].Value.Value)
+	}
+
+	b, err := xml.Marshal(fd)
+	suite.Require().NoError(err)
+	suite.Contains(string(b), `xmlns:d6p1="http://www.w3.org/2001/XMLSchema"`)
+
+	action := SQLAction{Expression: "SET priority = 'high'"}.ToActionDescription()
+	suite.Equal("SqlRuleAction", action.Type)
+	suite.Equal("SET priority = 'high'", *action.SQLExpression)
+}
+
 func (suite *serviceBusSuite) TestSubscriptionManagementWrites() {
 	tests := map[string]func(context.Context, *testing.T, *SubscriptionManager, string){
 		"TestPutDefaultSubscription": testPutSubscription,
@@ -148,6 +297,8 @@ func (suite *serviceBusSuite) TestSubscriptionManagement() {
 		"TestSubscriptionWithMessageTimeToLive":                testSubscriptionWithMessageTimeToLive,
 		"TestSubscriptionWithLockDuration":                     testSubscriptionWithLockDuration,
 		"TestSubscriptionWithBatchedOperations":                testSubscriptionWithBatchedOperations,
+		"TestSubscriptionWithMaxDeliveryCount":                 testSubscriptionWithMaxDeliveryCount,
+		"TestSubscriptionRules":                                testSubscriptionRules,
 	}
 
 	ns := suite.getNewSasInstance()
@@ -222,6 +373,32 @@ func testSubscriptionWithLockDuration(ctx context.Context, t *testing.T, sm *Sub
 	assert.Equal(t, "PT3M", *s.LockDuration)
 }
 
+func testSubscriptionWithMaxDeliveryCount(ctx context.Context, t *testing.T, sm *SubscriptionManager, _, name string) {
+	s := buildSubscription(ctx, t, sm, name, SubscriptionWithMaxDeliveryCount(3))
+	assert.Equal(t, int32(3), *s.MaxDeliveryCount)
+}
+
+func testSubscriptionRules(ctx context.Context, t *testing.T, sm *SubscriptionManager, _, name string) {
+	buildSubscription(ctx, t, sm, name)
+	rm := sm.NewRuleManager(name)
+
+	rule, err := rm.PutRule(ctx, "red", SQLFilter{Expression: "color = 'red'"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "SqlFilter", rule.Filter.Type)
+	assert.Equal(t, "color = 'red'", *rule.Filter.SQLExpression)
+
+	if !assert.NoError(t, rm.DeleteRule(ctx, DefaultRuleName)) {
+		return
+	}
+
+	rules, err := rm.ListRules(ctx)
+	if assert.NoError(t, err) && assert.Len(t, rules, 1) {
+		assert.Equal(t, "red", rules[0].Name)
+	}
+}
+
 func buildSubscription(ctx context.Context, t *testing.T, sm *SubscriptionManager, name string, opts ...SubscriptionManagementOption) *SubscriptionEntity {
 	_, err := sm.Put(ctx, name, opts...)
 	if err != nil {
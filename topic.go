@@ -25,7 +25,9 @@ package servicebus
 import (
 	"context"
 	"encoding/xml"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/Azure/azure-amqp-common-go/log"
 	"github.com/Azure/go-autorest/autorest/date"
@@ -51,23 +53,24 @@ type (
 	TopicDescription struct {
 		XMLName xml.Name `xml:"TopicDescription"`
 		BaseEntityDescription
-		DefaultMessageTimeToLive            *string       `xml:"DefaultMessageTimeToLive,omitempty"`            // DefaultMessageTimeToLive - ISO 8601 default message time span to live value. This is the duration after which the message expires, starting from when the message is sent to Service Bus. This is the default value used when TimeToLive is not set on a message itself.
-		MaxSizeInMegabytes                  *int32        `xml:"MaxSizeInMegabytes,omitempty"`                  // MaxSizeInMegabytes - The maximum size of the queue in megabytes, which is the size of memory allocated for the queue. Default is 1024.
-		RequiresDuplicateDetection          *bool         `xml:"RequiresDuplicateDetection,omitempty"`          // RequiresDuplicateDetection - A value indicating if this queue requires duplicate detection.
-		DuplicateDetectionHistoryTimeWindow *string       `xml:"DuplicateDetectionHistoryTimeWindow,omitempty"` // DuplicateDetectionHistoryTimeWindow - ISO 8601 timeSpan structure that defines the duration of the duplicate detection history. The default value is 10 minutes.
-		EnableBatchedOperations             *bool         `xml:"EnableBatchedOperations,omitempty"`             // EnableBatchedOperations - Value that indicates whether server-side batched operations are enabled.
-		SizeInBytes                         *int64        `xml:"SizeInBytes,omitempty"`                         // SizeInBytes - The size of the queue, in bytes.
-		FilteringMessagesBeforePublishing   *bool         `xml:"FilteringMessagesBeforePublishing,omitempty"`
-		IsAnonymousAccessible               *bool         `xml:"IsAnonymousAccessible,omitempty"`
-		Status                              *EntityStatus `xml:"Status,omitempty"`
-		CreatedAt                           *date.Time    `xml:"CreatedAt,omitempty"`
-		UpdatedAt                           *date.Time    `xml:"UpdatedAt,omitempty"`
-		SupportOrdering                     *bool         `xml:"SupportOrdering,omitempty"`
-		AutoDeleteOnIdle                    *string       `xml:"AutoDeleteOnIdle,omitempty"`
-		EnablePartitioning                  *bool         `xml:"EnablePartitioning,omitempty"`
-		EnableSubscriptionPartitioning      *bool         `xml:"EnableSubscriptionPartitioning,omitempty"`
-		EnableExpress                       *bool         `xml:"EnableExpress,omitempty"`
-		CountDetails                        *CountDetails `xml:"CountDetails,omitempty"`
+		DefaultMessageTimeToLive            *string             `xml:"DefaultMessageTimeToLive,omitempty"`            // DefaultMessageTimeToLive - ISO 8601 default message time span to live value. This is the duration after which the message expires, starting from when the message is sent to Service Bus. This is the default value used when TimeToLive is not set on a message itself.
+		MaxSizeInMegabytes                  *int32              `xml:"MaxSizeInMegabytes,omitempty"`                  // MaxSizeInMegabytes - The maximum size of the queue in megabytes, which is the size of memory allocated for the queue. Default is 1024.
+		RequiresDuplicateDetection          *bool               `xml:"RequiresDuplicateDetection,omitempty"`          // RequiresDuplicateDetection - A value indicating if this queue requires duplicate detection.
+		DuplicateDetectionHistoryTimeWindow *string             `xml:"DuplicateDetectionHistoryTimeWindow,omitempty"` // DuplicateDetectionHistoryTimeWindow - ISO 8601 timeSpan structure that defines the duration of the duplicate detection history. The default value is 10 minutes.
+		EnableBatchedOperations             *bool               `xml:"EnableBatchedOperations,omitempty"`             // EnableBatchedOperations - Value that indicates whether server-side batched operations are enabled.
+		SizeInBytes                         *int64              `xml:"SizeInBytes,omitempty"`                         // SizeInBytes - The size of the queue, in bytes.
+		FilteringMessagesBeforePublishing   *bool               `xml:"FilteringMessagesBeforePublishing,omitempty"`   // FilteringMessagesBeforePublishing - Value that indicates whether messages are filtered by subscription rules before they are published to the topic.
+		IsAnonymousAccessible               *bool               `xml:"IsAnonymousAccessible,omitempty"`
+		AuthorizationRules                  []AuthorizationRule `xml:"AuthorizationRules>AuthorizationRule,omitempty"` // AuthorizationRules - The shared access authorization rules of the entity, which grant the holders of their keys rights on it.
+		Status                              *EntityStatus       `xml:"Status,omitempty"`
+		CreatedAt                           *date.Time          `xml:"CreatedAt,omitempty"`
+		UpdatedAt                           *date.Time          `xml:"UpdatedAt,omitempty"`
+		SupportOrdering                     *bool               `xml:"SupportOrdering,omitempty"` // SupportOrdering - Value that indicates whether the topic supports ordering of messages.
+		AutoDeleteOnIdle                    *string             `xml:"AutoDeleteOnIdle,omitempty"`
+		EnablePartitioning                  *bool               `xml:"EnablePartitioning,omitempty"`
+		EnableSubscriptionPartitioning      *bool               `xml:"EnableSubscriptionPartitioning,omitempty"`
+		EnableExpress                       *bool               `xml:"EnableExpress,omitempty"`
+		CountDetails                        *CountDetails       `xml:"CountDetails,omitempty"`
 	}
 
 	// TopicOption represents named options for assisting Topic message handling
@@ -92,6 +95,16 @@ func (ns *Namespace) NewTopic(name string, opts ...TopicOption) (*Topic, error)
 	return topic, nil
 }
 
+// TopicWithMessageIDAssignment configures whether an ID is assigned to messages sent without one, which they are by
+// default. Disabling it saves creating IDs for messages sent to a topic which doesn't require duplicate detection, where
+// they are only useful to the application.
+func TopicWithMessageIDAssignment(enabled bool) TopicOption {
+	return func(t *Topic) error {
+		t.assignMessageIDs = &enabled
+		return nil
+	}
+}
+
 // Send sends messages to the Topic
 func (t *Topic) Send(ctx context.Context, event *Message, opts ...SendOption) error {
 	span, ctx := t.startSpanFromContext(ctx, "sb.Topic.Send")
@@ -105,6 +118,22 @@ func (t *Topic) Send(ctx context.Context, event *Message, opts ...SendOption) er
 	return t.sender.Send(ctx, event, opts...)
 }
 
+// SendWithOptions sends a message to the Topic, bounding how long to wait for the message to be transferred and for
+// Service Bus to confirm it was accepted by the timeouts of so. If the timeouts elapse, ErrConfirmTimeout is returned,
+// as the message may have been accepted. The AMQP library does not report when a transfer completes, so the two
+// timeouts bound the send together: a slow transfer shortens the wait for its confirmation, and the transfer may take
+// up to TransferTimeout + ConfirmTimeout.
+func (t *Topic) SendWithOptions(ctx context.Context, event *Message, so SendOptions, opts ...SendOption) error {
+	span, ctx := t.startSpanFromContext(ctx, "sb.Topic.SendWithOptions")
+	defer span.Finish()
+
+	if err := t.ensureSender(ctx); err != nil {
+		log.For(ctx).Error(err)
+		return err
+	}
+	return t.sender.SendWithOptions(ctx, event, so, opts...)
+}
+
 // Close the underlying connection to Service Bus
 func (t *Topic) Close(ctx context.Context) error {
 	span, ctx := t.startSpanFromContext(ctx, "sb.Topic.Close")
@@ -117,6 +146,17 @@ func (t *Topic) Close(ctx context.Context) error {
 	return nil
 }
 
+func (t *Topic) fetchProperties(ctx context.Context) (*entityProperties, error) {
+	te, err := t.namespace.NewTopicManager().Get(ctx, t.Name)
+	if err != nil {
+		return nil, err
+	}
+	if te == nil {
+		return nil, fmt.Errorf("topic %q was not found", t.Name)
+	}
+	return newEntityProperties(te.DefaultMessageTimeToLive, te.DuplicateDetectionHistoryTimeWindow), nil
+}
+
 func (t *Topic) ensureSender(ctx context.Context) error {
 	span, ctx := t.startSpanFromContext(ctx, "sb.Topic.ensureSender")
 	defer span.Finish()
@@ -125,7 +165,11 @@ func (t *Topic) ensureSender(ctx context.Context) error {
 	defer t.senderMu.Unlock()
 
 	if t.sender == nil {
-		s, err := t.namespace.newSender(ctx, t.Name)
+		s, err := t.namespace.newSender(ctx, t.Name,
+			sendWithMessageIDAssignment(t.assignsMessageIDs()),
+			sendWithDefaultMessageTTL(func(ctx context.Context) (time.Duration, bool) {
+				return t.defaultMessageTTL(ctx, t.fetchProperties)
+			}))
 		if err != nil {
 			log.For(ctx).Error(err)
 			return err
@@ -51,7 +51,7 @@ type (
 // NewTopicManager creates a new TopicManager for a Service Bus Namespace
 func (ns *Namespace) NewTopicManager() *TopicManager {
 	return &TopicManager{
-		entityManager: newEntityManager(ns.getHTTPSHostURI(), ns.TokenProvider),
+		entityManager: ns.newEntityManager(),
 	}
 }
 
@@ -81,6 +81,11 @@ func (tm *TopicManager) Put(ctx context.Context, name string, opts ...TopicManag
 		}
 	}
 
+	return tm.put(ctx, name, td)
+}
+
+// put creates or updates a Service Bus Topic from a complete description
+func (tm *TopicManager) put(ctx context.Context, name string, td *TopicDescription, mw ...func(*http.Request) *http.Request) (*TopicEntity, error) {
 	td.ServiceBusSchema = to.StringPtr(serviceBusSchema)
 
 	qe := &topicEntry{
@@ -100,7 +105,7 @@ func (tm *TopicManager) Put(ctx context.Context, name string, opts ...TopicManag
 	}
 
 	reqBytes = xmlDoc(reqBytes)
-	res, err := tm.entityManager.Put(ctx, "/"+name, reqBytes)
+	res, err := tm.entityManager.Put(ctx, "/"+name, reqBytes, mw...)
 	if res != nil {
 		defer res.Body.Close()
 	}
@@ -230,6 +235,15 @@ func TopicWithOrdering() TopicManagementOption {
 	}
 }
 
+// TopicWithFilteringMessagesBeforePublishing configures the topic to evaluate subscription rules before a message is
+// published, rather than when it is delivered to each subscription. Not all tiers support this option.
+func TopicWithFilteringMessagesBeforePublishing() TopicManagementOption {
+	return func(t *TopicDescription) error {
+		t.FilteringMessagesBeforePublishing = ptrBool(true)
+		return nil
+	}
+}
+
 // TopicWithDuplicateDetection configures the topic to detect duplicates for a given time window. If window
 // is not specified, then it uses the default of 10 minutes.
 func TopicWithDuplicateDetection(window *time.Duration) TopicManagementOption {
@@ -101,11 +101,29 @@ func (suite *serviceBusSuite) TestTopicUnmarshal() {
 	suite.Equal("PT10M", *td.DuplicateDetectionHistoryTimeWindow)
 	suite.Equal(true, *td.EnableBatchedOperations)
 	suite.Equal(false, *td.FilteringMessagesBeforePublishing)
+	suite.Equal(true, *td.SupportOrdering)
 	suite.Equal(false, *td.EnableExpress)
 	suite.Equal(int64(0), *td.SizeInBytes)
 	suite.EqualValues(servicebus.EntityStatusActive, *td.Status)
 }
 
+func (suite *serviceBusSuite) TestTopicOrderingAndFilteringRoundTrip() {
+	td := new(TopicDescription)
+	for _, opt := range []TopicManagementOption{TopicWithOrdering(), TopicWithFilteringMessagesBeforePublishing()} {
+		suite.Require().NoError(opt(td))
+	}
+
+	b, err := xml.Marshal(td)
+	suite.Require().NoError(err)
+	suite.Contains(string(b), "<SupportOrdering>true</SupportOrdering>")
+	suite.Contains(string(b), "<FilteringMessagesBeforePublishing>true</FilteringMessagesBeforePublishing>")
+
+	var roundTripped TopicDescription
+	suite.Require().NoError(xml.Unmarshal(b, &roundTripped))
+	suite.True(*roundTripped.SupportOrdering)
+	suite.True(*roundTripped.FilteringMessagesBeforePublishing)
+}
+
 func (suite *serviceBusSuite) TestTopicManagementWrites() {
 	tests := map[string]func(context.Context, *testing.T, *TopicManager, string){
 		"TestPutDefaultTopic": testPutTopic,
@@ -235,6 +253,11 @@ func testPartitionedTopic(ctx context.Context, t *testing.T, tm *TopicManager, n
 func testSupportOrdering(ctx context.Context, t *testing.T, tm *TopicManager, name string) {
 	topic := buildTopic(ctx, t, tm, name, TopicWithOrdering())
 	assert.True(t, *topic.SupportOrdering)
+
+	topic, err := tm.Get(ctx, name)
+	if assert.NoError(t, err) && assert.NotNil(t, topic) {
+		assert.True(t, *topic.SupportOrdering, "ordering should be reported when the topic is fetched again")
+	}
 }
 
 func testTopicWithDuplicateDetection(ctx context.Context, t *testing.T, tm *TopicManager, name string) {
@@ -288,6 +311,7 @@ func buildTopic(ctx context.Context, t *testing.T, tm *TopicManager, name string
 func (suite *serviceBusSuite) TestTopic() {
 	tests := map[string]func(context.Context, *testing.T, *Topic){
 		"SimpleSend": testTopicSend,
+		"SendBatch":  testTopicSendBatch,
 	}
 
 	ns := suite.getNewSasInstance()
@@ -315,6 +339,14 @@ func testTopicSend(ctx context.Context, t *testing.T, topic *Topic) {
 	assert.NoError(t, topic.Send(ctx, NewMessageFromString("hello!")))
 }
 
+func testTopicSendBatch(ctx context.Context, t *testing.T, topic *Topic) {
+	messages := make([]*Message, 10)
+	for i := range messages {
+		messages[i] = NewMessageFromString(fmt.Sprintf("hello %d", i))
+	}
+	assert.NoError(t, topic.SendBatch(ctx, messages))
+}
+
 func makeTopic(ctx context.Context, t *testing.T, ns *Namespace, name string, opts ...TopicManagementOption) func() {
 	tm := ns.NewTopicManager()
 	entity, err := tm.Get(ctx, name)
@@ -57,6 +57,14 @@ func (em *entityManager) startSpanFromContext(ctx context.Context, operationName
 	return span, ctx
 }
 
+func (ml *managementLink) startSpanFromContext(ctx context.Context, operationName string, opts ...opentracing.StartSpanOption) (opentracing.Span, context.Context) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, operationName, opts...)
+	applyComponentInfo(span)
+	tag.SpanKindRPCClient.Set(span)
+	tag.MessageBusDestination.Set(span, ml.address)
+	return span, ctx
+}
+
 func applyRequestInfo(span opentracing.Span, req *http.Request) {
 	tag.HTTPUrl.Set(span, req.URL.String())
 	tag.HTTPMethod.Set(span, req.Method)
@@ -112,3 +120,39 @@ func applyNetworkInfo(span opentracing.Span) {
 		tag.PeerHostname.Set(span, hostname)
 	}
 }
+
+// MessageCarrier reads and writes the trace context propagated with a message, such as the W3C traceparent and
+// tracestate headers, as user properties of the message. It implements the TextMapCarrier interface of OpenTelemetry
+// propagators, so tracers which are not bridged to OpenTracing can propagate their context end to end: inject into the
+// carrier of a message before it is sent, and extract from the carrier of a received message to link the consumer span
+// to the producer span.
+type MessageCarrier struct {
+	msg *Message
+}
+
+// TraceCarrier returns the carrier of the trace context propagated with the message
+func (m *Message) TraceCarrier() MessageCarrier {
+	return MessageCarrier{msg: m}
+}
+
+// Get returns the value of the trace context key, or an empty string if the message doesn't carry it
+func (c MessageCarrier) Get(key string) string {
+	value, _ := c.msg.UserProperties[key].(string)
+	return value
+}
+
+// Set sets the value of the trace context key
+func (c MessageCarrier) Set(key, value string) {
+	c.msg.Set(key, value)
+}
+
+// Keys returns the keys of the user properties of the message which hold strings, and so may carry trace context
+func (c MessageCarrier) Keys() []string {
+	keys := make([]string, 0, len(c.msg.UserProperties))
+	for key, value := range c.msg.UserProperties {
+		if _, ok := value.(string); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
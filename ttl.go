@@ -0,0 +1,106 @@
+package servicebus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Azure/azure-amqp-common-go/log"
+)
+
+// describe returns the properties of the entity. The entity is looked up with fetch the first time, and the properties
+// are cached for the life of the entity; if the lookup fails, the zero properties are cached, so the features which
+// rely on them fall back to their defaults rather than looking the entity up on every use.
+func (e *entity) describe(ctx context.Context, fetch func(context.Context) (*entityProperties, error)) entityProperties {
+	e.propertiesMu.Lock()
+	defer e.propertiesMu.Unlock()
+
+	if e.properties == nil {
+		props, err := fetch(ctx)
+		if err != nil {
+			log.For(ctx).Debug("unable to look up the description of the entity: " + err.Error())
+			props = new(entityProperties)
+		}
+		e.properties = props
+	}
+	return *e.properties
+}
+
+// newEntityProperties returns the properties of an entity with the given ISO 8601 durations of its description
+func newEntityProperties(defaultMessageTTL, duplicateDetectionWindow *string) *entityProperties {
+	props := new(entityProperties)
+	if defaultMessageTTL != nil {
+		props.defaultMessageTTL = ttlFromISO8601(*defaultMessageTTL)
+	}
+	if duplicateDetectionWindow != nil {
+		props.duplicateDetectionWindow = ttlFromISO8601(*duplicateDetectionWindow)
+	}
+	return props
+}
+
+// defaultMessageTTL returns the default message time to live of the entity, which is also the longest time to live
+// Service Bus honors for a message sent to it. If the entity could not be looked up, or has no bounded default, false
+// is returned.
+func (e *entity) defaultMessageTTL(ctx context.Context, fetch func(context.Context) (*entityProperties, error)) (time.Duration, bool) {
+	ttl := e.describe(ctx, fetch).defaultMessageTTL
+	return ttl, ttl > 0
+}
+
+// ttlFromISO8601 parses a duration of the description of an entity, such as its default message time to live. Service
+// Bus reports an entity without an expiration with the largest .NET time span, which exceeds time.Duration, so it and
+// malformed durations yield 0.
+func ttlFromISO8601(duration string) time.Duration {
+	seconds, ok := iso8601DurationSeconds(duration)
+	if !ok || seconds <= 0 || seconds >= math.MaxInt64/float64(time.Second) {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// effectiveTTL validates the time to live of a message, and caps it to the default message time to live of the
+// entity, which Service Bus would do when the message is enqueued, so the TTL of the message reflects the time to live
+// it is sent with
+func (s *sender) effectiveTTL(ctx context.Context, event *Message) error {
+	if event.TTL == nil {
+		return nil
+	}
+	if *event.TTL < 0 {
+		return fmt.Errorf("the time to live of the message must not be negative, but was %v", *event.TTL)
+	}
+	if *event.TTL == 0 || s.defaultTTL == nil {
+		return nil
+	}
+
+	entityTTL, ok := s.defaultTTL(ctx)
+	if !ok || *event.TTL <= entityTTL {
+		return nil
+	}
+
+	s.namespace.getLogger().Warn("message time to live exceeds the default of the entity and was capped",
+		"entity", s.entityPath, "message-id", event.ID, "ttl", *event.TTL, "default", entityTTL)
+	event.TTL = &entityTTL
+	return nil
+}
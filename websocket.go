@@ -0,0 +1,114 @@
+package servicebus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"pack.ag/amqp"
+)
+
+const (
+	// webSocketPath is the path of the endpoint Service Bus accepts AMQP over WebSocket connections on
+	webSocketPath = "$servicebus/websocket"
+	// webSocketProtocol is the WebSocket subprotocol of AMQP
+	webSocketProtocol = "AMQPWSB10"
+	// webSocketDialTimeout bounds opening the WebSocket connection, including its TLS handshake
+	webSocketDialTimeout = 30 * time.Second
+)
+
+// NamespaceWithWebSocket configures a namespace to tunnel its AMQP connections through a WebSocket on port 443, rather
+// than connecting to the AMQP port 5671, which firewalls which only allow HTTPS traffic may block. All operations
+// work the same over either transport.
+func NamespaceWithWebSocket() NamespaceOption {
+	return func(ns *Namespace) error {
+		ns.useWebSocket = true
+		return nil
+	}
+}
+
+func (ns *Namespace) getWebSocketURI() string {
+	return fmt.Sprintf("wss://%s.%s/%s", ns.Name, ns.Environment.ServiceBusEndpointSuffix, webSocketPath)
+}
+
+// newWebSocketConnection opens an AMQP connection over a secure WebSocket. The WebSocket is encrypted with TLS, so the
+// AMQP connection itself is not.
+func (ns *Namespace) newWebSocketConnection() (*amqp.Client, error) {
+	config, err := websocket.NewConfig(ns.getWebSocketURI(), ns.getHTTPSHostURI())
+	if err != nil {
+		return nil, err
+	}
+	config.Protocol = []string{webSocketProtocol}
+	config.Dialer = &net.Dialer{Timeout: webSocketDialTimeout}
+
+	ws, err := ns.dialWebSocket(config)
+	if err != nil {
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+
+	opts := append(ns.connectionOptions(), amqp.ConnServerHostname(config.Location.Hostname()))
+	client, err := amqp.New(ws, opts...)
+	if err != nil {
+		_ = ws.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// dialWebSocket opens the WebSocket of config, through a tunnel when a proxy is configured for it
+func (ns *Namespace) dialWebSocket(config *websocket.Config) (*websocket.Conn, error) {
+	host := config.Location.Hostname()
+	proxy, err := ns.proxyFor(&url.URL{Scheme: "https", Host: host})
+	if err != nil {
+		return nil, err
+	}
+	if proxy == nil {
+		return websocket.DialConfig(config)
+	}
+
+	conn, err := dialThroughProxy(proxy, net.JoinHostPort(host, "443"), webSocketDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+	_ = tlsConn.SetDeadline(time.Now().Add(webSocketDialTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	ws, err := websocket.NewClient(config, tlsConn)
+	if err != nil {
+		_ = tlsConn.Close()
+		return nil, err
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+	return ws, nil
+}